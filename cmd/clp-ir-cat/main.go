@@ -0,0 +1,181 @@
+// Command clp-ir-cat decodes KV-IR files and prints each log event as newline-delimited JSON.
+// Accepts disk buffer files (disk_buffer/ir/*.ir, disk_buffer/zstd/*.zst) and uploaded objects.
+// Zstd compression is detected automatically and unterminated streams, such as disk buffers of a
+// crashed plugin, are decoded up to the last complete event.
+//
+// Usage:
+//
+//	clp-ir-cat [-concat] [-private_key_file KEY] FILE...
+//
+// A disk buffer IR file only has an IR preamble if the IR was never flushed to its Zstd file, so
+// use -concat to decode a disk buffer as one stream:
+//
+//	clp-ir-cat -concat disk_buffer/zstd/<TAG>.zst disk_buffer/ir/<TAG>.ir
+//
+// Objects uploaded with client_encryption_key_file are decrypted with the matching RSA private key:
+//
+//	clp-ir-cat -private_key_file private.pem <OBJECT>.zst
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+)
+
+// Output format of each log event.
+type record struct {
+	Auto map[string]any `json:"auto"`
+	User map[string]any `json:"user"`
+}
+
+func main() {
+	concat := flag.Bool("concat", false, "decode all files as a single stream")
+	privateKeyFile := flag.String("private_key_file", "",
+		"PEM file with RSA private key to decrypt encrypted objects")
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage: %s [-concat] [-private_key_file KEY] FILE...\n",
+			os.Args[0],
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var provider envelope.KeyProvider
+	if *privateKeyFile != "" {
+		var err error
+		provider, err = envelope.NewFileKeyProvider(*privateKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "clp-ir-cat: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	output := bufio.NewWriter(os.Stdout)
+	defer output.Flush()
+
+	var err error
+	if *concat {
+		err = catFiles(flag.Args(), provider, output)
+	} else {
+		for _, path := range flag.Args() {
+			err = catFiles([]string{path}, provider, output)
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		output.Flush()
+		fmt.Fprintf(os.Stderr, "clp-ir-cat: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Decodes files as a single IR stream and writes events to output.
+//
+// Parameters:
+//   - paths: Paths of files to decode in order. "-" is read from stdin.
+//   - provider: Provider to decrypt encrypted objects, nil if no key was given
+//   - output: Destination for newline-delimited JSON
+//
+// Returns:
+//   - err: Error opening files, error decrypting objects, error decoding IR, error writing output
+func catFiles(paths []string, provider envelope.KeyProvider, output io.Writer) error {
+	var inputs []io.Reader
+	for _, path := range paths {
+		if path == "-" {
+			inputs = append(inputs, os.Stdin)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		inputs = append(inputs, f)
+	}
+
+	// Zstd frames and uncompressed IR cannot be mixed in one reader, so each file is decompressed
+	// separately before concatenating.
+	var decompressed []io.Reader
+	for i, input := range inputs {
+		input, err := decrypt(input, provider)
+		if err != nil {
+			return fmt.Errorf("error decrypting %s: %w", paths[i], err)
+		}
+		r, err := irzstd.NewDecompressor(input)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", paths[i], err)
+		}
+		defer r.Close()
+		decompressed = append(decompressed, r)
+	}
+
+	reader, err := irzstd.NewReader(io.MultiReader(decompressed...))
+	if err != nil {
+		return fmt.Errorf("error reading %v: %w", paths, err)
+	}
+	defer reader.Close()
+
+	encoder := json.NewEncoder(output)
+	encoder.SetEscapeHTML(false)
+	for {
+		event, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, irzstd.ErrUnterminatedStream) {
+			fmt.Fprintf(os.Stderr, "clp-ir-cat: warning: %v: %v\n", paths, err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error decoding %v: %w", paths, err)
+		}
+
+		err = encoder.Encode(record{Auto: event.AutoKvPairs, User: event.UserKvPairs})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Decrypts input if it is an encrypted object.
+//
+// Parameters:
+//   - input: File to decode
+//   - provider: Provider to decrypt encrypted objects, nil if no key was given
+//
+// Returns:
+//   - decrypted: Decrypted input, or input if it is not encrypted
+//   - err: Error no key was given for an encrypted object, error reading header, error
+//     unwrapping data key
+func decrypt(input io.Reader, provider envelope.KeyProvider) (io.Reader, error) {
+	bufferedInput := bufio.NewReader(input)
+	encrypted, err := envelope.IsEncrypted(bufferedInput)
+	if err != nil {
+		return nil, err
+	}
+	if !encrypted {
+		return bufferedInput, nil
+	}
+	if provider == nil {
+		return nil, errors.New("object is encrypted, use -private_key_file")
+	}
+	return envelope.NewDecryptReader(bufferedInput, provider)
+}
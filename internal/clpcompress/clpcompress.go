@@ -0,0 +1,347 @@
+// Package clpcompress ingests objects into a CLP package by staging them as files and running the
+// package's compress tool. The compress tool submits a compression job and waits until the job
+// finishes, so its exit status reports whether the object was ingested.
+package clpcompress
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Path of the compress tool relative to the package directory.
+const CompressScript = "sbin/compress.sh"
+
+// Maximum length of compress tool output included in errors.
+const maxOutputSize = 4096
+
+// Object to ingest.
+type Object struct {
+	// Key of object, used as the path of the staged file relative to the staging directory.
+	Key  string
+	Body io.Reader
+	// Identifier of the buffer the object was read from. A retried ingest of a buffer whose job
+	// did not finish in time waits for that job instead of submitting a new one.
+	Id string
+}
+
+// Error from a compress job which ran but did not succeed.
+type Error struct {
+	ExitCode int
+	// Tail of the combined stdout and stderr of the compress tool.
+	Output string
+}
+
+// Formats error.
+//
+// Returns:
+//   - message: Error message with exit code and output of compress tool
+func (e *Error) Error() string {
+	return fmt.Sprintf("compress tool exited with status %d: %s", e.ExitCode, e.Output)
+}
+
+// Compressor staging objects and ingesting them with a CLP package's compress tool.
+type Compressor struct {
+	command    []string
+	stagingDir string
+	timeout    time.Duration
+	keepFiles  bool
+
+	mu sync.Mutex
+	// Jobs which did not finish before their ingest returned, by object id.
+	pending map[string]*job
+}
+
+// Compress tool run on a staged file.
+type job struct {
+	path string
+	// Closed once the compress tool exits.
+	done chan struct{}
+	// Result of the compress tool, set before done is closed.
+	err error
+}
+
+// Creates a new [Compressor]. The staging directory must be readable by the CLP package, which
+// only reads files under its configured input directory.
+//
+// Parameters:
+//   - command: Compress tool and its arguments. The path of the staged file is appended.
+//   - stagingDir: Directory where objects are written before they are ingested
+//   - timeout: Time to wait for each compress job before ingest returns
+//   - keepFiles: Whether staged files are kept after they are ingested
+//
+// Returns:
+//   - compressor: CLP compressor
+//   - err: Error empty command, error creating staging directory
+func NewCompressor(
+	command []string,
+	stagingDir string,
+	timeout time.Duration,
+	keepFiles bool,
+) (*Compressor, error) {
+	if len(command) == 0 {
+		return nil, errors.New("error compress command is empty")
+	}
+
+	// The compress tool resolves paths relative to its own working directory, so staged files
+	// are passed as absolute paths.
+	stagingDir, err := filepath.Abs(stagingDir)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving staging directory: %w", err)
+	}
+	if err := os.MkdirAll(stagingDir, 0o700); err != nil {
+		return nil, fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	return &Compressor{
+		command:    command,
+		stagingDir: stagingDir,
+		timeout:    timeout,
+		keepFiles:  keepFiles,
+		pending:    make(map[string]*job),
+	}, nil
+}
+
+// Creates the default compress command of a CLP package.
+//
+// Parameters:
+//   - packageDir: Directory of CLP package
+//   - configFile: CLP package config file, default config of package if empty
+//   - timestampKey: Key of event timestamps, none if empty
+//
+// Returns:
+//   - command: Compress tool and its arguments
+func DefaultCommand(packageDir string, configFile string, timestampKey string) []string {
+	command := []string{filepath.Join(packageDir, filepath.FromSlash(CompressScript))}
+	if configFile != "" {
+		command = append(command, "--config", configFile)
+	}
+	if timestampKey != "" {
+		command = append(command, "--timestamp-key", timestampKey)
+	}
+	return command
+}
+
+// Stages an object and waits for the compress job ingesting it to finish. The staged file is
+// removed after it is ingested, unless files are kept. If the job fails, the staged file is removed
+// so it is not ingested by a later job for another object.
+//
+// If the job does not finish within the timeout or ctx is done, the job keeps running and the
+// staged file is kept. The next ingest of an object with the same id waits for that job instead of
+// staging the object again, so a job which finishes late does not ingest the events a second time.
+// The object is only staged again if the job failed.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to ingest
+//
+// Returns:
+//   - path: Path of the staged file
+//   - err: Error invalid key, error writing file, [Error] from compress tool, error running tool,
+//     context error if job did not finish in time
+func (c *Compressor) Ingest(ctx context.Context, object Object) (string, error) {
+	j := c.takePending(object.Id)
+	if j != nil {
+		err := c.wait(ctx, j)
+		if err == nil || !j.finished() {
+			return c.finish(object.Id, j, err)
+		}
+		// Previous job failed, so the object is ingested by a new job.
+		if err := c.remove(j, nil); err != nil {
+			return "", err
+		}
+	}
+
+	path, err := c.stage(object)
+	if err != nil {
+		return "", err
+	}
+	j, err = c.start(path)
+	if err != nil {
+		return "", c.remove(&job{path: path}, err)
+	}
+	return c.finish(object.Id, j, c.wait(ctx, j))
+}
+
+// Handles the result of waiting for a job. Unfinished jobs are kept pending, and staged files of
+// finished jobs are removed unless files are kept or the job succeeded.
+//
+// Parameters:
+//   - id: Object id
+//   - j: Job
+//   - err: Error waiting for job
+//
+// Returns:
+//   - path: Path of the staged file
+//   - err: Error from job, error removing staged file
+func (c *Compressor) finish(id string, j *job, err error) (string, error) {
+	if !j.finished() {
+		c.mu.Lock()
+		c.pending[id] = j
+		c.mu.Unlock()
+		return "", fmt.Errorf("error compress job for %s did not finish: %w", j.path, err)
+	}
+
+	if err != nil || !c.keepFiles {
+		err = c.remove(j, err)
+	}
+	if err != nil {
+		return "", err
+	}
+	return j.path, nil
+}
+
+// Removes the pending job of an object.
+//
+// Parameters:
+//   - id: Object id
+//
+// Returns:
+//   - job: Pending job, nil if the object has no pending job
+func (c *Compressor) takePending(id string) *job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	j := c.pending[id]
+	delete(c.pending, id)
+	return j
+}
+
+// Removes the staged file of a job.
+//
+// Parameters:
+//   - j: Job
+//   - err: Error of job
+//
+// Returns:
+//   - err: Error of job joined with error removing the staged file
+func (c *Compressor) remove(j *job, err error) error {
+	if removeErr := os.Remove(j.path); removeErr != nil {
+		err = errors.Join(err, fmt.Errorf("error removing staged file: %w", removeErr))
+	}
+	return err
+}
+
+// Writes an object to the staging directory. The object is written to a temporary file which is
+// renamed once complete, so the compress tool never reads a partial file.
+//
+// Parameters:
+//   - object: Object to stage
+//
+// Returns:
+//   - path: Path of the staged file
+//   - err: Error invalid key, error writing file
+func (c *Compressor) stage(object Object) (string, error) {
+	name := filepath.FromSlash(object.Key)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("error object key %s is not a relative path", object.Key)
+	}
+	path := filepath.Join(c.stagingDir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", fmt.Errorf("error creating staging directory: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".staging-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating staged file: %w", err)
+	}
+	_, err = io.Copy(f, object.Body)
+	err = errors.Join(err, f.Close())
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("error writing staged file: %w", err)
+	}
+	return path, nil
+}
+
+// Starts the compress tool on a staged file. The tool is not stopped if its ingest returns before
+// it exits, since the job it submitted keeps running in the CLP package.
+//
+// Parameters:
+//   - path: Path of staged file
+//
+// Returns:
+//   - job: Running job
+//   - err: Error starting tool
+func (c *Compressor) start(path string) (*job, error) {
+	args := append(c.command[1:len(c.command):len(c.command)], path)
+	cmd := exec.Command(c.command[0], args...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting compress tool: %w", err)
+	}
+
+	j := &job{path: path, done: make(chan struct{})}
+	go func() {
+		defer close(j.done)
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = &Error{ExitCode: exitErr.ExitCode(), Output: tail(output.String())}
+		}
+		j.err = err
+	}()
+	return j, nil
+}
+
+// Checks whether the compress tool of a job exited.
+//
+// Returns:
+//   - finished: Whether the job finished
+func (j *job) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Waits for a job to finish.
+//
+// Parameters:
+//   - ctx: Request context
+//   - j: Job
+//
+// Returns:
+//   - err: [Error] if tool exits with non-zero status, context error if the job does not finish
+//     within the timeout or ctx is done, error running tool
+func (c *Compressor) wait(ctx context.Context, j *job) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	select {
+	case <-j.done:
+		return j.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Trims output to its last lines, which describe why a job failed.
+//
+// Parameters:
+//   - output: Output of compress tool
+//
+// Returns:
+//   - tail: At most maxOutputSize bytes from the end of output
+func tail(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > maxOutputSize {
+		output = "..." + output[len(output)-maxOutputSize:]
+	}
+	return output
+}
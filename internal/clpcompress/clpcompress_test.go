@@ -0,0 +1,158 @@
+package clpcompress_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/clpcompress"
+	"github.com/y-scope/fluent-bit-clp/internal/testutil"
+)
+
+func TestIngest(t *testing.T) {
+	pkg := testutil.NewClpPackage(t)
+	stagingDir := t.TempDir()
+	command := clpcompress.DefaultCommand(pkg.Dir(), "", "timestamp")
+	compressor, err := clpcompress.NewCompressor(command, stagingDir, time.Minute, false)
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+
+	path, err := compressor.Ingest(context.Background(), clpcompress.Object{
+		Key:  "app/a.zst",
+		Body: bytes.NewReader([]byte("data")),
+	})
+	if err != nil {
+		t.Fatalf("ingest failed: %v", err)
+	}
+	if path != filepath.Join(stagingDir, "app", "a.zst") {
+		t.Errorf("unexpected staged path %s", path)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected staged file to be removed, got %v", err)
+	}
+
+	jobs := pkg.Jobs(t)
+	if len(jobs) != 1 || string(jobs[0].Data) != "data" {
+		t.Fatalf("unexpected jobs %v", jobs)
+	}
+	expectedArgs := []string{"--timestamp-key", "timestamp", path}
+	if strings.Join(jobs[0].Args, " ") != strings.Join(expectedArgs, " ") {
+		t.Errorf("expected arguments %v, got %v", expectedArgs, jobs[0].Args)
+	}
+}
+
+func TestIngestFailure(t *testing.T) {
+	pkg := testutil.NewClpPackage(t)
+	stagingDir := t.TempDir()
+	command := clpcompress.DefaultCommand(pkg.Dir(), "", "")
+	compressor, err := clpcompress.NewCompressor(command, stagingDir, time.Minute, true)
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+
+	pkg.FailNextJob(t)
+	_, err = compressor.Ingest(context.Background(), clpcompress.Object{
+		Key:  "a.zst",
+		Body: bytes.NewReader([]byte("data")),
+	})
+	var clpErr *clpcompress.Error
+	if !errors.As(err, &clpErr) || clpErr.ExitCode != 1 ||
+		clpErr.Output != "Compression job failed." {
+		t.Fatalf("expected compress tool error, got %v", err)
+	}
+	// Failed files are removed even if staged files are kept.
+	if entries, _ := os.ReadDir(stagingDir); len(entries) != 0 {
+		t.Errorf("expected empty staging directory, got %v", entries)
+	}
+
+	if _, err := compressor.Ingest(context.Background(), clpcompress.Object{
+		Key:  "../a.zst",
+		Body: bytes.NewReader(nil),
+	}); err == nil {
+		t.Errorf("expected error for key outside staging directory")
+	}
+}
+
+func TestIngestTimeout(t *testing.T) {
+	stagingDir := t.TempDir()
+	compressor, err := clpcompress.NewCompressor(
+		[]string{"sh", "-c", "sleep 10"},
+		stagingDir,
+		100*time.Millisecond,
+		false,
+	)
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+
+	_, err = compressor.Ingest(context.Background(), clpcompress.Object{
+		Key:  "a.zst",
+		Body: bytes.NewReader([]byte("data")),
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	// File is kept since the job may still be running.
+	if _, err := os.Stat(filepath.Join(stagingDir, "a.zst")); err != nil {
+		t.Errorf("expected staged file to be kept: %v", err)
+	}
+}
+
+func TestIngestTimeoutResumesJob(t *testing.T) {
+	stagingDir := t.TempDir()
+	runs := filepath.Join(t.TempDir(), "runs")
+	compressor, err := clpcompress.NewCompressor(
+		[]string{"sh", "-c", "echo \"$1\" >> " + runs + "; sleep 1", "sh"},
+		stagingDir,
+		100*time.Millisecond,
+		false,
+	)
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+
+	_, err = compressor.Ingest(context.Background(), clpcompress.Object{
+		Key:  "a.zst",
+		Body: bytes.NewReader([]byte("data")),
+		Id:   "app",
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	// Retried uploads have a new key, but wait for the running job instead of submitting another.
+	var path string
+	for attempt := 0; ; attempt++ {
+		path, err = compressor.Ingest(context.Background(), clpcompress.Object{
+			Key:  "b.zst",
+			Body: bytes.NewReader([]byte("data")),
+			Id:   "app",
+		})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, context.DeadlineExceeded) || attempt == 100 {
+			t.Fatalf("expected retry to finish the job, got %v", err)
+		}
+	}
+	if path != filepath.Join(stagingDir, "a.zst") {
+		t.Errorf("expected path of the first staged file, got %s", path)
+	}
+
+	data, err := os.ReadFile(runs)
+	if err != nil {
+		t.Fatalf("failed to read runs: %v", err)
+	}
+	if string(data) != path+"\n" {
+		t.Errorf("expected a single job for %s, got %q", path, data)
+	}
+	if entries, _ := os.ReadDir(stagingDir); len(entries) != 0 {
+		t.Errorf("expected empty staging directory, got %v", entries)
+	}
+}
@@ -0,0 +1,148 @@
+package decoder
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Encoding of Msgpack binary values. KV-IR has no binary type, so binary values are stored as
+// strings.
+type BinaryEncoding string
+
+// Supported binary encodings.
+const (
+	// Binary encoded as standard base64.
+	BinaryBase64 BinaryEncoding = "base64"
+	// Binary encoded as lowercase hexadecimal.
+	BinaryHex BinaryEncoding = "hex"
+	// Binary interpreted as UTF-8 text. Invalid UTF-8 sequences are replaced with U+FFFD.
+	BinaryString BinaryEncoding = "string"
+)
+
+// Key used to store a record which is not a map.
+const RecordValueKey = "_clp_record"
+
+// Keys of map used to store Msgpack extension types other than timestamps.
+const (
+	ExtTypeKey = "type"
+	ExtDataKey = "data"
+)
+
+// Converts a decoded Msgpack value into a value supported by KV-IR. Mapping is as follows:
+//
+//   - nil, bool, string, float64: Unchanged.
+//   - float32: float64.
+//   - Integers: int64. Unsigned integers larger than [math.MaxInt64] are stored as decimal strings.
+//   - Binary: String using decoder's [BinaryEncoding].
+//   - Fluent Bit, Fluentd EventTime, and Msgpack timestamps: RFC 3339 string in UTC with
+//     nanoseconds.
+//   - Other extension types: Map with the extension type under [ExtTypeKey], and the data under
+//     [ExtDataKey] using decoder's [BinaryEncoding].
+//   - Arrays: Arrays with each element converted.
+//   - Maps: Maps with string keys and each value converted. Keys are converted using
+//     [Decoder.convertKey].
+//
+// Parameters:
+//   - value: Value decoded by codec
+//
+// Returns:
+//   - converted: Value supported by KV-IR
+func (decoder *Decoder) convertValue(value any) any {
+	switch v := value.(type) {
+	case nil, bool, string, int64, float64:
+		return v
+	case float32:
+		return float64(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			return strconv.FormatUint(v, 10)
+		}
+		return int64(v)
+	case []byte:
+		return decoder.encodeBinary(v)
+	case FlbTime:
+		return formatTime(v.Time)
+	case time.Time:
+		return formatTime(v)
+	case codec.RawExt:
+		return map[string]any{
+			ExtTypeKey: int64(v.Tag),
+			ExtDataKey: decoder.encodeBinary(v.Data),
+		}
+	case []any:
+		converted := make([]any, len(v))
+		for i, element := range v {
+			converted[i] = decoder.convertValue(element)
+		}
+		return converted
+	case map[any]any:
+		converted := make(map[string]any, len(v))
+		for key, element := range v {
+			converted[decoder.convertKey(key)] = decoder.convertValue(element)
+		}
+		return converted
+	default:
+		// Codec should only output the types above.
+		return fmt.Sprint(v)
+	}
+}
+
+// Converts a decoded Msgpack map key into a string. String keys are unchanged. Codec converts
+// binary keys to strings, so they are also unchanged. Other keys are converted with
+// [Decoder.convertValue] and stored as JSON (e.g. 1, 1.5, true, null). Codec cannot decode array,
+// map, or non-timestamp extension keys, so records containing them are malformed.
+//
+// Parameters:
+//   - key: Key decoded by codec
+//
+// Returns:
+//   - converted: Key as string
+func (decoder *Decoder) convertKey(key any) string {
+	switch converted := decoder.convertValue(key).(type) {
+	case string:
+		return converted
+	default:
+		jsonKey, err := json.Marshal(converted)
+		if err != nil {
+			return fmt.Sprint(converted)
+		}
+		return string(jsonKey)
+	}
+}
+
+// Encodes binary value as a string.
+//
+// Parameters:
+//   - b: Binary value
+//
+// Returns:
+//   - encoded: Binary value encoded with decoder's [BinaryEncoding]
+func (decoder *Decoder) encodeBinary(b []byte) string {
+	switch decoder.binaryEncoding {
+	case BinaryHex:
+		return hex.EncodeToString(b)
+	case BinaryString:
+		return strings.ToValidUTF8(string(b), "�")
+	default:
+		return base64.StdEncoding.EncodeToString(b)
+	}
+}
+
+// Formats timestamp found in a record.
+//
+// Parameters:
+//   - t: Timestamp
+//
+// Returns:
+//   - formatted: Timestamp in RFC 3339 format in UTC with nanoseconds
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
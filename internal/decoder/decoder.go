@@ -15,13 +15,12 @@
 package decoder
 
 import (
-	"C"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
 	"time"
-	"unsafe"
 
 	"github.com/ugorji/go/codec"
 )
@@ -34,15 +33,44 @@ type FlbTime struct {
 	time.Time
 }
 
-// Initializes a Msgpack decoder which automatically converts bytes to strings. Decoder has an
-// extension setup for a custom Fluent Bit [timestamp format]. During [timestamp encoding],
-// Fluent Bit will set the [Msgpack extension type] to "0". This decoder can recognize the
-// extension type, and will then decode the custom Fluent Bit timestamp using a specific function
-// [ReadExt].
+// Error decoding a single record. Decoder skips past the record, so decoding can continue with the
+// next record. If the chunk is corrupt and the end of the record cannot be found, the rest of the
+// chunk is skipped.
+type RecordError struct {
+	// Undecoded Msgpack bytes of the skipped record(s).
+	Raw []byte
+	Err error
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("error decoding record: %s", e.Err)
+}
+
+func (e *RecordError) Unwrap() error {
+	return e.Err
+}
+
+// Msgpack decoder over a Fluent Bit chunk. Each record is validated, then decoded from a slice
+// bounded to the record.
+type Decoder struct {
+	codec          *codec.Decoder
+	data           []byte
+	offset         int
+	binaryEncoding BinaryEncoding
+}
+
+// Initializes a Msgpack decoder which automatically converts Msgpack strings to Go strings.
+// Decoder has an extension setup for a custom Fluent Bit [timestamp format]. During
+// [timestamp encoding], Fluent Bit will set the [Msgpack extension type] to "0". This decoder can
+// recognize the extension type, and will then decode the custom Fluent Bit timestamp using a
+// specific function [ReadExt].
+//
+// Decoder is pure Go so it can be used without cgo. Fluent Bit chunks must be copied into Go
+// memory before decoding.
 //
 // Parameters:
 //   - data: Msgpack data
-//   - length: Byte length
+//   - binaryEncoding: Encoding of Msgpack binary values in records
 //
 // Returns:
 //   - decoder: Msgpack decoder
@@ -50,30 +78,36 @@ type FlbTime struct {
 // [timestamp format]: https://github.com/fluent/fluent-bit-docs/blob/master/development/msgpack-format.md#fluent-bit-usage
 // [timestamp encoding]: https://github.com/fluent/fluent-bit/blob/2138cee8f4878733956d42d82f6dcf95f0aa9339/src/flb_time.c#L237
 // [Msgpack extension type]: https://github.com/msgpack/msgpack/blob/master/spec.md#extension-types
-func New(data unsafe.Pointer, length int) *codec.Decoder {
-	var b []byte
+func New(data []byte, binaryEncoding BinaryEncoding) *Decoder {
 	var mh codec.MsgpackHandle
 
-	// Decoder settings for string conversion and error handling.
-	mh.RawToString = true
+	// Decoder settings for string conversion and error handling. Binary values are kept as
+	// []byte, and maps keep their original key types. Both are converted by [convertValue].
 	mh.WriteExt = true
 	mh.ErrorIfNoArrayExpand = true
-	mh.MapType = reflect.TypeOf(map[string]interface{}{})
+	mh.MapType = reflect.TypeOf(map[interface{}]interface{}{})
 
 	// Set up custom extension for Fluent Bit timestamp format.
 	mh.SetBytesExt(reflect.TypeOf(FlbTime{}), 0, &FlbTime{})
 
-	b = C.GoBytes(data, C.int(length))
-	decoder := codec.NewDecoderBytes(b, &mh)
-	return decoder
+	decoder := Decoder{
+		codec:          codec.NewDecoderBytes(nil, &mh),
+		data:           data,
+		binaryEncoding: binaryEncoding,
+	}
+	return &decoder
 }
 
-// Updates a value from a []byte.
+// Updates a value from a []byte. Codec does not allow returning an error, but recovers panics
+// during decoding and returns them as errors.
 //
 // Parameters:
 //   - i: Pointer to the registered extension type
 //   - b: Msgpack data in fixext 8 format
 func (f FlbTime) ReadExt(i interface{}, b []byte) {
+	if len(b) != 8 {
+		panic(fmt.Errorf("error decoding Fluent Bit timestamp with length %d, expected 8", len(b)))
+	}
 	// Note that ts refers to the same object since i is a pointer.
 	ts := i.(*FlbTime)
 	sec := binary.BigEndian.Uint32(b)
@@ -96,60 +130,150 @@ func (f FlbTime) UpdateExt(dest interface{}, v interface{}) {
 	panic("unsupported")
 }
 
-// Retrieves data and timestamp from Msgpack object.
+// Retrieves data and timestamp from Msgpack object. Record values are converted to types supported
+// by KV-IR using [convertValue]. Malformed records are returned as [RecordError], after which the
+// next record can be retrieved.
 //
 // Parameters:
 //   - decoder: Msgpack decoder
 //
 // Returns:
 //   - timestamp: Timestamp retrieved from Fluent Bit
-//   - record: JSON record from Fluent Bit with variable amount of keys
-//   - err: decode error, error retrieving timestamp, error marshalling record
-func GetRecord(decoder *codec.Decoder) (interface{}, []byte, error) {
-	// Expect array of length 2 for timestamp and data. Also initialize expected types for
-	// timestamp and record
-	m := [2]interface{}{nil, make(map[string]interface{})}
-
-	err := decoder.Decode(&m)
+//   - record: Record from Fluent Bit with variable amount of keys
+//   - err: io.EOF at end of chunk, [RecordError] for malformed record
+func GetRecord(decoder *Decoder) (time.Time, map[string]any, error) {
+	// io.EOF errors signify chunk is empty. They should be caught and trigger end of decoding.
+	if decoder.offset >= len(decoder.data) {
+		return time.Time{}, nil, io.EOF
+	}
+
+	// Codec allocates containers using lengths read from the stream, so a corrupt length can
+	// exhaust memory. Validate record fits in chunk, then limit codec to the record's bytes.
+	// Validation also ensures a chunk ending in the middle of a record is not mistaken for the
+	// end of the chunk.
+	start := decoder.offset
+	size, err := validateObject(decoder.data[start:])
+	if err != nil {
+		// Start of next record is unknown, so skip rest of chunk.
+		decoder.offset = len(decoder.data)
+		return time.Time{}, nil, &RecordError{Raw: decoder.data[start:], Err: err}
+	}
+	end := start + size
+	decoder.offset = end
+
+	timestamp, record, err := decoder.decodeRecord(decoder.data[start:end:end])
+	if err != nil {
+		return time.Time{}, nil, &RecordError{Raw: decoder.data[start:end], Err: err}
+	}
+	return timestamp, record, nil
+}
+
+// Decodes a single validated record.
+//
+// Parameters:
+//   - data: Msgpack data of the record
+//
+// Returns:
+//   - timestamp: Timestamp retrieved from Fluent Bit
+//   - record: Record from Fluent Bit with variable amount of keys
+//   - err: decode error, error retrieving timestamp
+func (decoder *Decoder) decodeRecord(data []byte) (time.Time, map[string]any, error) {
+	decoder.codec.ResetBytes(data)
+
+	// Decode into an interface instead of typed containers. Codec does not check container type
+	// bytes when decoding into a typed array or map, and may misread other values as container
+	// lengths.
+	var event interface{}
+	err := decoder.codec.Decode(&event)
 	if err != nil {
-		// io.EOF errors signify chunk is empty. They should be caught and trigger end of decoding.
-		// Other decoding errors are not expected in normal operation of plugin.
-		return nil, nil, err
+		return time.Time{}, nil, err
+	}
+
+	// Expect array of length 2 for timestamp and data.
+	m, ok := event.([]interface{})
+	if !ok || len(m) != 2 {
+		err = fmt.Errorf("error decoding event %v, expected array of length 2", event)
+		return time.Time{}, nil, err
 	}
 
 	// Timestamp is located in first index.
-	t := m[0]
-	var timestamp interface{}
+	timestamp, err := decodeTimestamp(m[0])
+	if err != nil {
+		return time.Time{}, nil, err
+	}
 
+	// Record is located in second index. Records which are not maps are wrapped so they can still
+	// be stored as KV-IR.
+	var record map[string]any
+	switch body := decoder.convertValue(m[1]).(type) {
+	case map[string]any:
+		record = body
+	case nil:
+		record = make(map[string]any)
+	default:
+		record = map[string]any{RecordValueKey: body}
+	}
+
+	return timestamp, record, nil
+}
+
+// Converts decoded Fluent Bit timestamp into [time.Time].
+//
+// Parameters:
+//   - t: Decoded timestamp
+//
+// Returns:
+//   - timestamp: Timestamp as [time.Time]
+//   - err: Error unknown timestamp format
+func decodeTimestamp(t interface{}) (time.Time, error) {
 	// Fluent Bit can provide timestamp in multiple formats, so we use type switch to process
 	// correctly.
 	switch v := t.(type) {
-	// For earlier format [TIMESTAMP, MESSAGE].
+	// For earlier format [TIMESTAMP, MESSAGE]. Forwarders using the Fluentd [EventTime] format
+	// use the same extension as Fluent Bit.
+	//
+	// [EventTime]: https://github.com/fluent/fluentd/wiki/Forward-Protocol-Specification-v1#eventtime-ext-format
 	case FlbTime:
-		timestamp = v
+		return v.Time, nil
+	// Msgpack timestamp extension type "-1" is decoded by codec.
+	case time.Time:
+		return v, nil
+	// Codec decodes positive integers as uint64 and negative integers as int64.
 	case uint64:
-		timestamp = v
+		if v > math.MaxInt64 {
+			return time.Time{}, fmt.Errorf("error decoding timestamp %v from stream", v)
+		}
+		return time.Unix(int64(v), 0), nil
+	case int64:
+		return time.Unix(v, 0), nil
+	// Seconds with fractional nanoseconds.
+	case float64:
+		return floatToTime(v)
+	case float32:
+		return floatToTime(float64(v))
 	// For fluent-bit V2 metadata type of format [[TIMESTAMP, METADATA], MESSAGE].
 	case []interface{}:
 		if len(v) < 2 {
-			err = fmt.Errorf("error decoding timestamp %v from stream", v)
-			return nil, nil, err
+			return time.Time{}, fmt.Errorf("error decoding timestamp %v from stream", v)
 		}
-		timestamp = v[0]
+		return decodeTimestamp(v[0])
 	default:
-		err = fmt.Errorf("error decoding timestamp %v from stream", v)
-		return nil, nil, err
+		return time.Time{}, fmt.Errorf("error decoding timestamp %v from stream", v)
 	}
+}
 
-	// Record is located in second index.
-	record := m[1]
-
-	// Marshall record to json.
-	jsonRecord, err := json.Marshal(record)
-	if err != nil {
-		err = fmt.Errorf("failed to marshal record %v: %w", record, err)
-		return nil, nil, err
+// Converts a timestamp in fractional seconds into [time.Time].
+//
+// Parameters:
+//   - seconds: Seconds since the Unix epoch
+//
+// Returns:
+//   - timestamp: Timestamp as [time.Time]
+//   - err: Error if seconds is not finite or out of range
+func floatToTime(seconds float64) (time.Time, error) {
+	if math.IsNaN(seconds) || math.Abs(seconds) >= math.MaxInt64/1e9 {
+		return time.Time{}, fmt.Errorf("error decoding timestamp %v from stream", seconds)
 	}
-
-	return timestamp, jsonRecord, nil
+	sec, frac := math.Modf(seconds)
+	return time.Unix(int64(sec), int64(math.Round(frac*1e9))), nil
 }
@@ -0,0 +1,345 @@
+package decoder
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+var testTime = time.Unix(1704067200, 123456789)
+
+func encode(t testing.TB, v any) []byte {
+	var mh codec.MsgpackHandle
+	mh.WriteExt = true
+
+	var b []byte
+	if err := codec.NewEncoderBytes(&b, &mh).Encode(v); err != nil {
+		t.Fatalf("failed to encode %v: %v", v, err)
+	}
+	return b
+}
+
+func flbTime(ts time.Time) []byte {
+	b := []byte{0xd7, 0x00}
+	b = binary.BigEndian.AppendUint32(b, uint32(ts.Unix()))
+	return binary.BigEndian.AppendUint32(b, uint32(ts.Nanosecond()))
+}
+
+// Encodes [TIMESTAMP, RECORD] with an already encoded timestamp.
+func event(t testing.TB, timestamp []byte, record any) []byte {
+	b := append([]byte{0x92}, timestamp...)
+	return append(b, encode(t, record)...)
+}
+
+func TestGetRecord(t *testing.T) {
+	record := map[string]any{"log": "hello", "nested": map[string]any{"a": "b"}}
+	v2Timestamp := append([]byte{0x92}, flbTime(testTime)...)
+	v2Timestamp = append(v2Timestamp, encode(t, map[string]any{})...)
+	v2FloatTimestamp := append(append([]byte{0x92}, encode(t, 1.5)...), 0x80)
+
+	tests := map[string]struct {
+		timestamp []byte
+		expected  time.Time
+	}{
+		"legacy":           {encode(t, uint64(testTime.Unix())), time.Unix(testTime.Unix(), 0)},
+		"negativeInt":      {encode(t, int64(-1000)), time.Unix(-1000, 0)},
+		"floatSeconds":     {encode(t, 1704067200.5), time.Unix(1704067200, 500000000)},
+		"float32Seconds":   {encode(t, float32(1.25)), time.Unix(1, 250000000)},
+		"flbTime":          {flbTime(testTime), testTime},
+		"msgpackTimestamp": {[]byte{0xd6, 0xff, 0x65, 0x92, 0x00, 0x80}, time.Unix(1704067200, 0)},
+		"v2Metadata":       {v2Timestamp, testTime},
+		"v2MetadataFloat":  {v2FloatTimestamp, time.Unix(1, 500000000)},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			dec := New(event(t, test.timestamp, record), BinaryBase64)
+
+			timestamp, decoded, err := GetRecord(dec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !timestamp.Equal(test.expected) {
+				t.Errorf("expected timestamp %v, got %v", test.expected, timestamp)
+			}
+			if !reflect.DeepEqual(decoded, record) {
+				t.Errorf("expected record %v, got %v", record, decoded)
+			}
+
+			_, _, err = GetRecord(dec)
+			if !errors.Is(err, io.EOF) {
+				t.Errorf("expected EOF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGetRecordMalformed(t *testing.T) {
+	record := encode(t, map[string]any{"log": "hello"})
+
+	tests := map[string][]byte{
+		"stringTimestamp":    event(t, encode(t, "now"), map[string]any{}),
+		"shortExtTimestamp":  append([]byte{0x92, 0xd6, 0x00, 0, 0, 0, 1}, record...),
+		"emptyV2Timestamp":   event(t, []byte{0x90}, map[string]any{}),
+		"truncatedArray":     {0x92, 0xd7, 0x00, 0, 0},
+		"truncatedRecord":    append([]byte{0x92, 0x01}, record[:len(record)-2]...),
+		"notArray":           record,
+		"arrayTooLong":       {0x93, 0x01, 0x80, 0x80},
+		"nilTimestampInV2":   event(t, []byte{0x92, 0xc0, 0x80}, map[string]any{}),
+		"nestedV2Timestamp":  event(t, []byte{0x92, 0x92, 0xc0, 0x80, 0x80}, map[string]any{}),
+		"reservedByte":       {0xc1},
+		"timestampIsNil":     event(t, []byte{0xc0}, map[string]any{}),
+		"timestampIsBoolean": event(t, []byte{0xc3}, map[string]any{}),
+		"arrayKey":           {0x92, 0x01, 0x81, 0x91, 0x01, 0x02},
+		"mapKey":             {0x92, 0x01, 0x81, 0x80, 0x02},
+		"extKey":             {0x92, 0x01, 0x81, 0xd4, 0x05, 0xff, 0x01},
+		"oversizedKey":       {0x92, 0x01, 0x81, 0xdd, 0xfd, 0x42, 0x2e, 0xe0, 0x44, 0x97},
+		"oversizedString":    {0x92, 0x01, 0x81, 0xa1, 0x61, 0xdb, 0xff, 0xff, 0xff, 0xff},
+		"oversizedMap":       {0x92, 0x01, 0xdf, 0xff, 0xff, 0xff, 0xff, 0xa1, 0x61},
+		"oversizedExt":       {0x92, 0xc9, 0xff, 0xff, 0xff, 0xff, 0x00, 0x80},
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := GetRecord(New(data, BinaryBase64))
+			if err == nil || errors.Is(err, io.EOF) {
+				t.Errorf("expected decoding error, got %v", err)
+			}
+		})
+	}
+}
+
+// Checks that arbitrary input never panics and that successfully decoded records are valid JSON.
+// Checks value only contains types supported by KV-IR.
+func checkKvIrValue(value any) error {
+	switch v := value.(type) {
+	case nil, bool, string, int64, float64:
+		return nil
+	case []any:
+		for _, element := range v {
+			if err := checkKvIrValue(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]any:
+		for _, element := range v {
+			if err := checkKvIrValue(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+func TestGetRecordValueTypes(t *testing.T) {
+	tests := map[string]struct {
+		value    []byte
+		expected any
+	}{
+		"nil":            {[]byte{0xc0}, nil},
+		"true":           {[]byte{0xc3}, true},
+		"false":          {[]byte{0xc2}, false},
+		"positiveFixint": {[]byte{0x07}, int64(7)},
+		"negativeFixint": {[]byte{0xff}, int64(-1)},
+		"uint8":          {[]byte{0xcc, 0xff}, int64(255)},
+		"uint64":         {[]byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}, int64(1 << 32)},
+		"uint64Max": {
+			[]byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			"18446744073709551615",
+		},
+		"int64Min":    {[]byte{0xd3, 0x80, 0, 0, 0, 0, 0, 0, 0}, int64(math.MinInt64)},
+		"float32":     {[]byte{0xca, 0x3f, 0xc0, 0, 0}, 1.5},
+		"float64":     {encode(t, 2.25), 2.25},
+		"string":      {encode(t, "hello"), "hello"},
+		"emptyBinary": {[]byte{0xc4, 0x00}, ""},
+		"binary":      {[]byte{0xc4, 0x03, 0x00, 0xff, 0x61}, "AP9h"},
+		"flbTime":     {flbTime(testTime), "2024-01-01T00:00:00.123456789Z"},
+		"msgpackTimestamp": {
+			[]byte{0xd6, 0xff, 0x65, 0x92, 0x00, 0x80},
+			"2024-01-01T00:00:00Z",
+		},
+		"fixext": {
+			[]byte{0xd4, 0x05, 0xff},
+			map[string]any{ExtTypeKey: int64(5), ExtDataKey: "/w=="},
+		},
+		"ext8": {
+			[]byte{0xc7, 0x02, 0x7f, 0x01, 0x02},
+			map[string]any{ExtTypeKey: int64(127), ExtDataKey: "AQI="},
+		},
+		"arrayOfMaps": {
+			[]byte{0x92, 0x81, 0xa1, 0x61, 0x01, 0x81, 0xa1, 0x62, 0x90},
+			[]any{map[string]any{"a": int64(1)}, map[string]any{"b": []any{}}},
+		},
+		"nestedArrays": {
+			[]byte{0x92, 0x91, 0xc0, 0x91, 0x91, 0xc3},
+			[]any{[]any{nil}, []any{[]any{true}}},
+		},
+		"integerKeys": {
+			[]byte{0x82, 0x01, 0xa1, 0x61, 0xff, 0xa1, 0x62},
+			map[string]any{"1": "a", "-1": "b"},
+		},
+		"scalarKeys": {
+			[]byte{0x83, 0xc3, 0x01, 0xc0, 0x02, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0x03},
+			map[string]any{"true": int64(1), "null": int64(2), "1.5": int64(3)},
+		},
+		"binaryKey": {
+			[]byte{0x81, 0xc4, 0x01, 0x61, 0x01},
+			map[string]any{"a": int64(1)},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := append([]byte{0x81, 0xa1, 0x76}, test.value...)
+			_, record, err := GetRecord(New(append([]byte{0x92, 0x01}, value...), BinaryBase64))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(record["v"], test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, record["v"])
+			}
+			if err := checkKvIrValue(record); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestGetRecordBinaryEncodings(t *testing.T) {
+	value := []byte{0x92, 0x01, 0x81, 0xa1, 0x76, 0xc4, 0x04, 0x68, 0x69, 0xff, 0x00}
+	tests := map[BinaryEncoding]string{
+		BinaryBase64: "aGn/AA==",
+		BinaryHex:    "6869ff00",
+		BinaryString: "hi\ufffd\x00",
+	}
+
+	for encoding, expected := range tests {
+		t.Run(string(encoding), func(t *testing.T) {
+			_, record, err := GetRecord(New(value, encoding))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if record["v"] != expected {
+				t.Errorf("expected %q, got %q", expected, record["v"])
+			}
+		})
+	}
+}
+
+func TestGetRecordBody(t *testing.T) {
+	tests := map[string]struct {
+		body     []byte
+		expected map[string]any
+	}{
+		"nil":    {[]byte{0xc0}, map[string]any{}},
+		"string": {encode(t, "hello"), map[string]any{RecordValueKey: "hello"}},
+		"array": {
+			[]byte{0x92, 0x01, 0xa1, 0x61},
+			map[string]any{RecordValueKey: []any{int64(1), "a"}},
+		},
+		"integerKeys": {[]byte{0x81, 0x01, 0x02}, map[string]any{"1": int64(2)}},
+		// Codec would misread 0xcc as a map header if decoding into a map.
+		"integer": {[]byte{0xcc, 0xdd}, map[string]any{RecordValueKey: int64(221)}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, record, err := GetRecord(New(append([]byte{0x92, 0x01}, test.body...), BinaryHex))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(record, test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, record)
+			}
+		})
+	}
+}
+
+func TestGetRecordSkipsMalformed(t *testing.T) {
+	good := event(t, encode(t, uint64(1)), map[string]any{"log": "hello"})
+	bad := event(t, encode(t, "now"), map[string]any{"log": "bad"})
+	corrupt := []byte{0x92, 0x01, 0xdd, 0xff, 0xff, 0xff, 0xff}
+
+	var chunk []byte
+	for _, b := range [][]byte{good, bad, good, corrupt, good} {
+		chunk = append(chunk, b...)
+	}
+	dec := New(chunk, BinaryBase64)
+
+	expected := []struct {
+		raw []byte
+	}{
+		{nil},
+		{bad},
+		{nil},
+		// End of corrupt record is unknown, so rest of chunk is skipped.
+		{append(append([]byte{}, corrupt...), good...)},
+	}
+	for i, e := range expected {
+		_, record, err := GetRecord(dec)
+		if e.raw == nil {
+			if err != nil || record["log"] != "hello" {
+				t.Fatalf("record %d: expected good record, got %v, %v", i, record, err)
+			}
+			continue
+		}
+		var recordErr *RecordError
+		if !errors.As(err, &recordErr) {
+			t.Fatalf("record %d: expected RecordError, got %v", i, err)
+		}
+		if !bytes.Equal(recordErr.Raw, e.raw) {
+			t.Errorf("record %d: expected raw %x, got %x", i, e.raw, recordErr.Raw)
+		}
+	}
+
+	_, _, err := GetRecord(dec)
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func FuzzGetRecord(f *testing.F) {
+	record := encode(f, map[string]any{"log": "hello", "list": []any{"a", map[string]any{}}})
+	v2Timestamp := append([]byte{0x92}, flbTime(testTime)...)
+	v2Timestamp = append(v2Timestamp, 0x80)
+
+	seeds := [][]byte{
+		event(f, encode(f, uint64(testTime.Unix())), map[string]any{"log": "hello"}),
+		event(f, flbTime(testTime), map[string]any{"log": "hello"}),
+		append(append([]byte{0x92}, v2Timestamp...), record...),
+		event(f, encode(f, 1.5), map[string]any{"log": "hello"}),
+		event(f, encode(f, int64(-1)), map[string]any{"log": "hello"}),
+		append([]byte{0x92, 0xd6, 0x00, 0, 0, 0, 1}, record...),
+		{0x92, 0xd7, 0x00, 0, 0},
+		append([]byte{0x92, 0x01}, record[:len(record)-2]...),
+		event(f, []byte{0x01}, []any{"a", "b"}),
+		{0x92, 0x01, 0x81, 0x01, 0xc4, 0x01, 0xff},
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dec := New(data, BinaryBase64)
+		for i := 0; i < 100; i++ {
+			_, record, err := GetRecord(dec)
+			if err != nil {
+				return
+			}
+			if err := checkKvIrValue(record); err != nil {
+				t.Fatalf("record %v: %v", record, err)
+			}
+		}
+	})
+}
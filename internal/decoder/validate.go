@@ -0,0 +1,116 @@
+package decoder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var errTruncatedRecord = fmt.Errorf("error decoding truncated record: %w", io.ErrUnexpectedEOF)
+
+// Walks the headers of the next Msgpack [object] without decoding it, and checks that every length
+// in the object fits in the data. Each element of a container occupies at least one
+// byte, so container lengths are bounded by the size of the data as well. Nested objects are
+// tracked with a counter instead of recursion so deeply nested input cannot overflow the stack.
+//
+// Parameters:
+//   - data: Msgpack data starting at the object
+//
+// Returns:
+//   - size: Size of the object in bytes
+//   - err: Truncated object error, invalid type byte error
+//
+// [object]: https://github.com/msgpack/msgpack/blob/master/spec.md#formats
+func validateObject(data []byte) (int, error) {
+	pos := 0
+	pendingObjects := 1
+	for pendingObjects > 0 {
+		if pos >= len(data) {
+			return 0, errTruncatedRecord
+		}
+		b := data[pos]
+		pos++
+		pendingObjects--
+
+		var payloadSize, numChildren int
+		switch {
+		case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+			// Fixint, nil, and bool have no payload.
+		case b <= 0x8f:
+			numChildren = 2 * int(b&0x0f)
+		case b <= 0x9f:
+			numChildren = int(b & 0x0f)
+		case b <= 0xbf:
+			payloadSize = int(b & 0x1f)
+		case b == 0xc4, b == 0xd9:
+			payloadSize = readLength(data, &pos, 1)
+		case b == 0xc5, b == 0xda:
+			payloadSize = readLength(data, &pos, 2)
+		case b == 0xc6, b == 0xdb:
+			payloadSize = readLength(data, &pos, 4)
+		case b >= 0xc7 && b <= 0xc9:
+			// Ext length does not include the type byte.
+			payloadSize = readLength(data, &pos, 1<<(b-0xc7))
+			if payloadSize >= 0 {
+				payloadSize++
+			}
+		case b == 0xca:
+			payloadSize = 4
+		case b == 0xcb:
+			payloadSize = 8
+		case b >= 0xcc && b <= 0xcf:
+			payloadSize = 1 << (b - 0xcc)
+		case b >= 0xd0 && b <= 0xd3:
+			payloadSize = 1 << (b - 0xd0)
+		case b >= 0xd4 && b <= 0xd8:
+			payloadSize = 1<<(b-0xd4) + 1
+		case b == 0xdc:
+			numChildren = readLength(data, &pos, 2)
+		case b == 0xdd:
+			numChildren = readLength(data, &pos, 4)
+		case b == 0xde:
+			numChildren = 2 * readLength(data, &pos, 2)
+		case b == 0xdf:
+			numChildren = 2 * readLength(data, &pos, 4)
+		default:
+			return 0, errors.New("error decoding record with invalid Msgpack type byte 0xc1")
+		}
+
+		if payloadSize < 0 || numChildren < 0 || payloadSize > len(data)-pos {
+			return 0, errTruncatedRecord
+		}
+		pos += payloadSize
+		pendingObjects += numChildren
+		if pendingObjects > len(data)-pos {
+			return 0, errTruncatedRecord
+		}
+	}
+	return pos, nil
+}
+
+// Reads a big-endian length from data and advances the position past it.
+//
+// Parameters:
+//   - data: Msgpack data
+//   - pos: Position of the length in data
+//   - size: Size of the length in bytes
+//
+// Returns:
+//   - length: Length read, -1 if data is too short
+func readLength(data []byte, pos *int, size int) int {
+	if size > len(data)-*pos {
+		return -1
+	}
+	var length uint64
+	switch size {
+	case 1:
+		length = uint64(data[*pos])
+	case 2:
+		length = uint64(binary.BigEndian.Uint16(data[*pos:]))
+	case 4:
+		length = uint64(binary.BigEndian.Uint32(data[*pos:]))
+	}
+	*pos += size
+	return int(length)
+}
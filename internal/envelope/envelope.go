@@ -0,0 +1,402 @@
+// Package implements client-side envelope encryption of uploaded objects. Each object is encrypted
+// with a new random data key, and the data key is wrapped by a [KeyProvider] so only holders of the
+// provider's private key can decrypt the object.
+//
+// Encrypted objects start with a header followed by the ciphertext:
+//
+//	magic (4 bytes) | header length (4 bytes, little endian) | header (JSON) | segments
+//
+// The header holds the algorithms, the wrapped data key, and a random nonce prefix. The plaintext
+// is split into segments of [segmentSize] bytes, each encrypted with AES-256-GCM. The nonce of each
+// segment is the nonce prefix, the segment index, and a flag marking the last segment, so segments
+// cannot be reordered and truncation is detected. The header is authenticated as additional data of
+// every segment.
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Content encryption algorithm.
+const Algorithm = "AES-256-GCM-STREAM-64K"
+
+// Magic number at the start of every encrypted object.
+var magic = []byte{'C', 'L', 'P', 'X'}
+
+// Size of plaintext in each segment except the last.
+const segmentSize = 64 << 10
+
+// Sizes of encryption parameters.
+const (
+	dataKeySize     = 32
+	noncePrefixSize = 7
+	tagSize         = 16
+)
+
+// Maximum size of header. Wrapped keys are at most a few KB.
+const maxHeaderSize = 64 << 10
+
+// Returned when an encrypted object cannot be decrypted. Occurs if the object was modified or
+// truncated.
+var ErrAuthenticationFailed = errors.New("error authenticating encrypted object")
+
+// Describes how an object was encrypted. Stored in the object and in its metadata.
+type Header struct {
+	Algorithm    string `json:"algorithm"`
+	KeyAlgorithm string `json:"keyAlgorithm"`
+	KeyId        string `json:"keyId"`
+	WrappedKey   []byte `json:"wrappedKey"`
+	NoncePrefix  []byte `json:"noncePrefix"`
+}
+
+// Encrypts a stream with a new data key.
+type EncryptReader struct {
+	Header    Header
+	header    []byte
+	aead      cipher.AEAD
+	source    io.Reader
+	plaintext []byte
+	sealed    []byte
+	pending   []byte
+	index     uint32
+	done      bool
+}
+
+// Opens a reader which outputs the encrypted object for source. A data key is generated and
+// wrapped with provider.
+//
+// Parameters:
+//   - source: Plaintext
+//   - provider: Provider used to wrap the data key
+//
+// Returns:
+//   - reader: Reader for encrypted object
+//   - err: Error generating or wrapping data key
+func NewEncryptReader(source io.Reader, provider KeyProvider) (*EncryptReader, error) {
+	dataKey := make([]byte, dataKeySize)
+	noncePrefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("error generating data key: %w", err)
+	}
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	wrappedKey, err := provider.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error wrapping data key: %w", err)
+	}
+
+	header := Header{
+		Algorithm:    Algorithm,
+		KeyAlgorithm: provider.KeyAlgorithm(),
+		KeyId:        provider.KeyId(),
+		WrappedKey:   wrappedKey,
+		NoncePrefix:  noncePrefix,
+	}
+	encodedHeader, err := encodeHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptReader{
+		Header:    header,
+		header:    encodedHeader,
+		aead:      aead,
+		source:    source,
+		plaintext: make([]byte, segmentSize),
+		sealed:    make([]byte, 0, segmentSize+tagSize),
+		pending:   encodedHeader,
+	}, nil
+}
+
+// Computes size of encrypted object.
+//
+// Parameters:
+//   - plaintextSize: Size of source
+//
+// Returns:
+//   - size: Size of encrypted object
+func (r *EncryptReader) Size(plaintextSize int) int {
+	numSegments := plaintextSize/segmentSize + 1
+	return len(r.header) + plaintextSize + numSegments*tagSize
+}
+
+// Reads encrypted object.
+//
+// Parameters:
+//   - p: Destination buffer
+//
+// Returns:
+//   - n: Number of bytes read
+//   - err: [io.EOF] after the last segment, error reading source
+func (r *EncryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Reads and encrypts the next segment of source. A segment shorter than [segmentSize] is the last
+// segment, so if source ends on a segment boundary, an empty last segment is added.
+//
+// Returns:
+//   - err: Error reading source, error too many segments
+func (r *EncryptReader) sealSegment() error {
+	n, err := io.ReadFull(r.source, r.plaintext)
+	last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	if err != nil && !last {
+		return err
+	}
+	if r.index == math.MaxUint32 {
+		return errors.New("error object is too large to encrypt")
+	}
+
+	nonce := segmentNonce(r.Header.NoncePrefix, r.index, last)
+	r.pending = r.aead.Seal(r.sealed[:0], nonce, r.plaintext[:n], r.header)
+	r.index += 1
+	r.done = last
+	return nil
+}
+
+// Decrypts an encrypted object.
+type DecryptReader struct {
+	Header     Header
+	header     []byte
+	aead       cipher.AEAD
+	source     io.Reader
+	ciphertext []byte
+	plaintext  []byte
+	pending    []byte
+	index      uint32
+	done       bool
+}
+
+// Opens a reader which decrypts an encrypted object. The data key is unwrapped with provider.
+//
+// Parameters:
+//   - source: Encrypted object
+//   - provider: Provider holding the key used to wrap the data key
+//
+// Returns:
+//   - reader: Reader for plaintext
+//   - err: Error reading header, error unwrapping data key
+func NewDecryptReader(source io.Reader, provider KeyProvider) (*DecryptReader, error) {
+	header, encodedHeader, err := readHeader(source)
+	if err != nil {
+		return nil, err
+	}
+	if header.Algorithm != Algorithm {
+		return nil, fmt.Errorf("error unsupported encryption algorithm %q", header.Algorithm)
+	}
+	if len(header.NoncePrefix) != noncePrefixSize {
+		return nil, fmt.Errorf("error invalid nonce prefix")
+	}
+
+	dataKey, err := provider.UnwrapKey(header)
+	if err != nil {
+		return nil, fmt.Errorf("error unwrapping data key: %w", err)
+	}
+
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DecryptReader{
+		Header:     header,
+		header:     encodedHeader,
+		aead:       aead,
+		source:     source,
+		ciphertext: make([]byte, segmentSize+tagSize),
+		plaintext:  make([]byte, 0, segmentSize),
+	}, nil
+}
+
+// Reads plaintext.
+//
+// Parameters:
+//   - p: Destination buffer
+//
+// Returns:
+//   - n: Number of bytes read
+//   - err: [io.EOF] after the last segment, [ErrAuthenticationFailed] if object was modified or
+//     truncated, error reading source
+func (r *DecryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.openSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// Reads and decrypts the next segment. A segment shorter than a full segment is the last segment.
+// If the object was truncated on a segment boundary, the empty last segment fails authentication.
+//
+// Returns:
+//   - err: [ErrAuthenticationFailed] if segment cannot be authenticated, error reading source
+func (r *DecryptReader) openSegment() error {
+	n, err := io.ReadFull(r.source, r.ciphertext)
+	last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+	if err != nil && !last {
+		return err
+	}
+
+	nonce := segmentNonce(r.Header.NoncePrefix, r.index, last)
+	plaintext, err := r.aead.Open(r.plaintext[:0], nonce, r.ciphertext[:n], r.header)
+	if err != nil {
+		return ErrAuthenticationFailed
+	}
+	r.pending = plaintext
+	r.index += 1
+	r.done = last
+	return nil
+}
+
+// Checks whether input is an encrypted object. Input is not consumed.
+//
+// Parameters:
+//   - reader: Input
+//
+// Returns:
+//   - encrypted: Whether input starts with the magic number of encrypted objects
+//   - err: Error reading input
+func IsEncrypted(reader *bufio.Reader) (bool, error) {
+	prefix, err := reader.Peek(len(magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return bytes.Equal(prefix, magic), nil
+}
+
+// Converts header to S3 user metadata.
+//
+// Returns:
+//   - metadata: Algorithms, key id, and base64 encoded wrapped key
+func (h Header) Metadata() map[string]string {
+	return map[string]string{
+		"encryption-algorithm":     h.Algorithm,
+		"encryption-key-algorithm": h.KeyAlgorithm,
+		"encryption-key-id":        h.KeyId,
+		"encryption-wrapped-key":   base64.StdEncoding.EncodeToString(h.WrappedKey),
+	}
+}
+
+// Encodes header with magic number and length.
+//
+// Parameters:
+//   - header: Header
+//
+// Returns:
+//   - encoded: Encoded header
+//   - err: Error marshalling header
+func encodeHeader(header Header) ([]byte, error) {
+	data, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling header: %w", err)
+	}
+	encoded := make([]byte, len(magic)+4, len(magic)+4+len(data))
+	copy(encoded, magic)
+	binary.LittleEndian.PutUint32(encoded[len(magic):], uint32(len(data)))
+	return append(encoded, data...), nil
+}
+
+// Reads header with magic number and length.
+//
+// Parameters:
+//   - reader: Encrypted object
+//
+// Returns:
+//   - header: Decoded header
+//   - encoded: Encoded header, used as additional data of segments
+//   - err: Error input is not an encrypted object, error reading input
+func readHeader(reader io.Reader) (Header, []byte, error) {
+	var header Header
+	prefix := make([]byte, len(magic)+4)
+	if _, err := io.ReadFull(reader, prefix); err != nil {
+		return header, nil, fmt.Errorf("error reading header: %w", err)
+	}
+	if !bytes.Equal(prefix[:len(magic)], magic) {
+		return header, nil, errors.New("error input is not an encrypted object")
+	}
+	length := binary.LittleEndian.Uint32(prefix[len(magic):])
+	if length > maxHeaderSize {
+		return header, nil, fmt.Errorf("error header size %d exceeds maximum", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return header, nil, fmt.Errorf("error reading header: %w", err)
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return header, nil, fmt.Errorf("error decoding header: %w", err)
+	}
+	return header, append(prefix, data...), nil
+}
+
+// Creates AES-256-GCM cipher.
+//
+// Parameters:
+//   - dataKey: Data key
+//
+// Returns:
+//   - aead: Cipher
+//   - err: Error invalid key size
+func newAead(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != dataKeySize {
+		return nil, fmt.Errorf("error data key is %d bytes, expected %d", len(dataKey), dataKeySize)
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AES cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Creates nonce of a segment.
+//
+// Parameters:
+//   - prefix: Random nonce prefix of object
+//   - index: Index of segment
+//   - last: Whether segment is the last segment
+//
+// Returns:
+//   - nonce: Nonce of segment
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
@@ -0,0 +1,226 @@
+package envelope
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Generates an RSA key and writes its private and public keys to PEM files.
+//
+// Returns:
+//   - privateKeyPath: Path to PKCS #8 private key
+//   - publicKeyPath: Path to PKIX public key
+func writeKeyFiles(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode private key: %v", err)
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+
+	dir := t.TempDir()
+	privateKeyPath := filepath.Join(dir, "private.pem")
+	publicKeyPath := filepath.Join(dir, "public.pem")
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer})
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})
+	if err := os.WriteFile(privateKeyPath, privatePem, 0o600); err != nil {
+		t.Fatalf("failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(publicKeyPath, publicPem, 0o600); err != nil {
+		t.Fatalf("failed to write public key: %v", err)
+	}
+	return privateKeyPath, publicKeyPath
+}
+
+func newProviders(t *testing.T) (*FileKeyProvider, *FileKeyProvider) {
+	t.Helper()
+	privateKeyPath, publicKeyPath := writeKeyFiles(t)
+	privateProvider, err := NewFileKeyProvider(privateKeyPath)
+	if err != nil {
+		t.Fatalf("failed to load private key: %v", err)
+	}
+	publicProvider, err := NewFileKeyProvider(publicKeyPath)
+	if err != nil {
+		t.Fatalf("failed to load public key: %v", err)
+	}
+	return privateProvider, publicProvider
+}
+
+func encrypt(t *testing.T, plaintext []byte, provider KeyProvider) []byte {
+	t.Helper()
+	reader, err := NewEncryptReader(bytes.NewReader(plaintext), provider)
+	if err != nil {
+		t.Fatalf("failed to create encrypt reader: %v", err)
+	}
+	encrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	if size := reader.Size(len(plaintext)); size != len(encrypted) {
+		t.Errorf("expected size %d, got %d", len(encrypted), size)
+	}
+	return encrypted
+}
+
+func decrypt(encrypted []byte, provider KeyProvider) ([]byte, error) {
+	reader, err := NewDecryptReader(bytes.NewReader(encrypted), provider)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+func TestRoundTrip(t *testing.T) {
+	privateProvider, publicProvider := newProviders(t)
+	if privateProvider.KeyId() != publicProvider.KeyId() {
+		t.Fatalf("expected equal key ids for public and private key")
+	}
+
+	sizes := []int{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 100}
+	for _, size := range sizes {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		encrypted := encrypt(t, plaintext, publicProvider)
+		if size >= tagSize && bytes.Contains(encrypted, plaintext) {
+			t.Errorf("size %d: expected plaintext to be encrypted", size)
+		}
+		decrypted, err := decrypt(encrypted, privateProvider)
+		if err != nil {
+			t.Fatalf("size %d: failed to decrypt: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: decrypted data does not match", size)
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	privateProvider, publicProvider := newProviders(t)
+	plaintext := make([]byte, 2*segmentSize+10)
+	encrypted := encrypt(t, plaintext, publicProvider)
+
+	headerSize := len(encrypted) - len(plaintext) - 3*tagSize
+	tests := map[string][]byte{
+		"truncated mid segment":  encrypted[:len(encrypted)-5],
+		"truncated at segment":   encrypted[:headerSize+2*(segmentSize+tagSize)],
+		"truncated after header": encrypted[:headerSize],
+		"modified":               append([]byte{}, encrypted...),
+		"appended":               append(append([]byte{}, encrypted...), 0),
+		"segments swapped":       swapSegments(encrypted, headerSize),
+		"modified header":        append([]byte{}, encrypted...),
+	}
+	tests["modified"][headerSize+10] ^= 1
+	tests["modified header"][headerSize-3] ^= 1
+
+	for name, data := range tests {
+		_, err := decrypt(data, privateProvider)
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	_, publicProvider := newProviders(t)
+	otherPrivateProvider, _ := newProviders(t)
+	encrypted := encrypt(t, []byte("log"), publicProvider)
+
+	if _, err := decrypt(encrypted, otherPrivateProvider); err == nil {
+		t.Errorf("expected error decrypting with another key")
+	}
+	if _, err := decrypt(encrypted, publicProvider); err == nil {
+		t.Errorf("expected error decrypting with public key")
+	}
+}
+
+func TestHeaderMetadata(t *testing.T) {
+	privateProvider, publicProvider := newProviders(t)
+	reader, err := NewEncryptReader(bytes.NewReader(nil), publicProvider)
+	if err != nil {
+		t.Fatalf("failed to create encrypt reader: %v", err)
+	}
+
+	metadata := reader.Header.Metadata()
+	expected := map[string]string{
+		"encryption-algorithm":     Algorithm,
+		"encryption-key-algorithm": RsaOaepSha256,
+		"encryption-key-id":        privateProvider.KeyId(),
+	}
+	for key, value := range expected {
+		if metadata[key] != value {
+			t.Errorf("metadata %s: expected %q, got %q", key, value, metadata[key])
+		}
+	}
+	if metadata["encryption-wrapped-key"] == "" {
+		t.Errorf("expected wrapped key in metadata")
+	}
+}
+
+func TestIsEncrypted(t *testing.T) {
+	_, publicProvider := newProviders(t)
+	encrypted := encrypt(t, []byte("log"), publicProvider)
+
+	tests := map[string]struct {
+		data     []byte
+		expected bool
+	}{
+		"encrypted": {data: encrypted, expected: true},
+		"zstd":      {data: []byte{0x28, 0xb5, 0x2f, 0xfd, 0}, expected: false},
+		"short":     {data: []byte("CL"), expected: false},
+		"empty":     {data: nil, expected: false},
+	}
+	for name, test := range tests {
+		encrypted, err := IsEncrypted(bufioReader(test.data))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if encrypted != test.expected {
+			t.Errorf("%s: expected %v, got %v", name, test.expected, encrypted)
+		}
+	}
+}
+
+func TestNewFileKeyProviderInvalid(t *testing.T) {
+	dir := t.TempDir()
+	notPem := filepath.Join(dir, "key.txt")
+	if err := os.WriteFile(notPem, []byte("key"), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+
+	for _, path := range []string{notPem, filepath.Join(dir, "missing.pem")} {
+		if _, err := NewFileKeyProvider(path); err == nil {
+			t.Errorf("%s: expected error", path)
+		}
+	}
+}
+
+// Swaps the first two segments of an encrypted object.
+func swapSegments(encrypted []byte, headerSize int) []byte {
+	swapped := append([]byte{}, encrypted...)
+	first := swapped[headerSize : headerSize+segmentSize+tagSize]
+	second := swapped[headerSize+segmentSize+tagSize : headerSize+2*(segmentSize+tagSize)]
+	tmp := append([]byte{}, first...)
+	copy(first, second)
+	copy(second, tmp)
+	return swapped
+}
+
+func bufioReader(data []byte) *bufio.Reader {
+	return bufio.NewReader(bytes.NewReader(data))
+}
@@ -0,0 +1,182 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Wraps and unwraps data keys. Implementations may hold keys locally or call a key management
+// service, in which case the plugin never holds the key used to unwrap.
+type KeyProvider interface {
+	// Encrypts a data key.
+	//
+	// Parameters:
+	//   - dataKey: Data key
+	//
+	// Returns:
+	//   - wrappedKey: Encrypted data key
+	//   - err
+	WrapKey(dataKey []byte) ([]byte, error)
+
+	// Decrypts the data key of an encrypted object.
+	//
+	// Parameters:
+	//   - header: Header of encrypted object
+	//
+	// Returns:
+	//   - dataKey: Data key
+	//   - err
+	UnwrapKey(header Header) ([]byte, error)
+
+	// Getter for name of algorithm used to wrap data keys.
+	//
+	// Returns:
+	//   - algorithm: Key wrapping algorithm
+	KeyAlgorithm() string
+
+	// Getter for identifier of the key used to wrap data keys.
+	//
+	// Returns:
+	//   - keyId: Key identifier
+	KeyId() string
+}
+
+// Key wrapping algorithm of [FileKeyProvider].
+const RsaOaepSha256 = "RSA-OAEP-SHA256"
+
+// Wraps data keys with an RSA key read from a PEM file. A public key can only wrap data keys, so
+// the plugin can encrypt objects without being able to decrypt them. A private key can also
+// unwrap data keys.
+type FileKeyProvider struct {
+	publicKey  *rsa.PublicKey
+	privateKey *rsa.PrivateKey
+	keyId      string
+}
+
+// Creates a [FileKeyProvider] from a PEM file containing an RSA public key ("PUBLIC KEY") or
+// private key ("PRIVATE KEY" or "RSA PRIVATE KEY").
+//
+// Parameters:
+//   - path: Path to PEM file
+//
+// Returns:
+//   - provider: Key provider
+//   - err: Error reading file, error parsing key, error key is not RSA
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("error key file %s is not PEM encoded", path)
+	}
+
+	var provider FileKeyProvider
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing public key: %w", err)
+		}
+		publicKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("error public key is %T, expected RSA", key)
+		}
+		provider.publicKey = publicKey
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %w", err)
+		}
+		privateKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("error private key is %T, expected RSA", key)
+		}
+		provider.privateKey = privateKey
+		provider.publicKey = &privateKey.PublicKey
+	case "RSA PRIVATE KEY":
+		privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing private key: %w", err)
+		}
+		provider.privateKey = privateKey
+		provider.publicKey = &privateKey.PublicKey
+	default:
+		return nil, fmt.Errorf("error unsupported PEM block type %q", block.Type)
+	}
+
+	if provider.publicKey.N.BitLen() < 2048 {
+		return nil, errors.New("error RSA key must be at least 2048 bits")
+	}
+
+	publicKeyDer, err := x509.MarshalPKIXPublicKey(provider.publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding public key: %w", err)
+	}
+	fingerprint := sha256.Sum256(publicKeyDer)
+	provider.keyId = "sha256:" + hex.EncodeToString(fingerprint[:])
+
+	return &provider, nil
+}
+
+// Encrypts a data key with RSA-OAEP using SHA-256.
+//
+// Parameters:
+//   - dataKey: Data key
+//
+// Returns:
+//   - wrappedKey: Encrypted data key
+//   - err: Error encrypting
+func (p *FileKeyProvider) WrapKey(dataKey []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, p.publicKey, dataKey, nil)
+}
+
+// Decrypts the data key of an encrypted object.
+//
+// Parameters:
+//   - header: Header of encrypted object
+//
+// Returns:
+//   - dataKey: Data key
+//   - err: Error provider only has a public key, error algorithm or key id do not match, error
+//     decrypting
+func (p *FileKeyProvider) UnwrapKey(header Header) ([]byte, error) {
+	if p.privateKey == nil {
+		return nil, errors.New("error private key is required to decrypt")
+	}
+	if header.KeyAlgorithm != RsaOaepSha256 {
+		return nil, fmt.Errorf("error unsupported key algorithm %q", header.KeyAlgorithm)
+	}
+	if header.KeyId != p.keyId {
+		return nil, fmt.Errorf(
+			"error object was encrypted with key %s, not %s",
+			header.KeyId,
+			p.keyId,
+		)
+	}
+	return rsa.DecryptOAEP(sha256.New(), nil, p.privateKey, header.WrappedKey, nil)
+}
+
+// Getter for name of algorithm used to wrap data keys.
+//
+// Returns:
+//   - algorithm: [RsaOaepSha256]
+func (p *FileKeyProvider) KeyAlgorithm() string {
+	return RsaOaepSha256
+}
+
+// Getter for identifier of the key used to wrap data keys.
+//
+// Returns:
+//   - keyId: SHA-256 fingerprint of public key
+func (p *FileKeyProvider) KeyId() string {
+	return p.keyId
+}
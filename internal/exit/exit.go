@@ -0,0 +1,143 @@
+// Package exit provides functions for gracefully shutting down the plugin. Exit functions are only
+// called when Fluent Bit receives a kill signal, not during an abrupt crash. The plugin is given
+// limited time to clean up resources before Fluent Bit terminates it.
+
+package exit
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+)
+
+// NoUpload gracefully exits the plugin by closing writers without uploading. Hybrid buffers held
+// in memory are moved to disk so they are recovered on restart.
+//
+// Parameters:
+//   - ctx: Plugin context
+//
+// Returns:
+//   - err: Error persisting buffer, error closing file
+func NoUpload(ctx *outctx.Context) error {
+	for _, eventManager := range ctx.EventManagers {
+		eventManager.StopListening(context.Background())
+		err := eventManager.PersistBuffer()
+		if err != nil {
+			return err
+		}
+		err = eventManager.Writer.Close()
+		if err != nil {
+			return err
+		}
+		eventManager.Writer = nil
+	}
+
+	return nil
+}
+
+// Upload gracefully exits the plugin by flushing buffered data to storage. Makes a best-effort
+// attempt, however Fluent Bit may kill the plugin before the upload completes.
+//
+// Parameters:
+//   - ctx: Plugin context
+//
+// Returns:
+//   - err: Error closing file
+func Upload(ctx *outctx.Context) error {
+	for _, eventManager := range ctx.EventManagers {
+		eventManager.StopListening(context.Background())
+		empty, err := eventManager.Writer.Empty()
+		if err != nil {
+			return err
+		}
+		if empty {
+			continue
+		}
+		err = eventManager.UploadBuffer(context.TODO(), ctx.Config, ctx.Uploader)
+		if err != nil {
+			return err
+		}
+		// Listener already uploaded pending manifest entries when it stopped, so only the entry for
+		// the final upload may be pending.
+		err = eventManager.UploadManifest(context.TODO(), ctx.Config, ctx.Uploader)
+		if err != nil {
+			return err
+		}
+		err = eventManager.Writer.Close()
+		if err != nil {
+			return err
+		}
+		eventManager.Writer = nil
+	}
+
+	return nil
+}
+
+// UploadWithDeadline gracefully exits the plugin by uploading buffered data of all tags
+// concurrently, then closing writers. Uploads still in progress when the
+// [outctx.Config.UploadOnExitTimeout] deadline passes are cancelled. Buffers which failed to
+// upload are left on disk as done by [NoUpload], so they are recovered on restart.
+//
+// Parameters:
+//   - ctx: Plugin context
+//
+// Returns:
+//   - err: Error persisting buffer, error closing file
+func UploadWithDeadline(ctx *outctx.Context) error {
+	uploadCtx, cancel := context.WithTimeout(context.Background(), ctx.Config.UploadOnExitTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var failed atomic.Int32
+	for _, eventManager := range ctx.EventManagers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := uploadOnExit(uploadCtx, ctx, eventManager)
+			if err != nil {
+				log.Printf("Upload on exit failed for tag %s: %v", eventManager.Tag, err)
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := failed.Load(); n > 0 {
+		log.Printf("Leaving %d buffers on disk which failed to upload before exit", n)
+	}
+	return NoUpload(ctx)
+}
+
+// Stops the listener of an event manager, then uploads its buffer and pending manifest entries.
+// Uploads of the listener are also bounded by the upload deadline. Writer is left open so buffers
+// which failed to upload can be left on disk.
+//
+// Parameters:
+//   - uploadCtx: Request context with upload deadline
+//   - ctx: Plugin context
+//   - eventManager: Event manager
+//
+// Returns:
+//   - err: Error checking if buffer is empty, error uploading buffer, error uploading manifest
+func uploadOnExit(
+	uploadCtx context.Context,
+	ctx *outctx.Context,
+	eventManager *outctx.EventManager,
+) error {
+	eventManager.StopListening(uploadCtx)
+	empty, err := eventManager.Writer.Empty()
+	if err != nil {
+		return err
+	}
+	if empty {
+		return nil
+	}
+	err = eventManager.UploadBuffer(uploadCtx, ctx.Config, ctx.Uploader)
+	if err != nil {
+		return err
+	}
+	return eventManager.UploadManifest(uploadCtx, ctx.Config, ctx.Uploader)
+}
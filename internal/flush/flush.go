@@ -0,0 +1,213 @@
+// Package implements methods to send data to output. All data provided by Fluent Bit is encoded
+// with Msgpack.
+
+package flush
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/decoder"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+)
+
+// Keys of log event added in place of a malformed record.
+const (
+	DecodeErrorKey = "_clp_decode_error"
+	RawRecordKey   = "_clp_raw"
+)
+
+// Ingests Fluent Bit chunk, then sends to storage in IR format. Data may be buffered on disk or in
+// memory depending on plugin configuration. Returns once the log events are written to the buffer.
+//
+// Parameters:
+//   - data: Msgpack data copied from Fluent Bit
+//   - tag: Fluent Bit tag
+//   - ctx: Plugin context
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+//   - err: Error if flush fails
+func Ingest(data []byte, tag string, ctx *outctx.Context) (int, error) {
+	dec := decoder.New(data, decoder.BinaryEncoding(ctx.Config.BinaryEncoding))
+	logEvents, numMalformed, err := decodeMsgpack(dec, ctx)
+	if err != nil {
+		return output.FLB_ERROR, err
+	}
+
+	if numMalformed != 0 {
+		ctx.MalformedRecords += numMalformed
+		log.Printf(
+			"Skipped %d malformed records with tag %s, %d skipped since start",
+			numMalformed,
+			tag,
+			ctx.MalformedRecords,
+		)
+	}
+
+	if ctx.GroupKey == "" {
+		eventManager, err := ctx.GetEventManager(tag)
+		if err != nil {
+			return output.FLB_RETRY, fmt.Errorf("error getting event manager: %w", err)
+		}
+		return awaitWrites(eventManager.Send(logEvents))
+	}
+
+	// Groups are written by their listeners concurrently.
+	bufferTags, groups := groupLogEvents(logEvents, tag, ctx.GroupKey)
+	written := make([]<-chan error, 0, len(bufferTags))
+	for _, bufferTag := range bufferTags {
+		eventManager, err := ctx.GetEventManager(bufferTag)
+		if err != nil {
+			return output.FLB_RETRY, fmt.Errorf("error getting event manager: %w", err)
+		}
+		written = append(written, eventManager.Send(groups[bufferTag]))
+	}
+
+	return awaitWrites(written...)
+}
+
+// Waits until listeners have written log events, so the chunk is only acknowledged to Fluent Bit
+// once its events are buffered. If a write fails, the chunk is retried. Events written before the
+// failure are kept, so the retried chunk may duplicate them.
+//
+// Parameters:
+//   - written: Channels receiving the results of writes
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY)
+//   - err: Error writing log events
+func awaitWrites(written ...<-chan error) (int, error) {
+	for _, result := range written {
+		err := <-result
+		if err != nil {
+			return output.FLB_RETRY, fmt.Errorf("error writing log events: %w", err)
+		}
+	}
+	return output.FLB_OK, nil
+}
+
+// Groups log events by the value of a record key. Each group is buffered separately with the tag
+// created by [outctx.BufferTag]. Events missing the key, including events of malformed records,
+// are grouped together.
+//
+// Parameters:
+//   - logEvents: Log events with the same tag
+//   - tag: Fluent Bit tag
+//   - groupKey: Record key to group by
+//
+// Returns:
+//   - bufferTags: Buffer tags in order of first event
+//   - groups: Log events by buffer tag
+func groupLogEvents(
+	logEvents []irzstd.LogEvent,
+	tag string,
+	groupKey string,
+) ([]string, map[string][]irzstd.LogEvent) {
+	var bufferTags []string
+	groups := make(map[string][]irzstd.LogEvent)
+	for _, event := range logEvents {
+		var value string
+		switch v := event.UserKvPairs[groupKey].(type) {
+		case nil:
+		case string:
+			value = v
+		case []byte:
+			value = string(v)
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		bufferTag := outctx.BufferTag(tag, value)
+		if _, ok := groups[bufferTag]; !ok {
+			bufferTags = append(bufferTags, bufferTag)
+		}
+		groups[bufferTag] = append(groups[bufferTag], event)
+	}
+	return bufferTags, groups
+}
+
+// Decodes Msgpack Fluent Bit chunk into slice of log events. Decode of Msgpack based on
+// [Fluent Bit reference]. Malformed records are skipped so they do not cause the rest of the chunk
+// to be dropped.
+//
+// Parameters:
+//   - decoder: Msgpack decoder
+//   - ctx: Plugin context
+//
+// Returns:
+//   - logEvents: Slice of log events
+//   - numMalformed: Number of malformed records
+//   - err: Error decoding Msgpack
+//
+// [Fluent Bit reference]:
+// https://github.com/fluent/fluent-bit-go/blob/a7a013e2473cdf62d7320822658d5816b3063758/examples/out_multiinstance/out.go#L41
+func decodeMsgpack(
+	dec *decoder.Decoder,
+	ctx *outctx.Context,
+) ([]irzstd.LogEvent, int, error) {
+	var logEvents []irzstd.LogEvent
+	numMalformed := 0
+	for {
+		timestamp, record, err := decoder.GetRecord(dec)
+		var recordErr *decoder.RecordError
+		if errors.As(err, &recordErr) {
+			numMalformed++
+			if ctx.Config.PreserveMalformedRecords {
+				logEvents = append(logEvents, newDecodeErrorEvent(recordErr))
+			}
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return logEvents, numMalformed, nil
+		}
+		if err != nil {
+			return nil, numMalformed, err
+		}
+
+		record = ctx.KeyFilter.Apply(record)
+		ctx.Redactor.Apply(record)
+
+		var autoKvPairs map[string]any = make(map[string]any)
+		event := irzstd.LogEvent{
+			LogEvent: ffi.LogEvent{
+				AutoKvPairs: autoKvPairs,
+				UserKvPairs: record,
+			},
+			Timestamp: timestamp,
+		}
+		logEvents = append(logEvents, event)
+	}
+}
+
+// Creates a log event in place of a malformed record. Event contains the decoding error and the
+// raw Msgpack bytes encoded as base64. Timestamp of the malformed record is unknown so the current
+// time is used.
+//
+// Parameters:
+//   - recordErr: Error decoding record
+//
+// Returns:
+//   - logEvent: Log event describing malformed record
+func newDecodeErrorEvent(recordErr *decoder.RecordError) irzstd.LogEvent {
+	userKvPairs := map[string]any{
+		DecodeErrorKey: recordErr.Error(),
+		RawRecordKey:   base64.StdEncoding.EncodeToString(recordErr.Raw),
+	}
+
+	return irzstd.LogEvent{
+		LogEvent: ffi.LogEvent{
+			AutoKvPairs: make(map[string]any),
+			UserKvPairs: userKvPairs,
+		},
+		Timestamp: time.Now(),
+	}
+}
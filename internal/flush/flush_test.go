@@ -0,0 +1,844 @@
+package flush
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fluent/fluent-bit-go/output"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
+	"github.com/y-scope/fluent-bit-clp/internal/exit"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+	"github.com/y-scope/fluent-bit-clp/internal/recovery"
+	"github.com/y-scope/fluent-bit-clp/internal/testutil"
+)
+
+// Passes chunk to [Ingest] the same way as the Fluent Bit flush callback.
+func ingest(t *testing.T, ctx *outctx.Context, tag string, chunk []byte) {
+	t.Helper()
+	code, err := Ingest(chunk, tag, ctx)
+	if err != nil || code != output.FLB_OK {
+		t.Fatalf("ingest returned code %d: %v", code, err)
+	}
+}
+
+func testEvents(n int) []testutil.Event {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := make([]testutil.Event, n)
+	for i := range events {
+		events[i] = testutil.Event{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Record: map[string]any{
+				"log":    fmt.Sprintf("request %d took 1.5 ms", i),
+				"level":  "INFO",
+				"nested": map[string]any{"latency": 1.5, "path": "/api"},
+			},
+		}
+	}
+	return events
+}
+
+func TestIngestRoundTrip(t *testing.T) {
+	formats := map[string]testutil.EventFormat{
+		"legacy":     testutil.LegacyFormat,
+		"flbTime":    testutil.FlbTimeFormat,
+		"v2Metadata": testutil.V2MetadataFormat,
+	}
+
+	for name, format := range formats {
+		for _, useDiskBuffer := range []bool{true, false} {
+			t.Run(fmt.Sprintf("%s/useDiskBuffer=%t", name, useDiskBuffer), func(t *testing.T) {
+				server := testutil.NewS3Server(t)
+				config := testutil.NewS3Config(t)
+				config.UseDiskBuffer = useDiskBuffer
+				ctx := testutil.NewS3Context(t, server, config)
+
+				events := testEvents(10)
+				ingest(t, ctx, "app", testutil.Chunk(t, format, events[:5]...))
+				ingest(t, ctx, "app", testutil.Chunk(t, format, events[5:]...))
+
+				if err := exit.Upload(ctx); err != nil {
+					t.Fatalf("exit failed: %v", err)
+				}
+
+				objects := server.Objects(testutil.Bucket)
+				if len(objects) != 1 {
+					t.Fatalf("expected 1 object, got %d", len(objects))
+				}
+				object := objects[0]
+
+				decoded := testutil.DecodeEvents(t, object.Body)
+				if len(decoded) != len(events) {
+					t.Fatalf("expected %d events, got %d", len(events), len(decoded))
+				}
+				for i, event := range decoded {
+					if !reflect.DeepEqual(event.UserKvPairs, events[i].Record) {
+						t.Errorf(
+							"event %d: expected %v, got %v",
+							i,
+							events[i].Record,
+							event.UserKvPairs,
+						)
+					}
+				}
+
+				if object.Tagging != "fluentBitTag=app" {
+					t.Errorf("unexpected tagging %q", object.Tagging)
+				}
+
+				// Legacy format only has second precision, which is what test events use.
+				expectedMetadata := map[string]string{
+					"event-count":   "10",
+					"min-timestamp": "2024-01-01T00:00:00Z",
+					"max-timestamp": "2024-01-01T00:00:09Z",
+					"plugin-id":     "test",
+				}
+				for key, expected := range expectedMetadata {
+					if actual := object.Metadata[key]; actual != expected {
+						t.Errorf("metadata %s: expected %q, got %q", key, expected, actual)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIngestSeparatesTags(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	ctx := testutil.NewS3Context(t, server, testutil.NewS3Config(t))
+
+	events := testEvents(2)
+	ingest(t, ctx, "a", testutil.Chunk(t, testutil.V2MetadataFormat, events[0]))
+	ingest(t, ctx, "b", testutil.Chunk(t, testutil.V2MetadataFormat, events[1]))
+
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objects))
+	}
+	for i, object := range objects {
+		expectedTagging := "fluentBitTag=" + []string{"a", "b"}[i]
+		if object.Tagging != expectedTagging {
+			t.Errorf("expected tagging %q, got %q", expectedTagging, object.Tagging)
+		}
+		decoded := testutil.DecodeEvents(t, object.Body)
+		if len(decoded) != 1 || !reflect.DeepEqual(decoded[0].UserKvPairs, events[i].Record) {
+			t.Errorf("object %s: unexpected events %v", object.Key, decoded)
+		}
+	}
+}
+
+func TestIngestMalformedRecords(t *testing.T) {
+	events := testEvents(2)
+
+	// Array containing a string instead of a timestamp.
+	bad := append([]byte{0x92}, testutil.Encode(t, "not a timestamp")...)
+	bad = append(bad, testutil.Encode(t, map[string]any{"log": "x"})...)
+
+	var chunk []byte
+	chunk = append(chunk, testutil.Chunk(t, testutil.FlbTimeFormat, events[0])...)
+	chunk = append(chunk, bad...)
+	chunk = append(chunk, testutil.Chunk(t, testutil.FlbTimeFormat, events[1])...)
+
+	for _, preserve := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preserve=%t", preserve), func(t *testing.T) {
+			server := testutil.NewS3Server(t)
+			config := testutil.NewS3Config(t)
+			config.PreserveMalformedRecords = preserve
+			ctx := testutil.NewS3Context(t, server, config)
+
+			ingest(t, ctx, "app", chunk)
+			if ctx.MalformedRecords != 1 {
+				t.Errorf("expected 1 malformed record, got %d", ctx.MalformedRecords)
+			}
+			if err := exit.Upload(ctx); err != nil {
+				t.Fatalf("exit failed: %v", err)
+			}
+
+			objects := server.Objects(testutil.Bucket)
+			if len(objects) != 1 {
+				t.Fatalf("expected 1 object, got %d", len(objects))
+			}
+			decoded := testutil.DecodeEvents(t, objects[0].Body)
+
+			expected := []map[string]any{events[0].Record, events[1].Record}
+			if preserve {
+				if len(decoded) != 3 {
+					t.Fatalf("expected 3 events, got %v", decoded)
+				}
+				errorEvent := decoded[1].UserKvPairs
+				if _, ok := errorEvent[DecodeErrorKey].(string); !ok {
+					t.Errorf("expected %s in %v", DecodeErrorKey, errorEvent)
+				}
+				raw := base64.StdEncoding.EncodeToString(bad)
+				if errorEvent[RawRecordKey] != raw {
+					t.Errorf("expected raw record %s, got %v", raw, errorEvent[RawRecordKey])
+				}
+				decoded = append(decoded[:1], decoded[2:]...)
+			}
+			if len(decoded) != len(expected) {
+				t.Fatalf("expected %d events, got %v", len(expected), decoded)
+			}
+			for i, event := range decoded {
+				if !reflect.DeepEqual(event.UserKvPairs, expected[i]) {
+					t.Errorf("expected event %v, got %v", expected[i], event.UserKvPairs)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestUnstructuredLogs(t *testing.T) {
+	messages := []string{
+		"request 1 took 1.5 ms id=abc0x1f\r\n",
+		"user=bob retried -12 times after 0.05s, last 99999999999999999999\n",
+		"escaped \x11 \x12 \x13 \\ characters",
+		"",
+	}
+
+	for _, useDiskBuffer := range []bool{true, false} {
+		t.Run(fmt.Sprintf("useDiskBuffer=%t", useDiskBuffer), func(t *testing.T) {
+			server := testutil.NewS3Server(t)
+			config := testutil.NewS3Config(t)
+			config.UseDiskBuffer = useDiskBuffer
+			config.UnstructuredLogs = true
+			config.MessageKey = "message"
+			ctx := testutil.NewS3Context(t, server, config)
+
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var events []testutil.Event
+			for i, message := range messages {
+				events = append(events, testutil.Event{
+					Timestamp: start.Add(time.Duration(i) * time.Millisecond),
+					Record:    map[string]any{"message": message, "stream": "stdout"},
+				})
+			}
+			// Records without a string message are stored as JSON.
+			events = append(events, testutil.Event{
+				Timestamp: start.Add(time.Second),
+				Record:    map[string]any{"message": 1.5},
+			})
+			ingest(t, ctx, "app", testutil.Chunk(t, testutil.FlbTimeFormat, events[:2]...))
+			ingest(t, ctx, "app", testutil.Chunk(t, testutil.FlbTimeFormat, events[2:]...))
+			if err := exit.Upload(ctx); err != nil {
+				t.Fatalf("exit failed: %v", err)
+			}
+
+			objects := server.Objects(testutil.Bucket)
+			if len(objects) != 1 {
+				t.Fatalf("expected 1 object, got %d", len(objects))
+			}
+			decoded := testutil.DecodeEvents(t, objects[0].Body)
+			if len(decoded) != len(events) {
+				t.Fatalf("expected %d events, got %v", len(events), decoded)
+			}
+
+			expected := []string{
+				"request 1 took 1.5 ms id=abc0x1f",
+				"user=bob retried -12 times after 0.05s, last 99999999999999999999",
+				messages[2],
+				"",
+				`{"message":1.5}`,
+			}
+			for i, event := range decoded {
+				expectedKvPairs := map[string]any{"message": expected[i]}
+				if !reflect.DeepEqual(event.UserKvPairs, expectedKvPairs) {
+					t.Errorf("event %d: expected %v, got %v", i, expectedKvPairs, event.UserKvPairs)
+				}
+				timestamp := event.AutoKvPairs[irzstd.UnstructuredTimestampKey]
+				if timestamp != events[i].Timestamp.UnixMilli() {
+					t.Errorf(
+						"event %d: expected timestamp %d, got %v",
+						i,
+						events[i].Timestamp.UnixMilli(),
+						timestamp,
+					)
+				}
+			}
+		})
+	}
+}
+
+func TestIngestKeyFilter(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.ExcludeKeys = "kubernetes.annotations"
+	config.RenameKeys = "kubernetes.pod_name:pod,message:log"
+	ctx := testutil.NewS3Context(t, server, config)
+
+	event := testutil.Event{
+		Timestamp: time.Unix(1, 0),
+		Record: map[string]any{
+			"message": "request took 1.5 ms\n",
+			"kubernetes": map[string]any{
+				"pod_name":    "app-1",
+				"annotations": map[string]any{"a": "b"},
+			},
+		},
+	}
+	ingest(t, ctx, "app", testutil.Chunk(t, testutil.FlbTimeFormat, event))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	expected := map[string]any{
+		"log":        "request took 1.5 ms\n",
+		"pod":        "app-1",
+		"kubernetes": map[string]any{},
+	}
+	decoded := testutil.DecodeEvents(t, server.Objects(testutil.Bucket)[0].Body)
+	if len(decoded) != 1 || !reflect.DeepEqual(decoded[0].UserKvPairs, expected) {
+		t.Errorf("expected %v, got %v", expected, decoded)
+	}
+}
+
+func TestIngestRedaction(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.RedactPatterns = "email,bearer_token"
+	config.RedactKeys = "password"
+	ctx := testutil.NewS3Context(t, server, config)
+
+	event := testutil.Event{
+		Timestamp: time.Unix(1, 0),
+		Record: map[string]any{
+			"log":      "login for bob@example.com with Bearer abc.def",
+			"password": "hunter2",
+		},
+	}
+	ingest(t, ctx, "app", testutil.Chunk(t, testutil.FlbTimeFormat, event))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	expected := map[string]any{
+		"log":      "login for [REDACTED:email] with Bearer [REDACTED:bearer_token]",
+		"password": "[REDACTED:key]",
+	}
+	decoded := testutil.DecodeEvents(t, server.Objects(testutil.Bucket)[0].Body)
+	if len(decoded) != 1 || !reflect.DeepEqual(decoded[0].UserKvPairs, expected) {
+		t.Errorf("expected %v, got %v", expected, decoded)
+	}
+
+	expectedCounts := map[string]int{"email": 1, "bearer_token": 1, "key": 1}
+	if counts := ctx.Redactor.Counts(); !reflect.DeepEqual(counts, expectedCounts) {
+		t.Errorf("expected counts %v, got %v", expectedCounts, counts)
+	}
+}
+
+func TestIngestClientEncryption(t *testing.T) {
+	privateKeyPath, publicKeyPath := testutil.WriteRsaKeyFiles(t)
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.ClientEncryptionKeyFile = publicKeyPath
+	config.UploadManifest = true
+	ctx := testutil.NewS3Context(t, server, config)
+
+	events := testEvents(10)
+	ingest(t, ctx, "app", testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	var object testutil.S3Object
+	var manifest outctx.Manifest
+	for _, o := range server.Objects(testutil.Bucket) {
+		if strings.HasSuffix(o.Key, ".zst") {
+			object = o
+		} else if err := json.Unmarshal(o.Body, &manifest); err != nil {
+			t.Fatalf("failed to decode manifest: %v", err)
+		}
+	}
+
+	if _, err := testutil.DecodeUnterminatedEvents(object.Body); err == nil {
+		t.Fatalf("expected uploaded object to be encrypted")
+	}
+	if object.Metadata["encryption-algorithm"] != envelope.Algorithm {
+		t.Errorf("expected algorithm metadata, got %v", object.Metadata)
+	}
+	if len(manifest.Objects) != 1 || manifest.Objects[0].Size != len(object.Body) {
+		t.Errorf("expected manifest size %d, got %+v", len(object.Body), manifest.Objects)
+	}
+
+	provider, err := envelope.NewFileKeyProvider(privateKeyPath)
+	if err != nil {
+		t.Fatalf("failed to load private key: %v", err)
+	}
+	reader, err := envelope.NewDecryptReader(bytes.NewReader(object.Body), provider)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	decrypted, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	if decoded := testutil.DecodeEvents(t, decrypted); len(decoded) != len(events) {
+		t.Errorf("expected %d events, got %d", len(events), len(decoded))
+	}
+}
+
+func TestIngestGcs(t *testing.T) {
+	for _, useDiskBuffer := range []bool{true, false} {
+		t.Run(fmt.Sprintf("useDiskBuffer=%t", useDiskBuffer), func(t *testing.T) {
+			server := testutil.NewGcsServer(t)
+			config := testutil.NewGcsConfig(t, server)
+			config.GcsCredentialsFile = server.WriteCredentialsFile(t)
+			config.UseDiskBuffer = useDiskBuffer
+			config.UploadManifest = true
+			ctx := testutil.NewGcsContext(t, server, config)
+
+			events := testEvents(10)
+			ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events[:5]...))
+			ingest(t, ctx, "b", testutil.Chunk(t, testutil.FlbTimeFormat, events[5:]...))
+			if err := exit.Upload(ctx); err != nil {
+				t.Fatalf("exit failed: %v", err)
+			}
+
+			var objects []testutil.GcsObject
+			var manifests []outctx.Manifest
+			for _, object := range server.Objects(testutil.Bucket) {
+				if !strings.HasSuffix(object.Name, ".manifest.json") {
+					objects = append(objects, object)
+					continue
+				}
+				var manifest outctx.Manifest
+				if err := json.Unmarshal(object.Body, &manifest); err != nil {
+					t.Fatalf("failed to decode manifest: %v", err)
+				}
+				manifests = append(manifests, manifest)
+			}
+			if len(objects) != 2 || len(manifests) != 2 {
+				t.Fatalf(
+					"expected 2 objects and manifests, got %d and %d",
+					len(objects),
+					len(manifests),
+				)
+			}
+
+			for i, object := range objects {
+				tag := []string{"a", "b"}[i]
+				if !strings.HasPrefix(object.Name, "logs/"+tag+"_0_") {
+					t.Errorf("unexpected object name %s", object.Name)
+				}
+				if object.Metadata["fluentBitTag"] != tag || object.Metadata["event-count"] != "5" {
+					t.Errorf("unexpected metadata %v", object.Metadata)
+				}
+				decoded := testutil.DecodeEvents(t, object.Body)
+				if len(decoded) != 5 ||
+					!reflect.DeepEqual(decoded[0].UserKvPairs, events[5*i].Record) {
+					t.Errorf("object %s: unexpected events %v", object.Name, decoded)
+				}
+				if manifests[i].Objects[0].Key != object.Name {
+					t.Errorf("expected manifest key %s, got %+v", object.Name, manifests[i])
+				}
+			}
+
+			// Access token is cached across uploads.
+			if requests := server.TokenRequests(); requests != 1 {
+				t.Errorf("expected 1 token request, got %d", requests)
+			}
+		})
+	}
+}
+
+func TestIngestAzureBlob(t *testing.T) {
+	for _, useSasToken := range []bool{false, true} {
+		t.Run(fmt.Sprintf("useSasToken=%t", useSasToken), func(t *testing.T) {
+			server := testutil.NewAzureServer(t)
+			config := testutil.NewAzureBlobConfig(t, server)
+			if useSasToken {
+				config.AzureAccountKey = ""
+				config.AzureSasToken = server.SasToken()
+			}
+			ctx := testutil.NewAzureBlobContext(t, server, config)
+
+			events := testEvents(10)
+			ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+			if err := exit.Upload(ctx); err != nil {
+				t.Fatalf("exit failed: %v", err)
+			}
+
+			blobs := server.Objects(testutil.Bucket)
+			if len(blobs) != 1 {
+				t.Fatalf("expected 1 blob, got %d", len(blobs))
+			}
+			blob := blobs[0]
+			if !strings.HasPrefix(blob.Name, "logs/a_0_") || blob.Tags["fluentBitTag"] != "a" {
+				t.Errorf("unexpected blob %s with tags %v", blob.Name, blob.Tags)
+			}
+			// Dashes are not allowed in Azure metadata names.
+			if blob.Metadata["event_count"] != "10" {
+				t.Errorf("unexpected metadata %v", blob.Metadata)
+			}
+			decoded := testutil.DecodeEvents(t, blob.Body)
+			if len(decoded) != 10 || !reflect.DeepEqual(decoded[9].UserKvPairs, events[9].Record) {
+				t.Errorf("unexpected events %v", decoded)
+			}
+		})
+	}
+}
+
+func TestIngestHttp(t *testing.T) {
+	server := testutil.NewHttpServer(t)
+	config := testutil.NewHttpConfig(t, server)
+	config.HttpHeaders = "X-Api-Key:secret"
+	config.HttpBearerToken = "token"
+	config.UploadManifest = true
+	ctx := testutil.NewHttpContext(t, config)
+
+	// Throttled requests are retried.
+	server.FailRequests(2, http.StatusTooManyRequests)
+	events := testEvents(5)
+	ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	requests := server.Requests()
+	if len(requests) != 2 {
+		t.Fatalf("expected object and manifest requests, got %d", len(requests))
+	}
+	object, manifest := requests[0], requests[1]
+	for _, request := range requests {
+		if request.Method != http.MethodPost || request.Path != "/ingest" ||
+			request.Header.Get("Authorization") != "Bearer token" ||
+			request.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("unexpected request %s %s %v", request.Method, request.Path, request.Header)
+		}
+	}
+	if object.Header.Get("Content-Type") != "application/x-clp-ir+zstd" ||
+		object.Header.Get("X-Clp-Tag") != "a" ||
+		object.Header.Get("X-Clp-Meta-Event-Count") != "5" ||
+		!strings.HasPrefix(object.Header.Get("X-Clp-Object-Key"), "a_0_") {
+		t.Errorf("unexpected object headers %v", object.Header)
+	}
+	decoded := testutil.DecodeEvents(t, object.Body)
+	if len(decoded) != 5 || !reflect.DeepEqual(decoded[4].UserKvPairs, events[4].Record) {
+		t.Errorf("unexpected events %v", decoded)
+	}
+	if manifest.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected manifest headers %v", manifest.Header)
+	}
+}
+
+func TestIngestKafka(t *testing.T) {
+	broker := testutil.NewKafkaBroker(t, "logs", 3)
+	config := testutil.NewKafkaConfig(t, broker, "logs")
+	config.KafkaKeyField = "service"
+	ctx := testutil.NewKafkaContext(t, config)
+
+	events := testEvents(4)
+	for i, service := range []string{"api", "web", "api"} {
+		events[i].Record["service"] = service
+	}
+	// Retried produce requests are not duplicated.
+	broker.FailRequests(1)
+	broker.DropResponses(1)
+	ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	// Events missing the key field are published with the tag as key.
+	expectedCounts := map[string]int{"api": 2, "web": 1, "a": 1}
+	messages := broker.Messages()
+	if len(messages) != len(expectedCounts) {
+		t.Fatalf("expected %d messages, got %d", len(expectedCounts), len(messages))
+	}
+	seen := make(map[string]bool)
+	for _, message := range messages {
+		key := string(message.Key)
+		if _, ok := expectedCounts[key]; !ok || seen[key] {
+			t.Errorf("unexpected message key %q", key)
+		}
+		seen[key] = true
+		expectedCount := strconv.Itoa(expectedCounts[key])
+		if message.Headers["clp-tag"] != "a" || message.Headers["event-count"] != expectedCount ||
+			message.Headers["clp-part"] != "1" || message.Headers["clp-parts"] != "1" ||
+			message.Headers["content-type"] != "application/x-clp-ir+zstd" ||
+			message.Headers["min-timestamp"] == "" ||
+			!strings.HasPrefix(message.Headers["clp-object-key"], "a#") {
+			t.Errorf("key %s: unexpected headers %v", key, message.Headers)
+		}
+		decoded := testutil.DecodeEvents(t, message.Value)
+		if len(decoded) != expectedCounts[key] {
+			t.Errorf("key %s: unexpected events %v", key, decoded)
+		}
+	}
+}
+
+func TestIngestKafkaSplitsRecords(t *testing.T) {
+	broker := testutil.NewKafkaBroker(t, "logs", 1)
+	config := testutil.NewKafkaConfig(t, broker, "logs")
+	config.KafkaMaxRecordBytes = 1024
+	ctx := testutil.NewKafkaContext(t, config)
+
+	// Random values do not compress, so the object is larger than a record.
+	events := testEvents(100)
+	for _, event := range events {
+		event.Record["id"] = rand.Text()
+	}
+	ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	messages := broker.Messages()
+	if len(messages) < 2 {
+		t.Fatalf("expected object to be split, got %d messages", len(messages))
+	}
+	var object []byte
+	for i, message := range messages {
+		if string(message.Key) != "a" || len(message.Value) > config.KafkaMaxRecordBytes ||
+			message.Headers["clp-part"] != strconv.Itoa(i+1) ||
+			message.Headers["clp-parts"] != strconv.Itoa(len(messages)) {
+			t.Errorf("part %d: unexpected message %s %d %v",
+				i+1, message.Key, len(message.Value), message.Headers)
+		}
+		object = append(object, message.Value...)
+	}
+	decoded := testutil.DecodeEvents(t, object)
+	if len(decoded) != 100 || !reflect.DeepEqual(decoded[99].UserKvPairs, events[99].Record) {
+		t.Errorf("unexpected events %v", decoded)
+	}
+}
+
+func TestIngestKafkaSplitsRecordsAtFrames(t *testing.T) {
+	broker := testutil.NewKafkaBroker(t, "logs", 1)
+	config := testutil.NewKafkaConfig(t, broker, "logs")
+	config.KafkaMaxRecordBytes = 32 << 10
+	ctx := testutil.NewKafkaContext(t, config)
+
+	// The disk buffer compresses IR into a new Zstd frame every few MB.
+	events := testEvents(60000)
+	for i := 0; i < len(events); i += 10000 {
+		ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events[i:i+10000]...))
+	}
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	messages := broker.Messages()
+	if len(messages) < 2 {
+		t.Fatalf("expected object to be split, got %d messages", len(messages))
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v", err)
+	}
+	defer decoder.Close()
+	var object []byte
+	for i, message := range messages {
+		// Records only contain whole frames.
+		if _, err := decoder.DecodeAll(message.Value, nil); err != nil {
+			t.Errorf("part %d: failed to decompress: %v", i+1, err)
+		}
+		object = append(object, message.Value...)
+	}
+	if decoded := testutil.DecodeEvents(t, object); len(decoded) != len(events) {
+		t.Errorf("expected %d events, got %d", len(events), len(decoded))
+	}
+}
+
+func TestIngestClp(t *testing.T) {
+	pkg := testutil.NewClpPackage(t)
+	config := testutil.NewClpConfig(t, pkg)
+	config.ClpTimestampKey = "timestamp"
+	ctx := testutil.NewClpContext(t, config)
+
+	events := testEvents(5)
+	ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	jobs := pkg.Jobs(t)
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 compress job, got %d", len(jobs))
+	}
+	args := jobs[0].Args
+	if len(args) != 3 || args[0] != "--timestamp-key" || args[1] != "timestamp" ||
+		!strings.HasPrefix(args[2], filepath.Join(config.ClpStagingDir, "a_0_")) {
+		t.Errorf("unexpected compress arguments %v", args)
+	}
+	decoded := testutil.DecodeEvents(t, jobs[0].Data)
+	if len(decoded) != 5 || !reflect.DeepEqual(decoded[4].UserKvPairs, events[4].Record) {
+		t.Errorf("unexpected events %v", decoded)
+	}
+
+	config.UploadManifest = true
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error for upload_manifest")
+	}
+}
+
+func TestIngestObjectKeyTemplate(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.ObjectKeyTemplate = "{tag}/{id}/{index}.clp.zst"
+	ctx := testutil.NewS3Context(t, server, config)
+
+	ingest(t, ctx, "app", testutil.Chunk(t, testutil.FlbTimeFormat, testEvents(1)...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 1 || objects[0].Key != "logs/app/test/0.clp.zst" {
+		t.Errorf("unexpected objects %v", objects)
+	}
+
+	config.ObjectKeyTemplate = "{tag}_{date}.zst"
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error for unknown placeholder")
+	}
+}
+
+func TestIngestLargeUploadSize(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.UploadSizeMb = 4000
+	config.S3PartSizeMb = 64
+	config.S3UploadConcurrency = 2
+	ctx := testutil.NewS3Context(t, server, config)
+
+	ingest(t, ctx, "a", testutil.Chunk(t, testutil.FlbTimeFormat, testEvents(5)...))
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	if objects := server.Objects(testutil.Bucket); len(objects) != 1 {
+		t.Errorf("expected 1 object, got %d", len(objects))
+	}
+
+	config.UseDiskBuffer = false
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error for upload_size_mb without use_disk_buffer")
+	}
+
+	config.UseDiskBuffer = true
+	config.UploadSizeMb = 64*10000 + 1
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error for upload_size_mb exceeding parts of s3_part_size_mb")
+	}
+}
+
+func TestIngestMemoryBudget(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.UseDiskBuffer = false
+	config.UploadSizeMb = 64
+	config.MemoryBudgetMb = 1
+	ctx := testutil.NewS3Context(t, server, config)
+
+	// Random payloads do not compress, so buffers of both tags exceed the budget.
+	sent := map[string][]testutil.Event{}
+	for range 4 {
+		for _, tag := range []string{"a", "b"} {
+			events := testEvents(500)
+			for i := range events {
+				payload := make([]byte, 768)
+				rand.Read(payload)
+				events[i].Record["log"] = base64.StdEncoding.EncodeToString(payload)
+			}
+			ingest(t, ctx, tag, testutil.Chunk(t, testutil.FlbTimeFormat, events...))
+			sent[tag] = append(sent[tag], events...)
+		}
+	}
+	if err := exit.Upload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(config.DiskBufferPath, outctx.SpillDir)); err != nil {
+		t.Errorf("expected buffers to be spilled: %v", err)
+	}
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(objects))
+	}
+	for _, object := range objects {
+		tag := strings.TrimPrefix(object.Tagging, "fluentBitTag=")
+		decoded := testutil.DecodeEvents(t, object.Body)
+		if len(decoded) != len(sent[tag]) {
+			t.Fatalf("tag %s: expected %d events, got %d", tag, len(sent[tag]), len(decoded))
+		}
+		for i, event := range decoded {
+			if event.UserKvPairs["log"] != sent[tag][i].Record["log"] {
+				t.Fatalf("tag %s: event %d does not match", tag, i)
+			}
+		}
+	}
+
+	config.UseDiskBuffer = true
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error for memory_budget_mb with use_disk_buffer")
+	}
+
+	config.UseDiskBuffer = false
+	config.DiskBufferPath = ""
+	if err := config.Validate(); err == nil {
+		t.Errorf("expected error for memory_budget_mb without disk_buffer_path")
+	}
+
+	// Spill directory cannot be created below a regular file.
+	config.DiskBufferPath = filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(config.DiskBufferPath, nil, 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := outctx.NewContextFromConfig(&config.Config, ctx.Uploader); err == nil {
+		t.Errorf("expected error for unusable spill directory")
+	}
+}
+
+func TestIngestAcksAfterWrite(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	ctx := testutil.NewS3Context(t, server, config)
+
+	// Crash right after each acknowledgement by copying the disk buffer while the listener runs.
+	events := testEvents(20)
+	for i, event := range events {
+		ingest(t, ctx, "a", testutil.Chunk(t, testutil.V2MetadataFormat, event))
+
+		crashed := testutil.NewS3Config(t)
+		if err := os.CopyFS(crashed.DiskBufferPath, os.DirFS(config.DiskBufferPath)); err != nil {
+			t.Fatalf("failed to copy disk buffer: %v", err)
+		}
+		// Context recreates the bucket, so it only holds the recovered object.
+		restarted := testutil.NewS3Context(t, server, crashed)
+		if err := recovery.RecoverBufferFiles(restarted); err != nil {
+			t.Fatalf("recovery failed: %v", err)
+		}
+		if err := exit.NoUpload(restarted); err != nil {
+			t.Fatalf("exit failed: %v", err)
+		}
+
+		objects := server.Objects(testutil.Bucket)
+		if len(objects) != 1 {
+			t.Fatalf("expected 1 uploaded object after chunk %d, got %d", i, len(objects))
+		}
+		decoded, err := testutil.DecodeUnterminatedEvents(objects[0].Body)
+		if err != nil {
+			t.Fatalf("failed to decode uploaded object: %v", err)
+		}
+		if len(decoded) != i+1 {
+			t.Fatalf("expected %d acknowledged events after crash, got %d", i+1, len(decoded))
+		}
+	}
+}
@@ -0,0 +1,378 @@
+// Package httpout sends objects as the body of HTTP requests to a user-defined endpoint, such as an
+// ingestion gateway.
+package httpout
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content type of Zstd compressed KV-IR.
+const ContentType = "application/x-clp-ir+zstd"
+
+// Headers describing the object sent with each request. Object metadata is sent with
+// [MetadataHeaderPrefix] followed by the metadata key.
+const (
+	ObjectKeyHeader      = "X-Clp-Object-Key"
+	TagHeader            = "X-Clp-Tag"
+	MetadataHeaderPrefix = "X-Clp-Meta-"
+)
+
+// Maximum size of error response bodies read by the client.
+const maxResponseSize = 1 << 16
+
+// Requests without a Retry-After header are retried with exponential backoff starting at
+// retryBackoff. Waits are capped at maxRetryWait since the plugin blocks while waiting. The shift
+// is capped at maxBackoffShift so the backoff does not overflow with large retry limits.
+const (
+	retryBackoff    = time.Second
+	maxRetryWait    = time.Minute
+	maxBackoffShift = 16
+)
+
+// Object to send.
+type Object struct {
+	// Key of object, appended to the URL for PUT requests.
+	Key  string
+	Body io.Reader
+	// Content type of body, [ContentType] if empty.
+	ContentType string
+	Metadata    map[string]string
+	// Fluent Bit tag, empty if none.
+	Tag string
+}
+
+// Error response from endpoint.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+// Formats error.
+//
+// Returns:
+//   - message: Error message with HTTP status
+func (e *Error) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// Client sending objects to an HTTP endpoint.
+type Client struct {
+	httpClient *http.Client
+	url        string
+	method     string
+	// Headers added to every request, including authorization.
+	header     http.Header
+	retryLimit int
+}
+
+// Creates a new [Client].
+//
+// Parameters:
+//   - rawUrl: Endpoint URL. For PUT requests, object keys are appended to the URL path.
+//   - method: HTTP method, either POST or PUT
+//   - header: Headers added to every request
+//   - tlsConfig: TLS configuration, default configuration if nil
+//   - timeout: Timeout of each request
+//   - retryLimit: Number of times a failed request is retried
+//
+// Returns:
+//   - client: HTTP client
+func NewClient(
+	rawUrl string,
+	method string,
+	header http.Header,
+	tlsConfig *tls.Config,
+	timeout time.Duration,
+	retryLimit int,
+) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &Client{
+		httpClient: &http.Client{Transport: transport, Timeout: timeout},
+		url:        rawUrl,
+		method:     method,
+		header:     header,
+		retryLimit: retryLimit,
+	}
+}
+
+// Sends an object. Body is read into memory so it can be resent when a request is retried. Server
+// errors, throttling, and network errors are retried, waiting as long as the Retry-After header
+// requests.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to send
+//
+// Returns:
+//   - location: URL the object was sent to, or the Location header of the response if set
+//   - err: Error reading body, [Error] from endpoint, error sending request
+func (c *Client) Upload(ctx context.Context, object Object) (string, error) {
+	body, err := io.ReadAll(object.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading body: %w", err)
+	}
+
+	target := c.url
+	if c.method == http.MethodPut {
+		target = strings.TrimSuffix(c.url, "/") + "/" + escapeKey(object.Key)
+	}
+
+	header := c.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = ContentType
+	}
+	header.Set("Content-Type", contentType)
+	header.Set(ObjectKeyHeader, object.Key)
+	if object.Tag != "" {
+		header.Set(TagHeader, object.Tag)
+	}
+	for name, value := range object.Metadata {
+		header.Set(MetadataHeaderPrefix+name, value)
+	}
+
+	for attempt := 0; ; attempt++ {
+		location, retryAfter, err := c.send(ctx, target, header, body)
+		if err == nil {
+			return location, nil
+		}
+		if attempt == c.retryLimit || !retryable(err) {
+			return "", err
+		}
+
+		wait := backoff(attempt)
+		if retryAfter >= 0 {
+			wait = min(retryAfter, maxRetryWait)
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Computes the wait before retrying a request without a Retry-After header.
+//
+// Parameters:
+//   - attempt: Number of the failed attempt, starting at 0
+//
+// Returns:
+//   - wait: Exponential backoff capped at maxRetryWait
+func backoff(attempt int) time.Duration {
+	return min(retryBackoff<<min(attempt, maxBackoffShift), maxRetryWait)
+}
+
+// Sends a single request.
+//
+// Parameters:
+//   - ctx: Request context
+//   - target: Request URL
+//   - header: Request headers
+//   - body: Request body
+//
+// Returns:
+//   - location: URL the object was sent to
+//   - retryAfter: Wait requested by the Retry-After header, -1 if not set
+//   - err: [Error] if status is not 2xx, error sending request
+func (c *Client) send(
+	ctx context.Context,
+	target string,
+	header http.Header,
+	body []byte,
+) (string, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, c.method, target, bytes.NewReader(body))
+	if err != nil {
+		return "", -1, err
+	}
+	req.Header = header.Clone()
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", -1, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message := strings.TrimSpace(string(data))
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return "", parseRetryAfter(resp.Header.Get("Retry-After")),
+			&Error{StatusCode: resp.StatusCode, Message: message}
+	}
+
+	location := target
+	if resp.Header.Get("Location") != "" {
+		location = resp.Header.Get("Location")
+	}
+	return location, -1, nil
+}
+
+// Checks if a failed request may succeed when retried.
+//
+// Parameters:
+//   - err: Request error
+//
+// Returns:
+//   - retryable: Whether request should be retried
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var httpErr *Error
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode >= 500
+	}
+	return true
+}
+
+// Parses a Retry-After header, which is either a number of seconds or an HTTP date.
+//
+// Parameters:
+//   - value: Header value
+//
+// Returns:
+//   - wait: Requested wait, -1 if header is empty or invalid
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return -1
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return -1
+}
+
+// Parses headers in the format "Name:value, Name:value". Commas in values can be escaped with a
+// backslash.
+//
+// Parameters:
+//   - headers: Headers string
+//
+// Returns:
+//   - header: Parsed headers, nil if string is empty
+//   - err: Error parsing header
+func ParseHeaders(headers string) (http.Header, error) {
+	var header http.Header
+	for _, pair := range splitEscaped(headers, ',') {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("error parsing header %q, expected format name:value", pair)
+		}
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Add(name, strings.TrimSpace(value))
+	}
+	return header, nil
+}
+
+// Creates a TLS configuration to verify the server with a custom CA and to authenticate with a
+// client certificate.
+//
+// Parameters:
+//   - caFile: PEM file of CA certificates, system CAs are used if empty
+//   - certFile: PEM file of client certificate, empty if not used
+//   - keyFile: PEM file of client private key, empty if not used
+//
+// Returns:
+//   - tlsConfig: TLS configuration, nil if no files are set
+//   - err: Error reading files, error parsing certificates
+func NewTlsConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	tlsConfig := tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("error no certificates found in CA file %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &tlsConfig, nil
+}
+
+// Escapes each segment of an object key so slashes are kept in the URL path.
+//
+// Parameters:
+//   - key: Object key
+//
+// Returns:
+//   - escaped: Escaped object key
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// Splits a string on a separator which is not escaped with a backslash. Escaped separators are
+// unescaped.
+//
+// Parameters:
+//   - s: String to split
+//   - sep: Separator
+//
+// Returns:
+//   - parts: Parts of string
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == sep {
+			part.WriteByte(sep)
+			i++
+			continue
+		}
+		if s[i] == sep {
+			parts = append(parts, part.String())
+			part.Reset()
+			continue
+		}
+		part.WriteByte(s[i])
+	}
+	return append(parts, part.String())
+}
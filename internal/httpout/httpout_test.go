@@ -0,0 +1,265 @@
+package httpout
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Responds with the given statuses in order, then with 201 Created. Records bodies of all requests.
+func newServer(t *testing.T, statuses ...int) (*httptest.Server, *[][]byte) {
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, body)
+		if len(bodies) <= len(statuses) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statuses[len(bodies)-1])
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	return server, &bodies
+}
+
+func TestUploadRetries(t *testing.T) {
+	server, bodies := newServer(
+		t,
+		http.StatusTooManyRequests,
+		http.StatusServiceUnavailable,
+	)
+	client := NewClient(server.URL, http.MethodPost, nil, nil, time.Minute, 2)
+
+	_, err := client.Upload(context.Background(), Object{
+		Key:  "a.zst",
+		Body: bytes.NewReader([]byte("data")),
+	})
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	if len(*bodies) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(*bodies))
+	}
+	for _, body := range *bodies {
+		if string(body) != "data" {
+			t.Errorf("retry sent body %q", body)
+		}
+	}
+}
+
+func TestUploadRetryLimit(t *testing.T) {
+	for _, test := range []struct {
+		status   int
+		requests int
+	}{
+		{http.StatusInternalServerError, 2},
+		// Client errors are not retried.
+		{http.StatusBadRequest, 1},
+	} {
+		server, bodies := newServer(t, test.status, test.status)
+		client := NewClient(server.URL, http.MethodPost, nil, nil, time.Minute, 1)
+
+		_, err := client.Upload(context.Background(), Object{Body: bytes.NewReader(nil)})
+		var httpErr *Error
+		if !errors.As(err, &httpErr) || httpErr.StatusCode != test.status {
+			t.Errorf("expected status %d, got %v", test.status, err)
+		}
+		if len(*bodies) != test.requests {
+			t.Errorf("status %d: expected %d requests, got %d",
+				test.status, test.requests, len(*bodies))
+		}
+	}
+}
+
+func TestBackoffLargeRetryLimit(t *testing.T) {
+	const retryLimit = 1000
+	previous := time.Duration(0)
+	for attempt := 0; attempt < retryLimit; attempt++ {
+		wait := backoff(attempt)
+		if wait < previous || wait > maxRetryWait {
+			t.Fatalf("attempt %d: expected wait in [%v, %v], got %v",
+				attempt, previous, maxRetryWait, wait)
+		}
+		previous = wait
+	}
+	if previous != maxRetryWait {
+		t.Errorf("expected wait capped at %v, got %v", maxRetryWait, previous)
+	}
+}
+
+func TestUploadPut(t *testing.T) {
+	var request *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	header := http.Header{"X-Team": {"logs"}}
+	client := NewClient(server.URL+"/objects/", http.MethodPut, header, nil, time.Minute, 0)
+	location, err := client.Upload(context.Background(), Object{
+		Key:      "app/a b.zst",
+		Body:     bytes.NewReader([]byte("data")),
+		Metadata: map[string]string{"event-count": "5"},
+		Tag:      "app",
+	})
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if request.Method != http.MethodPut || request.URL.EscapedPath() != "/objects/app/a%20b.zst" {
+		t.Errorf("unexpected request %s %s", request.Method, request.URL.EscapedPath())
+	}
+	if location != server.URL+"/objects/app/a%20b.zst" {
+		t.Errorf("unexpected location %s", location)
+	}
+	expected := map[string]string{
+		"Content-Type":           ContentType,
+		"X-Clp-Object-Key":       "app/a b.zst",
+		"X-Clp-Tag":              "app",
+		"X-Clp-Meta-Event-Count": "5",
+		"X-Team":                 "logs",
+	}
+	for name, value := range expected {
+		if request.Header.Get(name) != value {
+			t.Errorf("expected header %s=%q, got %q", name, value, request.Header.Get(name))
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if wait := parseRetryAfter("2"); wait != 2*time.Second {
+		t.Errorf("expected 2s, got %v", wait)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if wait := parseRetryAfter(date); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("expected about 1h, got %v", wait)
+	}
+	for _, value := range []string{"", "-1", "soon"} {
+		if wait := parseRetryAfter(value); wait != -1 {
+			t.Errorf("%q: expected -1, got %v", value, wait)
+		}
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	header, err := ParseHeaders(`X-Api-Key: secret, X-Tags:a\,b,X-Empty:`)
+	if err != nil {
+		t.Fatalf("failed to parse headers: %v", err)
+	}
+	if header.Get("X-Api-Key") != "secret" || header.Get("X-Tags") != "a,b" ||
+		len(header) != 3 {
+		t.Errorf("unexpected headers %v", header)
+	}
+
+	if header, err := ParseHeaders(""); header != nil || err != nil {
+		t.Errorf("expected no headers, got %v, %v", header, err)
+	}
+	for _, headers := range []string{"X-Api-Key", ":value", "X Api:value"} {
+		if _, err := ParseHeaders(headers); err == nil {
+			t.Errorf("expected error parsing %q", headers)
+		}
+	}
+}
+
+func TestTlsClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeCertificate(t, dir)
+
+	handler := func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(handler))
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+		t.Fatalf("failed to write CA: %v", err)
+	}
+
+	for _, withCert := range []bool{true, false} {
+		tlsConfig, err := NewTlsConfig(caFile, "", "")
+		if withCert {
+			tlsConfig, err = NewTlsConfig(caFile, certFile, keyFile)
+		}
+		if err != nil {
+			t.Fatalf("failed to create TLS config: %v", err)
+		}
+		client := NewClient(server.URL, http.MethodPost, nil, tlsConfig, time.Minute, 0)
+		_, err = client.Upload(context.Background(), Object{Body: bytes.NewReader(nil)})
+		if withCert && err != nil {
+			t.Errorf("upload with client certificate failed: %v", err)
+		}
+		if !withCert && err == nil {
+			t.Errorf("expected upload without client certificate to fail")
+		}
+	}
+
+	if _, err := NewTlsConfig(keyFile, "", ""); err == nil {
+		t.Errorf("expected error for CA file without certificates")
+	}
+}
+
+// Generates a self-signed client certificate and writes it and its key to PEM files.
+func writeCertificate(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "fluent-bit"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client.key")
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: keyDer},
+	}
+	for path, block := range files {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+	return certFile, keyFile, cert
+}
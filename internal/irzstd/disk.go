@@ -1,6 +1,7 @@
 package irzstd
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
@@ -8,9 +9,6 @@ import (
 	"path/filepath"
 
 	"github.com/klauspost/compress/zstd"
-
-	"github.com/y-scope/clp-ffi-go/ffi"
-	"github.com/y-scope/clp-ffi-go/ir"
 )
 
 // 2 MB threshold to buffer IR before compressing to Zstd.
@@ -33,15 +31,26 @@ const irEndOfStreamByte = 0x0
 // "compacted"); however, if the chunks are small, the compression ratio would deteriorate. "Trash
 // compactor" design provides protection from log loss during abrupt crashes and maintains a high
 // compression ratio.
+//
+// If a [Cipher] is set, each IR write and each closed Zstd frame is staged in memory then appended
+// to its file as a sealed frame. Sealed frames are only appended once complete, so buffers remain
+// recoverable after a crash. Plaintext is never written to disk. Frames are encrypted with a data
+// key generated for each object, which is wrapped by the [Cipher].
 type diskWriter struct {
 	irPath       string // Path variable for debugging
 	zstdPath     string // Path variable for debugging
 	irFile       *os.File
 	zstdFile     *os.File
-	irWriter     *ir.Writer
+	irWriter     irEncoder
 	irTotalBytes int
 	zstdWriter   *zstd.Encoder
 	state        WriterState
+	stats        Stats
+	cipher       *Cipher      // Nil if buffers are not encrypted
+	dataKey      *dataKey     // Key of sealed frames, nil if buffers are not encrypted
+	irStaging    bytes.Buffer // IR waiting to be sealed if encrypted
+	zstdStaging  bytes.Buffer // Zstd frame waiting to be sealed if encrypted
+	messageKey   string       // Empty if records are written as KV-IR
 }
 
 // Opens a new [diskWriter] using files for IR and Zstd buffers. For use when use_disk_store
@@ -50,63 +59,59 @@ type diskWriter struct {
 // Parameters:
 //   - irPath: Path to IR disk buffer file
 //   - zstdPath: Path to Zstd disk buffer file
+//   - cipher: Cipher to encrypt buffers, nil to write buffers without encryption
+//   - messageKey: Key of the message written as CLP unstructured IR, empty to write KV-IR
 //
 // Returns:
 //   - diskWriter: Disk writer for Zstd compressed IR
 //   - err: Error creating new buffers, error opening Zstd writer
-func NewDiskWriter(irPath string, zstdPath string) (*diskWriter, error) {
+func NewDiskWriter(
+	irPath string,
+	zstdPath string,
+	cipher *Cipher,
+	messageKey string,
+) (*diskWriter, error) {
 	irFile, zstdFile, err := newFileBuffers(irPath, zstdPath)
 	if err != nil {
 		return nil, err
 	}
 
-	zstdWriter, err := zstd.NewWriter(zstdFile)
-	if err != nil {
-		return nil, fmt.Errorf("error opening Zstd writer: %w", err)
-	}
-
-	diskWriter := diskWriter{
-		irPath:     irPath,
-		irFile:     irFile,
-		zstdPath:   zstdPath,
-		zstdFile:   zstdFile,
-		zstdWriter: zstdWriter,
-		state:      Open,
-	}
-
-	return &diskWriter, nil
+	return newDiskWriter(irPath, irFile, zstdPath, zstdFile, cipher, messageKey)
 }
 
 // Recovers a [diskWriter] by opening buffer files from a previous execution of the output plugin.
 // Requires use_disk_store to be enabled. Returns an error if both disk buffers are empty, since
-// the IR would not have a preamble and would be invalid.
+// the IR would not have a preamble and would be invalid. An incomplete Zstd frame left by a crash
+// during compaction is truncated. The IR it contained is still in the IR buffer since the IR
+// buffer is only truncated after the frame is complete. If buffers are encrypted, every sealed
+// frame is decrypted to check the key, and an incomplete sealed frame at the end of either buffer
+// is truncated. Data keys wrapped with a previous key of the cipher are rewrapped with its current
+// key.
 //
 // Parameters:
 //   - irPath: Path to IR disk buffer file
 //   - zstdPath: Path to Zstd disk buffer file
+//   - cipher: Cipher used to encrypt buffers, nil if buffers are not encrypted
+//   - messageKey: Key of the message written as CLP unstructured IR, empty to write KV-IR
 //
 // Returns:
 //   - diskWriter: Disk writer for Zstd compressed IR
 //   - err: Error opening buffers, error opening Zstd/IR writers, error getting file sizes,
-//     error empty buffers
-func RecoverWriter(irPath string, zstdPath string) (*diskWriter, error) {
+//     error empty buffers, error decrypting buffers
+func RecoverWriter(
+	irPath string,
+	zstdPath string,
+	cipher *Cipher,
+	messageKey string,
+) (*diskWriter, error) {
 	irFile, zstdFile, err := openBufferFiles(irPath, zstdPath)
 	if err != nil {
 		return nil, fmt.Errorf("error opening files: %w", err)
 	}
 
-	zstdWriter, err := zstd.NewWriter(zstdFile)
+	diskWriter, err := newDiskWriter(irPath, irFile, zstdPath, zstdFile, cipher, messageKey)
 	if err != nil {
-		return nil, fmt.Errorf("error opening Zstd writer: %w", err)
-	}
-
-	diskWriter := diskWriter{
-		irPath:     irPath,
-		irFile:     irFile,
-		zstdPath:   zstdPath,
-		zstdFile:   zstdFile,
-		zstdWriter: zstdWriter,
-		state:      Open,
+		return nil, err
 	}
 
 	irFileSize, err := diskWriter.getIrFileSize()
@@ -123,8 +128,84 @@ func RecoverWriter(irPath string, zstdPath string) (*diskWriter, error) {
 		return nil, fmt.Errorf("error both IR and Zstd buffers are empty")
 	}
 
+	completeZstdFramesSize := completeFramesSize
+	if cipher != nil {
+		completeZstdFramesSize = cipher.completeSealedFramesSize
+	}
+	err = truncateIncompleteFrame(zstdFile, zstdFileSize, completeZstdFramesSize)
+	if err != nil {
+		return nil, fmt.Errorf("error truncating incomplete Zstd frame: %w", err)
+	}
+
+	// Unencrypted IR is decodable up to the last complete event, so it is not truncated.
+	if cipher != nil {
+		err = truncateIncompleteFrame(irFile, irFileSize, cipher.completeSealedFramesSize)
+		if err != nil {
+			return nil, fmt.Errorf("error truncating incomplete IR frame: %w", err)
+		}
+		irFileSize, err = diskWriter.getIrFileSize()
+		if err != nil {
+			return nil, fmt.Errorf("error getting size of IR file: %w", err)
+		}
+
+		for _, f := range []*os.File{irFile, zstdFile} {
+			err = cipher.rewrapKeys(f)
+			if err != nil {
+				return nil, fmt.Errorf("error rewrapping data keys: %w", err)
+			}
+		}
+	}
+
 	diskWriter.irTotalBytes = irFileSize
 
+	return diskWriter, nil
+}
+
+// Creates a [diskWriter] using opened buffer files.
+//
+// Parameters:
+//   - irPath: Path to IR disk buffer file
+//   - irFile: IR disk buffer file
+//   - zstdPath: Path to Zstd disk buffer file
+//   - zstdFile: Zstd disk buffer file
+//   - cipher: Cipher to encrypt buffers, nil to write buffers without encryption
+//   - messageKey: Key of the message written as CLP unstructured IR, empty to write KV-IR
+//
+// Returns:
+//   - diskWriter: Disk writer for Zstd compressed IR
+//   - err: Error opening Zstd writer, error generating data key
+func newDiskWriter(
+	irPath string,
+	irFile *os.File,
+	zstdPath string,
+	zstdFile *os.File,
+	cipher *Cipher,
+	messageKey string,
+) (*diskWriter, error) {
+	diskWriter := diskWriter{
+		irPath:     irPath,
+		irFile:     irFile,
+		zstdPath:   zstdPath,
+		zstdFile:   zstdFile,
+		cipher:     cipher,
+		state:      Open,
+		messageKey: messageKey,
+	}
+
+	if cipher != nil {
+		var err error
+		diskWriter.dataKey, err = cipher.newDataKey()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	zstdWriter, err := zstd.NewWriter(diskWriter.zstdSink())
+	if err != nil {
+		return nil, fmt.Errorf("error opening Zstd writer: %w", err)
+	}
+	diskWriter.zstdWriter = zstdWriter
+
 	return &diskWriter, nil
 }
 
@@ -133,28 +214,38 @@ func RecoverWriter(irPath string, zstdPath string) (*diskWriter, error) {
 // to a later call. See [diskWriter] for more specific details on behaviour. The IR writer is lazily
 // initialized on the first write. If initialized in [Reset], the preamble would make the IR file
 // non-empty even though there are no logs. Non-empty IR files persist across recovery and could
-// lead to empty files being uploaded to S3.
+// lead to empty files being uploaded to S3. Files are synced before returning, so written events
+// are recovered after a crash of the host.
 //
 // Parameters:
 //   - logEvents: A slice of log events to be encoded
 //
 // Returns:
 //   - numEvents: Number of log events successfully written to IR writer buffer
-//   - err: Error writing IR/Zstd, error flushing buffers
-func (w *diskWriter) WriteIrZstd(logEvents []ffi.LogEvent) (int, error) {
+//   - err: Error writing IR/Zstd, error flushing buffers, error syncing IR file
+func (w *diskWriter) WriteIrZstd(logEvents []LogEvent) (int, error) {
 	if w.state != Open {
 		return 0, fmt.Errorf("cannot write: writer state is %s, expected %s", w.state, Open)
 	}
 
 	if w.irWriter == nil {
 		var err error
-		w.irWriter, err = ir.NewWriter[ir.FourByteEncoding](w.irFile)
+		w.irWriter, err = newIrEncoder(w.irSink(), w.messageKey)
 		if err != nil {
 			return 0, fmt.Errorf("error creating IR writer: %w", err)
 		}
 	}
 
-	numBytes, numEvents, err := writeIr(w.irWriter, logEvents)
+	numBytes, numEvents, err := writeIr(w.irWriter, logEvents, &w.stats)
+	if w.cipher != nil {
+		// Events written before an error are kept, as they are without encryption.
+		var sealErr error
+		numBytes, sealErr = w.sealFrame(&w.irStaging, w.irFile)
+		if sealErr != nil {
+			w.state = Corrupted
+			return numEvents, fmt.Errorf("error writing encrypted IR: %w", sealErr)
+		}
+	}
 	if err != nil {
 		return numEvents, err
 	}
@@ -170,12 +261,17 @@ func (w *diskWriter) WriteIrZstd(logEvents []ffi.LogEvent) (int, error) {
 		}
 	}
 
+	err = w.irFile.Sync()
+	if err != nil {
+		return numEvents, fmt.Errorf("error syncing IR buffer: %w", err)
+	}
+
 	return numEvents, nil
 }
 
 // Closes IR stream and Zstd frame. Add trailing byte(s) required for IR/Zstd decoding. The IR
 // buffer is also flushed before ending stream. After calling close, [diskWriter] must be reset
-// prior to calling write. For recovered [diskWriter], [ir.Writer] will be nil so closing the
+// prior to calling write. For recovered [diskWriter], the IR encoder will be nil so closing the
 // IR writer is skipped. The IR trailing byte is written directly to [zstdWriter] as an
 // optimization to avoid an extra flush when the IR buffer is empty. [flushIrBuffer] exits early
 // if the IR buffer is empty.
@@ -197,7 +293,7 @@ func (w *diskWriter) CloseStreams() error {
 	}
 
 	if w.irWriter != nil {
-		err := w.irWriter.Serializer.Close()
+		err := w.irWriter.Release()
 		if err != nil {
 			return fmt.Errorf("error could not close irWriter: %w", err)
 		}
@@ -209,7 +305,7 @@ func (w *diskWriter) CloseStreams() error {
 		w.state = Corrupted
 		return fmt.Errorf("error writing IR end of stream byte: %w", err)
 	}
-	err = w.zstdWriter.Close()
+	err = w.closeZstdFrame()
 	if err != nil {
 		w.state = Corrupted
 		return err
@@ -225,11 +321,11 @@ func (w *diskWriter) CloseStreams() error {
 	return nil
 }
 
-// Reinitialize [diskWriter] after calling CloseStreams(). Resets Zstd writer and associated
-// buffer.
+// Reinitialize [diskWriter] after calling CloseStreams(). Resets Zstd writer, associated buffer and
+// statistics. If buffers are encrypted, a new data key is generated for the next object.
 //
 // Returns:
-//   - err: Error IR buffer not empty
+//   - err: Error IR buffer not empty, error generating data key
 func (w *diskWriter) Reset() error {
 	if w.state != StreamsClosed {
 		return fmt.Errorf("cannot reset: writer state is %s, expected %s", w.state, StreamsClosed)
@@ -254,23 +350,32 @@ func (w *diskWriter) Reset() error {
 		return err
 	}
 
-	w.zstdWriter.Reset(w.zstdFile)
+	if w.cipher != nil {
+		w.dataKey, err = w.cipher.newDataKey()
+		if err != nil {
+			w.state = Corrupted
+			return err
+		}
+	}
+
+	w.zstdWriter.Reset(w.zstdSink())
+	w.stats = Stats{}
 
 	w.state = Open
 	return nil
 }
 
 // Closes [diskWriter]. Currently used during recovery only, and advise caution using elsewhere.
-// Using [ir.Writer.Serializer.Close] instead of [ir.Writer.Close] so EndofStream byte is not
-// added. It is preferable to add postamble on recovery so that IR is in the same state
-// (i.e. not terminated) for an abrupt crash and a graceful exit. Function does not call
-// [zstd.Encoder.Close] as it does not explicitly free memory and may add undesirable null frame.
+// The IR encoder is released instead of closed so EndofStream byte is not added. It is preferable
+// to add postamble on recovery so that IR is in the same state (i.e. not terminated) for an abrupt
+// crash and a graceful exit. Function does not call [zstd.Encoder.Close] as it does not explicitly
+// free memory and may add undesirable null frame.
 //
 // Returns:
 //   - err: Error closing irWriter, error closing files
 func (w *diskWriter) Close() error {
 	if w.irWriter != nil {
-		err := w.irWriter.Serializer.Close()
+		err := w.irWriter.Release()
 		if err != nil {
 			return fmt.Errorf("error could not close irWriter: %w", err)
 		}
@@ -298,19 +403,22 @@ func (w *diskWriter) GetState() WriterState {
 	return w.state
 }
 
-// Getter for Zstd Output.
+// Getter for Zstd Output. Encrypted buffers are decrypted while reading.
 //
 // Returns:
 //   - zstdOutput: Reader for Zstd output
 func (w *diskWriter) GetZstdOutput() io.Reader {
-	return w.zstdFile
+	return NewDecryptReader(w.zstdFile, w.cipher)
 }
 
-// Get size of Zstd output.
+// Get size of Zstd output. Size of encrypted buffers excludes encryption overhead.
 //
 // Returns:
 //   - err: Error getting size
 func (w *diskWriter) GetZstdOutputSize() (int, error) {
+	if w.cipher != nil {
+		return plaintextSize(w.zstdFile)
+	}
 	return w.getZstdFileSize()
 }
 
@@ -351,13 +459,20 @@ func (w *diskWriter) flushIrBuffer() error {
 		return err
 	}
 
-	_, err = io.Copy(w.zstdWriter, w.irFile)
+	_, err = io.Copy(w.zstdWriter, NewDecryptReader(w.irFile, w.cipher))
+	if err != nil {
+		w.state = Corrupted
+		return err
+	}
+
+	err = w.closeZstdFrame()
 	if err != nil {
 		w.state = Corrupted
 		return err
 	}
 
-	err = w.zstdWriter.Close()
+	// Frame must be durable before the IR it holds is truncated.
+	err = w.zstdFile.Sync()
 	if err != nil {
 		w.state = Corrupted
 		return err
@@ -365,7 +480,7 @@ func (w *diskWriter) flushIrBuffer() error {
 
 	// The Zstd file is not truncated since it should keep accumulating frames until ready to
 	// upload.
-	w.zstdWriter.Reset(w.zstdFile)
+	w.zstdWriter.Reset(w.zstdSink())
 
 	_, err = w.irFile.Seek(0, io.SeekStart)
 	if err != nil {
@@ -384,6 +499,66 @@ func (w *diskWriter) flushIrBuffer() error {
 	return nil
 }
 
+// Closes the current Zstd frame. If buffers are encrypted, the frame is then sealed and appended to
+// the Zstd file.
+//
+// Returns:
+//   - err: Error from Zstd Encoder, error writing sealed frame
+func (w *diskWriter) closeZstdFrame() error {
+	err := w.zstdWriter.Close()
+	if err != nil {
+		return err
+	}
+	if w.cipher == nil {
+		return nil
+	}
+	_, err = w.sealFrame(&w.zstdStaging, w.zstdFile)
+	return err
+}
+
+// Encrypts staged data into a sealed frame and appends it to file. Staging buffer is emptied.
+//
+// Parameters:
+//   - staging: Data to seal
+//   - f: File to append sealed frame to
+//
+// Returns:
+//   - numBytes: Size of sealed frame, 0 if there was no data
+//   - err: Error encrypting data, error writing file
+func (w *diskWriter) sealFrame(staging *bytes.Buffer, f *os.File) (int, error) {
+	if staging.Len() == 0 {
+		return 0, nil
+	}
+	frame, err := w.dataKey.seal(staging.Bytes())
+	staging.Reset()
+	if err != nil {
+		return 0, err
+	}
+	return f.Write(frame)
+}
+
+// Retrieves destination of IR writer. Encrypted IR is staged until it can be sealed.
+//
+// Returns:
+//   - sink: IR file, or staging buffer if buffers are encrypted
+func (w *diskWriter) irSink() io.Writer {
+	if w.cipher != nil {
+		return &w.irStaging
+	}
+	return w.irFile
+}
+
+// Retrieves destination of Zstd writer. Encrypted Zstd frames are staged until they can be sealed.
+//
+// Returns:
+//   - sink: Zstd file, or staging buffer if buffers are encrypted
+func (w *diskWriter) zstdSink() io.Writer {
+	if w.cipher != nil {
+		return &w.zstdStaging
+	}
+	return w.zstdFile
+}
+
 // Creates file buffers to hold logs prior to sending to s3.
 //
 // Parameters:
@@ -422,15 +597,16 @@ func newFileBuffers(
 //   - f: The created file
 //   - err: Could not create directory, could not create file
 func createFile(path string) (*os.File, error) {
-	// Make directory if does not exist.
+	// Make directory if does not exist. Buffers hold log contents, so only the owner may access
+	// them.
 	dir := filepath.Dir(path)
-	err := os.MkdirAll(dir, 0o751)
+	err := os.MkdirAll(dir, 0o700)
 	if err != nil {
 		err = fmt.Errorf("failed to create directory %s: %w", dir, err)
 		return nil, err
 	}
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o751)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o600)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create file %s: %w", path, err)
 	}
@@ -446,12 +622,12 @@ func createFile(path string) (*os.File, error) {
 // Returns:
 //   - err: error opening files
 func openBufferFiles(irPath string, zstdPath string) (*os.File, *os.File, error) {
-	irFile, err := os.OpenFile(irPath, os.O_RDWR, 0o751)
+	irFile, err := os.OpenFile(irPath, os.O_RDWR, 0o600)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error opening ir file %s: %w", irPath, err)
 	}
 
-	zstdFile, err := os.OpenFile(zstdPath, os.O_RDWR, 0o751)
+	zstdFile, err := os.OpenFile(zstdPath, os.O_RDWR, 0o600)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error opening zstd file %s: %w", zstdPath, err)
 	}
@@ -467,6 +643,48 @@ func openBufferFiles(irPath string, zstdPath string) (*os.File, *os.File, error)
 	return irFile, zstdFile, nil
 }
 
+// Truncates an incomplete frame at the end of a disk buffer. File whence is [io.SeekEnd] after
+// truncation.
+//
+// Parameters:
+//   - f: Disk buffer file
+//   - fileSize: Size of file
+//   - completeFramesSize: Function to find the size of the complete frames in file
+//
+// Returns:
+//   - err: Error reading file, error truncating file
+func truncateIncompleteFrame(
+	f *os.File,
+	fileSize int,
+	completeFramesSize func(io.Reader) (int64, error),
+) error {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	completeSize, err := completeFramesSize(f)
+	if err != nil {
+		return err
+	}
+
+	if completeSize != int64(fileSize) {
+		log.Printf(
+			"truncating incomplete frame in %s from %d to %d bytes",
+			filepath.Base(f.Name()),
+			fileSize,
+			completeSize,
+		)
+		err = f.Truncate(completeSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = f.Seek(0, io.SeekEnd)
+	return err
+}
+
 // Get size of IR file. In general, can use [irTotalBytes] to track size of IR file;
 // however, [irTotalBytes] will only track writes by current process and will not have info for
 // recovered stores.
@@ -498,3 +716,11 @@ func (w *diskWriter) getZstdFileSize() (int, error) {
 	zstdFileSize := int(zstdFileInfo.Size())
 	return zstdFileSize, err
 }
+
+// Getter for statistics of buffered events.
+//
+// Returns:
+//   - stats: Statistics since the last reset
+func (w *diskWriter) GetStats() Stats {
+	return w.stats
+}
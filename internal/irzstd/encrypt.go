@@ -0,0 +1,482 @@
+package irzstd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// Disk buffers are encrypted with envelope encryption. Each buffer is encrypted with a random data
+// key, and the data key is wrapped (encrypted) with the configured key encryption key. Encrypted
+// disk buffers are a sequence of sealed frames. Each sealed frame is a header, the wrapped data
+// key, a random nonce, and AES-GCM ciphertext:
+//
+//	magic (4 bytes) | ciphertext length (4 bytes, little endian) | wrapped key (60 bytes) |
+//	nonce (12 bytes) | ciphertext
+//
+// The wrapped key is a random nonce followed by the data key sealed with the key encryption key.
+// The header is authenticated as additional data of the ciphertext. The wrapped key is not, so it
+// can be rewrapped with a new key encryption key without decrypting the frame. Frames are only
+// appended once complete, so a crash can only leave a truncated frame at the end of a file. Frames
+// can be decrypted independently, so the truncated frame is removed on recovery without losing
+// earlier frames.
+var sealedFrameMagic = []byte{'C', 'L', 'P', 'E'}
+
+// Sizes of sealed frame fields.
+const (
+	sealedHeaderSize = 8
+	gcmNonceSize     = 12
+	gcmTagSize       = 16
+	wrappedKeySize   = gcmNonceSize + KeySize + gcmTagSize
+)
+
+// Size of key for AES-256.
+const KeySize = 32
+
+// Returned when input is not a sealed frame. Occurs if a buffer was written without encryption.
+var errInvalidSealedFrame = errors.New("invalid sealed frame")
+
+// Returned when a sealed frame cannot be decrypted. Occurs if the key differs from the key used to
+// write the buffer or if the buffer was modified.
+var ErrDecryptionFailed = errors.New("error decrypting disk buffer, key may be incorrect")
+
+// Wraps data keys of disk buffers with a key encryption key, and decrypts disk buffer frames.
+// Previous key encryption keys are only used to unwrap data keys of buffers written before the key
+// was rotated.
+type Cipher struct {
+	keyEncryptionKey cipher.AEAD
+	previousKeys     []cipher.AEAD
+}
+
+// Random key encrypting the frames of a buffer, and the key wrapped by a [Cipher].
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+}
+
+// Creates a new [Cipher].
+//
+// Parameters:
+//   - key: AES-256 key encryption key
+//   - previousKeys: Key encryption keys used before the key was rotated
+//
+// Returns:
+//   - cipher: Cipher for disk buffers
+//   - err: Error key is not [KeySize] bytes
+func NewCipher(key []byte, previousKeys ...[]byte) (*Cipher, error) {
+	keyEncryptionKey, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	c := Cipher{keyEncryptionKey: keyEncryptionKey}
+	for _, previousKey := range previousKeys {
+		aead, err := newAead(previousKey)
+		if err != nil {
+			return nil, fmt.Errorf("error previous key: %w", err)
+		}
+		c.previousKeys = append(c.previousKeys, aead)
+	}
+	return &c, nil
+}
+
+// Creates an AES-256-GCM cipher.
+//
+// Parameters:
+//   - key: AES-256 key
+//
+// Returns:
+//   - aead: AES-GCM cipher
+//   - err: Error key is not [KeySize] bytes
+func newAead(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("error key is %d bytes, expected %d bytes", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating AES cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCM cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// Parses keys encoded as hex or standard base64. Keys are separated by commas or whitespace, so
+// keys can be read from files with one key per line.
+//
+// Parameters:
+//   - encoded: Encoded keys
+//
+// Returns:
+//   - keys: Decoded keys in order
+//   - err: Error no key is set, error a key is not [KeySize] bytes encoded as hex or base64
+func ParseKeys(encoded string) ([][]byte, error) {
+	fields := strings.FieldsFunc(encoded, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("error no key is set")
+	}
+
+	keys := make([][]byte, 0, len(fields))
+	for _, field := range fields {
+		key, err := ParseKey(field)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Parses a key encoded as hex or standard base64. Surrounding whitespace is removed so keys can be
+// read from files ending with a newline.
+//
+// Parameters:
+//   - encoded: Encoded key
+//
+// Returns:
+//   - key: Decoded key
+//   - err: Error key is not [KeySize] bytes encoded as hex or base64
+func ParseKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	if len(encoded) == hex.EncodedLen(KeySize) {
+		if key, err := hex.DecodeString(encoded); err == nil {
+			return key, nil
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("error key must be %d bytes encoded as hex or base64", KeySize)
+	}
+	return key, nil
+}
+
+// Generates a random data key and wraps it with the key encryption key.
+//
+// Returns:
+//   - dataKey: Data key for a buffer
+//   - err: Error generating key
+func (c *Cipher) newDataKey() (*dataKey, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("error generating data key: %w", err)
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrapKey(c.keyEncryptionKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &dataKey{aead: aead, wrapped: wrapped}, nil
+}
+
+// Seals a data key with a key encryption key.
+//
+// Parameters:
+//   - keyEncryptionKey: Key encryption key
+//   - key: Data key
+//
+// Returns:
+//   - wrapped: Nonce followed by sealed data key
+//   - err: Error generating nonce
+func wrapKey(keyEncryptionKey cipher.AEAD, key []byte) ([]byte, error) {
+	wrapped := make([]byte, gcmNonceSize, wrappedKeySize)
+	if _, err := rand.Read(wrapped); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	return keyEncryptionKey.Seal(wrapped, wrapped, key, sealedFrameMagic), nil
+}
+
+// Unwraps a data key with the key encryption key, or a previous key encryption key if the key was
+// rotated.
+//
+// Parameters:
+//   - wrapped: Wrapped data key
+//
+// Returns:
+//   - key: Data key
+//   - rotated: Whether the data key was wrapped with a previous key encryption key
+//   - err: [ErrDecryptionFailed] if no key encryption key can unwrap the data key
+func (c *Cipher) unwrapKey(wrapped []byte) ([]byte, bool, error) {
+	nonce, sealed := wrapped[:gcmNonceSize], wrapped[gcmNonceSize:]
+	key, err := c.keyEncryptionKey.Open(nil, nonce, sealed, sealedFrameMagic)
+	if err == nil {
+		return key, false, nil
+	}
+	for _, previousKey := range c.previousKeys {
+		key, err := previousKey.Open(nil, nonce, sealed, sealedFrameMagic)
+		if err == nil {
+			return key, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("error unwrapping data key: %w", ErrDecryptionFailed)
+}
+
+// Encrypts data into a sealed frame.
+//
+// Parameters:
+//   - plaintext: Data to encrypt
+//
+// Returns:
+//   - frame: Sealed frame
+//   - err: Error generating nonce
+func (k *dataKey) seal(plaintext []byte) ([]byte, error) {
+	frame := make([]byte, sealedHeaderSize, sealedFrameSize(len(plaintext)))
+	copy(frame, sealedFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:], uint32(len(plaintext)+gcmTagSize))
+	frame = append(frame, k.wrapped...)
+
+	nonce := frame[len(frame) : len(frame)+gcmNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %w", err)
+	}
+	frame = frame[:len(frame)+gcmNonceSize]
+	return k.aead.Seal(frame, nonce, plaintext, frame[:sealedHeaderSize]), nil
+}
+
+// Reads and decrypts a single sealed frame.
+//
+// Parameters:
+//   - reader: Input positioned at the start of a sealed frame
+//
+// Returns:
+//   - plaintext: Decrypted data
+//   - size: Byte length of sealed frame
+//   - err: [io.EOF] if there is no input, [io.ErrUnexpectedEOF] if frame is incomplete,
+//     [errInvalidSealedFrame] if input is not a sealed frame, [ErrDecryptionFailed] if data key
+//     cannot be unwrapped or frame cannot be authenticated, error reading input
+func (c *Cipher) open(reader io.Reader) ([]byte, int64, error) {
+	var header [sealedHeaderSize + wrappedKeySize + gcmNonceSize]byte
+	n, err := io.ReadFull(reader, header[:])
+	magic := header[:min(n, len(sealedFrameMagic))]
+	if !bytes.HasPrefix(sealedFrameMagic, magic) {
+		return nil, 0, errInvalidSealedFrame
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(magic, sealedFrameMagic) {
+		return nil, 0, errInvalidSealedFrame
+	}
+	length := int64(binary.LittleEndian.Uint32(header[4:sealedHeaderSize]))
+	if length < gcmTagSize {
+		return nil, 0, errInvalidSealedFrame
+	}
+
+	// Copying instead of allocating the frame length up front since a corrupted length could be up
+	// to 4 GB.
+	var ciphertext bytes.Buffer
+	copied, err := io.CopyN(&ciphertext, reader, length)
+	if copied < length {
+		return nil, 0, unexpectedEof(err)
+	}
+
+	wrapped := header[sealedHeaderSize : sealedHeaderSize+wrappedKeySize]
+	key, _, err := c.unwrapKey(wrapped)
+	if err != nil {
+		return nil, 0, err
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nonce := header[sealedHeaderSize+wrappedKeySize:]
+	plaintext, err := aead.Open(nil, nonce, ciphertext.Bytes(), header[:sealedHeaderSize])
+	if err != nil {
+		return nil, 0, ErrDecryptionFailed
+	}
+	return plaintext, int64(len(header)) + length, nil
+}
+
+// Finds the size of the complete sealed frames at the start of input. Unlike
+// [completeFramesSize], input which is not a sealed frame or cannot be decrypted is an error since
+// truncating it would discard a buffer written without encryption or with a different key.
+//
+// Parameters:
+//   - r: Encrypted disk buffer
+//
+// Returns:
+//   - size: Byte length of complete sealed frames
+//   - err: Error input is not encrypted with key, error reading input
+func (c *Cipher) completeSealedFramesSize(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	var size int64
+	for {
+		_, frameSize, err := c.open(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return size, nil
+		}
+		if errors.Is(err, errInvalidSealedFrame) {
+			return 0, fmt.Errorf("error disk buffer is not encrypted or is corrupted: %w", err)
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += frameSize
+	}
+}
+
+// Rewraps data keys wrapped with a previous key encryption key, so the buffer can be decrypted
+// once the previous key is removed. Only wrapped keys are rewritten, frames are not re-encrypted.
+// The file must only contain complete sealed frames.
+//
+// Parameters:
+//   - f: Encrypted disk buffer
+//
+// Returns:
+//   - err: Error reading or writing file, error input is not a sealed frame, [ErrDecryptionFailed]
+//     if a data key cannot be unwrapped
+func (c *Cipher) rewrapKeys(f *os.File) error {
+	// Frames of a buffer share a data key, so each wrapped key is only rewrapped once.
+	rewrapped := make(map[string][]byte)
+	numRewrapped := 0
+	var offset int64
+	for {
+		var header [sealedHeaderSize + wrappedKeySize]byte
+		_, err := f.ReadAt(header[:], offset)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(header[:4], sealedFrameMagic) {
+			return errInvalidSealedFrame
+		}
+
+		wrapped := header[sealedHeaderSize:]
+		newWrapped, ok := rewrapped[string(wrapped)]
+		if !ok {
+			key, rotated, err := c.unwrapKey(wrapped)
+			if err != nil {
+				return err
+			}
+			if rotated {
+				newWrapped, err = wrapKey(c.keyEncryptionKey, key)
+				if err != nil {
+					return err
+				}
+			}
+			rewrapped[string(wrapped)] = newWrapped
+		}
+		if newWrapped != nil {
+			_, err = f.WriteAt(newWrapped, offset+sealedHeaderSize)
+			if err != nil {
+				return err
+			}
+			numRewrapped++
+		}
+
+		length := int64(binary.LittleEndian.Uint32(header[4:sealedHeaderSize]))
+		offset += sealedHeaderSize + wrappedKeySize + gcmNonceSize + length
+	}
+
+	if numRewrapped == 0 {
+		return nil
+	}
+	log.Printf("rewrapped data keys of %d frames in %s", numRewrapped, filepath.Base(f.Name()))
+	return f.Sync()
+}
+
+// Finds the decrypted size of an encrypted disk buffer. Only headers are read.
+//
+// Parameters:
+//   - f: Encrypted disk buffer
+//
+// Returns:
+//   - size: Total byte length of decrypted frames
+//   - err: Error reading file, error input is not a sealed frame
+func plaintextSize(f *os.File) (int, error) {
+	var size int
+	var offset int64
+	for {
+		var header [sealedHeaderSize]byte
+		_, err := f.ReadAt(header[:], offset)
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(header[:4], sealedFrameMagic) {
+			return 0, errInvalidSealedFrame
+		}
+		length := int64(binary.LittleEndian.Uint32(header[4:]))
+		size += int(length) - gcmTagSize
+		offset += sealedHeaderSize + wrappedKeySize + gcmNonceSize + length
+	}
+}
+
+// Computes size of a sealed frame.
+//
+// Parameters:
+//   - plaintextSize: Size of data in frame
+//
+// Returns:
+//   - size: Byte length of sealed frame
+func sealedFrameSize(plaintextSize int) int {
+	return sealedHeaderSize + wrappedKeySize + gcmNonceSize + plaintextSize + gcmTagSize
+}
+
+// Outputs decrypted data from a sequence of sealed frames.
+type decryptReader struct {
+	cipher    *Cipher
+	reader    *bufio.Reader
+	plaintext []byte
+	err       error
+}
+
+// Opens a reader which decrypts an encrypted disk buffer. If cipher is nil, the buffer is not
+// encrypted and r is returned unchanged.
+//
+// Parameters:
+//   - r: Disk buffer
+//   - cipher: Cipher used to write buffer, nil if buffer is not encrypted
+//
+// Returns:
+//   - reader: Reader for decrypted data
+func NewDecryptReader(r io.Reader, cipher *Cipher) io.Reader {
+	if cipher == nil {
+		return r
+	}
+	return &decryptReader{cipher: cipher, reader: bufio.NewReader(r)}
+}
+
+// Reads decrypted data.
+//
+// Parameters:
+//   - p: Destination buffer
+//
+// Returns:
+//   - n: Number of bytes read
+//   - err: [io.EOF] at end of input, [io.ErrUnexpectedEOF] if last frame is incomplete, error
+//     decrypting frame
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.plaintext, _, r.err = r.cipher.open(r.reader)
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
@@ -0,0 +1,219 @@
+package irzstd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Magic numbers of Zstd frames. See [Zstd frame format].
+//
+// [Zstd frame format]: https://github.com/facebook/zstd/blob/dev/doc/zstd_compression_format.md#frames
+const (
+	zstdFrameMagic          = 0xfd2fb528
+	zstdSkippableMagicMask  = 0xfffffff0
+	zstdSkippableMagicValue = 0x184d2a50
+)
+
+// Zstd block types.
+const (
+	zstdBlockRle      = 1
+	zstdBlockReserved = 3
+)
+
+// Finds the size of the complete Zstd frames at the start of input. A crash while compacting IR
+// leaves an incomplete frame at the end of the Zstd disk buffer. Appending new frames after an
+// incomplete frame would make all following frames undecodable, so the incomplete frame must be
+// truncated before recovery. Frames are only parsed, not decompressed.
+//
+// Parameters:
+//   - r: Zstd disk buffer
+//
+// Returns:
+//   - size: Byte length of complete frames
+//   - err: Error reading input
+func completeFramesSize(r io.Reader) (int64, error) {
+	reader := bufio.NewReader(r)
+	var size int64
+	for {
+		frameSize, err := readFrame(reader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, errInvalidFrame) {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += frameSize
+	}
+}
+
+// Splits Zstd compressed data into chunks of at most maxSize bytes. Chunks end at frame boundaries,
+// so consumers can decompress each chunk on its own. Frames larger than maxSize, and data which is
+// not Zstd frames, such as encrypted buffers, are split every maxSize bytes.
+//
+// Parameters:
+//   - data: Zstd frames
+//   - maxSize: Maximum byte length of chunks
+//
+// Returns:
+//   - chunks: Slices of data in order, at least one even if data is empty
+func SplitFrames(data []byte, maxSize int) [][]byte {
+	var frameEnds []int
+	reader := bufio.NewReader(bytes.NewReader(data))
+	end := 0
+	for end < len(data) {
+		frameSize, err := readFrame(reader)
+		if err != nil {
+			// Remaining data is split every maxSize bytes.
+			end = len(data)
+		} else {
+			end += int(frameSize)
+		}
+		frameEnds = append(frameEnds, end)
+	}
+
+	chunks := [][]byte{}
+	start := 0
+	end = 0
+	for _, frameEnd := range frameEnds {
+		if frameEnd-start > maxSize && end > start {
+			chunks = append(chunks, data[start:end])
+			start = end
+		}
+		for frameEnd-start > maxSize {
+			chunks = append(chunks, data[start:start+maxSize])
+			start += maxSize
+		}
+		end = frameEnd
+	}
+	if end > start || len(chunks) == 0 {
+		chunks = append(chunks, data[start:end])
+	}
+	return chunks
+}
+
+// Returned when input is not a Zstd frame.
+var errInvalidFrame = errors.New("invalid Zstd frame")
+
+// Reads a single Zstd frame or skippable frame.
+//
+// Parameters:
+//   - reader: Input positioned at the start of a frame
+//
+// Returns:
+//   - size: Byte length of frame
+//   - err: [io.EOF] if there is no input, [io.ErrUnexpectedEOF] if frame is incomplete,
+//     [errInvalidFrame] if input is not a frame, error reading input
+func readFrame(reader *bufio.Reader) (int64, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, err
+	}
+	magic := binary.LittleEndian.Uint32(header[:])
+
+	if (magic & zstdSkippableMagicMask) == zstdSkippableMagicValue {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return 0, unexpectedEof(err)
+		}
+		frameSize := int64(binary.LittleEndian.Uint32(header[:]))
+		if err := discard(reader, frameSize); err != nil {
+			return 0, err
+		}
+		return 8 + frameSize, nil
+	}
+
+	if magic != zstdFrameMagic {
+		return 0, errInvalidFrame
+	}
+
+	descriptor, err := reader.ReadByte()
+	if err != nil {
+		return 0, unexpectedEof(err)
+	}
+	contentSizeFlag := descriptor >> 6
+	singleSegment := (descriptor>>5)&1 == 1
+	hasChecksum := (descriptor>>2)&1 == 1
+	dictionaryIdFlag := descriptor & 3
+
+	headerSize := int64([]int{0, 1, 2, 4}[dictionaryIdFlag])
+	headerSize += int64([]int{0, 2, 4, 8}[contentSizeFlag])
+	if !singleSegment {
+		// Window descriptor.
+		headerSize += 1
+	} else if contentSizeFlag == 0 {
+		headerSize += 1
+	}
+	if err := discard(reader, headerSize); err != nil {
+		return 0, err
+	}
+
+	frameSize := 5 + headerSize
+	for {
+		var blockHeader [4]byte
+		if _, err := io.ReadFull(reader, blockHeader[:3]); err != nil {
+			return 0, unexpectedEof(err)
+		}
+		fields := binary.LittleEndian.Uint32(blockHeader[:])
+		lastBlock := fields&1 == 1
+		blockType := (fields >> 1) & 3
+		blockSize := int64(fields >> 3)
+
+		if blockType == zstdBlockReserved {
+			return 0, errInvalidFrame
+		}
+		if blockType == zstdBlockRle {
+			blockSize = 1
+		}
+		if err := discard(reader, blockSize); err != nil {
+			return 0, err
+		}
+		frameSize += 3 + blockSize
+
+		if lastBlock {
+			break
+		}
+	}
+
+	if hasChecksum {
+		if err := discard(reader, 4); err != nil {
+			return 0, err
+		}
+		frameSize += 4
+	}
+
+	return frameSize, nil
+}
+
+// Discards bytes from reader.
+//
+// Parameters:
+//   - reader: Input
+//   - n: Number of bytes to discard
+//
+// Returns:
+//   - err: [io.ErrUnexpectedEOF] if input ends early, error reading input
+func discard(reader *bufio.Reader, n int64) error {
+	discarded, err := io.CopyN(io.Discard, reader, n)
+	if discarded < n {
+		return unexpectedEof(err)
+	}
+	return err
+}
+
+// Converts [io.EOF] into [io.ErrUnexpectedEOF] since input ended in the middle of a frame.
+//
+// Parameters:
+//   - err: Error reading input
+//
+// Returns:
+//   - err: Converted error
+func unexpectedEof(err error) error {
+	if err == nil || errors.Is(err, io.EOF) {
+		return fmt.Errorf("incomplete Zstd frame: %w", io.ErrUnexpectedEOF)
+	}
+	return err
+}
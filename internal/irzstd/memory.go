@@ -1,50 +1,57 @@
 package irzstd
 
 import (
-	"bytes"
 	"fmt"
 	"io"
+	"os"
 
 	"github.com/klauspost/compress/zstd"
-
-	"github.com/y-scope/clp-ffi-go/ffi"
-	"github.com/y-scope/clp-ffi-go/ir"
 )
 
 // Converts log events into Zstd compressed IR. Log events are immediately converted to Zstd
-// compressed IR and stored in [memoryWriter.zstdBuffer].
+// compressed IR and stored in [memoryWriter.zstdBuffer], which may be spilled to disk to limit
+// memory use.
 type memoryWriter struct {
-	zstdBuffer   *bytes.Buffer
-	irWriter     *ir.Writer
+	zstdBuffer   *spillBuffer
+	irSink       *irDestination
+	irWriter     irEncoder
 	zstdWriter   *zstd.Encoder
 	state        WriterState
+	stats        Stats
 	irTotalBytes int
+	messageKey   string // Empty if records are written as KV-IR
 }
 
 // Opens a new [memoryWriter] with a memory buffer for Zstd output. For use when use_disk_store is
 // off.
 //
+// Parameters:
+//   - messageKey: Key of the message written as CLP unstructured IR, empty to write KV-IR
+//
 // Returns:
 //   - memoryWriter: Memory writer for Zstd compressed IR
 //   - err: Error opening Zstd/IR writers
-func NewMemoryWriter() (*memoryWriter, error) {
-	var zstdBuffer bytes.Buffer
+func NewMemoryWriter(messageKey string) (*memoryWriter, error) {
+	var zstdBuffer spillBuffer
 
 	zstdWriter, err := zstd.NewWriter(&zstdBuffer)
 	if err != nil {
 		return nil, fmt.Errorf("error opening Zstd writer: %w", err)
 	}
 
-	irWriter, err := ir.NewWriter[ir.FourByteEncoding](zstdWriter)
+	irSink := irDestination{Writer: zstdWriter}
+	irWriter, err := newIrEncoder(&irSink, messageKey)
 	if err != nil {
 		return nil, fmt.Errorf("error opening IR writer: %w", err)
 	}
 
 	memoryWriter := memoryWriter{
+		irSink:     &irSink,
 		irWriter:   irWriter,
 		zstdWriter: zstdWriter,
 		zstdBuffer: &zstdBuffer,
 		state:      Open,
+		messageKey: messageKey,
 	}
 
 	return &memoryWriter, nil
@@ -58,12 +65,12 @@ func NewMemoryWriter() (*memoryWriter, error) {
 // Returns:
 //   - numEvents: Number of log events successfully written to IR writer buffer
 //   - err: Error writing IR/Zstd
-func (w *memoryWriter) WriteIrZstd(logEvents []ffi.LogEvent) (int, error) {
+func (w *memoryWriter) WriteIrZstd(logEvents []LogEvent) (int, error) {
 	if w.state != Open {
 		return 0, fmt.Errorf("cannot write: writer state is %s, expected %s", w.state, Open)
 	}
 
-	numBytes, numEvents, err := writeIr(w.irWriter, logEvents)
+	numBytes, numEvents, err := writeIr(w.irWriter, logEvents, &w.stats)
 	w.irTotalBytes += numBytes
 	if err != nil {
 		return numEvents, err
@@ -99,8 +106,8 @@ func (w *memoryWriter) CloseStreams() error {
 	return nil
 }
 
-// Reinitialize [memoryWriter] after calling CloseStreams(). Resets individual IR and Zstd writers
-// and associated buffers.
+// Reinitialize [memoryWriter] after calling CloseStreams(). Resets individual IR and Zstd writers,
+// associated buffers and statistics.
 //
 // Returns:
 //   - err: Error opening IR writer
@@ -109,12 +116,16 @@ func (w *memoryWriter) Reset() error {
 		return fmt.Errorf("cannot reset: writer state is %s, expected %s", w.state, StreamsClosed)
 	}
 
-	var err error
-	w.zstdBuffer.Reset()
+	err := w.zstdBuffer.reset()
+	if err != nil {
+		w.state = Corrupted
+		return err
+	}
 	w.zstdWriter.Reset(w.zstdBuffer)
 	w.irTotalBytes = 0
+	w.stats = Stats{}
 
-	w.irWriter, err = ir.NewWriter[ir.FourByteEncoding](w.zstdWriter)
+	w.irWriter, err = newIrEncoder(w.irSink, w.messageKey)
 	if err != nil {
 		w.state = Corrupted
 		return err
@@ -129,7 +140,7 @@ func (w *memoryWriter) Reset() error {
 // Returns:
 //   - zstdOutput: Reader for Zstd output
 func (w *memoryWriter) GetZstdOutput() io.Reader {
-	return w.zstdBuffer
+	return w.zstdBuffer.reader()
 }
 
 // Get size of Zstd output. [zstd] does not provide the amount of bytes written with each write.
@@ -140,7 +151,27 @@ func (w *memoryWriter) GetZstdOutput() io.Reader {
 //   - size: Bytes written
 //   - err: nil error to comply with interface
 func (w *memoryWriter) GetZstdOutputSize() (int, error) {
-	return w.zstdBuffer.Len(), nil
+	return w.zstdBuffer.len(), nil
+}
+
+// Moves Zstd output to a temporary file so it no longer uses memory. Subsequent output is appended
+// to the file until the writer is reset. Encoder state remains in memory.
+//
+// Parameters:
+//   - dir: Directory of the temporary file
+//
+// Returns:
+//   - err: Error creating or writing file
+func (w *memoryWriter) Spill(dir string) error {
+	return w.zstdBuffer.spill(dir)
+}
+
+// Get size of Zstd output held in memory.
+//
+// Returns:
+//   - size: Bytes held in memory, 0 if output was spilled
+func (w *memoryWriter) GetMemorySize() int {
+	return w.zstdBuffer.memorySize()
 }
 
 // Getter for state.
@@ -152,22 +183,22 @@ func (w *memoryWriter) GetState() WriterState {
 }
 
 // Closes [memoryWriter]. Currently used during recovery only, and advise caution using elsewhere.
-// Using [ir.Writer.Serializer.Close] instead of [ir.Writer.Close] so EndofStream byte is not
-// added. It is preferable to add postamble on recovery so that IR is in the same state
-// (i.e. not terminated) for an abrupt crash and a graceful exit. Function does not call
-// [zstd.Encoder.Close] as it does not explicitly free memory and may add undesirable null frame.
+// The IR encoder is released instead of closed so EndofStream byte is not added. It is preferable
+// to add postamble on recovery so that IR is in the same state (i.e. not terminated) for an abrupt
+// crash and a graceful exit. Function does not call [zstd.Encoder.Close] as it does not explicitly
+// free memory and may add undesirable null frame.
 //
 // Returns:
-//   - err: Error closing irWriter, error closing files
+//   - err: Error closing irWriter, error closing spill file
 func (w *memoryWriter) Close() error {
 	if w.irWriter != nil {
-		err := w.irWriter.Serializer.Close()
+		err := w.irWriter.Release()
 		if err != nil {
 			return fmt.Errorf("error could not close irWriter: %w", err)
 		}
 	}
 	w.state = Closed
-	return nil
+	return w.zstdBuffer.close()
 }
 
 // Checks if writer is empty. True if no events are buffered.
@@ -178,3 +209,126 @@ func (w *memoryWriter) Close() error {
 func (w *memoryWriter) Empty() (bool, error) {
 	return w.irTotalBytes == 0, nil
 }
+
+// Getter for statistics of buffered events.
+//
+// Returns:
+//   - stats: Statistics since the last reset
+func (w *memoryWriter) GetStats() Stats {
+	return w.stats
+}
+
+// Moves buffered events to disk buffer files and returns a [diskWriter] using the files. If
+// streams are open, the Zstd frame is closed without terminating the IR stream, and the IR writer
+// is moved to the disk writer, so later events continue the same IR stream. If streams are closed,
+// the disk writer is returned with closed streams and must be reset after its output is read. The
+// [memoryWriter] is closed and must not be used afterwards.
+//
+// Parameters:
+//   - irPath: Path to IR disk buffer file
+//   - zstdPath: Path to Zstd disk buffer file
+//   - cipher: Cipher to encrypt buffers, nil to write buffers without encryption
+//
+// Returns:
+//   - diskWriter: Disk writer continuing the buffer
+//   - err: Error closing Zstd frame, error creating or writing buffer files
+func (w *memoryWriter) Persist(irPath string, zstdPath string, cipher *Cipher) (Writer, error) {
+	if (w.state != Open) && (w.state != StreamsClosed) {
+		return nil, fmt.Errorf("cannot persist: writer state is %s", w.state)
+	}
+
+	// Events were never written, so the IR writer is not moved to avoid a Zstd buffer holding only
+	// a preamble.
+	if (w.state == Open) && (w.irTotalBytes == 0) {
+		diskWriter, err := NewDiskWriter(irPath, zstdPath, cipher, w.messageKey)
+		if err != nil {
+			return nil, err
+		}
+		w.state = Closed
+		return diskWriter, w.zstdBuffer.reset()
+	}
+
+	irFile, zstdFile, err := newFileBuffers(irPath, zstdPath)
+	if err != nil {
+		return nil, err
+	}
+	diskWriter, err := w.persistZstdBuffer(irPath, irFile, zstdPath, zstdFile, cipher)
+	if err != nil {
+		irFile.Close()
+		zstdFile.Close()
+		os.Remove(irPath)
+		os.Remove(zstdPath)
+		return nil, err
+	}
+
+	diskWriter.stats = w.stats
+	if w.state == Open {
+		w.irSink.Writer = diskWriter.irSink()
+		diskWriter.irWriter = w.irWriter
+		w.irWriter = nil
+	} else {
+		_, err = zstdFile.Seek(0, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+		diskWriter.state = StreamsClosed
+	}
+
+	w.state = Closed
+	return diskWriter, w.zstdBuffer.reset()
+}
+
+// Closes the Zstd frame if streams are open, and copies the Zstd buffer to the Zstd file of a new
+// [diskWriter]. The writer is corrupted if the frame cannot be closed, since the IR stream can no
+// longer be continued.
+//
+// Parameters:
+//   - irPath: Path to IR disk buffer file
+//   - irFile: Empty IR disk buffer file
+//   - zstdPath: Path to Zstd disk buffer file
+//   - zstdFile: Empty Zstd disk buffer file
+//   - cipher: Cipher to encrypt buffers, nil to write buffers without encryption
+//
+// Returns:
+//   - diskWriter: Disk writer holding the Zstd buffer
+//   - err: Error closing Zstd frame, error writing Zstd file
+func (w *memoryWriter) persistZstdBuffer(
+	irPath string,
+	irFile *os.File,
+	zstdPath string,
+	zstdFile *os.File,
+	cipher *Cipher,
+) (*diskWriter, error) {
+	diskWriter, err := newDiskWriter(irPath, irFile, zstdPath, zstdFile, cipher, w.messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.state == Open {
+		err := w.zstdWriter.Close()
+		if err != nil {
+			w.state = Corrupted
+			return nil, fmt.Errorf("error closing Zstd frame: %w", err)
+		}
+	}
+
+	_, err = io.Copy(diskWriter.zstdSink(), w.zstdBuffer.reader())
+	if err == nil && cipher != nil {
+		_, err = diskWriter.sealFrame(&diskWriter.zstdStaging, zstdFile)
+	}
+	if err != nil {
+		if w.state == Open {
+			w.state = Corrupted
+		}
+		return nil, fmt.Errorf("error writing Zstd buffer %s: %w", zstdPath, err)
+	}
+
+	return diskWriter, nil
+}
+
+// Destination of IR written by [memoryWriter]. The IR writer keeps the encoding state of the
+// stream, so its destination is changed instead of creating a new IR writer when the buffer is
+// persisted.
+type irDestination struct {
+	io.Writer
+}
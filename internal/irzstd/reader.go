@@ -0,0 +1,143 @@
+package irzstd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/y-scope/clp-ffi-go/ffi"
+	"github.com/y-scope/clp-ffi-go/ir"
+)
+
+// Magic number at the start of every Zstd frame.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Returned by [Reader.Read] if the input ends before the IR end of stream byte. Expected for disk
+// buffers of a crashed plugin and for IR which was flushed but not yet terminated. All events prior
+// to the error were read successfully.
+var ErrUnterminatedStream = errors.New("IR stream ended without end of stream byte")
+
+// Outputs uncompressed IR from Zstd compressed IR or uncompressed IR. Compression is detected from
+// the first bytes of input. Zstd input may contain multiple frames as produced by [diskWriter].
+type Decompressor struct {
+	reader     io.Reader
+	zstdReader *zstd.Decoder
+}
+
+// Opens a new [Decompressor].
+//
+// Parameters:
+//   - r: Zstd compressed IR or uncompressed IR
+//
+// Returns:
+//   - decompressor: Reader for uncompressed IR
+//   - err: Error reading input, error opening Zstd reader
+func NewDecompressor(r io.Reader) (*Decompressor, error) {
+	bufferedReader := bufio.NewReader(r)
+	magic, err := bufferedReader.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error reading input: %w", err)
+	}
+
+	if !bytes.Equal(magic, zstdMagic) {
+		return &Decompressor{reader: bufferedReader}, nil
+	}
+
+	zstdReader, err := zstd.NewReader(bufferedReader)
+	if err != nil {
+		return nil, fmt.Errorf("error opening Zstd reader: %w", err)
+	}
+	return &Decompressor{reader: zstdReader, zstdReader: zstdReader}, nil
+}
+
+// Reads uncompressed IR.
+//
+// Parameters:
+//   - p: Destination buffer
+//
+// Returns:
+//   - n: Number of bytes read
+//   - err: [io.EOF] at end of input, error decompressing Zstd
+func (d *Decompressor) Read(p []byte) (int, error) {
+	return d.reader.Read(p)
+}
+
+// Closes [Decompressor] and frees Zstd decoder resources.
+func (d *Decompressor) Close() {
+	if d.zstdReader != nil {
+		d.zstdReader.Close()
+	}
+}
+
+// Reads log events from Zstd compressed IR or uncompressed IR. KV-IR and CLP unstructured IR
+// written by [unstructuredEncoder] are detected from the IR preamble.
+type Reader struct {
+	decompressor *Decompressor
+	irReader     irDecoder
+}
+
+// Decodes log events from an IR stream.
+type irDecoder interface {
+	Read() (*ffi.LogEvent, error)
+	Close() error
+}
+
+// Opens a new [Reader].
+//
+// Parameters:
+//   - r: Zstd compressed IR or uncompressed IR
+//
+// Returns:
+//   - reader: Reader for log events
+//   - err: Error opening Zstd reader, error reading IR preamble
+func NewReader(r io.Reader) (*Reader, error) {
+	decompressor, err := NewDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Large enough to peek the metadata of unstructured IR.
+	bufferedReader := bufio.NewReaderSize(decompressor, 1<<17)
+	var irReader irDecoder
+	if isUnstructured(bufferedReader) {
+		irReader, err = newUnstructuredDecoder(bufferedReader)
+	} else {
+		irReader, err = ir.NewReader(bufferedReader)
+	}
+	if err != nil {
+		decompressor.Close()
+		return nil, fmt.Errorf("error opening IR reader: %w", err)
+	}
+
+	return &Reader{decompressor: decompressor, irReader: irReader}, nil
+}
+
+// Reads the next log event.
+//
+// Returns:
+//   - event: Next log event
+//   - err: [io.EOF] at end of stream, [ErrUnterminatedStream] if input is truncated, error decoding
+//     IR/Zstd
+func (r *Reader) Read() (*ffi.LogEvent, error) {
+	event, err := r.irReader.Read()
+	if err == nil {
+		return event, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return nil, io.EOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrUnterminatedStream
+	}
+	return nil, err
+}
+
+// Closes [Reader] and frees decoder resources.
+func (r *Reader) Close() {
+	r.irReader.Close()
+	r.decompressor.Close()
+}
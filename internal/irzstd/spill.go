@@ -0,0 +1,135 @@
+package irzstd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Destination of Zstd output of [memoryWriter]. Output is kept in memory until it is spilled to a
+// temporary file, after which output is appended to the file. The file is removed from its
+// directory once created, so it is freed when closed or when the plugin stops, including after a
+// crash.
+type spillBuffer struct {
+	memory bytes.Buffer
+	file   *os.File
+	// Bytes written to the file.
+	fileSize int
+}
+
+// Appends Zstd output to memory, or to the file if the buffer is spilled.
+//
+// Parameters:
+//   - p: Zstd output
+//
+// Returns:
+//   - n: Number of bytes written
+//   - err: Error writing to file
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil {
+		return b.memory.Write(p)
+	}
+	n, err := b.file.Write(p)
+	b.fileSize += n
+	return n, err
+}
+
+// Moves output held in memory to a temporary file. Does nothing if the buffer is already spilled.
+//
+// Parameters:
+//   - dir: Directory of the temporary file
+//
+// Returns:
+//   - err: Error creating directory, error creating, removing, or writing file
+func (b *spillBuffer) spill(dir string) error {
+	if b.file != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("error creating spill directory %s: %w", dir, err)
+	}
+	file, err := os.CreateTemp(dir, "spill-*.zst")
+	if err != nil {
+		return fmt.Errorf("error creating spill file: %w", err)
+	}
+
+	// Open file remains readable and writable after it is removed.
+	err = os.Remove(file.Name())
+	var n int
+	if err == nil {
+		n, err = file.Write(b.memory.Bytes())
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("error writing spill file: %w", err)
+	}
+
+	b.file = file
+	b.fileSize = n
+	// Replacing the buffer releases its memory, which Reset would keep for reuse.
+	b.memory = bytes.Buffer{}
+	return nil
+}
+
+// Getter for buffered output. Reading does not drain the buffer, so output can be read again if an
+// upload fails. The returned reader also implements [io.ReaderAt] and [io.Seeker].
+//
+// Returns:
+//   - output: Reader for buffered output
+func (b *spillBuffer) reader() io.Reader {
+	if b.file == nil {
+		return bytes.NewReader(b.memory.Bytes())
+	}
+	return io.NewSectionReader(b.file, 0, int64(b.fileSize))
+}
+
+// Getter for size of buffered output.
+//
+// Returns:
+//   - size: Bytes buffered
+func (b *spillBuffer) len() int {
+	if b.file == nil {
+		return b.memory.Len()
+	}
+	return b.fileSize
+}
+
+// Getter for size of output held in memory.
+//
+// Returns:
+//   - size: Bytes held in memory, 0 if spilled
+func (b *spillBuffer) memorySize() int {
+	if b.file != nil {
+		return 0
+	}
+	return b.memory.Len()
+}
+
+// Empties the buffer. A spilled buffer returns to memory and its file is closed.
+//
+// Returns:
+//   - err: Error closing file
+func (b *spillBuffer) reset() error {
+	b.memory.Reset()
+	b.fileSize = 0
+	return b.close()
+}
+
+// Closes the file of a spilled buffer.
+//
+// Returns:
+//   - err: Error closing file
+func (b *spillBuffer) close() error {
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	if err != nil {
+		return fmt.Errorf("error closing spill file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,703 @@
+package irzstd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/y-scope/clp-ffi-go/ffi"
+)
+
+// Constants of CLP's unstructured IR protocol with eight-byte encoding. Values match
+// ffi/ir_stream/protocol_constants.hpp in CLP.
+const (
+	metadataEncodingJson = 0x1
+	metadataLengthUByte  = 0x11
+	metadataLengthUShort = 0x12
+
+	varStrLenUByte       = 0x11
+	varStrLenUShort      = 0x12
+	varStrLenInt         = 0x13
+	varEightByteEncoding = 0x19
+	logtypeStrLenUByte   = 0x21
+	logtypeStrLenUShort  = 0x22
+	logtypeStrLenInt     = 0x23
+	timestampVal         = 0x30
+
+	placeholderInteger    = 0x11
+	placeholderDictionary = 0x12
+	placeholderFloat      = 0x13
+	placeholderEscape     = '\\'
+
+	// Unstructured IR protocol version. KV-IR streams have version 0.1.0 or later.
+	unstructuredVersion = "0.0.1"
+	// Eight-byte encoded floats have at most 16 digits stored in 54 bits.
+	maxFloatDigits     = 16
+	floatDigitsBitMask = 1<<54 - 1
+)
+
+// Magic number at the start of IR streams with eight-byte encoding.
+var eightByteEncodingMagicNumber = []byte{0xfd, 0x2f, 0xb5, 0x30}
+
+// Key of auto-generated pair holding the timestamp of decoded unstructured events.
+const UnstructuredTimestampKey = "timestamp"
+
+// Key of decoded unstructured messages if the stream does not record the message key.
+const defaultMessageKey = "message"
+
+// Metadata of an unstructured IR stream. The message key is kept as user-defined metadata so
+// decoded events have the key of the original records.
+type unstructuredMetadata struct {
+	Version                string                   `json:"VERSION"`
+	TimestampPattern       string                   `json:"TIMESTAMP_PATTERN"`
+	TimestampPatternSyntax string                   `json:"TIMESTAMP_PATTERN_SYNTAX"`
+	TimeZoneId             string                   `json:"TZ_ID"`
+	UserDefinedMetadata    unstructuredUserMetadata `json:"USER_DEFINED_METADATA"`
+}
+
+type unstructuredUserMetadata struct {
+	MessageKey string `json:"message_key,omitempty"`
+}
+
+// Encodes log events as CLP unstructured log messages using eight-byte encoding. The value of the
+// message key is CLP-encoded: variables such as numbers and IDs are extracted from the message and
+// the remaining text becomes the logtype, so messages compress and search like CLP unstructured
+// logs. Other keys of the record are not stored. Each event has an absolute timestamp, so a stream
+// continued after recovery does not depend on the timestamp of the previous event.
+type unstructuredEncoder struct {
+	writer     io.Writer
+	messageKey string
+	buf        bytes.Buffer
+	logtype    []byte
+}
+
+// Opens a new [unstructuredEncoder] and writes the IR preamble.
+//
+// Parameters:
+//   - w: Destination of IR stream
+//   - messageKey: Key of the message in records
+//
+// Returns:
+//   - encoder: Encoder for unstructured IR
+//   - err: Error marshalling metadata, error writing preamble
+func newUnstructuredEncoder(w io.Writer, messageKey string) (*unstructuredEncoder, error) {
+	metadata, err := json.Marshal(unstructuredMetadata{
+		Version:             unstructuredVersion,
+		TimestampPattern:    "%Y-%m-%d %H:%M:%S,%3",
+		TimeZoneId:          "UTC",
+		UserDefinedMetadata: unstructuredUserMetadata{MessageKey: messageKey},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling IR metadata: %w", err)
+	}
+	if len(metadata) > math.MaxUint16 {
+		return nil, fmt.Errorf("error IR metadata is %d bytes", len(metadata))
+	}
+
+	e := unstructuredEncoder{writer: w, messageKey: messageKey}
+	e.buf.Write(eightByteEncodingMagicNumber)
+	e.buf.WriteByte(metadataEncodingJson)
+	if len(metadata) <= math.MaxUint8 {
+		e.buf.WriteByte(metadataLengthUByte)
+		e.buf.WriteByte(byte(len(metadata)))
+	} else {
+		e.buf.WriteByte(metadataLengthUShort)
+		e.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(metadata))))
+	}
+	e.buf.Write(metadata)
+	if _, err := w.Write(e.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// Encodes the message of a log event with its Fluent Bit timestamp.
+//
+// Parameters:
+//   - event: Log event
+//
+// Returns:
+//   - numBytes: IR bytes written
+//   - err: Error writing IR
+func (e *unstructuredEncoder) WriteLogEvent(event LogEvent) (int, error) {
+	e.buf.Reset()
+	e.logtype = e.logtype[:0]
+	e.encodeMessage(unstructuredMessage(event.UserKvPairs, e.messageKey))
+	writeString(&e.buf, e.logtype, logtypeStrLenUByte, logtypeStrLenUShort, logtypeStrLenInt)
+	e.buf.WriteByte(timestampVal)
+	e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(event.Timestamp.UnixMilli())))
+	return e.writer.Write(e.buf.Bytes())
+}
+
+// Adds the end of stream byte.
+//
+// Returns:
+//   - err: Error writing IR
+func (e *unstructuredEncoder) Close() error {
+	_, err := e.writer.Write([]byte{irEndOfStreamByte})
+	return err
+}
+
+// Does nothing since the encoder holds no resources. The stream is left unterminated.
+//
+// Returns:
+//   - err: nil
+func (e *unstructuredEncoder) Release() error {
+	return nil
+}
+
+// Gets the message of a record. Trailing line endings left by inputs such as tail are removed,
+// otherwise they would be appended to the last variable of the message. Records without a string
+// message are encoded as JSON, so their contents are not lost.
+//
+// Parameters:
+//   - record: Record from Fluent Bit
+//   - messageKey: Key of the message in record
+//
+// Returns:
+//   - message: Message to encode
+func unstructuredMessage(record map[string]any, messageKey string) string {
+	if message, ok := record[messageKey].(string); ok {
+		message = strings.TrimSuffix(message, "\n")
+		return strings.TrimSuffix(message, "\r")
+	}
+	message, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Sprint(record)
+	}
+	return string(message)
+}
+
+// Splits a message into variables and a logtype the way CLP does. Variables are written to the
+// buffer in order of appearance, and the logtype is the message with each variable replaced by a
+// placeholder.
+//
+// Parameters:
+//   - message: Message to encode
+func (e *unstructuredEncoder) encodeMessage(message string) {
+	constantBegin := 0
+	for {
+		varBegin, varEnd := nextVariable(message, constantBegin)
+		if varBegin == len(message) {
+			break
+		}
+		e.appendConstant(message[constantBegin:varBegin])
+		constantBegin = varEnd
+
+		token := message[varBegin:varEnd]
+		if encoded, ok := encodeFloat(token); ok {
+			e.logtype = append(e.logtype, placeholderFloat)
+			e.buf.WriteByte(varEightByteEncoding)
+			e.buf.Write(binary.BigEndian.AppendUint64(nil, encoded))
+		} else if encoded, ok := encodeInteger(token); ok {
+			e.logtype = append(e.logtype, placeholderInteger)
+			e.buf.WriteByte(varEightByteEncoding)
+			e.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(encoded)))
+		} else {
+			e.logtype = append(e.logtype, placeholderDictionary)
+			writeString(&e.buf, []byte(token), varStrLenUByte, varStrLenUShort, varStrLenInt)
+		}
+	}
+	e.appendConstant(message[constantBegin:])
+}
+
+// Appends constant text to the logtype. Placeholder and escape characters in the text are escaped.
+//
+// Parameters:
+//   - constant: Text between variables
+func (e *unstructuredEncoder) appendConstant(constant string) {
+	for i := 0; i < len(constant); i++ {
+		c := constant[i]
+		if isPlaceholder(c) {
+			e.logtype = append(e.logtype, placeholderEscape)
+		}
+		e.logtype = append(e.logtype, c)
+	}
+}
+
+// Finds the next variable in a message. Tokens are separated by delimiters. A token is a variable
+// if it contains a decimal digit, if it follows '=' and contains a letter, or if it could be a
+// multi-digit hexadecimal value.
+//
+// Parameters:
+//   - message: Message to search
+//   - begin: Position to start searching from
+//
+// Returns:
+//   - varBegin: Start of variable, len(message) if there are no more variables
+//   - varEnd: End of variable
+func nextVariable(message string, begin int) (int, int) {
+	for {
+		for begin < len(message) && isDelimiter(message[begin]) {
+			begin++
+		}
+		if begin == len(message) {
+			return len(message), len(message)
+		}
+		end := begin
+		for end < len(message) && !isDelimiter(message[end]) {
+			end++
+		}
+
+		token := message[begin:end]
+		if strings.ContainsAny(token, "0123456789") ||
+			(begin > 0 && message[begin-1] == '=' && containsLetter(token)) ||
+			couldBeMultiDigitHex(token) {
+			return begin, end
+		}
+		begin = end
+	}
+}
+
+// Checks if a character separates tokens of a message.
+func isDelimiter(c byte) bool {
+	return !(c == '+' || c == '-' || c == '.' || ('0' <= c && c <= '9') ||
+		('A' <= c && c <= 'Z') || c == '\\' || c == '_' || ('a' <= c && c <= 'z'))
+}
+
+// Checks if a character has to be escaped in a logtype.
+func isPlaceholder(c byte) bool {
+	return c == placeholderInteger || c == placeholderDictionary || c == placeholderFloat ||
+		c == placeholderEscape
+}
+
+// Checks if a token contains an ASCII letter.
+func containsLetter(token string) bool {
+	for i := 0; i < len(token); i++ {
+		if c := token[i] | 0x20; 'a' <= c && c <= 'z' {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a token has at least two characters which are all hexadecimal digits.
+func couldBeMultiDigitHex(token string) bool {
+	if len(token) < 2 {
+		return false
+	}
+	for i := 0; i < len(token); i++ {
+		c := token[i]
+		if !(('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encodes a token as an eight-byte integer if it is decoded to the same text.
+//
+// Parameters:
+//   - token: Variable token
+//
+// Returns:
+//   - encoded: Integer value
+//   - ok: Whether the token is an integer
+func encodeInteger(token string) (int64, bool) {
+	value, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || strconv.FormatInt(value, 10) != token {
+		return 0, false
+	}
+	return value, true
+}
+
+// Encodes a token as an eight-byte float if it is a decimal number decoded to the same text. The
+// encoding has 1 bit for the sign, 1 unused bit, 54 bits for the digits, 4 bits for the number of
+// digits minus 1, and 4 bits for the number of digits after the decimal point minus 1.
+//
+// Parameters:
+//   - token: Variable token
+//
+// Returns:
+//   - encoded: Encoded float
+//   - ok: Whether the token is a float
+func encodeFloat(token string) (uint64, bool) {
+	negative := strings.HasPrefix(token, "-")
+	integerPart, fractionPart, found := strings.Cut(strings.TrimPrefix(token, "-"), ".")
+	if !found || integerPart == "" || fractionPart == "" {
+		return 0, false
+	}
+	digitsText := integerPart + fractionPart
+	if len(digitsText) > maxFloatDigits {
+		return 0, false
+	}
+	var digits uint64
+	for i := 0; i < len(digitsText); i++ {
+		c := digitsText[i]
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		digits = digits*10 + uint64(c-'0')
+	}
+	if digits > floatDigitsBitMask {
+		return 0, false
+	}
+
+	var encoded uint64
+	if negative {
+		encoded = 1
+	}
+	encoded <<= 55
+	encoded |= digits
+	encoded <<= 4
+	encoded |= uint64(len(digitsText)-1) & 0xf
+	encoded <<= 4
+	encoded |= uint64(len(fractionPart)-1) & 0xf
+	return encoded, true
+}
+
+// Decodes a float encoded by [encodeFloat].
+//
+// Parameters:
+//   - encoded: Encoded float
+//
+// Returns:
+//   - token: Text of the float
+func decodeFloat(encoded uint64) string {
+	numFractionDigits := int(encoded&0xf) + 1
+	numDigits := int((encoded>>4)&0xf) + 1
+	digits := (encoded >> 8) & floatDigitsBitMask
+	text := fmt.Sprintf("%0*d", numDigits, digits)
+	text = text[:len(text)-numFractionDigits] + "." + text[len(text)-numFractionDigits:]
+	if encoded>>63 == 1 {
+		text = "-" + text
+	}
+	return text
+}
+
+// Writes a string prefixed with a tag for the smallest length that fits.
+//
+// Parameters:
+//   - buf: Destination
+//   - value: String to write
+//   - tagUByte: Tag of strings with a one-byte length
+//   - tagUShort: Tag of strings with a two-byte length
+//   - tagInt: Tag of strings with a four-byte length
+func writeString(buf *bytes.Buffer, value []byte, tagUByte byte, tagUShort byte, tagInt byte) {
+	switch {
+	case len(value) <= math.MaxUint8:
+		buf.WriteByte(tagUByte)
+		buf.WriteByte(byte(len(value)))
+	case len(value) <= math.MaxUint16:
+		buf.WriteByte(tagUShort)
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(value))))
+	default:
+		buf.WriteByte(tagInt)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(value))))
+	}
+	buf.Write(value)
+}
+
+// Checks if IR starts with the preamble of an unstructured IR stream with eight-byte encoding.
+//
+// Parameters:
+//   - r: Uncompressed IR
+//
+// Returns:
+//   - unstructured: Whether the stream is unstructured IR
+func isUnstructured(r *bufio.Reader) bool {
+	preamble, err := r.Peek(len(eightByteEncodingMagicNumber) + 2)
+	if err != nil || !bytes.Equal(preamble[:4], eightByteEncodingMagicNumber) ||
+		preamble[4] != metadataEncodingJson {
+		return false
+	}
+
+	headerSize := len(preamble)
+	var metadataSize int
+	switch preamble[5] {
+	case metadataLengthUByte:
+		header, err := r.Peek(headerSize + 1)
+		if err != nil {
+			return false
+		}
+		metadataSize = int(header[headerSize])
+		headerSize += 1
+	case metadataLengthUShort:
+		header, err := r.Peek(headerSize + 2)
+		if err != nil {
+			return false
+		}
+		metadataSize = int(binary.BigEndian.Uint16(header[headerSize:]))
+		headerSize += 2
+	default:
+		return false
+	}
+
+	header, err := r.Peek(headerSize + metadataSize)
+	if err != nil {
+		return false
+	}
+	var metadata unstructuredMetadata
+	if json.Unmarshal(header[headerSize:], &metadata) != nil {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimPrefix(metadata.Version, "v"), "0.0.")
+}
+
+// Decodes log events of an unstructured IR stream written by [unstructuredEncoder]. Each event has
+// the message under the message key of the stream and the timestamp under
+// [UnstructuredTimestampKey].
+type unstructuredDecoder struct {
+	reader     *bufio.Reader
+	messageKey string
+}
+
+// Opens a new [unstructuredDecoder] and reads the IR preamble.
+//
+// Parameters:
+//   - r: Uncompressed unstructured IR
+//
+// Returns:
+//   - decoder: Decoder for unstructured IR
+//   - err: Error reading preamble
+func newUnstructuredDecoder(r *bufio.Reader) (*unstructuredDecoder, error) {
+	if _, err := r.Discard(len(eightByteEncodingMagicNumber) + 1); err != nil {
+		return nil, err
+	}
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	metadataSize, err := readLength(r, tag, metadataLengthUByte, metadataLengthUShort, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata := make([]byte, metadataSize)
+	if _, err := io.ReadFull(r, metadata); err != nil {
+		return nil, err
+	}
+	var parsed unstructuredMetadata
+	if err := json.Unmarshal(metadata, &parsed); err != nil {
+		return nil, fmt.Errorf("error parsing IR metadata: %w", err)
+	}
+
+	messageKey := parsed.UserDefinedMetadata.MessageKey
+	if messageKey == "" {
+		messageKey = defaultMessageKey
+	}
+	return &unstructuredDecoder{reader: r, messageKey: messageKey}, nil
+}
+
+// Reads the next log event.
+//
+// Returns:
+//   - event: Next log event
+//   - err: [io.EOF] at end of stream, [io.ErrUnexpectedEOF] if input is truncated, error decoding
+//     IR
+func (d *unstructuredDecoder) Read() (*ffi.LogEvent, error) {
+	var encodedVars []uint64
+	var dictionaryVars []string
+	for {
+		tag, err := d.reader.ReadByte()
+		if err != nil {
+			return nil, truncatedEvent(err)
+		}
+
+		switch tag {
+		case irEndOfStreamByte:
+			return nil, io.EOF
+		case varEightByteEncoding:
+			var encoded [8]byte
+			if _, err := io.ReadFull(d.reader, encoded[:]); err != nil {
+				return nil, truncatedEvent(err)
+			}
+			encodedVars = append(encodedVars, binary.BigEndian.Uint64(encoded[:]))
+		case varStrLenUByte, varStrLenUShort, varStrLenInt:
+			value, err := d.readString(tag, varStrLenUByte, varStrLenUShort, varStrLenInt)
+			if err != nil {
+				return nil, err
+			}
+			dictionaryVars = append(dictionaryVars, string(value))
+		case logtypeStrLenUByte, logtypeStrLenUShort, logtypeStrLenInt:
+			logtype, err := d.readString(
+				tag,
+				logtypeStrLenUByte,
+				logtypeStrLenUShort,
+				logtypeStrLenInt,
+			)
+			if err != nil {
+				return nil, err
+			}
+			return d.readTimestamp(logtype, encodedVars, dictionaryVars)
+		default:
+			return nil, fmt.Errorf("error unexpected IR tag %#x", tag)
+		}
+	}
+}
+
+// Reads the timestamp following a logtype and creates the log event.
+//
+// Parameters:
+//   - logtype: Logtype of the message
+//   - encodedVars: Encoded variables of the message in order
+//   - dictionaryVars: Dictionary variables of the message in order
+//
+// Returns:
+//   - event: Log event
+//   - err: Error reading timestamp, error decoding message
+func (d *unstructuredDecoder) readTimestamp(
+	logtype []byte,
+	encodedVars []uint64,
+	dictionaryVars []string,
+) (*ffi.LogEvent, error) {
+	tag, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, truncatedEvent(err)
+	}
+	if tag != timestampVal {
+		return nil, fmt.Errorf("error expected IR timestamp, got tag %#x", tag)
+	}
+	var timestamp [8]byte
+	if _, err := io.ReadFull(d.reader, timestamp[:]); err != nil {
+		return nil, truncatedEvent(err)
+	}
+
+	message, err := decodeMessage(logtype, encodedVars, dictionaryVars)
+	if err != nil {
+		return nil, err
+	}
+	return &ffi.LogEvent{
+		AutoKvPairs: map[string]any{
+			UnstructuredTimestampKey: int64(binary.BigEndian.Uint64(timestamp[:])),
+		},
+		UserKvPairs: map[string]any{d.messageKey: message},
+	}, nil
+}
+
+// Reads a string prefixed with its length.
+//
+// Parameters:
+//   - tag: Tag read before the length
+//   - tagUByte: Tag of strings with a one-byte length
+//   - tagUShort: Tag of strings with a two-byte length
+//   - tagInt: Tag of strings with a four-byte length
+//
+// Returns:
+//   - value: String
+//   - err: Error reading IR
+func (d *unstructuredDecoder) readString(
+	tag byte,
+	tagUByte byte,
+	tagUShort byte,
+	tagInt byte,
+) ([]byte, error) {
+	length, err := readLength(d.reader, tag, tagUByte, tagUShort, tagInt)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(d.reader, value); err != nil {
+		return nil, truncatedEvent(err)
+	}
+	return value, nil
+}
+
+// Closes [unstructuredDecoder]. Does nothing since the decoder holds no resources.
+//
+// Returns:
+//   - err: nil
+func (d *unstructuredDecoder) Close() error {
+	return nil
+}
+
+// Reads a length of the size given by its tag.
+//
+// Parameters:
+//   - r: IR
+//   - tag: Tag read before the length
+//   - tagUByte: Tag of one-byte lengths
+//   - tagUShort: Tag of two-byte lengths
+//   - tagInt: Tag of four-byte lengths, 0 if not allowed
+//
+// Returns:
+//   - length: Length
+//   - err: Error reading IR, error unexpected tag
+func readLength(
+	r *bufio.Reader,
+	tag byte,
+	tagUByte byte,
+	tagUShort byte,
+	tagInt byte,
+) (int, error) {
+	var size int
+	switch {
+	case tag == tagUByte:
+		size = 1
+	case tag == tagUShort:
+		size = 2
+	case tagInt != 0 && tag == tagInt:
+		size = 4
+	default:
+		return 0, fmt.Errorf("error unexpected IR length tag %#x", tag)
+	}
+
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[4-size:]); err != nil {
+		return 0, truncatedEvent(err)
+	}
+	return int(binary.BigEndian.Uint32(length[:])), nil
+}
+
+// Replaces the message placeholders of a logtype with variables.
+//
+// Parameters:
+//   - logtype: Logtype of the message
+//   - encodedVars: Encoded variables of the message in order
+//   - dictionaryVars: Dictionary variables of the message in order
+//
+// Returns:
+//   - message: Decoded message
+//   - err: Error logtype has more placeholders than variables
+func decodeMessage(logtype []byte, encodedVars []uint64, dictionaryVars []string) (string, error) {
+	errMissingVar := errors.New("error IR logtype has more placeholders than variables")
+	var message strings.Builder
+	for i := 0; i < len(logtype); i++ {
+		switch c := logtype[i]; c {
+		case placeholderEscape:
+			i++
+			if i < len(logtype) {
+				message.WriteByte(logtype[i])
+			}
+		case placeholderInteger, placeholderFloat:
+			if len(encodedVars) == 0 {
+				return "", errMissingVar
+			}
+			if c == placeholderInteger {
+				message.WriteString(strconv.FormatInt(int64(encodedVars[0]), 10))
+			} else {
+				message.WriteString(decodeFloat(encodedVars[0]))
+			}
+			encodedVars = encodedVars[1:]
+		case placeholderDictionary:
+			if len(dictionaryVars) == 0 {
+				return "", errMissingVar
+			}
+			message.WriteString(dictionaryVars[0])
+			dictionaryVars = dictionaryVars[1:]
+		default:
+			message.WriteByte(c)
+		}
+	}
+	return message.String(), nil
+}
+
+// Converts [io.EOF] into [io.ErrUnexpectedEOF] since input ended before the end of stream byte.
+//
+// Parameters:
+//   - err: Error reading input
+//
+// Returns:
+//   - err: Converted error
+func truncatedEvent(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
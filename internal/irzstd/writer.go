@@ -6,11 +6,28 @@ package irzstd
 import (
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/y-scope/clp-ffi-go/ffi"
 	"github.com/y-scope/clp-ffi-go/ir"
 )
 
+// Log event with the timestamp assigned by Fluent Bit. Only the embedded [ffi.LogEvent] is encoded
+// into IR. The timestamp is used to collect [Stats].
+type LogEvent struct {
+	ffi.LogEvent
+	Timestamp time.Time
+}
+
+// Statistics for log events written to a [Writer] since it was last reset. Statistics are not
+// persisted, so a recovered [Writer] only has statistics for events written after recovery.
+type Stats struct {
+	NumEvents    int
+	IrBytes      int
+	MinTimestamp time.Time
+	MaxTimestamp time.Time
+}
+
 type Writer interface {
 	// Converts log events to Zstd compressed IR and outputs to the Zstd buffer.
 	//
@@ -20,7 +37,7 @@ type Writer interface {
 	// Returns:
 	//   - numEvents: Number of log events successfully written to IR writer buffer
 	//   - err
-	WriteIrZstd([]ffi.LogEvent) (int, error)
+	WriteIrZstd([]LogEvent) (int, error)
 
 	// Closes IR stream and Zstd frame. After calling close, Writer must be Reset() prior to calling
 	// write.
@@ -66,29 +83,153 @@ type Writer interface {
 	//   - empty: Boolean value that is true if buffer is empty
 	//   - err
 	Empty() (bool, error)
+
+	// Getter for statistics of buffered events.
+	//
+	// Returns:
+	//   - stats: Statistics since the last reset
+	GetStats() Stats
+}
+
+// Writer which buffers Zstd output in memory and can move it to disk to limit memory use or to make
+// it durable.
+type SpillWriter interface {
+	Writer
+
+	// Moves Zstd output to a temporary file. Subsequent output is appended to the file until the
+	// writer is reset.
+	//
+	// Parameters:
+	//   - dir: Directory of the temporary file
+	//
+	// Returns:
+	//   - err
+	Spill(dir string) error
+
+	// Get size of Zstd output held in memory.
+	//
+	// Returns:
+	//   - size: Bytes held in memory, 0 if output was spilled
+	GetMemorySize() int
+
+	// Moves buffered events to disk buffer files. The returned writer continues the buffer, and
+	// this writer must not be used afterwards.
+	//
+	// Parameters:
+	//   - irPath: Path to IR disk buffer file
+	//   - zstdPath: Path to Zstd disk buffer file
+	//   - cipher: Cipher to encrypt buffers, nil to write buffers without encryption
+	//
+	// Returns:
+	//   - writer: Disk writer continuing the buffer
+	//   - err
+	Persist(irPath string, zstdPath string, cipher *Cipher) (Writer, error)
 }
 
-// Writes log events to a IR Writer.
+// Encodes log events into an IR stream.
+type irEncoder interface {
+	// Encodes a log event.
+	//
+	// Parameters:
+	//   - event: Log event
+	//
+	// Returns:
+	//   - numBytes: IR bytes written
+	//   - err
+	WriteLogEvent(event LogEvent) (int, error)
+
+	// Adds the end of stream byte and frees resources.
+	//
+	// Returns:
+	//   - err
+	Close() error
+
+	// Frees resources without adding the end of stream byte.
+	//
+	// Returns:
+	//   - err
+	Release() error
+}
+
+// Encodes log events as KV-IR records with [ir.Writer].
+type kvIrEncoder struct {
+	writer *ir.Writer
+}
+
+func (e kvIrEncoder) WriteLogEvent(event LogEvent) (int, error) {
+	return e.writer.WriteLogEvent(event.LogEvent)
+}
+
+func (e kvIrEncoder) Close() error {
+	return e.writer.Close()
+}
+
+func (e kvIrEncoder) Release() error {
+	return e.writer.Serializer.Close()
+}
+
+// Opens an encoder writing a new IR stream. Records are encoded as KV-IR, or their messages are
+// encoded as CLP unstructured IR if a message key is given.
 //
 // Parameters:
-//   - irWriter: CLP IR writer to write each log event with
+//   - w: Destination of IR stream
+//   - messageKey: Key of the message written as unstructured IR, empty to write KV-IR
+//
+// Returns:
+//   - encoder: IR encoder
+//   - err: Error writing preamble
+func newIrEncoder(w io.Writer, messageKey string) (irEncoder, error) {
+	if messageKey != "" {
+		return newUnstructuredEncoder(w, messageKey)
+	}
+	irWriter, err := ir.NewWriter[ir.FourByteEncoding](w)
+	if err != nil {
+		return nil, err
+	}
+	return kvIrEncoder{writer: irWriter}, nil
+}
+
+// Writes log events to an IR encoder and updates statistics with the events written.
+//
+// Parameters:
+//   - irWriter: IR encoder to write each log event with
 //   - logEvents: A slice of log events to be encoded
+//   - stats: Statistics to update
 //
 // Returns:
 //   - numBytes: Total IR bytes written for the batch
 //   - numEvents: Number of log events successfully written to IR writer buffer
 //   - err: Error if an event could not be written
-func writeIr(irWriter *ir.Writer, logEvents []ffi.LogEvent) (int, int, error) {
+func writeIr(irWriter irEncoder, logEvents []LogEvent, stats *Stats) (int, int, error) {
 	var numEvents int
 	var numBytes int
 	for _, event := range logEvents {
 		n, err := irWriter.WriteLogEvent(event)
 		numBytes += n
+		stats.IrBytes += n
 		if err != nil {
-			err = fmt.Errorf("failed to encode event %v into ir: %w", event, err)
+			err = fmt.Errorf("failed to encode event %v into ir: %w", event.LogEvent, err)
 			return numBytes, numEvents, err
 		}
 		numEvents += 1
+		stats.add(event.Timestamp)
 	}
 	return numBytes, numEvents, nil
 }
+
+// Adds an event to statistics.
+//
+// Parameters:
+//   - timestamp: Timestamp of the event
+func (s *Stats) add(timestamp time.Time) {
+	s.NumEvents += 1
+	if timestamp.IsZero() {
+		return
+	}
+	if s.MinTimestamp.IsZero() || timestamp.Before(s.MinTimestamp) {
+		s.MinTimestamp = timestamp
+	}
+	if timestamp.After(s.MaxTimestamp) {
+		s.MaxTimestamp = timestamp
+	}
+}
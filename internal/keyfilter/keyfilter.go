@@ -0,0 +1,308 @@
+// Package implements filtering and renaming of record keys before records are encoded as KV-IR.
+// Filtering in the output plugin avoids the extra copies of Fluent Bit filters, which run in C
+// before records are buffered.
+//
+// Options are lists separated by commas. Nested keys are addressed with paths separated by dots
+// (e.g. "kubernetes.annotations"). Keys containing a comma, dot, colon, or backslash can be
+// addressed by escaping the character with a backslash (e.g. "app\.kubernetes\.io/name"). Arrays
+// are not traversed.
+package keyfilter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Path of a key in nested maps. Each element is a key in the map at that depth.
+type path []string
+
+// Moves the value at one path to another.
+type rename struct {
+	from path
+	to   path
+}
+
+// Filters and renames record keys. Keys are included, then excluded, then renamed.
+type Filter struct {
+	include []path
+	exclude []path
+	rename  []rename
+}
+
+// Creates a new filter. Returns a nil filter if no options are set.
+//
+// Parameters:
+//   - includeKeys: Paths of keys to keep. If empty, all keys are kept.
+//   - excludeKeys: Paths of keys to remove
+//   - renameKeys: Pairs of paths separated by a colon (e.g. "kubernetes.pod_name:pod")
+//
+// Returns:
+//   - filter: Filter, nil if no options are set
+//   - err: Error parsing options
+func New(includeKeys string, excludeKeys string, renameKeys string) (*Filter, error) {
+	var filter Filter
+	var err error
+
+	filter.include, err = parsePaths(includeKeys)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing include keys: %w", err)
+	}
+
+	filter.exclude, err = parsePaths(excludeKeys)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing exclude keys: %w", err)
+	}
+
+	for _, pair := range splitEscaped(renameKeys, ',') {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		paths := splitEscaped(pair, ':')
+		if len(paths) != 2 {
+			return nil, fmt.Errorf("error parsing rename %q, expected format from:to", pair)
+		}
+		from, err := parsePath(paths[0])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rename %q: %w", pair, err)
+		}
+		to, err := parsePath(paths[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing rename %q: %w", pair, err)
+		}
+		if hasPrefix(to, from) {
+			return nil, fmt.Errorf("error parsing rename %q, cannot move key into itself", pair)
+		}
+		filter.rename = append(filter.rename, rename{from: from, to: to})
+	}
+
+	if filter.include == nil && filter.exclude == nil && filter.rename == nil {
+		return nil, nil
+	}
+	return &filter, nil
+}
+
+// Applies filter to record. Record may be modified.
+//
+// Parameters:
+//   - record: Record from Fluent Bit
+//
+// Returns:
+//   - filtered: Filtered record
+func (filter *Filter) Apply(record map[string]any) map[string]any {
+	if filter == nil {
+		return record
+	}
+
+	if filter.include != nil {
+		included := make(map[string]any)
+		for _, p := range filter.include {
+			if value, ok := get(record, p); ok {
+				set(included, p, value)
+			}
+		}
+		record = included
+	}
+
+	for _, p := range filter.exclude {
+		remove(record, p)
+	}
+
+	for _, r := range filter.rename {
+		value, ok := get(record, r.from)
+		if !ok {
+			continue
+		}
+		if set(record, r.to, value) {
+			remove(record, r.from)
+		}
+	}
+
+	return record
+}
+
+// Retrieves value at path.
+//
+// Parameters:
+//   - record: Record
+//   - p: Path
+//
+// Returns:
+//   - value: Value at path
+//   - ok: Whether path exists
+func get(record map[string]any, p path) (any, bool) {
+	m := record
+	for _, key := range p[:len(p)-1] {
+		child, ok := m[key].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		m = child
+	}
+	value, ok := m[p[len(p)-1]]
+	return value, ok
+}
+
+// Sets value at path, creating intermediate maps if they do not exist.
+//
+// Parameters:
+//   - record: Record
+//   - p: Path
+//   - value: Value to set
+//
+// Returns:
+//   - ok: False if an intermediate key exists and is not a map
+func set(record map[string]any, p path, value any) bool {
+	m := record
+	for _, key := range p[:len(p)-1] {
+		existing, exists := m[key]
+		if !exists {
+			child := make(map[string]any)
+			m[key] = child
+			m = child
+			continue
+		}
+		child, ok := existing.(map[string]any)
+		if !ok {
+			return false
+		}
+		m = child
+	}
+	m[p[len(p)-1]] = value
+	return true
+}
+
+// Removes key at path if it exists.
+//
+// Parameters:
+//   - record: Record
+//   - p: Path
+func remove(record map[string]any, p path) {
+	m := record
+	for _, key := range p[:len(p)-1] {
+		child, ok := m[key].(map[string]any)
+		if !ok {
+			return
+		}
+		m = child
+	}
+	delete(m, p[len(p)-1])
+}
+
+// Checks whether path starts with prefix.
+//
+// Parameters:
+//   - p: Path
+//   - prefix: Prefix
+//
+// Returns:
+//   - hasPrefix: Whether path starts with prefix
+func hasPrefix(p path, prefix path) bool {
+	if len(prefix) > len(p) {
+		return false
+	}
+	for i := range prefix {
+		if p[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses list of paths separated by commas.
+//
+// Parameters:
+//   - s: List of paths
+//
+// Returns:
+//   - paths: Parsed paths, nil if list is empty
+//   - err: Error parsing path
+func parsePaths(s string) ([]path, error) {
+	var paths []path
+	for _, item := range splitEscaped(s, ',') {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		p, err := parsePath(item)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, p)
+	}
+	return paths, nil
+}
+
+// Parses path separated by dots. Surrounding whitespace is removed.
+//
+// Parameters:
+//   - s: Path
+//
+// Returns:
+//   - path: Parsed path
+//   - err: Error if path or a key in path is empty, error unescaping key
+func parsePath(s string) (path, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty path")
+	}
+
+	var p path
+	for _, escapedKey := range splitEscaped(s, '.') {
+		key, err := unescape(escapedKey)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing path %q: %w", s, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("error parsing path %q: empty key", s)
+		}
+		p = append(p, key)
+	}
+	return p, nil
+}
+
+// Splits string on separator unless separator is escaped with a backslash. Escape sequences are
+// kept so parts can be split again.
+//
+// Parameters:
+//   - s: String to split
+//   - sep: Separator
+//
+// Returns:
+//   - parts: Parts of string
+func splitEscaped(s string, sep byte) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			// Skip escaped character.
+			i++
+		case sep:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Removes escape backslashes from string.
+//
+// Parameters:
+//   - s: Escaped string
+//
+// Returns:
+//   - unescaped: Unescaped string
+//   - err: Error if string ends with an unescaped backslash
+func unescape(s string) (string, error) {
+	var builder strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			if i == len(s) {
+				return "", errors.New("trailing backslash")
+			}
+		}
+		builder.WriteByte(s[i])
+	}
+	return builder.String(), nil
+}
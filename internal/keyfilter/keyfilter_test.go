@@ -0,0 +1,132 @@
+package keyfilter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testRecord() map[string]any {
+	return map[string]any{
+		"log": "hello",
+		"kubernetes": map[string]any{
+			"pod_name": "app-1",
+			"labels":   map[string]any{"app": "web"},
+			"annotations": map[string]any{
+				"kubectl.kubernetes.io/restartedAt": "2024-01-01",
+			},
+		},
+		"app.kubernetes.io/name": "web",
+		"list":                   []any{map[string]any{"a": int64(1)}},
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := map[string]struct {
+		include  string
+		exclude  string
+		rename   string
+		expected map[string]any
+	}{
+		"include": {
+			include: "log, kubernetes.labels.app, missing, kubernetes.missing.key",
+			expected: map[string]any{
+				"log":        "hello",
+				"kubernetes": map[string]any{"labels": map[string]any{"app": "web"}},
+			},
+		},
+		"includeNestedAndParent": {
+			include: "kubernetes.pod_name,kubernetes",
+			expected: map[string]any{
+				"kubernetes": testRecord()["kubernetes"],
+			},
+		},
+		"exclude": {
+			exclude: "kubernetes.annotations,list,log.not_a_map,missing",
+			expected: map[string]any{
+				"log": "hello",
+				"kubernetes": map[string]any{
+					"pod_name": "app-1",
+					"labels":   map[string]any{"app": "web"},
+				},
+				"app.kubernetes.io/name": "web",
+			},
+		},
+		"escapedKey": {
+			include:  `app\.kubernetes\.io/name`,
+			expected: map[string]any{"app.kubernetes.io/name": "web"},
+		},
+		"rename": {
+			include: "log,kubernetes.pod_name",
+			rename:  "kubernetes.pod_name:pod, log:message.text, missing:other",
+			expected: map[string]any{
+				"message":    map[string]any{"text": "hello"},
+				"pod":        "app-1",
+				"kubernetes": map[string]any{},
+			},
+		},
+		"renameOntoNonMap": {
+			include: "log,kubernetes.pod_name",
+			rename:  "kubernetes.pod_name:log.pod",
+			expected: map[string]any{
+				"log":        "hello",
+				"kubernetes": map[string]any{"pod_name": "app-1"},
+			},
+		},
+		"includeThenExcludeThenRename": {
+			include: "kubernetes",
+			exclude: "kubernetes.annotations,kubernetes.labels",
+			rename:  "kubernetes:k8s",
+			expected: map[string]any{
+				"k8s": map[string]any{"pod_name": "app-1"},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filter, err := New(test.include, test.exclude, test.rename)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			filtered := filter.Apply(testRecord())
+			if !reflect.DeepEqual(filtered, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, filtered)
+			}
+		})
+	}
+}
+
+func TestNoOptions(t *testing.T) {
+	filter, err := New("", " , ", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if filter != nil {
+		t.Fatalf("expected nil filter, got %v", filter)
+	}
+	if filtered := filter.Apply(testRecord()); !reflect.DeepEqual(filtered, testRecord()) {
+		t.Errorf("expected unchanged record, got %v", filtered)
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	tests := map[string][3]string{
+		"emptyKey":          {"a..b", "", ""},
+		"leadingDot":        {"", ".a", ""},
+		"trailingBackslash": {`a\`, "", ""},
+		"renameMissingTo":   {"", "", "a"},
+		"renameEmptyTo":     {"", "", "a: "},
+		"renameThreePaths":  {"", "", "a:b:c"},
+		"renameIntoItself":  {"", "", "a:a.b"},
+		"renameToSelf":      {"", "", "a.b:a.b"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(test[0], test[1], test[2])
+			if err == nil {
+				t.Errorf("expected error for %q", test)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package outctx
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+)
+
+// Limits memory used by buffers of all event managers without disk buffers. Each listener records
+// the size of its buffer held in memory after writing events. When the total exceeds the limit,
+// the largest buffer is spilled to disk, or uploaded if it cannot be spilled. Encoder state is not
+// counted.
+type MemoryBudget struct {
+	mu    sync.Mutex
+	limit int
+	sizes map[*EventManager]int
+}
+
+// Creates a [MemoryBudget].
+//
+// Parameters:
+//   - limit: Byte limit of buffers held in memory
+//
+// Returns:
+//   - budget: Memory budget
+func NewMemoryBudget(limit int) *MemoryBudget {
+	return &MemoryBudget{
+		limit: limit,
+		sizes: make(map[*EventManager]int),
+	}
+}
+
+// Records the size of an event manager's buffer held in memory.
+//
+// Parameters:
+//   - m: Event manager
+//   - size: Bytes held in memory
+//
+// Returns:
+//   - largest: Event manager with the largest buffer if the limit is exceeded, otherwise nil
+func (b *MemoryBudget) update(m *EventManager, size int) *EventManager {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sizes[m] = size
+
+	total := 0
+	var largest *EventManager
+	for eventManager, size := range b.sizes {
+		total += size
+		if (largest == nil) || (size > b.sizes[largest]) {
+			largest = eventManager
+		}
+	}
+
+	if total <= b.limit {
+		return nil
+	}
+	return largest
+}
+
+// Records the size of the buffer held in memory after events are written or uploaded. If the
+// budget is exceeded, relieves the largest buffer. Buffers of other listeners are relieved by
+// their own listener, since writers are not safe for concurrent use.
+//
+// Parameters:
+//   - ctx: Request context of uploads
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+//   - timer: Listener buffer age timer
+func (m *EventManager) updateMemoryBudget(
+	ctx context.Context,
+	config Config,
+	uploader Uploader,
+	timer *time.Timer,
+) {
+	if m.budget == nil {
+		return
+	}
+
+	largest := m.budget.update(m, m.memorySize())
+	if largest == nil {
+		return
+	}
+	if largest == m {
+		m.relieveMemory(ctx, config, uploader, timer)
+		return
+	}
+
+	// Listener may already be signaled, in which case it has yet to relieve its buffer.
+	select {
+	case largest.relieve <- struct{}{}:
+	default:
+	}
+}
+
+// Spills the buffer to disk so it no longer counts against the memory budget. If the buffer cannot
+// be spilled, it is uploaded early instead.
+//
+// Parameters:
+//   - ctx: Request context of uploads
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+//   - timer: Listener buffer age timer
+func (m *EventManager) relieveMemory(
+	ctx context.Context,
+	config Config,
+	uploader Uploader,
+	timer *time.Timer,
+) {
+	size := m.memorySize()
+	if size == 0 {
+		return
+	}
+
+	log.Printf("Memory budget exceeded, spilling buffer of %d bytes for tag %s", size, m.Tag)
+	if spillWriter, ok := m.Writer.(irzstd.SpillWriter); ok {
+		err := spillWriter.Spill(m.spillDir)
+		if err == nil {
+			m.budget.update(m, 0)
+			return
+		}
+		log.Printf("error spilling buffer for tag %s: %v", m.Tag, err)
+	}
+
+	log.Printf("Uploading buffer for tag %s early to relieve memory", m.Tag)
+	m.upload(ctx, config, uploader)
+	m.resetBufferAge(timer, config.MaxBufferAge)
+	m.budget.update(m, m.memorySize())
+}
+
+// Getter for size of the buffer held in memory.
+//
+// Returns:
+//   - size: Bytes held in memory, 0 if the buffer is on disk
+func (m *EventManager) memorySize() int {
+	spillWriter, ok := m.Writer.(irzstd.SpillWriter)
+	if !ok {
+		return 0
+	}
+	return spillWriter.GetMemorySize()
+}
@@ -1,37 +1,211 @@
 package outctx
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
 	"reflect"
 	"strconv"
 	"strings"
 	"time"
 	"unsafe"
 
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 
 	"github.com/fluent/fluent-bit-go/output"
+
+	"github.com/y-scope/fluent-bit-clp/internal/clpcompress"
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
+	"github.com/y-scope/fluent-bit-clp/internal/httpout"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/keyfilter"
+	"github.com/y-scope/fluent-bit-clp/internal/redact"
 )
 
-// Holds settings for S3 CLP plugin from user-defined Fluent Bit configuration file.
+// Holds settings shared by all CLP output plugins from user-defined Fluent Bit configuration file.
 // The "conf" struct tags are the plugin options described to user in README, and allow user to see
 // snake case "use_disk_buffer" vs. camel case "UseDiskBuffer" in validation error messages. The
 // "validate" struct tags are rules to be consumed by [validator]. The functionality of each rule
 // can be found in docs for [validator].
 //
 //nolint:revive
+type Config struct {
+	Id                       string        `conf:"id"                         validate:"required"`
+	UseDiskBuffer            bool          `conf:"use_disk_buffer"            validate:"-"`
+	HybridBuffer             bool          `conf:"hybrid_buffer"              validate:"-"`
+	HybridBufferWatermarkMb  int           `conf:"hybrid_buffer_watermark_mb" validate:"gte=0,lt=1000"`
+	DiskBufferPath           string        `conf:"disk_buffer_path"           validate:"omitempty,dirpath"`
+	DiskBufferKeyFile        string        `conf:"disk_buffer_key_file"       validate:"omitempty,excluded_with=DiskBufferKeyEnv"`
+	DiskBufferKeyEnv         string        `conf:"disk_buffer_key_env"        validate:"-"`
+	ClientEncryptionKeyFile  string        `conf:"client_encryption_key_file" validate:"-"`
+	ObjectKeyTemplate        string        `conf:"object_key_template"        validate:"required"`
+	MaxBufferAge             time.Duration `conf:"max_buffer_age"             validate:"gt=0"`
+	UploadSizeMb             int           `conf:"upload_size_mb"             validate:"omitempty,gte=2"`
+	MemoryBudgetMb           int           `conf:"memory_budget_mb"           validate:"gte=0"`
+	UploadOnExit             bool          `conf:"upload_on_exit"             validate:"-"`
+	UploadOnExitTimeout      time.Duration `conf:"upload_on_exit_timeout"     validate:"gt=0"`
+	UploadManifest           bool          `conf:"upload_manifest"            validate:"-"`
+	ManifestInterval         time.Duration `conf:"manifest_interval"          validate:"gte=0"`
+	PreserveMalformedRecords bool          `conf:"preserve_malformed_records" validate:"-"`
+	BinaryEncoding           string        `conf:"binary_encoding"            validate:"oneof=base64 hex string"`
+	UnstructuredLogs         bool          `conf:"unstructured_logs"          validate:"-"`
+	MessageKey               string        `conf:"message_key"                validate:"required"`
+	IncludeKeys              string        `conf:"include_keys"               validate:"-"`
+	ExcludeKeys              string        `conf:"exclude_keys"               validate:"-"`
+	RenameKeys               string        `conf:"rename_keys"                validate:"-"`
+	RedactPatterns           string        `conf:"redact_patterns"            validate:"-"`
+	RedactKeys               string        `conf:"redact_keys"                validate:"-"`
+	RedactRegex              string        `conf:"redact_regex"               validate:"-"`
+	RedactMode               string        `conf:"redact_mode"                validate:"oneof=mask hash"`
+	RedactHashKey            string        `conf:"redact_hash_key"            validate:"-"`
+}
+
+// Holds settings for S3 CLP plugin from user-defined Fluent Bit configuration file.
+//
+//nolint:revive
 type S3Config struct {
-	S3Region       string        `conf:"s3_region"        validate:"required"`
-	S3Bucket       string        `conf:"s3_bucket"        validate:"required"`
-	S3BucketPrefix string        `conf:"s3_bucket_prefix" validate:"dirpath"`
-	RoleArn        string        `conf:"role_arn"         validate:"omitempty,startswith=arn:aws:iam"`
-	Id             string        `conf:"id"               validate:"required"`
-	UseDiskBuffer  bool          `conf:"use_disk_buffer"  validate:"-"`
-	DiskBufferPath string        `conf:"disk_buffer_path" validate:"omitempty,dirpath"`
-	Timeout        time.Duration `conf:"timeout"          validate:"gt=0"`
-	UploadSizeMb   int           `conf:"upload_size_mb"   validate:"omitempty,gte=2,lt=1000"`
+	Config
+	S3Region             string `conf:"s3_region"              validate:"required"`
+	S3Bucket             string `conf:"s3_bucket"              validate:"required"`
+	S3BucketPrefix       string `conf:"s3_bucket_prefix"       validate:"dirpath"`
+	RoleArn              string `conf:"role_arn"               validate:"omitempty,startswith=arn:aws:iam"`
+	S3MultipartStreaming bool   `conf:"s3_multipart_streaming" validate:"-"`
+	S3PartSizeMb         int    `conf:"s3_part_size_mb"        validate:"gte=5,lte=5120"`
+	S3UploadConcurrency  int    `conf:"s3_upload_concurrency"  validate:"gte=1,lte=100"`
+}
+
+// Holds settings for GCS CLP plugin from user-defined Fluent Bit configuration file.
+//
+//nolint:revive
+type GcsConfig struct {
+	Config
+	GcsBucket          string `conf:"gcs_bucket"           validate:"required"`
+	GcsBucketPrefix    string `conf:"gcs_bucket_prefix"    validate:"dirpath"`
+	GcsCredentialsFile string `conf:"gcs_credentials_file" validate:"omitempty,file"`
+	GcsEndpoint        string `conf:"gcs_endpoint"         validate:"omitempty,url"`
+}
+
+// Holds settings for Azure Blob Storage CLP plugin from user-defined Fluent Bit configuration file.
+// Requests are authorized with either an account key or a SAS token.
+//
+//nolint:revive
+type AzureBlobConfig struct {
+	Config
+	AzureAccountName string `conf:"azure_account_name"  validate:"required_without=AzureEndpoint,required_with=AzureAccountKey"`
+	AzureAccountKey  string `conf:"azure_account_key"   validate:"required_without=AzureSasToken,excluded_with=AzureSasToken"`
+	AzureSasToken    string `conf:"azure_sas_token"     validate:"-"`
+	AzureContainer   string `conf:"azure_container"     validate:"required"`
+	AzureBlobPrefix  string `conf:"azure_blob_prefix"   validate:"dirpath"`
+	AzureEndpoint    string `conf:"azure_endpoint"      validate:"omitempty,url"`
+	AzureBlockSizeMb int    `conf:"azure_block_size_mb" validate:"gte=1,lte=4000"`
+}
+
+// Holds settings for HTTP CLP plugin from user-defined Fluent Bit configuration file.
+//
+//nolint:revive
+type HttpConfig struct {
+	Config
+	HttpUrl         string        `conf:"http_url"           validate:"required,url"`
+	HttpMethod      string        `conf:"http_method"        validate:"oneof=POST PUT"`
+	HttpHeaders     string        `conf:"http_headers"       validate:"-"`
+	HttpBearerToken string        `conf:"http_bearer_token"  validate:"excluded_with=HttpUser"`
+	HttpUser        string        `conf:"http_user"          validate:"required_with=HttpPassword"`
+	HttpPassword    string        `conf:"http_password"      validate:"-"`
+	HttpTlsCaFile   string        `conf:"http_tls_ca_file"   validate:"omitempty,file"`
+	HttpTlsCertFile string        `conf:"http_tls_cert_file" validate:"required_with=HttpTlsKeyFile"`
+	HttpTlsKeyFile  string        `conf:"http_tls_key_file"  validate:"required_with=HttpTlsCertFile"`
+	HttpTimeout     time.Duration `conf:"http_timeout"       validate:"gt=0"`
+	HttpRetryLimit  int           `conf:"http_retry_limit"   validate:"gte=0"`
+}
+
+// Holds settings for Kafka CLP plugin from user-defined Fluent Bit configuration file.
+//
+//nolint:revive
+type KafkaConfig struct {
+	Config
+	KafkaBrokers        string        `conf:"kafka_brokers"          validate:"required"`
+	KafkaTopic          string        `conf:"kafka_topic"            validate:"required,max=249"`
+	KafkaKeyField       string        `conf:"kafka_key_field"        validate:"-"`
+	KafkaMaxRecordBytes int           `conf:"kafka_max_record_bytes" validate:"gte=1024"`
+	KafkaTimeout        time.Duration `conf:"kafka_timeout"          validate:"gt=0"`
+	KafkaRetryLimit     int           `conf:"kafka_retry_limit"      validate:"gte=0"`
+}
+
+// Holds settings for CLP package plugin from user-defined Fluent Bit configuration file.
+//
+//nolint:revive
+type ClpConfig struct {
+	Config
+	ClpPackageDir      string        `conf:"clp_package_dir"       validate:"required_without=ClpCompressCommand,excluded_with=ClpCompressCommand"`
+	ClpCompressCommand string        `conf:"clp_compress_command"  validate:"-"`
+	ClpConfigFile      string        `conf:"clp_config_file"       validate:"omitempty,file,excluded_with=ClpCompressCommand"`
+	ClpTimestampKey    string        `conf:"clp_timestamp_key"     validate:"excluded_with=ClpCompressCommand"`
+	ClpStagingDir      string        `conf:"clp_staging_dir"       validate:"required,dirpath"`
+	ClpKeepStagedFiles bool          `conf:"clp_keep_staged_files" validate:"-"`
+	ClpTimeout         time.Duration `conf:"clp_timeout"           validate:"gt=0"`
+}
+
+// Default template for object keys. Index and time keep keys unique across uploads and restarts,
+// and id keeps keys unique across collectors sending logs to the same bucket.
+const DefaultObjectKeyTemplate = "{tag}_{index}_{time}_{id}.zst"
+
+// Default size of parts of S3 multipart uploads. Matches the minimum part size allowed by S3.
+const DefaultS3PartSizeMb = int(manager.MinUploadPartSize >> 20)
+
+// Default number of parts of an S3 object uploaded in parallel.
+const DefaultS3UploadConcurrency = manager.DefaultUploadConcurrency
+
+// Upload size limit without disk buffer. Buffers are held in memory until they are uploaded.
+const maxMemoryUploadSizeMb = 1000
+
+// Maps current setting names to names used by previous versions of the plugin. Deprecated names are
+// only read if the user did not specify the current name.
+var deprecatedSettingNames = map[string]string{
+	"max_buffer_age": "timeout",
+}
+
+// DefaultConfig creates configuration with default values for settings shared by all plugins.
+// Setting defaults before validation simplifies validation configuration, and ensures that default
+// settings are also validated.
+//
+// Returns:
+//   - config: Default configuration
+func DefaultConfig() Config {
+	return Config{
+		// Default Id is uuid to safeguard against filename namespace collision. User may use
+		// multiple collectors to send logs to same path. Id is appended to filename.
+		Id:                uuid.New().String(),
+		UseDiskBuffer:     true,
+		DiskBufferPath:    "./disk_buffer/",
+		ObjectKeyTemplate: DefaultObjectKeyTemplate,
+		MaxBufferAge:      15 * time.Minute,
+		UploadSizeMb:      16,
+		// Below the default grace period of Fluent Bit, which stops the plugin after 5 seconds.
+		UploadOnExitTimeout: 4 * time.Second,
+		BinaryEncoding:      "base64",
+		MessageKey:          "log",
+		RedactMode:          redact.ModeMask,
+	}
+}
+
+// DefaultS3Config creates S3 configuration with default values. Required settings are left empty.
+//
+// Returns:
+//   - config: Default S3 configuration
+func DefaultS3Config() S3Config {
+	return S3Config{
+		Config:              DefaultConfig(),
+		S3Region:            "us-east-1",
+		S3BucketPrefix:      "logs/",
+		S3PartSizeMb:        DefaultS3PartSizeMb,
+		S3UploadConcurrency: DefaultS3UploadConcurrency,
+	}
 }
 
 // Generates configuration struct containing user-defined settings. In addition, sets default values
@@ -44,39 +218,281 @@ type S3Config struct {
 //   - S3Config: Configuration based on fluent-bit.conf
 //   - err: All validation errors in config wrapped, parse bool error
 func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
-	// Define default values for settings. Setting defaults before validation simplifies validation
-	// configuration, and ensures that default settings are also validated.
-	config := S3Config{
-		// Default Id is uuid to safeguard against s3 filename namespace collision. User may use
-		// multiple collectors to send logs to same s3 path. Id is appended to s3 filename.
-		S3Region:       "us-east-1",
-		S3BucketPrefix: "logs/",
-		Id:             uuid.New().String(),
-		UseDiskBuffer:  true,
-		DiskBufferPath: "./disk_buffer/",
-		Timeout:        15 * time.Minute,
-		UploadSizeMb:   16,
+	config := DefaultS3Config()
+
+	pluginSettings := config.settings()
+	pluginSettings["s3_region"] = &config.S3Region
+	pluginSettings["s3_bucket"] = &config.S3Bucket
+	pluginSettings["s3_bucket_prefix"] = &config.S3BucketPrefix
+	pluginSettings["role_arn"] = &config.RoleArn
+	pluginSettings["s3_multipart_streaming"] = &config.S3MultipartStreaming
+	pluginSettings["s3_part_size_mb"] = &config.S3PartSizeMb
+	pluginSettings["s3_upload_concurrency"] = &config.S3UploadConcurrency
+
+	err := loadSettings(plugin, pluginSettings)
+	if err != nil {
+		return nil, err
 	}
 
-	// Map used to loop over user inputs saving a [output.FLBPluginConfigKey] call for each key.
-	// Potential to iterate over struct using reflect; however, better to avoid reflect package.
-	pluginSettings := map[string]interface{}{
-		"s3_region":        &config.S3Region,
-		"s3_bucket":        &config.S3Bucket,
-		"s3_bucket_prefix": &config.S3BucketPrefix,
-		"role_arn":         &config.RoleArn,
-		"id":               &config.Id,
-		"use_disk_buffer":  &config.UseDiskBuffer,
-		"disk_buffer_path": &config.DiskBufferPath,
-		"timeout":          &config.Timeout,
-		"upload_size_mb":   &config.UploadSizeMb,
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Generates configuration struct containing user-defined settings. In addition, sets default values
+// and validates user input.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - GcsConfig: Configuration based on fluent-bit.conf
+//   - err: All validation errors in config wrapped, parse bool error
+func NewGcsConfig(plugin unsafe.Pointer) (*GcsConfig, error) {
+	config := GcsConfig{
+		Config:          DefaultConfig(),
+		GcsBucketPrefix: "logs/",
+	}
+
+	pluginSettings := config.settings()
+	pluginSettings["gcs_bucket"] = &config.GcsBucket
+	pluginSettings["gcs_bucket_prefix"] = &config.GcsBucketPrefix
+	pluginSettings["gcs_credentials_file"] = &config.GcsCredentialsFile
+	pluginSettings["gcs_endpoint"] = &config.GcsEndpoint
+
+	err := loadSettings(plugin, pluginSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Generates configuration struct containing user-defined settings. In addition, sets default values
+// and validates user input.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - AzureBlobConfig: Configuration based on fluent-bit.conf
+//   - err: All validation errors in config wrapped, parse bool error
+func NewAzureBlobConfig(plugin unsafe.Pointer) (*AzureBlobConfig, error) {
+	config := AzureBlobConfig{
+		Config:           DefaultConfig(),
+		AzureBlobPrefix:  "logs/",
+		AzureBlockSizeMb: 4,
+	}
+
+	pluginSettings := config.settings()
+	pluginSettings["azure_account_name"] = &config.AzureAccountName
+	pluginSettings["azure_account_key"] = &config.AzureAccountKey
+	pluginSettings["azure_sas_token"] = &config.AzureSasToken
+	pluginSettings["azure_container"] = &config.AzureContainer
+	pluginSettings["azure_blob_prefix"] = &config.AzureBlobPrefix
+	pluginSettings["azure_endpoint"] = &config.AzureEndpoint
+	pluginSettings["azure_block_size_mb"] = &config.AzureBlockSizeMb
+
+	err := loadSettings(plugin, pluginSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Generates configuration struct containing user-defined settings. In addition, sets default values
+// and validates user input.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - HttpConfig: Configuration based on fluent-bit.conf
+//   - err: All validation errors in config wrapped, parse bool error
+func NewHttpConfig(plugin unsafe.Pointer) (*HttpConfig, error) {
+	config := HttpConfig{
+		Config:         DefaultConfig(),
+		HttpMethod:     http.MethodPost,
+		HttpTimeout:    time.Minute,
+		HttpRetryLimit: 3,
+	}
+
+	pluginSettings := config.settings()
+	pluginSettings["http_url"] = &config.HttpUrl
+	pluginSettings["http_method"] = &config.HttpMethod
+	pluginSettings["http_headers"] = &config.HttpHeaders
+	pluginSettings["http_bearer_token"] = &config.HttpBearerToken
+	pluginSettings["http_user"] = &config.HttpUser
+	pluginSettings["http_password"] = &config.HttpPassword
+	pluginSettings["http_tls_ca_file"] = &config.HttpTlsCaFile
+	pluginSettings["http_tls_cert_file"] = &config.HttpTlsCertFile
+	pluginSettings["http_tls_key_file"] = &config.HttpTlsKeyFile
+	pluginSettings["http_timeout"] = &config.HttpTimeout
+	pluginSettings["http_retry_limit"] = &config.HttpRetryLimit
+
+	err := loadSettings(plugin, pluginSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Generates configuration struct containing user-defined settings. In addition, sets default values
+// and validates user input.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - KafkaConfig: Configuration based on fluent-bit.conf
+//   - err: All validation errors in config wrapped, parse bool error
+func NewKafkaConfig(plugin unsafe.Pointer) (*KafkaConfig, error) {
+	config := KafkaConfig{
+		Config:              DefaultConfig(),
+		KafkaMaxRecordBytes: 1000000,
+		KafkaTimeout:        30 * time.Second,
+		KafkaRetryLimit:     3,
+	}
+
+	pluginSettings := config.settings()
+	pluginSettings["kafka_brokers"] = &config.KafkaBrokers
+	pluginSettings["kafka_topic"] = &config.KafkaTopic
+	pluginSettings["kafka_key_field"] = &config.KafkaKeyField
+	pluginSettings["kafka_max_record_bytes"] = &config.KafkaMaxRecordBytes
+	pluginSettings["kafka_timeout"] = &config.KafkaTimeout
+	pluginSettings["kafka_retry_limit"] = &config.KafkaRetryLimit
+
+	err := loadSettings(plugin, pluginSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Generates configuration struct containing user-defined settings. In addition, sets default values
+// and validates user input.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - ClpConfig: Configuration based on fluent-bit.conf
+//   - err: All validation errors in config wrapped, parse bool error
+func NewClpConfig(plugin unsafe.Pointer) (*ClpConfig, error) {
+	config := ClpConfig{
+		Config:        DefaultConfig(),
+		ClpStagingDir: "./clp_staging/",
+		ClpTimeout:    time.Minute,
+	}
+
+	pluginSettings := config.settings()
+	pluginSettings["clp_package_dir"] = &config.ClpPackageDir
+	pluginSettings["clp_compress_command"] = &config.ClpCompressCommand
+	pluginSettings["clp_config_file"] = &config.ClpConfigFile
+	pluginSettings["clp_timestamp_key"] = &config.ClpTimestampKey
+	pluginSettings["clp_staging_dir"] = &config.ClpStagingDir
+	pluginSettings["clp_keep_staged_files"] = &config.ClpKeepStagedFiles
+	pluginSettings["clp_timeout"] = &config.ClpTimeout
+
+	err := loadSettings(plugin, pluginSettings)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// Maps setting names to fields of shared settings. Plugins add their own settings to the map.
+// Potential to iterate over struct using reflect; however, better to avoid reflect package.
+//
+// Returns:
+//   - pluginSettings: Map of setting names to pointers to config fields
+func (config *Config) settings() map[string]interface{} {
+	return map[string]interface{}{
+		"id":                         &config.Id,
+		"use_disk_buffer":            &config.UseDiskBuffer,
+		"hybrid_buffer":              &config.HybridBuffer,
+		"hybrid_buffer_watermark_mb": &config.HybridBufferWatermarkMb,
+		"disk_buffer_path":           &config.DiskBufferPath,
+		"disk_buffer_key_file":       &config.DiskBufferKeyFile,
+		"disk_buffer_key_env":        &config.DiskBufferKeyEnv,
+		"client_encryption_key_file": &config.ClientEncryptionKeyFile,
+		"object_key_template":        &config.ObjectKeyTemplate,
+		"max_buffer_age":             &config.MaxBufferAge,
+		"upload_size_mb":             &config.UploadSizeMb,
+		"memory_budget_mb":           &config.MemoryBudgetMb,
+		"upload_on_exit":             &config.UploadOnExit,
+		"upload_on_exit_timeout":     &config.UploadOnExitTimeout,
+		"upload_manifest":            &config.UploadManifest,
+		"manifest_interval":          &config.ManifestInterval,
+		"preserve_malformed_records": &config.PreserveMalformedRecords,
+		"binary_encoding":            &config.BinaryEncoding,
+		"unstructured_logs":          &config.UnstructuredLogs,
+		"message_key":                &config.MessageKey,
+		"include_keys":               &config.IncludeKeys,
+		"exclude_keys":               &config.ExcludeKeys,
+		"rename_keys":                &config.RenameKeys,
+		"redact_patterns":            &config.RedactPatterns,
+		"redact_keys":                &config.RedactKeys,
+		"redact_regex":               &config.RedactRegex,
+		"redact_mode":                &config.RedactMode,
+		"redact_hash_key":            &config.RedactHashKey,
 	}
+}
 
+// Loads user inputs into config fields. Fields of settings not defined by the user keep their
+// default values.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//   - pluginSettings: Map of setting names to pointers to config fields
+//
+// Returns:
+//   - err: Error parsing input, error unsupported field type
+func loadSettings(plugin unsafe.Pointer, pluginSettings map[string]interface{}) error {
+	// Map used to loop over user inputs saving a [output.FLBPluginConfigKey] call for each key.
 	for settingName, untypedField := range pluginSettings {
 		// [output.FLBPluginConfigKey] retrieves values defined in fluent-bit.conf. Unfortunately,
 		// retrieves all values as strings. If the option is not defined by user, it is set to "".
 		userInput := output.FLBPluginConfigKey(plugin, settingName)
 
+		if userInput == "" {
+			if deprecatedName, ok := deprecatedSettingNames[settingName]; ok {
+				userInput = output.FLBPluginConfigKey(plugin, deprecatedName)
+			}
+		}
+
 		// If user did not specify a value, do not overwrite default value.
 		if userInput == "" {
 			continue
@@ -91,26 +507,152 @@ func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
 			// This will throw error if input is "".
 			boolInput, err := strconv.ParseBool(userInput)
 			if err != nil {
-				return nil, fmt.Errorf("error could not parse input %v into bool", userInput)
+				return fmt.Errorf("error could not parse input %v into bool", userInput)
 			}
 			*configField = boolInput
 		case *time.Duration:
 			durationInput, err := time.ParseDuration(userInput)
 			if err != nil {
-				return nil, fmt.Errorf("error could not parse input %v into duration", userInput)
+				return fmt.Errorf("error could not parse input %v into duration", userInput)
 			}
 			*configField = durationInput
 		case *int:
 			intInput, err := strconv.Atoi(userInput)
 			if err != nil {
-				return nil, fmt.Errorf("error could not parse input %v into int", userInput)
+				return fmt.Errorf("error could not parse input %v into int", userInput)
 			}
 			*configField = intInput
 		default:
-			return nil, fmt.Errorf("unable to parse type %T", untypedField)
+			return fmt.Errorf("unable to parse type %T", untypedField)
+		}
+	}
+
+	return nil
+}
+
+// Validates settings. Returns all errors at once so user can fix all errors at once.
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func (config *S3Config) Validate() error {
+	configErrors := []error{validate(config, &config.Config)}
+
+	// Parts are read from the Zstd disk buffer at offsets of the uploaded object, so buffers and
+	// objects cannot be encrypted. Manifest checksums would require reading the whole buffer.
+	if config.S3MultipartStreaming {
+		if !config.UseDiskBuffer {
+			configErrors = append(configErrors, errors.New(
+				"error option s3_multipart_streaming requires use_disk_buffer"))
+		}
+		if config.DiskBufferKeyFile != "" || config.DiskBufferKeyEnv != "" {
+			configErrors = append(configErrors, errors.New(
+				"error option s3_multipart_streaming is not supported with disk buffer encryption"))
 		}
+		if config.ClientEncryptionKeyFile != "" {
+			configErrors = append(configErrors, errors.New("error option s3_multipart_streaming "+
+				"is not supported with client_encryption_key_file"))
+		}
+		if config.UploadManifest {
+			configErrors = append(configErrors, errors.New(
+				"error option s3_multipart_streaming is not supported with upload_manifest"))
+		}
+		if config.HybridBuffer {
+			configErrors = append(configErrors, errors.New(
+				"error option s3_multipart_streaming is not supported with hybrid_buffer"))
+		}
+	}
+
+	// S3 limits the number of parts of an object. Buffers are uploaded in parts of the configured
+	// size unless the uploader can read their size in advance.
+	if config.UploadSizeMb > config.S3PartSizeMb*int(manager.MaxUploadParts) {
+		configErrors = append(configErrors, fmt.Errorf(
+			"error option upload_size_mb=%d exceeds %d parts of s3_part_size_mb=%d",
+			config.UploadSizeMb,
+			manager.MaxUploadParts,
+			config.S3PartSizeMb,
+		))
 	}
 
+	return errors.Join(configErrors...)
+}
+
+// Validates settings. Returns all errors at once so user can fix all errors at once.
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func (config *GcsConfig) Validate() error {
+	return validate(config, &config.Config)
+}
+
+// Validates settings. Returns all errors at once so user can fix all errors at once.
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func (config *AzureBlobConfig) Validate() error {
+	return validate(config, &config.Config)
+}
+
+// Validates settings. Returns all errors at once so user can fix all errors at once.
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func (config *HttpConfig) Validate() error {
+	err := validate(config, &config.Config)
+
+	// Headers and TLS files have their own syntax which cannot be validated with struct tags.
+	_, headerErr := config.NewHeader()
+	_, tlsErr := config.NewTlsConfig()
+
+	return errors.Join(err, headerErr, tlsErr)
+}
+
+// Validates settings. Returns all errors at once so user can fix all errors at once.
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func (config *KafkaConfig) Validate() error {
+	err := validate(config, &config.Config)
+
+	// Broker list has its own syntax which cannot be validated with struct tags.
+	_, brokersErr := config.Brokers()
+
+	return errors.Join(err, brokersErr)
+}
+
+// Validates settings. Returns all errors at once so user can fix all errors at once.
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func (config *ClpConfig) Validate() error {
+	configErrors := []error{validate(config, &config.Config)}
+
+	// The CLP package tracks ingested files and cannot decrypt objects, so shared options for
+	// storage destinations are not supported.
+	if config.UploadManifest {
+		configErrors = append(configErrors,
+			errors.New("error option upload_manifest is not supported by CLP package plugin"))
+	}
+	if config.ClientEncryptionKeyFile != "" {
+		configErrors = append(configErrors, errors.New(
+			"error option client_encryption_key_file is not supported by CLP package plugin"))
+	}
+	if config.ClpCompressCommand != "" && len(config.NewCompressCommand()) == 0 {
+		configErrors = append(configErrors,
+			errors.New("error validating option clp_compress_command, no command"))
+	}
+
+	return errors.Join(configErrors...)
+}
+
+// Validates struct tags of a plugin configuration and shared options which have their own syntax.
+//
+// Parameters:
+//   - pluginConfig: Plugin configuration struct embedding shared settings
+//   - config: Shared settings of plugin configuration
+//
+// Returns:
+//   - err: All validation errors in config wrapped
+func validate(pluginConfig any, config *Config) error {
 	validate := validator.New(validator.WithRequiredStructEnabled())
 
 	// Sets validator to return snake case setting names to user. Used example directly from
@@ -124,7 +666,7 @@ func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
 		return name
 	})
 
-	err := validate.Struct(&config)
+	err := validate.Struct(pluginConfig)
 
 	// Slice holds config errors allowing function to return all errors at once instead of
 	// one at a time. User can fix all errors at once.
@@ -139,10 +681,245 @@ func NewS3Config(plugin unsafe.Pointer) (*S3Config, error) {
 				err.Field(), err.Value(), err.Tag())
 			configErrors = append(configErrors, err)
 		}
-		// Wrap all errors into one error before returning.
-		err = errors.Join(configErrors...)
+	}
+
+	// Hybrid buffers are held in memory until an upload fails unless they have a watermark.
+	memoryBuffer := !config.UseDiskBuffer ||
+		(config.HybridBuffer && (config.HybridBufferWatermarkMb == 0))
+	if memoryBuffer && (config.UploadSizeMb >= maxMemoryUploadSizeMb) {
+		configErrors = append(configErrors, fmt.Errorf(
+			"error option upload_size_mb=%d must be less than %d for buffers in memory",
+			config.UploadSizeMb,
+			maxMemoryUploadSizeMb,
+		))
+	}
+
+	if config.HybridBuffer && !config.UseDiskBuffer {
+		configErrors = append(configErrors,
+			errors.New("error option hybrid_buffer requires use_disk_buffer"))
+	}
+
+	if config.UploadOnExit && !config.UseDiskBuffer {
+		configErrors = append(configErrors,
+			errors.New("error option upload_on_exit requires use_disk_buffer"))
+	}
+
+	if config.UseDiskBuffer && (config.MemoryBudgetMb > 0) {
+		configErrors = append(configErrors,
+			errors.New("error option memory_budget_mb is not supported with use_disk_buffer"))
+	}
+
+	// Buffers over the memory budget are spilled to disk_buffer_path.
+	if (config.MemoryBudgetMb > 0) && (config.DiskBufferPath == "") {
+		configErrors = append(configErrors,
+			errors.New("error option memory_budget_mb requires disk_buffer_path"))
+	}
+
+	// Key, redaction, and template options have their own syntax which cannot be validated with
+	// struct tags.
+	_, err = config.NewKeyFilter()
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	_, err = config.NewRedactor()
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	_, err = config.NewBufferCipher()
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	_, err = config.NewKeyProvider()
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+	err = validateObjectKeyTemplate(config.ObjectKeyTemplate)
+	if err != nil {
+		configErrors = append(configErrors, err)
+	}
+
+	// Wrap all errors into one error before returning.
+	return errors.Join(configErrors...)
+}
+
+// Creates headers added to every request from the http_headers option and the authorization
+// options.
+//
+// Returns:
+//   - header: Request headers, nil if no headers are set
+//   - err: Error parsing headers
+func (config *HttpConfig) NewHeader() (http.Header, error) {
+	header, err := httpout.ParseHeaders(config.HttpHeaders)
+	if err != nil {
 		return nil, err
 	}
 
-	return &config, nil
+	var authorization string
+	switch {
+	case config.HttpBearerToken != "":
+		authorization = "Bearer " + config.HttpBearerToken
+	case config.HttpUser != "":
+		credentials := config.HttpUser + ":" + config.HttpPassword
+		authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	default:
+		return header, nil
+	}
+
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Authorization", authorization)
+	return header, nil
+}
+
+// Creates a TLS configuration from the TLS file options.
+//
+// Returns:
+//   - tlsConfig: TLS configuration, nil if no files are set
+//   - err: Error reading files, error parsing certificates
+func (config *HttpConfig) NewTlsConfig() (*tls.Config, error) {
+	return httpout.NewTlsConfig(config.HttpTlsCaFile, config.HttpTlsCertFile, config.HttpTlsKeyFile)
+}
+
+// Parses the kafka_brokers option, a comma-separated list of broker addresses.
+//
+// Returns:
+//   - brokers: Broker addresses in "host:port" format
+//   - err: Error invalid address
+func (config *KafkaConfig) Brokers() ([]string, error) {
+	var brokers []string
+	for _, broker := range strings.Split(config.KafkaBrokers, ",") {
+		broker = strings.TrimSpace(broker)
+		if broker == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(broker)
+		if err != nil || host == "" || port == "" {
+			return nil, fmt.Errorf("error validating option kafka_brokers, invalid address %q",
+				broker)
+		}
+		brokers = append(brokers, broker)
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("error validating option kafka_brokers, no addresses")
+	}
+	return brokers, nil
+}
+
+// Creates the command which ingests staged files. Uses clp_compress_command if set, otherwise the
+// compress tool of clp_package_dir.
+//
+// Returns:
+//   - command: Compress tool and its arguments
+func (config *ClpConfig) NewCompressCommand() []string {
+	if config.ClpCompressCommand != "" {
+		return strings.Fields(config.ClpCompressCommand)
+	}
+	return clpcompress.DefaultCommand(
+		config.ClpPackageDir,
+		config.ClpConfigFile,
+		config.ClpTimestampKey,
+	)
+}
+
+// Gets the key of the message written as a CLP-encoded unstructured log event.
+//
+// Returns:
+//   - messageKey: Value of message_key, empty if unstructured_logs is not set
+func (config *Config) UnstructuredMessageKey() string {
+	if !config.UnstructuredLogs {
+		return ""
+	}
+	return config.MessageKey
+}
+
+// Creates a filter from the include_keys, exclude_keys, and rename_keys options.
+//
+// Returns:
+//   - filter: Key filter, nil if options are not set
+//   - err: Error parsing options
+func (config *Config) NewKeyFilter() (*keyfilter.Filter, error) {
+	return keyfilter.New(config.IncludeKeys, config.ExcludeKeys, config.RenameKeys)
+}
+
+// Creates a redactor from the redaction options.
+//
+// Returns:
+//   - redactor: Redactor, nil if no redaction rules are set
+//   - err: Error parsing options
+func (config *Config) NewRedactor() (*redact.Redactor, error) {
+	return redact.New(
+		config.RedactPatterns,
+		config.RedactKeys,
+		config.RedactRegex,
+		config.RedactMode,
+		config.RedactHashKey,
+	)
+}
+
+// Creates a cipher to encrypt disk buffers from the keys in disk_buffer_key_file or the environment
+// variable named by disk_buffer_key_env. The first key wraps data keys of new buffers, and the
+// following keys are previous keys used to recover buffers written before the key was rotated.
+//
+// Returns:
+//   - cipher: Cipher for disk buffers, nil if no key is set
+//   - err: Error key set without disk buffer, error reading key, error invalid key
+func (config *Config) NewBufferCipher() (*irzstd.Cipher, error) {
+	var encodedKey string
+	switch {
+	case config.DiskBufferKeyFile != "":
+		data, err := os.ReadFile(config.DiskBufferKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading disk buffer key file: %w", err)
+		}
+		encodedKey = string(data)
+	case config.DiskBufferKeyEnv != "":
+		var ok bool
+		encodedKey, ok = os.LookupEnv(config.DiskBufferKeyEnv)
+		if !ok {
+			return nil, fmt.Errorf(
+				"error disk buffer key environment variable %s is not set",
+				config.DiskBufferKeyEnv,
+			)
+		}
+	default:
+		return nil, nil
+	}
+
+	if !config.UseDiskBuffer {
+		return nil, fmt.Errorf("error disk buffer key is set but use_disk_buffer is off")
+	}
+
+	keys, err := irzstd.ParseKeys(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing disk buffer key: %w", err)
+	}
+	return irzstd.NewCipher(keys[0], keys[1:]...)
+}
+
+// Creates a provider to wrap keys of encrypted uploads from client_encryption_key_file.
+//
+// Returns:
+//   - provider: Key provider, nil if uploads are not encrypted
+//   - err: Error reading key
+func (config *Config) NewKeyProvider() (envelope.KeyProvider, error) {
+	if config.ClientEncryptionKeyFile == "" {
+		return nil, nil
+	}
+	provider, err := envelope.NewFileKeyProvider(config.ClientEncryptionKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading client encryption key: %w", err)
+	}
+	return provider, nil
+}
+
+// Creates a budget for buffers held in memory from memory_budget_mb.
+//
+// Returns:
+//   - budget: Memory budget, nil if memory use is not limited or buffers are on disk
+func (config *Config) NewMemoryBudget() *MemoryBudget {
+	if config.UseDiskBuffer || (config.MemoryBudgetMb == 0) {
+		return nil
+	}
+	return NewMemoryBudget(config.MemoryBudgetMb << 20)
 }
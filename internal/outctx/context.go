@@ -8,32 +8,58 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"unsafe"
 
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
 	"github.com/aws/smithy-go"
-	"github.com/y-scope/clp-ffi-go/ffi"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"google.golang.org/api/googleapi"
 
+	"github.com/y-scope/fluent-bit-clp/internal/clpcompress"
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
+	"github.com/y-scope/fluent-bit-clp/internal/httpout"
 	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/keyfilter"
 	"github.com/y-scope/fluent-bit-clp/internal/pathregistry"
+	"github.com/y-scope/fluent-bit-clp/internal/redact"
 )
 
 // Names of disk buffering directories.
 const (
-	IrDir   = "ir"
-	ZstdDir = "zstd"
+	IrDir        = "ir"
+	ZstdDir      = "zstd"
+	MultipartDir = "multipart"
+	SpillDir     = "spill"
 )
 
+// Separates the Fluent Bit tag from the group key value in buffer tags. Escaped values never
+// contain the separator, so buffer tags are split at the last separator.
+const groupSeparator = "#"
+
+// Version of the plugin. Overridden at build time using "-ldflags -X".
+var Version = "dev"
+
+// Environment variable used by Google Cloud libraries to locate service account credentials.
+const gcsCredentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS"
+
 // AWS error codes.
 const (
 	invalidCredsCode  = "InvalidClientTokenId"
 	bucketMissingCode = "NotFound"
+	noSuchUploadCode  = "NoSuchUpload"
 )
 
 // Holds objects accessible to plugin during flush. Fluent Bit uses a single thread for Go output
@@ -41,32 +67,58 @@ const (
 // could cause synchronization issues for C plugins according to [docs] but "coroutines" are not
 // used in Go plugins.
 // [docs]: https://github.com/fluent/fluent-bit/blob/master/DEVELOPER_GUIDE.md#concurrency
-type S3Context struct {
-	Config        S3Config
-	Uploader      *manager.Uploader
-	EventManagers map[string]*S3EventManager
+type Context struct {
+	Config        Config
+	Uploader      Uploader
+	EventManagers map[string]*EventManager
+	// Filter created from key options, nil if options are not set.
+	KeyFilter *keyfilter.Filter
+	// Redactor created from redaction options, nil if no rules are set.
+	Redactor *redact.Redactor
+	// Cipher for disk buffers created from disk buffer key options, nil if no key is set.
+	BufferCipher *irzstd.Cipher
+	// Provider to wrap keys of encrypted uploads, nil if uploads are not encrypted.
+	KeyProvider envelope.KeyProvider
+	// Number of malformed records skipped since plugin start.
+	MalformedRecords int
+	// Record key whose value splits events with the same tag into separate buffers, empty if
+	// events are only buffered by tag. See [BufferTag].
+	GroupKey string
+	// Size of parts uploaded while disk buffers are filling, 0 if buffers are uploaded when they
+	// are complete. Requires [Context.Uploader] to be a [MultipartUploader].
+	MultipartPartSize int
+	// Budget shared by buffers held in memory, nil if memory use is not limited.
+	MemoryBudget *MemoryBudget
 }
 
-// Creates a new context. Loads configuration from user. Loads and tests aws credentials.
+// Creates a new context for S3 plugin. Loads configuration from user. Loads and tests aws
+// credentials.
 //
 // Parameters:
 //   - plugin: Fluent Bit plugin reference
 //
 // Returns:
-//   - S3Context: Plugin context
+//   - Context: Plugin context
 //   - err: User configuration load failed, aws errors
-func NewS3Context(plugin unsafe.Pointer) (*S3Context, error) {
+func NewS3Context(plugin unsafe.Pointer) (*Context, error) {
 	config, err := NewS3Config(plugin)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
 
-	if config.UseDiskBuffer {
-		if err := pathregistry.Register(config.DiskBufferPath); err != nil {
-			return nil, err
-		}
-	}
+	return NewS3ContextFromConfig(config)
+}
 
+// Creates a new context for S3 plugin from a validated configuration. Loads and tests aws
+// credentials. Allows tools to reuse plugin upload code without Fluent Bit.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Disk buffer path in use, aws errors
+func NewS3ContextFromConfig(config *S3Config) (*Context, error) {
 	// Load the aws credentials. [awsConfig.LoadDefaultConfig] will look for credentials in a
 	// specific hierarchy.
 	// https://aws.github.io/aws-sdk-go-v2/docs/configuring-sdk/
@@ -111,17 +163,425 @@ func NewS3Context(plugin unsafe.Pointer) (*S3Context, error) {
 		return nil, err
 	}
 
-	uploader := manager.NewUploader(s3Client)
+	uploader := NewS3Uploader(
+		s3Client,
+		config.S3Bucket,
+		config.S3BucketPrefix,
+		config.S3PartSizeMb<<20,
+		config.S3UploadConcurrency,
+	)
+
+	ctx, err := NewContextFromConfig(&config.Config, uploader)
+	if err != nil {
+		return nil, err
+	}
+	if config.S3MultipartStreaming {
+		ctx.MultipartPartSize = config.S3PartSizeMb << 20
+	}
+
+	return ctx, nil
+}
+
+// Creates a new context for GCS plugin. Loads configuration from user. Loads and tests service
+// account credentials.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: User configuration load failed, GCS errors
+func NewGcsContext(plugin unsafe.Pointer) (*Context, error) {
+	config, err := NewGcsConfig(plugin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return NewGcsContextFromConfig(config)
+}
+
+// Creates a new context for GCS plugin from a validated configuration. Credentials are read from
+// gcs_credentials_file, or the file named by the GOOGLE_APPLICATION_CREDENTIALS environment
+// variable. Requests are not authenticated if neither is set and a custom endpoint is used, since
+// emulators do not check credentials.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Error no credentials, error loading credentials, disk buffer path in use, GCS errors
+func NewGcsContextFromConfig(config *GcsConfig) (*Context, error) {
+	credentialsFile := config.GcsCredentialsFile
+	if credentialsFile == "" {
+		credentialsFile = os.Getenv(gcsCredentialsEnv)
+	}
+	if credentialsFile == "" && config.GcsEndpoint == "" {
+		return nil, fmt.Errorf(
+			"error gcs_credentials_file or %s is required unless gcs_endpoint is set",
+			gcsCredentialsEnv,
+		)
+	}
+
+	client, err := NewGcsClient(context.TODO(), config.GcsEndpoint, credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load gcs credentials: %w", err)
+	}
+
+	// Confirm bucket exists and test credentials.
+	_, err = client.Bucket(config.GcsBucket).Attrs(context.TODO())
+	if err != nil {
+		var apiErr *googleapi.Error
+		switch {
+		case errors.Is(err, storage.ErrBucketNotExist):
+			err = fmt.Errorf("error bucket %s could not be found: %w", config.GcsBucket, err)
+		case errors.As(err, &apiErr) &&
+			(apiErr.Code == http.StatusUnauthorized || apiErr.Code == http.StatusForbidden):
+			err = fmt.Errorf("error gcs credentials are invalid: %w", err)
+		default:
+			err = fmt.Errorf("error gcs: %w", err)
+		}
+		return nil, err
+	}
+
+	uploader := NewGcsUploader(client, config.GcsBucket, config.GcsBucketPrefix)
+
+	return NewContextFromConfig(&config.Config, uploader)
+}
+
+// Creates a new context for Azure Blob Storage plugin. Loads configuration from user. Tests
+// account key credentials.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: User configuration load failed, Azure errors
+func NewAzureBlobContext(plugin unsafe.Pointer) (*Context, error) {
+	config, err := NewAzureBlobConfig(plugin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return NewAzureBlobContextFromConfig(config)
+}
 
-	ctx := S3Context{
+// Creates a new context for Azure Blob Storage plugin from a validated configuration. Container
+// and credentials are only checked on startup when using an account key, since SAS tokens are
+// often scoped to writing blobs and cannot read container properties.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Error invalid credentials, disk buffer path in use, Azure errors
+func NewAzureBlobContextFromConfig(config *AzureBlobConfig) (*Context, error) {
+	client, err := NewAzureBlobClient(
+		config.AzureEndpoint,
+		config.AzureAccountName,
+		config.AzureAccountKey,
+		config.AzureSasToken,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not load azure credentials: %w", err)
+	}
+
+	if config.AzureAccountKey != "" {
+		// Confirm container exists and test credentials.
+		_, err = client.ServiceClient().
+			NewContainerClient(config.AzureContainer).
+			GetProperties(context.TODO(), nil)
+		if err != nil {
+			var respErr *azcore.ResponseError
+			if errors.As(err, &respErr) {
+				switch respErr.StatusCode {
+				case http.StatusForbidden:
+					err = fmt.Errorf("error azure credentials are invalid: %w", err)
+				case http.StatusNotFound:
+					err = fmt.Errorf(
+						"error container %s could not be found: %w",
+						config.AzureContainer,
+						err,
+					)
+				default:
+					err = fmt.Errorf("error azure: %w", err)
+				}
+			}
+			return nil, err
+		}
+	}
+
+	uploader := NewAzureBlobUploader(
+		client,
+		config.AzureContainer,
+		config.AzureBlobPrefix,
+		config.AzureBlockSizeMb<<20,
+	)
+
+	return NewContextFromConfig(&config.Config, uploader)
+}
+
+// Creates a new context for HTTP plugin. Loads configuration from user.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: User configuration load failed, disk buffer path in use
+func NewHttpContext(plugin unsafe.Pointer) (*Context, error) {
+	config, err := NewHttpConfig(plugin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return NewHttpContextFromConfig(config)
+}
+
+// Creates a new context for HTTP plugin from a validated configuration. Unlike other plugins, the
+// endpoint is not checked on startup since endpoints may only accept objects.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Error parsing headers, error loading TLS files, disk buffer path in use
+func NewHttpContextFromConfig(config *HttpConfig) (*Context, error) {
+	header, err := config.NewHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := config.NewTlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client := httpout.NewClient(
+		config.HttpUrl,
+		config.HttpMethod,
+		header,
+		tlsConfig,
+		config.HttpTimeout,
+		config.HttpRetryLimit,
+	)
+
+	return NewContextFromConfig(&config.Config, NewHttpUploader(client))
+}
+
+// Creates a new context for Kafka plugin. Loads configuration from user. Checks that the topic
+// exists.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: User configuration load failed, Kafka errors
+func NewKafkaContext(plugin unsafe.Pointer) (*Context, error) {
+	config, err := NewKafkaConfig(plugin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return NewKafkaContextFromConfig(config)
+}
+
+// Creates a new context for Kafka plugin from a validated configuration. Fetches the metadata of
+// the topic, which checks that brokers are reachable and the topic exists. Events are grouped by
+// kafka_key_field if set, so the field can be used as the message key.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Error parsing brokers, disk buffer path in use, Kafka errors
+func NewKafkaContextFromConfig(config *KafkaConfig) (*Context, error) {
+	brokers, err := config.Brokers()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewKafkaClient(
+		brokers,
+		config.KafkaTopic,
+		config.Id,
+		config.KafkaTimeout,
+		config.KafkaRetryLimit,
+		config.KafkaMaxRecordBytes,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error kafka: %w", err)
+	}
+
+	// Confirm topic exists and brokers are reachable.
+	request := kmsg.NewPtrMetadataRequest()
+	requestTopic := kmsg.NewMetadataRequestTopic()
+	requestTopic.Topic = kmsg.StringPtr(config.KafkaTopic)
+	request.Topics = append(request.Topics, requestTopic)
+	response, err := request.RequestWith(context.TODO(), client)
+	if err == nil && len(response.Topics) == 1 {
+		err = kerr.ErrorForCode(response.Topics[0].ErrorCode)
+	}
+	if err != nil {
+		client.Close()
+		if errors.Is(err, kerr.UnknownTopicOrPartition) {
+			err = fmt.Errorf("error topic %s could not be found: %w", config.KafkaTopic, err)
+		} else {
+			err = fmt.Errorf("error kafka: %w", err)
+		}
+		return nil, err
+	}
+
+	uploader := NewKafkaUploader(
+		client,
+		config.KafkaTopic,
+		config.KafkaMaxRecordBytes,
+		config.KafkaKeyField != "",
+	)
+
+	ctx, err := NewContextFromConfig(&config.Config, uploader)
+	if err != nil {
+		return nil, err
+	}
+	ctx.GroupKey = config.KafkaKeyField
+
+	return ctx, nil
+}
+
+// Creates a new context for CLP package plugin. Loads configuration from user. Checks that the
+// compress tool exists.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: User configuration load failed, error finding compress tool
+func NewClpContext(plugin unsafe.Pointer) (*Context, error) {
+	config, err := NewClpConfig(plugin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	return NewClpContextFromConfig(config)
+}
+
+// Creates a new context for CLP package plugin from a validated configuration. Only checks that
+// the compress tool exists, since running it would submit a job.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Error finding compress tool, error creating staging directory, disk buffer path in use
+func NewClpContextFromConfig(config *ClpConfig) (*Context, error) {
+	command := config.NewCompressCommand()
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, fmt.Errorf("error clp compress tool could not be found: %w", err)
+	}
+
+	compressor, err := clpcompress.NewCompressor(
+		command,
+		config.ClpStagingDir,
+		config.ClpTimeout,
+		config.ClpKeepStagedFiles,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewContextFromConfig(&config.Config, NewClpUploader(compressor))
+}
+
+// Creates a new context from validated shared settings and an uploader for the storage
+// destination. Registers the disk buffer path so it cannot be used by another plugin instance.
+//
+// Parameters:
+//   - config: Shared plugin configuration
+//   - uploader: Uploader for storage destination
+//
+// Returns:
+//   - Context: Plugin context
+//   - err: Error parsing options, disk buffer path in use
+func NewContextFromConfig(config *Config, uploader Uploader) (*Context, error) {
+	keyFilter, err := config.NewKeyFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	redactor, err := config.NewRedactor()
+	if err != nil {
+		return nil, err
+	}
+
+	bufferCipher, err := config.NewBufferCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	keyProvider, err := config.NewKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.UseDiskBuffer {
+		if err := pathregistry.Register(config.DiskBufferPath); err != nil {
+			return nil, err
+		}
+	}
+
+	memoryBudget := config.NewMemoryBudget()
+	if memoryBudget != nil {
+		if err := checkSpillDir(filepath.Join(config.DiskBufferPath, SpillDir)); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx := Context{
 		Config:        *config,
 		Uploader:      uploader,
-		EventManagers: make(map[string]*S3EventManager),
+		EventManagers: make(map[string]*EventManager),
+		KeyFilter:     keyFilter,
+		Redactor:      redactor,
+		BufferCipher:  bufferCipher,
+		KeyProvider:   keyProvider,
+		MemoryBudget:  memoryBudget,
 	}
 
 	return &ctx, nil
 }
 
+// Creates the directory of spilled buffers and checks that files can be created in it, so an
+// unusable disk_buffer_path fails on startup instead of when a buffer is first spilled.
+//
+// Parameters:
+//   - dir: Directory of spilled buffers
+//
+// Returns:
+//   - err: Error creating directory, error creating or removing file
+func checkSpillDir(dir string) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return fmt.Errorf("error creating spill directory %s: %w", dir, err)
+	}
+	file, err := os.CreateTemp(dir, "check-*")
+	if err != nil {
+		return fmt.Errorf("error creating file in spill directory %s: %w", dir, err)
+	}
+	file.Close()
+	err = os.Remove(file.Name())
+	if err != nil {
+		return fmt.Errorf("error removing file in spill directory %s: %w", dir, err)
+	}
+	return nil
+}
+
 // If the event manager for the tag has been initialized, get the corresponding event manager. If
 // not, create new one.
 //
@@ -130,35 +590,47 @@ func NewS3Context(plugin unsafe.Pointer) (*S3Context, error) {
 //
 // Returns:
 //   - err: Could not create buffers or tag
-func (ctx *S3Context) GetEventManager(tag string) (*S3EventManager, error) {
+func (ctx *Context) GetEventManager(tag string) (*EventManager, error) {
 	if eventManager, ok := ctx.EventManagers[tag]; ok {
 		return eventManager, nil
 	}
 	return ctx.newEventManager(tag)
 }
 
-// Recovers [S3EventManager] from previous execution using existing disk buffers.
+// Recovers [EventManager] from previous execution using existing disk buffers.
 //
 // Parameters:
 //   - tag: Fluent Bit tag
 //
 // Returns:
 //   - err: Error creating new writer, error uploading recovered buffer
-func (ctx *S3Context) RecoverEventManager(tag string) error {
+func (ctx *Context) RecoverEventManager(tag string) error {
 	irPath, zstdPath := ctx.GetBufferFilePaths(tag)
-	writer, err := irzstd.RecoverWriter(irPath, zstdPath)
+	writer, err := irzstd.RecoverWriter(
+		irPath,
+		zstdPath,
+		ctx.BufferCipher,
+		ctx.Config.UnstructuredMessageKey(),
+	)
 	if err != nil {
 		return err
 	}
 
-	eventManager := S3EventManager{
-		Tag:       tag,
-		Writer:    writer,
-		LogEvents: make(chan []ffi.LogEvent),
+	eventManager := EventManager{
+		Tag:         tag,
+		Writer:      writer,
+		LogEvents:   make(chan LogBatch),
+		KeyProvider: ctx.KeyProvider,
+	}
+	err = ctx.enableMultipartUpload(&eventManager)
+	if err != nil {
+		return err
 	}
+	ctx.enableHybridBuffer(&eventManager)
 
-	// Upload recovered buffer before starting listener.
-	err = eventManager.ToS3(ctx.Config, ctx.Uploader)
+	// Upload recovered buffer before starting listener. A multipart upload of the buffer is
+	// resumed, so only the end of the buffer is uploaded.
+	err = eventManager.UploadBuffer(context.TODO(), ctx.Config, ctx.Uploader)
 	if err != nil {
 		return fmt.Errorf("error uploading recovered buffer for tag %s: %w", tag, err)
 	}
@@ -170,9 +642,10 @@ func (ctx *S3Context) RecoverEventManager(tag string) error {
 	return nil
 }
 
-// Creates a new [S3EventManager] with a new [irzstd.Writer]. If UseDiskBuffer is set, buffers are
+// Creates a new [EventManager] with a new [irzstd.Writer]. If UseDiskBuffer is set, buffers are
 // created on disk and are used to buffer Fluent Bit chunks. If UseDiskBuffer is off, buffer is
-// in memory and chunks are not buffered.
+// in memory and chunks are not buffered. If HybridBuffer is set, buffer is in memory until it is
+// moved to disk.
 //
 // Parameters:
 //   - tag: Fluent Bit tag
@@ -180,25 +653,41 @@ func (ctx *S3Context) RecoverEventManager(tag string) error {
 // Returns:
 //   - eventManager: Manager for Fluent Bit events with the same tag
 //   - err: Error creating new writer
-func (ctx *S3Context) newEventManager(tag string) (*S3EventManager, error) {
+func (ctx *Context) newEventManager(tag string) (*EventManager, error) {
 	var err error
 	var writer irzstd.Writer
 
-	if ctx.Config.UseDiskBuffer {
+	if ctx.Config.UseDiskBuffer && !ctx.Config.HybridBuffer {
 		irPath, zstdPath := ctx.GetBufferFilePaths(tag)
-		writer, err = irzstd.NewDiskWriter(irPath, zstdPath)
+		writer, err = irzstd.NewDiskWriter(
+			irPath,
+			zstdPath,
+			ctx.BufferCipher,
+			ctx.Config.UnstructuredMessageKey(),
+		)
 	} else {
-		writer, err = irzstd.NewMemoryWriter()
+		writer, err = irzstd.NewMemoryWriter(ctx.Config.UnstructuredMessageKey())
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	eventManager := S3EventManager{
-		Tag:       tag,
-		Writer:    writer,
-		LogEvents: make(chan []ffi.LogEvent),
+	eventManager := EventManager{
+		Tag:         tag,
+		Writer:      writer,
+		LogEvents:   make(chan LogBatch),
+		KeyProvider: ctx.KeyProvider,
+	}
+	err = ctx.enableMultipartUpload(&eventManager)
+	if err != nil {
+		return nil, err
+	}
+	ctx.enableHybridBuffer(&eventManager)
+	if (ctx.MemoryBudget != nil) && !ctx.Config.UseDiskBuffer {
+		eventManager.budget = ctx.MemoryBudget
+		eventManager.relieve = make(chan struct{}, 1)
+		eventManager.spillDir = filepath.Join(ctx.Config.DiskBufferPath, SpillDir)
 	}
 
 	eventManager.StartListening(ctx.Config, ctx.Uploader)
@@ -213,7 +702,7 @@ func (ctx *S3Context) newEventManager(tag string) (*S3EventManager, error) {
 // Returns:
 //   - irBufferPath: Path of IR disk buffer directory
 //   - zstdBufferPath: Path of Zstd disk buffer directory
-func (ctx *S3Context) GetBufferPaths() (string, string) {
+func (ctx *Context) GetBufferPaths() (string, string) {
 	irBufferPath := filepath.Join(ctx.Config.DiskBufferPath, IrDir)
 	zstdBufferPath := filepath.Join(ctx.Config.DiskBufferPath, ZstdDir)
 	return irBufferPath, zstdBufferPath
@@ -227,7 +716,7 @@ func (ctx *S3Context) GetBufferPaths() (string, string) {
 // Returns:
 //   - irPath: Path to IR disk buffer file
 //   - zstdPath: Path to Zstd disk buffer file
-func (ctx *S3Context) GetBufferFilePaths(
+func (ctx *Context) GetBufferFilePaths(
 	tag string,
 ) (string, string) {
 	irFileName := fmt.Sprintf("%s.ir", tag)
@@ -238,3 +727,48 @@ func (ctx *S3Context) GetBufferFilePaths(
 
 	return irPath, zstdPath
 }
+
+// Retrieves path of the file persisting the multipart upload of a disk buffer.
+//
+// Parameters:
+//   - tag: Fluent Bit tag
+//
+// Returns:
+//   - multipartPath: Path to multipart upload file
+func (ctx *Context) GetMultipartFilePath(tag string) string {
+	return filepath.Join(ctx.Config.DiskBufferPath, MultipartDir, fmt.Sprintf("%s.json", tag))
+}
+
+// Creates the tag of the buffer for events with a tag and a value of [Context.GroupKey]. The value
+// is escaped so buffer tags can be used in file names and split with [SplitBufferTag].
+//
+// Parameters:
+//   - tag: Fluent Bit tag
+//   - value: Value of group key, empty if the key is missing
+//
+// Returns:
+//   - bufferTag: Tag of buffer
+func BufferTag(tag string, value string) string {
+	return tag + groupSeparator + url.PathEscape(value)
+}
+
+// Splits a tag created by [BufferTag].
+//
+// Parameters:
+//   - bufferTag: Tag of buffer
+//
+// Returns:
+//   - tag: Fluent Bit tag
+//   - value: Value of group key, empty if the key is missing
+//   - err: Error tag was not created by [BufferTag]
+func SplitBufferTag(bufferTag string) (string, string, error) {
+	i := strings.LastIndex(bufferTag, groupSeparator)
+	if i < 0 {
+		return "", "", fmt.Errorf("error buffer tag %s has no group", bufferTag)
+	}
+	value, err := url.PathUnescape(bufferTag[i+len(groupSeparator):])
+	if err != nil {
+		return "", "", fmt.Errorf("error buffer tag %s has invalid group: %w", bufferTag, err)
+	}
+	return bufferTag[:i], value, nil
+}
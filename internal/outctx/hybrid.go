@@ -0,0 +1,135 @@
+package outctx
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+)
+
+// Disk buffer files used by a hybrid buffer once it is persisted. Hybrid buffers are held in memory
+// until an upload fails or the buffer crosses the watermark, then moved to disk buffer files so
+// they are recovered after a crash.
+type hybridBuffer struct {
+	irPath   string
+	zstdPath string
+	cipher   *irzstd.Cipher
+	// Message key of memory writers, empty if records are written as KV-IR.
+	messageKey string
+	// Byte size of buffers moved to disk, 0 if buffers are only moved when an upload fails.
+	watermark int
+}
+
+// Enables hybrid buffering for an event manager if configured.
+//
+// Parameters:
+//   - eventManager: Event manager
+func (ctx *Context) enableHybridBuffer(eventManager *EventManager) {
+	if !ctx.Config.HybridBuffer {
+		return
+	}
+
+	irPath, zstdPath := ctx.GetBufferFilePaths(eventManager.Tag)
+	eventManager.hybrid = &hybridBuffer{
+		irPath:     irPath,
+		zstdPath:   zstdPath,
+		cipher:     ctx.BufferCipher,
+		messageKey: ctx.Config.UnstructuredMessageKey(),
+		watermark:  ctx.Config.HybridBufferWatermarkMb << 20,
+	}
+}
+
+// Moves a hybrid buffer held in memory to disk buffer files if it crossed the watermark. Logs
+// instead of returning error.
+func (m *EventManager) checkHybridWatermark() {
+	if (m.hybrid == nil) || (m.hybrid.watermark == 0) {
+		return
+	}
+	if _, ok := m.Writer.(irzstd.SpillWriter); !ok {
+		return
+	}
+
+	size, err := m.Writer.GetZstdOutputSize()
+	if err != nil {
+		log.Printf("error could not get size of buffer for tag %s: %v", m.Tag, err)
+		return
+	}
+	if size < m.hybrid.watermark {
+		return
+	}
+
+	log.Printf("Buffer for tag %s crossed watermark of %d bytes", m.Tag, m.hybrid.watermark)
+	if err := m.PersistBuffer(); err != nil {
+		log.Printf("error persisting buffer for tag %s: %v", m.Tag, err)
+	}
+}
+
+// Moves a hybrid buffer held in memory to disk buffer files, so it is recovered after a crash.
+// Later events are written to the disk buffer until the buffer is uploaded. Does nothing if the
+// event manager does not use a hybrid buffer, or if the buffer is already on disk or empty.
+//
+// Returns:
+//   - err: Error checking if buffer is empty, error persisting buffer
+func (m *EventManager) PersistBuffer() error {
+	if m.hybrid == nil {
+		return nil
+	}
+	spillWriter, ok := m.Writer.(irzstd.SpillWriter)
+	if !ok {
+		return nil
+	}
+
+	empty, err := m.Writer.Empty()
+	if err != nil {
+		return fmt.Errorf("failed to check if buffer is empty for tag %s: %w", m.Tag, err)
+	}
+	if empty {
+		return nil
+	}
+
+	writer, err := spillWriter.Persist(m.hybrid.irPath, m.hybrid.zstdPath, m.hybrid.cipher)
+	if err != nil {
+		return err
+	}
+	m.Writer = writer
+
+	log.Printf("Moved buffer for tag %s to disk", m.Tag)
+	return nil
+}
+
+// Moves a hybrid buffer back to memory after its disk buffer was uploaded. Disk buffer files are
+// removed. Does nothing if the event manager does not use a hybrid buffer, or if the buffer is
+// already in memory.
+//
+// Returns:
+//   - err: Error closing writer, error removing files, error creating memory writer
+func (m *EventManager) restoreHybridBuffer() error {
+	if m.hybrid == nil {
+		return nil
+	}
+	if _, ok := m.Writer.(irzstd.SpillWriter); ok {
+		return nil
+	}
+
+	writer, err := irzstd.NewMemoryWriter(m.hybrid.messageKey)
+	if err != nil {
+		return err
+	}
+
+	err = m.Writer.Close()
+	if err != nil {
+		return err
+	}
+	m.Writer = writer
+
+	for _, path := range []string{m.hybrid.irPath, m.hybrid.zstdPath} {
+		err := os.Remove(path)
+		if err != nil {
+			return fmt.Errorf("error removing disk buffer %s: %w", path, err)
+		}
+	}
+
+	log.Printf("Moved buffer for tag %s to memory", m.Tag)
+	return nil
+}
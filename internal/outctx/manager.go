@@ -2,105 +2,193 @@ package outctx
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"log"
-	"net/url"
-	"path/filepath"
+	"maps"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/y-scope/clp-ffi-go/ffi"
-
+	"github.com/y-scope/fluent-bit-clp/internal/envelope"
 	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
 )
 
-// Tag key when tagging s3 objects with Fluent Bit tag.
-const s3TagKey = "fluentBitTag"
+// User metadata keys for object statistics. S3 adds the "x-amz-meta-" prefix.
+const (
+	eventCountMetadataKey     = "event-count"
+	irSizeMetadataKey         = "ir-size"
+	compressedSizeMetadataKey = "compressed-size"
+	minTimestampMetadataKey   = "min-timestamp"
+	maxTimestampMetadataKey   = "max-timestamp"
+	pluginIdMetadataKey       = "plugin-id"
+	pluginVersionMetadataKey  = "plugin-version"
+)
+
+// Log events sent to a listener.
+type LogBatch struct {
+	Events []irzstd.LogEvent
+	// Receives the error writing the events once they are written, nil if the sender does not wait
+	// for the write.
+	Written chan<- error
+}
 
 // Resources and metadata to process Fluent Bit events with the same tag.
-type S3EventManager struct {
+type EventManager struct {
 	Tag       string
 	Index     int
 	Writer    irzstd.Writer
 	WaitGroup sync.WaitGroup
-	LogEvents chan []ffi.LogEvent
+	LogEvents chan LogBatch
 	Listening bool
+	// Cancels uploads of the listener, nil if the listener is not running.
+	cancelListener context.CancelFunc
+	// Provider to wrap keys of encrypted uploads, nil if uploads are not encrypted.
+	KeyProvider envelope.KeyProvider
+
+	// Arrival time of the oldest event in the buffer. Zero if the buffer is empty.
+	oldestEventTime time.Time
+
+	// Entries for uploaded objects not yet included in a manifest.
+	manifestEntries []ManifestEntry
+	manifestIndex   int
+
+	// Path of the file persisting the multipart upload of the buffer, empty if the buffer is
+	// uploaded when it is complete.
+	multipartPath string
+	// Size of parts uploaded while the buffer is filling.
+	partSize int
+	// Multipart upload of the buffer, nil if no part has been uploaded since the last upload.
+	multipart *multipartUpload
+
+	// Budget shared by buffers held in memory, nil if memory use is not limited.
+	budget *MemoryBudget
+	// Signals the listener to relieve its buffer when the budget is exceeded.
+	relieve chan struct{}
+	// Directory of files of spilled buffers.
+	spillDir string
+
+	// Disk buffer files of a hybrid buffer, nil if the buffer is only in memory or only on disk.
+	hybrid *hybridBuffer
 }
 
 // Starts the upload listener goroutine.
 //
 // Parameters:
 //   - config: Plugin configuration
-//   - uploader: S3 uploader manager
-func (m *S3EventManager) StartListening(config S3Config, uploader *manager.Uploader) {
+//   - uploader: Uploader for storage destination
+func (m *EventManager) StartListening(config Config, uploader Uploader) {
 	log.Printf("Starting upload listener for event manager with tag %s", m.Tag)
+	listenerCtx, cancel := context.WithCancel(context.Background())
+	m.cancelListener = cancel
 	m.Listening = true
 	m.WaitGroup.Add(1)
-	go m.listen(config, uploader)
+	go m.listen(listenerCtx, config, uploader)
+}
+
+// Send sends log events to the listener. The returned channel receives the result once the events
+// are written to the buffer. Disk buffers are synced before the result is sent, so received events
+// are recovered after a crash.
+//
+// Parameters:
+//   - logEvents: Log events
+//
+// Returns:
+//   - written: Receives nil once the events are written, or the error writing them
+func (m *EventManager) Send(logEvents []irzstd.LogEvent) <-chan error {
+	written := make(chan error, 1)
+	m.LogEvents <- LogBatch{Events: logEvents, Written: written}
+	return written
 }
 
-// Ends listener goroutine.
-func (m *S3EventManager) StopListening() {
+// Ends listener goroutine. The listener may be uploading when it is stopped, and uploads pending
+// manifest entries before it ends. Once ctx is done, uploads of the listener are cancelled so the
+// listener ends without waiting for them.
+//
+// Parameters:
+//   - ctx: Context bounding how long uploads of the listener may take
+func (m *EventManager) StopListening(ctx context.Context) {
 	if !m.Listening {
 		return
 	}
 
 	log.Printf("Stopping upload listener for event manager with tag %s", m.Tag)
 
+	stop := context.AfterFunc(ctx, m.cancelListener)
+	defer stop()
+
 	// Closing the channel sends terminate signal to goroutine. The WaitGroup
 	// will block until it actually terminates.
 	close(m.LogEvents)
 	m.WaitGroup.Wait()
+	m.cancelListener()
+	m.cancelListener = nil
 	m.Listening = false
 }
 
-// ToS3 uploads events in the buffer to s3.
-//
-// Parameters:
-//   - config: Plugin configuration
-//   - uploader: S3 uploader manager
-//
-// Returns:
-//   - err: Error closing streams, error uploading, error resetting writer
-func (m *S3EventManager) ToS3(config S3Config, uploader *manager.Uploader) error {
-	return m.toS3(config, uploader)
-}
-
 // Starts upload listener which receives log events on LogEvents channel, writes them to the
-// IR buffer, and triggers uploads when criteria are met or on timeout. This function should
-// be called as a goroutine. Function runs an immortal loop which only exits if the LogEvents
-// channel is closed. When function does exit, it decrements a WaitGroup letting the event
-// manager know it has exited. WaitGroup allows graceful exit of listener when Fluent Bit
-// receives a kill signal. Without WaitGroup, OS may abruptly kill listen goroutine.
+// IR buffer, and triggers uploads when criteria are met or when the oldest buffered event exceeds
+// the max buffer age. This function should be called as a goroutine. Function runs an immortal
+// loop which only exits if the LogEvents channel is closed. When function does exit, it decrements
+// a WaitGroup letting the event manager know it has exited. WaitGroup allows graceful exit of
+// listener when Fluent Bit receives a kill signal. Without WaitGroup, OS may abruptly kill listen
+// goroutine.
 //
 // Parameters:
+//   - ctx: Context of listener uploads, cancelled when the listener is stopped at a deadline
 //   - config: Plugin configuration
-//   - uploader: S3 uploader manager
-func (m *S3EventManager) listen(config S3Config, uploader *manager.Uploader) {
+//   - uploader: Uploader for storage destination
+func (m *EventManager) listen(ctx context.Context, config Config, uploader Uploader) {
 	defer m.WaitGroup.Done()
 
-	timer := time.NewTimer(config.Timeout)
+	// Timer is only armed while the buffer holds events, so an idle listener is never woken up.
+	// It is started when the first event arrives in an empty buffer, so events are buffered for at
+	// most the max buffer age.
+	timer := time.NewTimer(config.MaxBufferAge)
+	timer.Stop()
 	defer timer.Stop()
 
+	// Receiving from a nil channel blocks forever, so manifest case is disabled unless manifest
+	// entries are batched.
+	var manifestTick <-chan time.Time
+	if config.UploadManifest && (config.ManifestInterval > 0) {
+		ticker := time.NewTicker(config.ManifestInterval)
+		defer ticker.Stop()
+		manifestTick = ticker.C
+	}
+
 	for {
 		select {
-		case logEvents, more := <-m.LogEvents:
+		case batch, more := <-m.LogEvents:
 			if !more {
+				m.uploadPendingManifest(ctx, config, uploader)
 				return
 			}
 			log.Printf("Listener with tag %s received log events", m.Tag)
-			numEvents, err := m.Writer.WriteIrZstd(logEvents)
+			numEvents, err := m.Writer.WriteIrZstd(batch.Events)
+			if (numEvents > 0) && m.oldestEventTime.IsZero() {
+				m.oldestEventTime = time.Now()
+				timer.Reset(config.MaxBufferAge)
+			}
 			if err != nil {
-				log.Printf(
-					"Wrote %d out of %d total log events for tag %s: %v",
+				err = fmt.Errorf(
+					"wrote %d out of %d total log events for tag %s: %w",
 					numEvents,
-					len(logEvents),
+					len(batch.Events),
 					m.Tag,
 					err,
 				)
+				log.Print(err)
+			}
+			// Sender is answered before uploading, so uploads do not delay Fluent Bit.
+			if batch.Written != nil {
+				batch.Written <- err
+			}
+			if err != nil {
 				continue
 			}
 			uploadCriteriaMet, err := m.checkUploadCriteriaMet(config.UploadSizeMb)
@@ -109,24 +197,60 @@ func (m *S3EventManager) listen(config S3Config, uploader *manager.Uploader) {
 				continue
 			}
 			if uploadCriteriaMet {
-				m.upload(config, uploader)
-				timer.Reset(config.Timeout)
+				m.upload(ctx, config, uploader)
+				m.resetBufferAge(timer, config.MaxBufferAge)
+			} else if m.multipartPath != "" {
+				m.uploadParts(ctx, config, uploader)
+			} else {
+				m.checkHybridWatermark()
 			}
+			m.updateMemoryBudget(ctx, config, uploader, timer)
 		case <-timer.C:
-			log.Printf("Timeout surpassed for listener with tag %s", m.Tag)
-			m.upload(config, uploader)
-			timer.Reset(config.Timeout)
+			log.Printf(
+				"Oldest event for listener with tag %s exceeded max buffer age of %s",
+				m.Tag,
+				config.MaxBufferAge,
+			)
+			m.upload(ctx, config, uploader)
+			m.resetBufferAge(timer, config.MaxBufferAge)
+			m.updateMemoryBudget(ctx, config, uploader, timer)
+		case <-m.relieve:
+			m.relieveMemory(ctx, config, uploader, timer)
+		case <-manifestTick:
+			m.uploadPendingManifest(ctx, config, uploader)
 		}
 	}
 }
 
-// Uploads to s3 if the buffer is non-empty. Must check that buffer is not empty as timeout can
-// trigger on empty buffer. Logs instead of returning error.
+// Updates buffer age tracking after an upload attempt. If the buffer was emptied, the timer is
+// stopped until the next event arrives. If the upload failed and events remain in the buffer, the
+// timer is rearmed so the upload is retried after another max buffer age.
+//
+// Parameters:
+//   - timer: Listener buffer age timer
+//   - maxBufferAge: Maximum time an event may be buffered
+func (m *EventManager) resetBufferAge(timer *time.Timer, maxBufferAge time.Duration) {
+	empty, err := m.Writer.Empty()
+	if err != nil {
+		log.Printf("failed to check if buffer is empty for tag %s: %v", m.Tag, err)
+	}
+
+	if empty {
+		m.oldestEventTime = time.Time{}
+		timer.Stop()
+		return
+	}
+
+	timer.Reset(maxBufferAge)
+}
+
+// Uploads buffer if it is non-empty. Logs instead of returning error.
 //
 // Parameters:
+//   - ctx: Request context
 //   - config: Plugin configuration
-//   - uploader: S3 uploader manager
-func (m *S3EventManager) upload(config S3Config, uploader *manager.Uploader) {
+//   - uploader: Uploader for storage destination
+func (m *EventManager) upload(ctx context.Context, config Config, uploader Uploader) {
 	empty, err := m.Writer.Empty()
 	if err != nil {
 		log.Printf("failed to check if buffer is empty for tag %s: %v", m.Tag, err)
@@ -138,20 +262,24 @@ func (m *S3EventManager) upload(config S3Config, uploader *manager.Uploader) {
 		return
 	}
 
-	if err := m.toS3(config, uploader); err != nil {
+	if err := m.UploadBuffer(ctx, config, uploader); err != nil {
 		log.Printf("listener upload failed: %v", err)
+		// Buffer is kept on disk until the upload is retried, so it is recovered after a crash.
+		if err := m.PersistBuffer(); err != nil {
+			log.Printf("error persisting buffer for tag %s: %v", m.Tag, err)
+		}
 	}
 }
 
 // Checks whether Zstd buffer size is greater than or equal to upload size.
 //
 // Parameters:
-//   - uploadSizeMb: S3 upload size in MB
+//   - uploadSizeMb: Upload size in MB
 //
 // Returns:
 //   - uploadCriteriaMet: Boolean if upload criteria met or not
 //   - err: Error getting Zstd buffer size
-func (m *S3EventManager) checkUploadCriteriaMet(uploadSizeMb int) (bool, error) {
+func (m *EventManager) checkUploadCriteriaMet(uploadSizeMb int) (bool, error) {
 	bufferSize, err := m.Writer.GetZstdOutputSize()
 	if err != nil {
 		return false, fmt.Errorf("error could not get size of buffer: %w", err)
@@ -172,85 +300,154 @@ func (m *S3EventManager) checkUploadCriteriaMet(uploadSizeMb int) (bool, error)
 	return false, nil
 }
 
-// toS3 sends Zstd buffer to s3 and resets writer and buffers for future uploads. Prior to upload,
-// IR buffer is flushed and IR/Zstd streams are terminated. The [S3EventManager.Index] is
+// UploadBuffer sends Zstd buffer to storage and resets writer and buffers for future uploads. Prior
+// to upload, IR buffer is flushed and IR/Zstd streams are terminated. The [EventManager.Index] is
 // incremented on successful upload.
 //
 // Parameters:
+//   - ctx: Request context, which bounds how long the upload may take
 //   - config: Plugin configuration
-//   - uploader: S3 uploader manager
+//   - uploader: Uploader for storage destination
 //
 // Returns:
 //   - err: Error closing streams, error uploading, error resetting writer
-func (m *S3EventManager) toS3(config S3Config, uploader *manager.Uploader) error {
+func (m *EventManager) UploadBuffer(ctx context.Context, config Config, uploader Uploader) error {
 	err := m.Writer.CloseStreams()
 	if err != nil {
 		return fmt.Errorf("error closing irzstd stream for tag %s: %w", m.Tag, err)
 	}
 
-	outputLocation, err := s3Request(
-		config.S3Bucket,
-		config.S3BucketPrefix,
-		m,
-		config.Id,
-		uploader,
-	)
+	// Size is retrieved before upload since encrypting the buffer changes the upload size.
+	size, err := m.Writer.GetZstdOutputSize()
+	if err != nil {
+		return fmt.Errorf("error could not get size of buffer for tag %s: %w", m.Tag, err)
+	}
+
+	if m.multipart != nil {
+		key, outputLocation, err := m.completeMultipartUpload(ctx, config, uploader, size)
+		if err == nil {
+			return m.finishUpload(ctx, config, uploader, key, outputLocation, size, "")
+		}
+		if !errors.Is(err, errMultipartUploadDiscarded) {
+			return fmt.Errorf("upload failed for event manager with tag %s: %w", m.Tag, err)
+		}
+		log.Printf("Uploading buffer for tag %s as a single object", m.Tag)
+	}
+
+	metadata := m.objectMetadata(config.Id, size)
+
+	body := m.Writer.GetZstdOutput()
+	uploadSize := size
+	if m.KeyProvider != nil {
+		encryptReader, err := envelope.NewEncryptReader(body, m.KeyProvider)
+		if err != nil {
+			return fmt.Errorf("error encrypting buffer for tag %s: %w", m.Tag, err)
+		}
+		maps.Copy(metadata, encryptReader.Header.Metadata())
+		uploadSize = encryptReader.Size(size)
+		body = encryptReader
+	}
+
+	// Checksum is only computed if needed for the manifest. Wrapping the body hides
+	// [io.ReaderAt] from the uploader, which would otherwise read disk buffers in parallel.
+	var checksum hash.Hash
+	if config.UploadManifest {
+		checksum = sha256.New()
+		body = io.TeeReader(body, checksum)
+	}
+
+	key, outputLocation, err := uploader.Upload(ctx, Object{
+		Key:      ObjectKey(config.ObjectKeyTemplate, m.Tag, m.Index, time.Now(), config.Id),
+		Body:     body,
+		Size:     uploadSize,
+		Metadata: metadata,
+		Tag:      m.Tag,
+	})
 	if err != nil {
-		return fmt.Errorf("S3 request failed for event manager with tag %s: %w", m.Tag, err)
+		return fmt.Errorf("upload failed for event manager with tag %s: %w", m.Tag, err)
 	}
 
+	var sha256Sum string
+	if config.UploadManifest {
+		sha256Sum = hex.EncodeToString(checksum.Sum(nil))
+	}
+
+	return m.finishUpload(ctx, config, uploader, key, outputLocation, uploadSize, sha256Sum)
+}
+
+// Records a successful upload and resets the writer. The [EventManager.Index] is incremented.
+//
+// Parameters:
+//   - ctx: Request context of the manifest upload
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+//   - key: Full key of the uploaded object
+//   - outputLocation: URL of the uploaded object
+//   - uploadSize: Size of the uploaded object
+//   - checksum: Hex encoded SHA-256 checksum of the uploaded object, empty without manifests
+//
+// Returns:
+//   - err: Error resetting writer
+func (m *EventManager) finishUpload(
+	ctx context.Context,
+	config Config,
+	uploader Uploader,
+	key string,
+	outputLocation string,
+	uploadSize int,
+	checksum string,
+) error {
 	m.Index += 1
 
 	log.Printf("chunk uploaded to %s", outputLocation)
 
-	err = m.Writer.Reset()
+	if config.UploadManifest {
+		m.addManifestEntry(key, uploadSize, checksum)
+		if config.ManifestInterval == 0 {
+			m.uploadPendingManifest(ctx, config, uploader)
+		}
+	}
+
+	err := m.Writer.Reset()
 	if err != nil {
 		return fmt.Errorf("error resetting irzstd stream for tag %s: %w", m.Tag, err)
 	}
 
+	err = m.restoreHybridBuffer()
+	if err != nil {
+		return fmt.Errorf("error moving buffer for tag %s to memory: %w", m.Tag, err)
+	}
+
 	return nil
 }
 
-// Uploads log events to s3.
+// Collects statistics of the buffered events as object user metadata. Event statistics are omitted
+// for recovered buffers since statistics are not persisted across restarts.
 //
 // Parameters:
-//   - bucket: S3 bucket
-//   - bucketPrefix: Directory prefix in s3
-//   - eventManager: Manager for Fluent Bit events with the same tag
 //   - id: Id of output plugin
-//   - uploader: AWS s3 upload manager
+//   - size: Size of Zstd output after streams are closed
 //
 // Returns:
-//   - err: Error uploading, error unescaping string
-func s3Request(
-	bucket string,
-	bucketPrefix string,
-	eventManager *S3EventManager,
-	id string,
-	uploader *manager.Uploader,
-) (string, error) {
-	currentTime := time.Now()
-	timeString := currentTime.Format(time.RFC3339)
-
-	fileName := fmt.Sprintf("%s_%d_%s_%s.zst", eventManager.Tag, eventManager.Index, timeString, id)
-	fullFilePath := filepath.Join(bucketPrefix, fileName)
-
-	tag := fmt.Sprintf("%s=%s", s3TagKey, eventManager.Tag)
-	result, err := uploader.Upload(context.TODO(), &s3.PutObjectInput{
-		Bucket:  aws.String(bucket),
-		Key:     aws.String(fullFilePath),
-		Body:    eventManager.Writer.GetZstdOutput(),
-		Tagging: &tag,
-	})
-	if err != nil {
-		return "", err
+//   - metadata: Object user metadata
+func (m *EventManager) objectMetadata(id string, size int) map[string]string {
+	metadata := map[string]string{
+		compressedSizeMetadataKey: strconv.Itoa(size),
+		pluginIdMetadataKey:       id,
+		pluginVersionMetadataKey:  Version,
 	}
 
-	// Result location is less readable when escaped.
-	uploadLocation, err := url.QueryUnescape(result.Location)
-	if err != nil {
-		return "", err
+	stats := m.Writer.GetStats()
+	if stats.NumEvents == 0 {
+		return metadata
+	}
+
+	metadata[eventCountMetadataKey] = strconv.Itoa(stats.NumEvents)
+	metadata[irSizeMetadataKey] = strconv.Itoa(stats.IrBytes)
+	if !stats.MinTimestamp.IsZero() {
+		metadata[minTimestampMetadataKey] = stats.MinTimestamp.UTC().Format(time.RFC3339Nano)
+		metadata[maxTimestampMetadataKey] = stats.MaxTimestamp.UTC().Format(time.RFC3339Nano)
 	}
 
-	return uploadLocation, nil
+	return metadata
 }
@@ -0,0 +1,121 @@
+package outctx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Describes an uploaded object in a manifest. Event statistics are omitted for objects uploaded
+// from recovered buffers since statistics are not persisted across restarts.
+type ManifestEntry struct {
+	Key          string `json:"key"`
+	Size         int    `json:"size"`
+	EventCount   int    `json:"eventCount,omitempty"`
+	MinTimestamp string `json:"minTimestamp,omitempty"`
+	MaxTimestamp string `json:"maxTimestamp,omitempty"`
+	Tag          string `json:"tag"`
+	Sha256       string `json:"sha256"`
+}
+
+// Sidecar object listing uploaded objects so downstream ingestion does not need to list or
+// download objects.
+type Manifest struct {
+	Objects []ManifestEntry `json:"objects"`
+}
+
+// Adds an entry for an uploaded object to the pending manifest. Must be called before the writer
+// is reset so statistics are still available.
+//
+// Parameters:
+//   - key: Key of the uploaded object
+//   - size: Size of the uploaded object
+//   - checksum: Hex encoded SHA-256 checksum of the uploaded object
+func (m *EventManager) addManifestEntry(key string, size int, checksum string) {
+	entry := ManifestEntry{
+		Key:    key,
+		Size:   size,
+		Tag:    m.Tag,
+		Sha256: checksum,
+	}
+
+	stats := m.Writer.GetStats()
+	entry.EventCount = stats.NumEvents
+	if !stats.MinTimestamp.IsZero() {
+		entry.MinTimestamp = stats.MinTimestamp.UTC().Format(time.RFC3339Nano)
+		entry.MaxTimestamp = stats.MaxTimestamp.UTC().Format(time.RFC3339Nano)
+	}
+
+	m.manifestEntries = append(m.manifestEntries, entry)
+}
+
+// UploadManifest uploads a manifest with all pending entries. Pending entries are only cleared
+// if the upload succeeds, so they are included in the next manifest after a failure. Nothing is
+// uploaded if there are no pending entries.
+//
+// Parameters:
+//   - ctx: Request context, which bounds the upload
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+//
+// Returns:
+//   - err: Error marshalling manifest, error uploading
+func (m *EventManager) UploadManifest(
+	ctx context.Context,
+	config Config,
+	uploader Uploader,
+) error {
+	if len(m.manifestEntries) == 0 {
+		return nil
+	}
+
+	manifest, err := json.Marshal(Manifest{Objects: m.manifestEntries})
+	if err != nil {
+		return fmt.Errorf("error marshalling manifest: %w", err)
+	}
+
+	timeString := time.Now().Format(time.RFC3339)
+	fileName := fmt.Sprintf(
+		"%s_%d_%s_%s.manifest.json",
+		m.Tag,
+		m.manifestIndex,
+		timeString,
+		config.Id,
+	)
+
+	key, _, err := uploader.Upload(ctx, Object{
+		Key:         fileName,
+		Body:        bytes.NewReader(manifest),
+		Size:        len(manifest),
+		ContentType: "application/json",
+		Tag:         m.Tag,
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("manifest with %d entries uploaded to %s", len(m.manifestEntries), key)
+
+	m.manifestIndex += 1
+	m.manifestEntries = nil
+	return nil
+}
+
+// Uploads pending manifest entries. Logs instead of returning error.
+//
+// Parameters:
+//   - ctx: Request context
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+func (m *EventManager) uploadPendingManifest(
+	ctx context.Context,
+	config Config,
+	uploader Uploader,
+) {
+	if err := m.UploadManifest(ctx, config, uploader); err != nil {
+		log.Printf("failed to upload manifest for tag %s: %v", m.Tag, err)
+	}
+}
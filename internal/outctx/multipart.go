@@ -0,0 +1,403 @@
+package outctx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Multipart upload of a disk buffer. Persisted in the multipart directory of the disk buffer after
+// each change, so the upload can be resumed after a restart.
+type multipartUpload struct {
+	// Key of object relative to the bucket prefix.
+	Key string `json:"key"`
+	// Id of the upload. Empty if the plugin stopped before the upload was created, since the key is
+	// persisted first so the upload can still be found and aborted.
+	UploadId string `json:"uploadId,omitempty"`
+	Parts    []Part `json:"parts,omitempty"`
+	// Number of bytes from the start of the Zstd buffer uploaded as parts.
+	Size int `json:"size"`
+}
+
+// Error returned when a multipart upload cannot be completed and was aborted, so the buffer must
+// be uploaded as a single object.
+var errMultipartUploadDiscarded = errors.New("multipart upload discarded")
+
+// Enables multipart uploads for an event manager if buffers are streamed to storage. A multipart
+// upload persisted for the buffer by a previous execution is loaded so it can be resumed. Uploads
+// which were never created are aborted since their parts are unknown.
+//
+// Parameters:
+//   - eventManager: Event manager with disk buffer
+//
+// Returns:
+//   - err: Error uploader does not support multipart uploads, error reading multipart upload file,
+//     error aborting upload
+func (ctx *Context) enableMultipartUpload(eventManager *EventManager) error {
+	if ctx.MultipartPartSize == 0 {
+		return nil
+	}
+	uploader, ok := ctx.Uploader.(MultipartUploader)
+	if !ok {
+		return errors.New("error uploader does not support multipart uploads")
+	}
+
+	eventManager.multipartPath = ctx.GetMultipartFilePath(eventManager.Tag)
+	eventManager.partSize = ctx.MultipartPartSize
+
+	upload, err := readMultipartUpload(eventManager.multipartPath)
+	if err != nil || upload == nil {
+		return err
+	}
+	eventManager.multipart = upload
+	if upload.UploadId == "" {
+		return eventManager.discardMultipartUpload(context.TODO(), uploader)
+	}
+
+	log.Printf("Resuming multipart upload of %s for tag %s", upload.Key, eventManager.Tag)
+	return nil
+}
+
+// Aborts the multipart upload persisted for a disk buffer by a previous execution and removes its
+// file. Used during recovery for uploads which cannot be resumed, since their buffer is missing or
+// empty, or buffers are no longer streamed.
+//
+// Parameters:
+//   - tag: Fluent Bit tag
+//
+// Returns:
+//   - err: Error reading multipart upload file, error aborting upload, error removing file
+func (ctx *Context) AbortMultipartUpload(tag string) error {
+	eventManager := EventManager{Tag: tag, multipartPath: ctx.GetMultipartFilePath(tag)}
+
+	upload, err := readMultipartUpload(eventManager.multipartPath)
+	if err != nil || upload == nil {
+		return err
+	}
+	eventManager.multipart = upload
+
+	uploader, ok := ctx.Uploader.(MultipartUploader)
+	if !ok {
+		// Buffers were streamed by a plugin for other storage. The upload is left to the bucket's
+		// lifecycle rules.
+		log.Printf("Cannot abort multipart upload of %s for tag %s", upload.Key, tag)
+		return eventManager.removeMultipartUpload()
+	}
+
+	return eventManager.discardMultipartUpload(context.TODO(), uploader)
+}
+
+// Uploads complete parts of the Zstd buffer. Parts are only uploaded once the buffer exceeds the
+// part size, so buffers smaller than a part are uploaded as single objects. Zstd frames are only
+// appended to the buffer once complete and the buffer is only truncated after an upload, so
+// uploaded parts never change. Errors are logged and uploading is retried after the next write.
+//
+// Parameters:
+//   - ctx: Listener context, canceled when listening stops
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+func (m *EventManager) uploadParts(ctx context.Context, config Config, uploader Uploader) {
+	multipartUploader, ok := uploader.(MultipartUploader)
+	if !ok {
+		log.Printf("uploader for tag %s does not support multipart uploads", m.Tag)
+		return
+	}
+
+	size, err := m.Writer.GetZstdOutputSize()
+	if err != nil {
+		log.Printf("error could not get size of buffer for tag %s: %v", m.Tag, err)
+		return
+	}
+
+	uploadedSize := 0
+	if m.multipart != nil {
+		uploadedSize = m.multipart.Size
+	}
+	if size-uploadedSize < m.partSize {
+		return
+	}
+
+	if m.multipart == nil {
+		m.multipart = &multipartUpload{
+			Key: ObjectKey(config.ObjectKeyTemplate, m.Tag, m.Index, time.Now(), config.Id),
+		}
+	}
+
+	for size-m.multipart.Size >= m.partSize {
+		err := m.uploadPart(ctx, config, multipartUploader, m.partSize)
+		if err != nil {
+			log.Printf("error uploading part for tag %s: %v", m.Tag, err)
+			return
+		}
+	}
+}
+
+// Uploads the next part of the Zstd buffer, creating the multipart upload if needed. The upload is
+// persisted after each request.
+//
+// Parameters:
+//   - ctx: Request context
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+//   - size: Size of part
+//
+// Returns:
+//   - err: Error creating upload, error reading buffer, error uploading part, error persisting
+//     upload
+func (m *EventManager) uploadPart(
+	ctx context.Context,
+	config Config,
+	uploader MultipartUploader,
+	size int,
+) error {
+	if m.multipart.UploadId == "" {
+		// Key is persisted before the upload is created, so the upload can be aborted if the plugin
+		// stops before the response is received.
+		err := m.writeMultipartUpload()
+		if err != nil {
+			return err
+		}
+
+		// Statistics are not known until the buffer is complete, so only plugin metadata is set.
+		uploadId, err := uploader.CreateMultipartUpload(ctx, Object{
+			Key: m.multipart.Key,
+			Metadata: map[string]string{
+				pluginIdMetadataKey:      config.Id,
+				pluginVersionMetadataKey: Version,
+			},
+			Tag: m.Tag,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating multipart upload: %w", err)
+		}
+		m.multipart.UploadId = uploadId
+		log.Printf("Created multipart upload of %s for tag %s", m.multipart.Key, m.Tag)
+
+		err = m.writeMultipartUpload()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Disk buffers without encryption are read directly from the Zstd file.
+	buffer, ok := m.Writer.GetZstdOutput().(io.ReaderAt)
+	if !ok {
+		return fmt.Errorf("error buffer for tag %s cannot be read at an offset", m.Tag)
+	}
+
+	number := int32(len(m.multipart.Parts) + 1)
+	etag, err := uploader.UploadPart(
+		ctx,
+		m.multipart.Key,
+		m.multipart.UploadId,
+		number,
+		io.NewSectionReader(buffer, int64(m.multipart.Size), int64(size)),
+		int64(size),
+	)
+	if err != nil {
+		return fmt.Errorf("error uploading part %d: %w", number, err)
+	}
+
+	m.multipart.Parts = append(m.multipart.Parts, Part{Number: number, ETag: etag})
+	m.multipart.Size += size
+	return m.writeMultipartUpload()
+}
+
+// Completes the multipart upload of the buffer by uploading the rest of the Zstd buffer as the last
+// part. Must be called after streams are closed. If the upload no longer exists or does not match
+// the buffer, it is aborted and [errMultipartUploadDiscarded] is returned.
+//
+// Parameters:
+//   - ctx: Request context
+//   - config: Plugin configuration
+//   - uploader: Uploader for storage destination
+//   - size: Size of Zstd output after streams are closed
+//
+// Returns:
+//   - key: Full key of the uploaded object including bucket prefix
+//   - location: URL of the uploaded object
+//   - err: [errMultipartUploadDiscarded], error uploading part, error completing upload, error
+//     persisting upload
+func (m *EventManager) completeMultipartUpload(
+	ctx context.Context,
+	config Config,
+	uploader Uploader,
+	size int,
+) (string, string, error) {
+	multipartUploader, ok := uploader.(MultipartUploader)
+	if !ok {
+		return "", "", errors.New("error uploader does not support multipart uploads")
+	}
+
+	// Recovered buffers are truncated to complete Zstd frames, which always include the uploaded
+	// parts unless the buffer was modified.
+	if size < m.multipart.Size {
+		log.Printf(
+			"Buffer for tag %s is smaller than uploaded parts of multipart upload %s",
+			m.Tag,
+			m.multipart.Key,
+		)
+		return "", "", m.discardUnusableMultipartUpload(ctx, multipartUploader)
+	}
+
+	// The rest of the buffer may exceed the part size if events were written since parts were last
+	// uploaded, so it is split to keep parts within the part size. The last part may be smaller. A
+	// part is uploaded even if the rest of the buffer is empty, since an upload must have at least
+	// one part.
+	for (size > m.multipart.Size) || (len(m.multipart.Parts) == 0) {
+		err := m.uploadPart(ctx, config, multipartUploader, min(size-m.multipart.Size, m.partSize))
+		if errors.Is(err, ErrUploadNotFound) {
+			return "", "", m.discardUnusableMultipartUpload(ctx, multipartUploader)
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	key, location, err := multipartUploader.CompleteMultipartUpload(
+		ctx,
+		m.multipart.Key,
+		m.multipart.UploadId,
+		m.multipart.Parts,
+	)
+	if errors.Is(err, ErrUploadNotFound) {
+		return "", "", m.discardUnusableMultipartUpload(ctx, multipartUploader)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("error completing multipart upload: %w", err)
+	}
+
+	// File is removed before the buffer is reset. If the plugin stops in between, the buffer is
+	// uploaded again as done after other uploads.
+	err = m.removeMultipartUpload()
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, location, nil
+}
+
+// Aborts a multipart upload which cannot be completed.
+//
+// Parameters:
+//   - ctx: Request context
+//   - uploader: Uploader for storage destination
+//
+// Returns:
+//   - err: [errMultipartUploadDiscarded], error aborting upload
+func (m *EventManager) discardUnusableMultipartUpload(
+	ctx context.Context,
+	uploader MultipartUploader,
+) error {
+	err := m.discardMultipartUpload(ctx, uploader)
+	if err != nil {
+		return err
+	}
+	return errMultipartUploadDiscarded
+}
+
+// Aborts the multipart upload of the buffer and removes its file. If the upload was never created,
+// every upload in progress for its key is aborted. Uploads which no longer exist are ignored.
+//
+// Parameters:
+//   - ctx: Request context
+//   - uploader: Uploader for storage destination
+//
+// Returns:
+//   - err: Error listing uploads, error aborting upload, error removing file
+func (m *EventManager) discardMultipartUpload(
+	ctx context.Context,
+	uploader MultipartUploader,
+) error {
+	uploadIds := []string{m.multipart.UploadId}
+	if m.multipart.UploadId == "" {
+		var err error
+		uploadIds, err = uploader.ListMultipartUploads(ctx, m.multipart.Key)
+		if err != nil {
+			return fmt.Errorf("error listing multipart uploads of %s: %w", m.multipart.Key, err)
+		}
+	}
+
+	for _, uploadId := range uploadIds {
+		err := uploader.AbortMultipartUpload(ctx, m.multipart.Key, uploadId)
+		if err != nil && !errors.Is(err, ErrUploadNotFound) {
+			return fmt.Errorf("error aborting multipart upload of %s: %w", m.multipart.Key, err)
+		}
+	}
+	log.Printf("Aborted multipart upload of %s for tag %s", m.multipart.Key, m.Tag)
+
+	return m.removeMultipartUpload()
+}
+
+// Persists the multipart upload of the buffer. The file is replaced atomically, so it is complete
+// after a crash.
+//
+// Returns:
+//   - err: Error writing file
+func (m *EventManager) writeMultipartUpload() error {
+	data, err := json.Marshal(m.multipart)
+	if err != nil {
+		return fmt.Errorf("error encoding multipart upload: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(m.multipartPath), 0o700)
+	if err != nil {
+		return fmt.Errorf("error creating multipart directory: %w", err)
+	}
+
+	tempPath := m.multipartPath + ".tmp"
+	err = os.WriteFile(tempPath, data, 0o600)
+	if err == nil {
+		err = os.Rename(tempPath, m.multipartPath)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing multipart upload file %s: %w", m.multipartPath, err)
+	}
+
+	return nil
+}
+
+// Removes the file of the multipart upload and forgets the upload.
+//
+// Returns:
+//   - err: Error removing file
+func (m *EventManager) removeMultipartUpload() error {
+	err := os.Remove(m.multipartPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing multipart upload file %s: %w", m.multipartPath, err)
+	}
+	m.multipart = nil
+	return nil
+}
+
+// Reads a persisted multipart upload.
+//
+// Parameters:
+//   - path: Path to multipart upload file
+//
+// Returns:
+//   - upload: Multipart upload, nil if the file does not exist
+//   - err: Error reading file, error decoding file
+func readMultipartUpload(path string) (*multipartUpload, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading multipart upload file %s: %w", path, err)
+	}
+
+	var upload multipartUpload
+	err = json.Unmarshal(data, &upload)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding multipart upload file %s: %w", path, err)
+	}
+
+	return &upload, nil
+}
@@ -0,0 +1,64 @@
+package outctx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Placeholders replaced in object_key_template.
+const (
+	tagPlaceholder   = "{tag}"
+	indexPlaceholder = "{index}"
+	timePlaceholder  = "{time}"
+	idPlaceholder    = "{id}"
+)
+
+// Checks that an object key template only contains known placeholders.
+//
+// Parameters:
+//   - template: Object key template
+//
+// Returns:
+//   - err: Error template contains unknown placeholder
+func validateObjectKeyTemplate(template string) error {
+	remaining := strings.NewReplacer(
+		tagPlaceholder, "",
+		indexPlaceholder, "",
+		timePlaceholder, "",
+		idPlaceholder, "",
+	).Replace(template)
+	if strings.ContainsAny(remaining, "{}") {
+		return fmt.Errorf(
+			"error object_key_template %q contains unknown placeholder, supported "+
+				"placeholders are %s, %s, %s, and %s",
+			template,
+			tagPlaceholder,
+			indexPlaceholder,
+			timePlaceholder,
+			idPlaceholder,
+		)
+	}
+	return nil
+}
+
+// ObjectKey generates the key of an uploaded object relative to the bucket prefix.
+//
+// Parameters:
+//   - template: Object key template
+//   - tag: Fluent Bit tag
+//   - index: Index of upload for tag
+//   - uploadTime: Time of upload
+//   - id: Id of output plugin
+//
+// Returns:
+//   - key: Object key
+func ObjectKey(template string, tag string, index int, uploadTime time.Time, id string) string {
+	return strings.NewReplacer(
+		tagPlaceholder, tag,
+		indexPlaceholder, strconv.Itoa(index),
+		timePlaceholder, uploadTime.Format(time.RFC3339),
+		idPlaceholder, id,
+	).Replace(template)
+}
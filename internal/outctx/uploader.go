@@ -0,0 +1,883 @@
+package outctx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"google.golang.org/api/option"
+
+	"github.com/y-scope/fluent-bit-clp/internal/clpcompress"
+	"github.com/y-scope/fluent-bit-clp/internal/httpout"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+)
+
+// Key when tagging objects with Fluent Bit tag. Used as a metadata key for storage without object
+// tags.
+const tagKey = "fluentBitTag"
+
+// Object to upload.
+type Object struct {
+	// Key of object relative to the bucket prefix.
+	Key  string
+	Body io.Reader
+	// Byte length of body.
+	Size        int
+	ContentType string
+	// User metadata of object.
+	Metadata map[string]string
+	// Fluent Bit tag of events in object.
+	Tag string
+}
+
+// Uploads objects to a storage destination. Allows event managers to be shared by plugins for
+// different destinations.
+type Uploader interface {
+	// Uploads an object.
+	//
+	// Parameters:
+	//   - ctx: Request context
+	//   - object: Object to upload
+	//
+	// Returns:
+	//   - key: Full key of the uploaded object including bucket prefix
+	//   - location: URL of the uploaded object
+	//   - err
+	Upload(ctx context.Context, object Object) (string, string, error)
+}
+
+// Part of a multipart upload.
+type Part struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// Uploads objects in parts as they are buffered. Implemented by uploaders for storage which
+// supports multipart uploads, so large buffers can be uploaded without reading them again when they
+// are complete.
+type MultipartUploader interface {
+	Uploader
+
+	// Starts a multipart upload. The body of the object is ignored.
+	//
+	// Parameters:
+	//   - ctx: Request context
+	//   - object: Object to upload
+	//
+	// Returns:
+	//   - uploadId: Id of the multipart upload
+	//   - err
+	CreateMultipartUpload(ctx context.Context, object Object) (string, error)
+
+	// Uploads a part. Uploading a part with the number of an uploaded part replaces it.
+	//
+	// Parameters:
+	//   - ctx: Request context
+	//   - key: Key of object relative to the bucket prefix
+	//   - uploadId: Id of the multipart upload
+	//   - number: Part number, starting at 1
+	//   - body: Content of the part
+	//   - size: Byte length of body
+	//
+	// Returns:
+	//   - etag: Entity tag of the uploaded part
+	//   - err: [ErrUploadNotFound] if the multipart upload does not exist
+	UploadPart(
+		ctx context.Context,
+		key string,
+		uploadId string,
+		number int32,
+		body io.ReadSeeker,
+		size int64,
+	) (string, error)
+
+	// Completes a multipart upload by concatenating its parts.
+	//
+	// Parameters:
+	//   - ctx: Request context
+	//   - key: Key of object relative to the bucket prefix
+	//   - uploadId: Id of the multipart upload
+	//   - parts: Uploaded parts in order
+	//
+	// Returns:
+	//   - key: Full key of the uploaded object including bucket prefix
+	//   - location: URL of the uploaded object
+	//   - err: [ErrUploadNotFound] if the multipart upload does not exist
+	CompleteMultipartUpload(
+		ctx context.Context,
+		key string,
+		uploadId string,
+		parts []Part,
+	) (string, string, error)
+
+	// Aborts a multipart upload and removes its parts.
+	//
+	// Parameters:
+	//   - ctx: Request context
+	//   - key: Key of object relative to the bucket prefix
+	//   - uploadId: Id of the multipart upload
+	//
+	// Returns:
+	//   - err: [ErrUploadNotFound] if the multipart upload does not exist
+	AbortMultipartUpload(ctx context.Context, key string, uploadId string) error
+
+	// Lists multipart uploads in progress for a key.
+	//
+	// Parameters:
+	//   - ctx: Request context
+	//   - key: Key of object relative to the bucket prefix
+	//
+	// Returns:
+	//   - uploadIds: Ids of multipart uploads
+	//   - err
+	ListMultipartUploads(ctx context.Context, key string) ([]string, error)
+}
+
+// Error returned by [MultipartUploader] if a multipart upload does not exist, e.g. since it was
+// completed, aborted, or removed by a bucket lifecycle rule.
+var ErrUploadNotFound = errors.New("multipart upload not found")
+
+// Uploads objects to an S3 bucket. Objects are tagged with their Fluent Bit tag.
+type s3Uploader struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+// Creates a [MultipartUploader] for an S3 bucket.
+//
+// Parameters:
+//   - client: S3 client
+//   - bucket: S3 bucket
+//   - prefix: Directory prefix in s3
+//   - partSize: Byte size of parts of multipart uploads
+//   - concurrency: Number of parts of an object uploaded in parallel
+//
+// Returns:
+//   - uploader: S3 uploader
+func NewS3Uploader(
+	client *s3.Client,
+	bucket string,
+	prefix string,
+	partSize int,
+	concurrency int,
+) MultipartUploader {
+	return &s3Uploader{
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			u.PartSize = int64(partSize)
+			u.Concurrency = concurrency
+		}),
+		bucket: bucket,
+		prefix: prefix,
+	}
+}
+
+// Uploads an object to s3.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to upload
+//
+// Returns:
+//   - key: S3 key of the uploaded object
+//   - location: URL of the uploaded object
+//   - err: Error uploading, error unescaping string
+func (u *s3Uploader) Upload(ctx context.Context, object Object) (string, string, error) {
+	key := filepath.Join(u.prefix, object.Key)
+
+	input := s3.PutObjectInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(key),
+		Body:     object.Body,
+		Metadata: object.Metadata,
+	}
+	if object.ContentType != "" {
+		input.ContentType = aws.String(object.ContentType)
+	}
+	if object.Tag != "" {
+		input.Tagging = aws.String(fmt.Sprintf("%s=%s", tagKey, object.Tag))
+	}
+
+	result, err := u.uploader.Upload(ctx, &input)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Result location is less readable when escaped.
+	location, err := url.QueryUnescape(result.Location)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, location, nil
+}
+
+// Starts a multipart upload to s3. Objects are tagged and their metadata is set when the upload is
+// created.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to upload
+//
+// Returns:
+//   - uploadId: Id of the multipart upload
+//   - err: Error creating upload
+func (u *s3Uploader) CreateMultipartUpload(ctx context.Context, object Object) (string, error) {
+	input := s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(filepath.Join(u.prefix, object.Key)),
+		Metadata: object.Metadata,
+	}
+	if object.ContentType != "" {
+		input.ContentType = aws.String(object.ContentType)
+	}
+	if object.Tag != "" {
+		input.Tagging = aws.String(fmt.Sprintf("%s=%s", tagKey, object.Tag))
+	}
+
+	result, err := u.client.CreateMultipartUpload(ctx, &input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.ToString(result.UploadId), nil
+}
+
+// Uploads a part to s3.
+//
+// Parameters:
+//   - ctx: Request context
+//   - key: Key of object relative to the bucket prefix
+//   - uploadId: Id of the multipart upload
+//   - number: Part number, starting at 1
+//   - body: Content of the part
+//   - size: Byte length of body
+//
+// Returns:
+//   - etag: Entity tag of the uploaded part
+//   - err: [ErrUploadNotFound], error uploading
+func (u *s3Uploader) UploadPart(
+	ctx context.Context,
+	key string,
+	uploadId string,
+	number int32,
+	body io.ReadSeeker,
+	size int64,
+) (string, error) {
+	result, err := u.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(u.bucket),
+		Key:           aws.String(filepath.Join(u.prefix, key)),
+		UploadId:      aws.String(uploadId),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return "", s3UploadError(err)
+	}
+
+	return aws.ToString(result.ETag), nil
+}
+
+// Completes a multipart upload to s3.
+//
+// Parameters:
+//   - ctx: Request context
+//   - key: Key of object relative to the bucket prefix
+//   - uploadId: Id of the multipart upload
+//   - parts: Uploaded parts in order
+//
+// Returns:
+//   - key: S3 key of the uploaded object
+//   - location: URL of the uploaded object
+//   - err: [ErrUploadNotFound], error completing upload, error unescaping string
+func (u *s3Uploader) CompleteMultipartUpload(
+	ctx context.Context,
+	key string,
+	uploadId string,
+	parts []Part,
+) (string, string, error) {
+	key = filepath.Join(u.prefix, key)
+
+	completedParts := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedParts = append(completedParts, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int32(part.Number),
+		})
+	}
+
+	result, err := u.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(u.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+	if err != nil {
+		return "", "", s3UploadError(err)
+	}
+
+	location, err := url.QueryUnescape(aws.ToString(result.Location))
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, location, nil
+}
+
+// Aborts a multipart upload to s3.
+//
+// Parameters:
+//   - ctx: Request context
+//   - key: Key of object relative to the bucket prefix
+//   - uploadId: Id of the multipart upload
+//
+// Returns:
+//   - err: [ErrUploadNotFound], error aborting upload
+func (u *s3Uploader) AbortMultipartUpload(ctx context.Context, key string, uploadId string) error {
+	_, err := u.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(filepath.Join(u.prefix, key)),
+		UploadId: aws.String(uploadId),
+	})
+	if err != nil {
+		return s3UploadError(err)
+	}
+	return nil
+}
+
+// Lists multipart uploads to s3 in progress for a key.
+//
+// Parameters:
+//   - ctx: Request context
+//   - key: Key of object relative to the bucket prefix
+//
+// Returns:
+//   - uploadIds: Ids of multipart uploads
+//   - err: Error listing uploads
+func (u *s3Uploader) ListMultipartUploads(ctx context.Context, key string) ([]string, error) {
+	key = filepath.Join(u.prefix, key)
+
+	// Keys are unique to an event manager, so there are too few uploads to need pagination.
+	result, err := u.client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(u.bucket),
+		Prefix: aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var uploadIds []string
+	for _, upload := range result.Uploads {
+		// Prefix also matches longer keys.
+		if aws.ToString(upload.Key) == key {
+			uploadIds = append(uploadIds, aws.ToString(upload.UploadId))
+		}
+	}
+
+	return uploadIds, nil
+}
+
+// Converts S3 errors for missing multipart uploads to [ErrUploadNotFound].
+//
+// Parameters:
+//   - err: Error from S3 request
+//
+// Returns:
+//   - err: Wrapped [ErrUploadNotFound], or err
+func s3UploadError(err error) error {
+	var ae smithy.APIError
+	if errors.As(err, &ae) && ae.ErrorCode() == noSuchUploadCode {
+		return fmt.Errorf("%w: %w", ErrUploadNotFound, err)
+	}
+	return err
+}
+
+// Uploads objects to a GCS bucket. GCS does not support object tags, so the Fluent Bit tag is
+// added to the object metadata.
+type gcsUploader struct {
+	client *storage.Client
+	bucket string
+	prefix string
+}
+
+// Creates a GCS client. Requests are sent to endpoint if set, and are not authenticated if
+// credentialsFile is empty.
+//
+// Parameters:
+//   - ctx: Context used to load credentials
+//   - endpoint: Base URL of the GCS JSON API, or empty for the default
+//   - credentialsFile: Service account JSON key file, or empty
+//
+// Returns:
+//   - client: GCS client
+//   - err: Error loading credentials
+func NewGcsClient(
+	ctx context.Context,
+	endpoint string,
+	credentialsFile string,
+) (*storage.Client, error) {
+	var options []option.ClientOption
+	if endpoint != "" {
+		options = append(
+			options,
+			option.WithEndpoint(strings.TrimSuffix(endpoint, "/")+"/storage/v1/"),
+		)
+	}
+	if credentialsFile != "" {
+		options = append(options, option.WithCredentialsFile(credentialsFile))
+	} else {
+		options = append(options, option.WithoutAuthentication())
+	}
+	return storage.NewClient(ctx, options...)
+}
+
+// Creates an [Uploader] for a GCS bucket.
+//
+// Parameters:
+//   - client: GCS client
+//   - bucket: GCS bucket
+//   - prefix: Directory prefix in bucket
+//
+// Returns:
+//   - uploader: GCS uploader
+func NewGcsUploader(client *storage.Client, bucket string, prefix string) Uploader {
+	return &gcsUploader{client: client, bucket: bucket, prefix: prefix}
+}
+
+// Uploads an object to GCS.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to upload
+//
+// Returns:
+//   - key: Name of the uploaded object
+//   - location: gs:// URL of the uploaded object
+//   - err: Error uploading
+func (u *gcsUploader) Upload(ctx context.Context, object Object) (string, string, error) {
+	// GCS object names always use forward slashes.
+	key := path.Join(u.prefix, object.Key)
+
+	metadata := make(map[string]string, len(object.Metadata)+1)
+	maps.Copy(metadata, object.Metadata)
+	if object.Tag != "" {
+		metadata[tagKey] = object.Tag
+	}
+
+	// Canceling the context aborts the upload if the body cannot be read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	writer := u.client.Bucket(u.bucket).Object(key).NewWriter(ctx)
+	writer.ContentType = object.ContentType
+	writer.Metadata = metadata
+	// Send the object in a single request rather than a resumable upload.
+	writer.ChunkSize = 0
+
+	_, err := io.Copy(writer, object.Body)
+	if err != nil {
+		return "", "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, fmt.Sprintf("gs://%s/%s", u.bucket, key), nil
+}
+
+// Uploads objects to an Azure Blob Storage container as block blobs. The Fluent Bit tag is added
+// as a blob index tag.
+type azureBlobUploader struct {
+	client    *azblob.Client
+	container string
+	prefix    string
+	blockSize int
+}
+
+// Creates an Azure Blob Storage client. Requests are authorized with either an account key or a
+// SAS token.
+//
+// Parameters:
+//   - endpoint: Base URL of storage account, https://<accountName>.blob.core.windows.net if empty
+//   - accountName: Storage account name
+//   - accountKey: Base64 encoded account key, empty if using a SAS token
+//   - sasToken: SAS token, empty if using an account key
+//
+// Returns:
+//   - client: Azure Blob Storage client
+//   - err: Error no credentials, error account name missing, error decoding account key
+func NewAzureBlobClient(
+	endpoint string,
+	accountName string,
+	accountKey string,
+	sasToken string,
+) (*azblob.Client, error) {
+	if endpoint == "" {
+		if accountName == "" {
+			return nil, errors.New("error account name is required without an endpoint")
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", accountName)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/") + "/"
+
+	switch {
+	case accountKey != "" && sasToken != "":
+		return nil, errors.New("error only one of account key and SAS token may be set")
+	case accountKey != "":
+		if accountName == "" {
+			return nil, errors.New("error account name is required with an account key")
+		}
+		credential, err := azblob.NewSharedKeyCredential(accountName, accountKey)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding account key: %w", err)
+		}
+		return azblob.NewClientWithSharedKeyCredential(endpoint, credential, nil)
+	case sasToken != "":
+		return azblob.NewClientWithNoCredential(
+			endpoint+"?"+strings.TrimPrefix(sasToken, "?"),
+			nil,
+		)
+	default:
+		return nil, errors.New("error account key or SAS token is required")
+	}
+}
+
+// Creates an [Uploader] for an Azure Blob Storage container.
+//
+// Parameters:
+//   - client: Azure Blob Storage client
+//   - container: Azure container
+//   - prefix: Directory prefix in container
+//   - blockSize: Size of staged blocks in bytes
+//
+// Returns:
+//   - uploader: Azure Blob Storage uploader
+func NewAzureBlobUploader(
+	client *azblob.Client,
+	container string,
+	prefix string,
+	blockSize int,
+) Uploader {
+	return &azureBlobUploader{
+		client:    client,
+		container: container,
+		prefix:    prefix,
+		blockSize: blockSize,
+	}
+}
+
+// Uploads an object to Azure Blob Storage. Body is staged one block at a time, so only one block
+// is held in memory. Metadata names must be C# identifiers, so dashes in metadata keys are
+// replaced with underscores.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to upload
+//
+// Returns:
+//   - key: Name of the uploaded blob
+//   - location: URL of the uploaded blob
+//   - err: Error uploading
+func (u *azureBlobUploader) Upload(ctx context.Context, object Object) (string, string, error) {
+	key := path.Join(u.prefix, object.Key)
+
+	metadata := make(map[string]*string, len(object.Metadata))
+	for name, value := range object.Metadata {
+		metadata[strings.ReplaceAll(name, "-", "_")] = &value
+	}
+
+	var tags map[string]string
+	if object.Tag != "" {
+		tags = map[string]string{tagKey: object.Tag}
+	}
+
+	options := azblob.UploadStreamOptions{
+		BlockSize:   int64(u.blockSize),
+		Concurrency: 1,
+		Metadata:    metadata,
+		Tags:        tags,
+	}
+	if object.ContentType != "" {
+		options.HTTPHeaders = &blob.HTTPHeaders{BlobContentType: &object.ContentType}
+	}
+	_, err := u.client.UploadStream(ctx, u.container, key, object.Body, &options)
+	if err != nil {
+		return "", "", err
+	}
+
+	blobClient := u.client.ServiceClient().NewContainerClient(u.container).NewBlobClient(key)
+	location, err := url.Parse(blobClient.URL())
+	if err != nil {
+		return "", "", err
+	}
+	// Do not record the SAS token.
+	location.RawQuery = ""
+
+	return key, location.String(), nil
+}
+
+// Sends objects to an HTTP endpoint. The Fluent Bit tag and metadata are sent as headers.
+type httpUploader struct {
+	client *httpout.Client
+}
+
+// Creates an [Uploader] for an HTTP endpoint.
+//
+// Parameters:
+//   - client: HTTP client
+//
+// Returns:
+//   - uploader: HTTP uploader
+func NewHttpUploader(client *httpout.Client) Uploader {
+	return &httpUploader{client: client}
+}
+
+// Sends an object to the HTTP endpoint.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to send
+//
+// Returns:
+//   - key: Key of the sent object
+//   - location: URL the object was sent to
+//   - err: Error sending
+func (u *httpUploader) Upload(ctx context.Context, object Object) (string, string, error) {
+	location, err := u.client.Upload(ctx, httpout.Object{
+		Key:         object.Key,
+		Body:        object.Body,
+		ContentType: object.ContentType,
+		Metadata:    object.Metadata,
+		Tag:         object.Tag,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return object.Key, location, nil
+}
+
+// Headers describing the object published in each Kafka record. Object metadata is sent with the
+// metadata key as the header key.
+const (
+	kafkaContentTypeHeader = "content-type"
+	kafkaObjectKeyHeader   = "clp-object-key"
+	kafkaTagHeader         = "clp-tag"
+	// Index of the record in the object starting at 1, and number of records of the object.
+	kafkaPartHeader  = "clp-part"
+	kafkaPartsHeader = "clp-parts"
+)
+
+// Content type of Zstd compressed KV-IR published to Kafka.
+const kafkaContentType = "application/x-clp-ir+zstd"
+
+// Room left in produce batches for record headers and batch overhead.
+const kafkaBatchOverhead = 64 << 10
+
+// Creates an idempotent Kafka producer for a single topic. Records are acknowledged by all in-sync
+// replicas, and keyed records are partitioned like the Java client. Brokers are not contacted
+// until the first request.
+//
+// Parameters:
+//   - brokers: Addresses of brokers used to discover the cluster
+//   - topic: Topic to publish to
+//   - clientId: Client id sent with each request
+//   - timeout: Timeout of each request
+//   - retryLimit: Number of times a failed request is retried
+//   - maxRecordBytes: Maximum size of record values
+//   - opts: Additional client options, which override the defaults
+//
+// Returns:
+//   - client: Kafka client
+//   - err: Error invalid options
+func NewKafkaClient(
+	brokers []string,
+	topic string,
+	clientId string,
+	timeout time.Duration,
+	retryLimit int,
+	maxRecordBytes int,
+	opts ...kgo.Opt,
+) (*kgo.Client, error) {
+	defaults := []kgo.Opt{
+		kgo.SeedBrokers(brokers...),
+		kgo.DefaultProduceTopic(topic),
+		kgo.ClientID(clientId),
+		kgo.DialTimeout(timeout),
+		kgo.ProduceRequestTimeout(timeout),
+		kgo.RequestRetries(retryLimit),
+		kgo.RecordRetries(retryLimit),
+		kgo.ProducerBatchMaxBytes(int32(maxRecordBytes + kafkaBatchOverhead)),
+	}
+	return kgo.NewClient(append(defaults, opts...)...)
+}
+
+// Publishes objects to a Kafka topic. Objects larger than the maximum record size are split into
+// several records which must be concatenated by consumers.
+type kafkaUploader struct {
+	client         *kgo.Client
+	topic          string
+	maxRecordBytes int
+	// Whether object tags are buffer tags created by [BufferTag].
+	grouped bool
+}
+
+// Creates an [Uploader] for a Kafka topic.
+//
+// Parameters:
+//   - client: Kafka client
+//   - topic: Kafka topic
+//   - maxRecordBytes: Maximum size of record values
+//   - grouped: Whether events are grouped by a record key, which is used as the message key
+//
+// Returns:
+//   - uploader: Kafka uploader
+func NewKafkaUploader(
+	client *kgo.Client,
+	topic string,
+	maxRecordBytes int,
+	grouped bool,
+) Uploader {
+	return &kafkaUploader{
+		client:         client,
+		topic:          topic,
+		maxRecordBytes: maxRecordBytes,
+		grouped:        grouped,
+	}
+}
+
+// Publishes an object to Kafka. The object is read into memory and split into records at Zstd
+// frame boundaries, so each record can be decompressed on its own unless a frame is larger than a
+// record. Records of an object have the same message key, so they are published to the same
+// partition in order. The message key is the value of the group key, or the Fluent Bit tag if
+// events are not grouped or the value is missing. If publishing a record fails, previous records
+// of the object are not removed and are published again when the upload is retried.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to publish
+//
+// Returns:
+//   - key: Key of the published object
+//   - location: kafka:// URL of the first record of the object
+//   - err: Error reading body, error publishing
+func (u *kafkaUploader) Upload(ctx context.Context, object Object) (string, string, error) {
+	tag := object.Tag
+	messageKey := object.Tag
+	// Buffers recovered from before grouping was enabled have plain tags.
+	if u.grouped {
+		if fluentBitTag, value, err := SplitBufferTag(object.Tag); err == nil {
+			tag = fluentBitTag
+			messageKey = fluentBitTag
+			if value != "" {
+				messageKey = value
+			}
+		}
+	}
+
+	var body bytes.Buffer
+	body.Grow(object.Size)
+	if _, err := body.ReadFrom(object.Body); err != nil {
+		return "", "", fmt.Errorf("error reading object %s: %w", object.Key, err)
+	}
+	parts := irzstd.SplitFrames(body.Bytes(), u.maxRecordBytes)
+
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = kafkaContentType
+	}
+	headers := []kgo.RecordHeader{
+		{Key: kafkaContentTypeHeader, Value: []byte(contentType)},
+		{Key: kafkaObjectKeyHeader, Value: []byte(object.Key)},
+		{Key: kafkaTagHeader, Value: []byte(tag)},
+		{Key: kafkaPartsHeader, Value: []byte(strconv.Itoa(len(parts)))},
+	}
+	for _, name := range slices.Sorted(maps.Keys(object.Metadata)) {
+		headers = append(headers, kgo.RecordHeader{
+			Key:   name,
+			Value: []byte(object.Metadata[name]),
+		})
+	}
+
+	var location string
+	for i, value := range parts {
+		part := i + 1
+		partHeader := kgo.RecordHeader{Key: kafkaPartHeader, Value: []byte(strconv.Itoa(part))}
+		record, err := u.client.ProduceSync(ctx, &kgo.Record{
+			Key:     []byte(messageKey),
+			Value:   value,
+			Headers: append(slices.Clip(headers), partHeader),
+		}).First()
+		if err != nil {
+			return "", "", fmt.Errorf("error publishing part %d of %d: %w", part, len(parts), err)
+		}
+		if part == 1 {
+			location = fmt.Sprintf("kafka://%s/%d/%d", u.topic, record.Partition, record.Offset)
+		}
+	}
+
+	return object.Key, location, nil
+}
+
+// Ingests objects into a CLP package. Objects are staged as files named by their keys.
+type clpUploader struct {
+	compressor *clpcompress.Compressor
+}
+
+// Creates an [Uploader] for a CLP package.
+//
+// Parameters:
+//   - compressor: CLP compressor
+//
+// Returns:
+//   - uploader: CLP package uploader
+func NewClpUploader(compressor *clpcompress.Compressor) Uploader {
+	return &clpUploader{compressor: compressor}
+}
+
+// Ingests an object into the CLP package and waits for the compress job to finish. Metadata and
+// tag are not stored since the CLP package only ingests the events.
+//
+// Parameters:
+//   - ctx: Request context
+//   - object: Object to ingest
+//
+// Returns:
+//   - key: Key of the ingested object
+//   - location: Path of the staged file
+//   - err: Error staging object, error from compress job
+func (u *clpUploader) Upload(ctx context.Context, object Object) (string, string, error) {
+	path, err := u.compressor.Ingest(ctx, clpcompress.Object{
+		Key:  object.Key,
+		Body: object.Body,
+		Id:   object.Tag,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return object.Key, path, nil
+}
@@ -0,0 +1,165 @@
+// Package plugin implements the Fluent Bit callbacks shared by all output plugins. Each plugin's
+// main package exports the callbacks required by Fluent Bit and forwards them to this package
+// with the constructor of its output context.
+package plugin
+
+import (
+	"fmt"
+	"log"
+	"unsafe"
+
+	"github.com/fluent/fluent-bit-go/output"
+
+	"github.com/y-scope/fluent-bit-clp/internal/exit"
+	"github.com/y-scope/fluent-bit-clp/internal/flush"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+	"github.com/y-scope/fluent-bit-clp/internal/pathregistry"
+	"github.com/y-scope/fluent-bit-clp/internal/recovery"
+)
+
+// NewContext creates the output context of a plugin instance from its Fluent Bit plugin
+// reference.
+type NewContext func(plugin unsafe.Pointer) (*outctx.Context, error)
+
+// Register registers the plugin with Fluent Bit and sets the log prefix to the plugin name.
+//
+// Parameters:
+//   - def: Fluent Bit plugin definition
+//   - name: Name of the plugin
+//   - description: Description of the plugin
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+func Register(def unsafe.Pointer, name string, description string) int {
+	logPrefix := fmt.Sprintf("[%s] ", name)
+	log.SetPrefix(logPrefix)
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+	log.Printf("Register called")
+	return output.FLBPluginRegister(def, name, description)
+}
+
+// Init creates the output context of a plugin instance and recovers logs stored on disk.
+//
+// Parameters:
+//   - plugin: Fluent Bit plugin reference
+//   - newContext: Constructor of the output context
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+func Init(plugin unsafe.Pointer, newContext NewContext) int {
+	outCtx, err := newContext(plugin)
+	if err != nil {
+		log.Fatalf("Failed to initialize plugin: %s", err)
+	}
+
+	log.Printf("Init called for id: %s", outCtx.Config.Id)
+
+	if outCtx.Config.UseDiskBuffer {
+		err = recovery.RecoverBufferFiles(outCtx)
+		if err != nil {
+			log.Fatalf("Failed to recover logs stored on disk: %s", err)
+		}
+	}
+
+	// Set the context for this instance so that params can be retrieved during flush.
+	output.FLBPluginSetContext(plugin, outCtx)
+	return output.FLB_OK
+}
+
+// Flush ingests a chunk of records into the plugin instance.
+//
+// Parameters:
+//   - ctx: Fluent Bit plugin context
+//   - chunk: Msgpack data copied into Go memory
+//   - tag: Fluent Bit tag
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+func Flush(ctx unsafe.Pointer, chunk []byte, tag string) int {
+	outCtx := getContext(ctx)
+
+	log.Printf(
+		"Flush called for id %s with tag %s and size %d",
+		outCtx.Config.Id,
+		tag,
+		len(chunk),
+	)
+
+	code, err := flush.Ingest(chunk, tag, outCtx)
+	if err != nil {
+		log.Printf("error flushing data: %s", err)
+		// RETRY or ERROR
+		return code
+	}
+
+	return output.FLB_OK
+}
+
+// Exit handles the exit callback called without a plugin instance.
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+func Exit() int {
+	log.Printf("Exit called for unknown instance")
+	return output.FLB_OK
+}
+
+// ExitCtx gracefully exits a plugin instance, uploading its buffers depending on the config.
+//
+// Parameters:
+//   - ctx: Fluent Bit plugin context
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+func ExitCtx(ctx unsafe.Pointer) int {
+	outCtx := getContext(ctx)
+
+	log.Printf("Exit called for id: %s", outCtx.Config.Id)
+
+	var err error
+	if outCtx.Config.UseDiskBuffer {
+		if outCtx.Config.UploadOnExit {
+			err = exit.UploadWithDeadline(outCtx)
+		} else {
+			err = exit.NoUpload(outCtx)
+		}
+		pathregistry.Unregister(outCtx.Config.DiskBufferPath)
+	} else {
+		err = exit.Upload(outCtx)
+	}
+	if err != nil {
+		log.Printf("Failed to exit gracefully")
+	}
+
+	if outCtx.Redactor != nil {
+		log.Printf("Redacted values by rule: %s", outCtx.Redactor)
+	}
+
+	return output.FLB_OK
+}
+
+// Unregister unregisters the plugin from Fluent Bit.
+//
+// Parameters:
+//   - def: Fluent Bit plugin definition
+func Unregister(def unsafe.Pointer) {
+	log.Printf("Unregister called")
+	output.FLBPluginUnregister(def)
+}
+
+// Retrieves the output context of a plugin instance.
+//
+// Parameters:
+//   - ctx: Fluent Bit plugin context
+//
+// Returns:
+//   - outCtx: Output context set during initialization
+func getContext(ctx unsafe.Pointer) *outctx.Context {
+	p := output.FLBPluginGetContext(ctx)
+	// Type assert context back into the original type for the Go variable.
+	outCtx, ok := p.(*outctx.Context)
+	if !ok {
+		log.Fatal("Could not read plugin context")
+	}
+	return outCtx
+}
@@ -1,4 +1,4 @@
-// Package provides ability to recover disk buffer on startup and send to s3.
+// Package provides ability to recover disk buffer on startup and send to storage.
 
 package recovery
 
@@ -8,41 +8,125 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/y-scope/fluent-bit-clp/internal/outctx"
 )
 
-// Sends existing disk buffers to S3.
+// Disk buffer files for a Fluent Bit tag.
+type Buffer struct {
+	Tag      string
+	IrPath   string
+	ZstdPath string
+	IrSize   int64
+	ZstdSize int64
+}
+
+// Sends existing disk buffers to storage.
 //
 // Parameters:
 //   - ctx: Plugin context
 //
 // Returns:
 //   - err: Error retrieving files, error files not valid, error flushing existing buffer
-func RecoverBufferFiles(ctx *outctx.S3Context) error {
-	irFiles, zstdFiles, err := getBufferFiles(ctx)
+func RecoverBufferFiles(ctx *outctx.Context) error {
+	buffers, err := GetBuffers(ctx)
 	if err != nil {
 		return err
 	}
 
-	err = checkFilesValid(irFiles, zstdFiles)
+	err = abortMultipartUploads(ctx, buffers)
 	if err != nil {
 		return err
 	}
 
+	for _, buffer := range buffers {
+		err := flushExistingBuffer(buffer, ctx)
+		if err != nil {
+			return fmt.Errorf("error flushing existing buffer '%s': %w", buffer.Tag, err)
+		}
+	}
+
+	return nil
+}
+
+// GetBuffers retrieves existing disk buffers sorted by tag. Checks that every tag has both an IR
+// and a Zstd buffer file.
+//
+// Parameters:
+//   - ctx: Plugin context
+//
+// Returns:
+//   - buffers: Disk buffers
+//   - err: Error retrieving files, error files not valid
+func GetBuffers(ctx *outctx.Context) ([]Buffer, error) {
+	irFiles, zstdFiles, err := getBufferFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkFilesValid(irFiles, zstdFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	buffers := make([]Buffer, 0, len(irFiles))
 	for tag, irFileInfo := range irFiles {
 		// Don't need to check ok return value since we already checked if key exists.
 		zstdFileInfo := zstdFiles[tag]
-		err := flushExistingBuffer(tag, irFileInfo, zstdFileInfo, ctx)
+		irPath, zstdPath := ctx.GetBufferFilePaths(tag)
+		buffers = append(buffers, Buffer{
+			Tag:      tag,
+			IrPath:   irPath,
+			ZstdPath: zstdPath,
+			IrSize:   irFileInfo.Size(),
+			ZstdSize: zstdFileInfo.Size(),
+		})
+	}
+
+	sort.Slice(buffers, func(i, j int) bool {
+		return buffers[i].Tag < buffers[j].Tag
+	})
+
+	return buffers, nil
+}
+
+// RemoveEmptyBufferFiles removes disk buffer files for tags whose IR and Zstd buffers are both
+// empty.
+//
+// Parameters:
+//   - ctx: Plugin context
+//
+// Returns:
+//   - err: Error retrieving files, error files not valid, error removing files
+func RemoveEmptyBufferFiles(ctx *outctx.Context) error {
+	buffers, err := GetBuffers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, buffer := range buffers {
+		if !buffer.Empty() {
+			continue
+		}
+		err := removeBufferFiles(buffer.IrPath, buffer.ZstdPath)
 		if err != nil {
-			return fmt.Errorf("error flushing existing buffer '%s': %w", tag, err)
+			return err
 		}
 	}
 
 	return nil
 }
 
+// Checks if buffer is empty.
+//
+// Returns:
+//   - empty: Boolean value that is true if both IR and Zstd buffer files are empty
+func (b Buffer) Empty() bool {
+	return (b.IrSize == 0) && (b.ZstdSize == 0)
+}
+
 // Retrieves FileInfo for every file in IR and Zstd disk buffer directories. For both IR and Zstd
 // directories, returns map with FluentBit tag as keys and FileInfo as values.
 //
@@ -54,7 +138,7 @@ func RecoverBufferFiles(ctx *outctx.S3Context) error {
 //   - ZstdFiles: Zstd file map
 //   - err: Error reading directory
 func getBufferFiles(
-	ctx *outctx.S3Context,
+	ctx *outctx.Context,
 ) (map[string]os.FileInfo, map[string]os.FileInfo, error) {
 	irBufferPath, zstdBufferPath := ctx.GetBufferPaths()
 	irFiles, err := readDirectory(irBufferPath)
@@ -151,41 +235,73 @@ func checkFilesValid(irFiles map[string]fs.FileInfo, zstdFiles map[string]fs.Fil
 	return nil
 }
 
-// Flushes existing disk buffer to s3 on startup. Prior to sending, opens disk buffer files and
-// creates new [outctx.S3EventManager] using existing buffer files.
+// Aborts multipart uploads persisted by a previous execution which cannot be resumed. Uploads are
+// resumed when their buffer is recovered, so uploads are only aborted if their buffer is missing or
+// empty, or if buffers are no longer uploaded with multipart uploads.
+//
+// Parameters:
+//   - ctx: Plugin context
+//   - buffers: Disk buffers
+//
+// Returns:
+//   - err: Error reading directory, error aborting upload
+func abortMultipartUploads(ctx *outctx.Context, buffers []Buffer) error {
+	multipartPath := filepath.Join(ctx.Config.DiskBufferPath, outctx.MultipartDir)
+	dirEntries, err := os.ReadDir(multipartPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("error reading directory '%s': %w", multipartPath, err)
+	}
+
+	resumable := make(map[string]bool)
+	if ctx.MultipartPartSize > 0 {
+		for _, buffer := range buffers {
+			resumable[buffer.Tag] = !buffer.Empty()
+		}
+	}
+
+	for _, dirEntry := range dirEntries {
+		// Skips temporary files left by a crash while the upload was persisted.
+		tag, ok := strings.CutSuffix(dirEntry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if resumable[tag] {
+			continue
+		}
+		err := ctx.AbortMultipartUpload(tag)
+		if err != nil {
+			return fmt.Errorf("error aborting multipart upload for tag %s: %w", tag, err)
+		}
+	}
+
+	return nil
+}
+
+// Flushes existing disk buffer to storage on startup. Prior to sending, opens disk buffer files and
+// creates new [outctx.EventManager] using existing buffer files.
 //
 // Parameters:
-//   - tag: Fluent Bit tag
-//   - irFileInfo: FileInfo for IR disk buffer file
-//   - zstdFileInfo: FileInfo for Zstd disk buffer file
+//   - buffer: Disk buffer files
 //   - ctx: Plugin context
 //
 // Returns:
-//   - err: error removing/open files, error creating event manager, error flushing to s3
-func flushExistingBuffer(
-	tag string,
-	irFileInfo fs.FileInfo,
-	zstdFileInfo fs.FileInfo,
-	ctx *outctx.S3Context,
-) error {
-	irPath, zstdPath := ctx.GetBufferFilePaths(tag)
-
-	irFileSize := irFileInfo.Size()
-	zstdFileSize := zstdFileInfo.Size()
-
-	if (irFileSize == 0) && (zstdFileSize == 0) {
-		err := removeBufferFiles(irPath, zstdPath)
+//   - err: error removing/open files, error creating event manager, error uploading
+func flushExistingBuffer(buffer Buffer, ctx *outctx.Context) error {
+	if buffer.Empty() {
+		err := removeBufferFiles(buffer.IrPath, buffer.ZstdPath)
 		// If both files are empty, and there is no error, it will skip tag. Creating unnecessary
 		// event manager is wasteful. Also prevents accumulation of event mangers with tags no
 		// longer being sent by Fluent Bit.
 		return err
 	}
 
-	err := ctx.RecoverEventManager(tag)
+	err := ctx.RecoverEventManager(buffer.Tag)
 	if err != nil {
 		return fmt.Errorf("error recovering event manager with tag: %w", err)
 	}
-	log.Printf("Recovered disk buffers with tag %s", tag)
+	log.Printf("Recovered disk buffers with tag %s", buffer.Tag)
 	return nil
 }
 
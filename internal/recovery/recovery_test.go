@@ -0,0 +1,823 @@
+package recovery
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/exit"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+	"github.com/y-scope/fluent-bit-clp/internal/testutil"
+)
+
+const testTag = "app"
+
+// Environment variable holding disk buffer key for encrypted tests.
+const testKeyEnv = "CLP_TEST_DISK_BUFFER_KEY"
+
+// Simulates crashes by writing disk buffers with [irzstd.NewDiskWriter], then modifying the
+// buffer files to match the state at the crash. Events are acknowledged once
+// [irzstd.Writer.WriteIrZstd] returns, since Fluent Bit is then told the chunk was flushed.
+type crashTest struct {
+	t        *testing.T
+	server   *testutil.S3Server
+	ctx      *outctx.Context
+	irPath   string
+	zstdPath string
+	writer   irzstd.Writer
+	acked    []irzstd.LogEvent
+	rand     *rand.Rand
+	next     int
+}
+
+func newCrashTest(t *testing.T) *crashTest {
+	return newCrashTestWithConfig(t, testutil.NewS3Config(t))
+}
+
+// Creates a crash test with disk buffers encrypted using a key from an environment variable.
+func newEncryptedCrashTest(t *testing.T) *crashTest {
+	t.Setenv(testKeyEnv, strings.Repeat("ab", irzstd.KeySize))
+	config := testutil.NewS3Config(t)
+	config.DiskBufferKeyEnv = testKeyEnv
+	return newCrashTestWithConfig(t, config)
+}
+
+func newCrashTestWithConfig(t *testing.T, config outctx.S3Config) *crashTest {
+	server := testutil.NewS3Server(t)
+	ctx := testutil.NewS3Context(t, server, config)
+	irPath, zstdPath := ctx.GetBufferFilePaths(testTag)
+
+	writer, err := irzstd.NewDiskWriter(irPath, zstdPath, ctx.BufferCipher, "")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+
+	return &crashTest{
+		t:        t,
+		server:   server,
+		ctx:      ctx,
+		irPath:   irPath,
+		zstdPath: zstdPath,
+		writer:   writer,
+		rand:     rand.New(rand.NewSource(1)),
+	}
+}
+
+// Writes events with random payloads so IR compresses poorly and reaches the compaction threshold
+// quickly.
+func (c *crashTest) write(n int) {
+	events := make([]irzstd.LogEvent, n)
+	for i := range events {
+		events[i].LogEvent = ffi.LogEvent{
+			AutoKvPairs: map[string]any{},
+			UserKvPairs: map[string]any{
+				"log": fmt.Sprintf("event %d payload %x", c.next, c.rand.Uint64()),
+			},
+		}
+		c.next += 1
+	}
+
+	numEvents, err := c.writer.WriteIrZstd(events)
+	if err != nil {
+		c.t.Fatalf("failed to write events: %v", err)
+	}
+	c.acked = append(c.acked, events[:numEvents]...)
+}
+
+// Writes events until IR is compacted into at least one Zstd frame.
+func (c *crashTest) writeUntilCompacted() {
+	for fileSize(c.t, c.zstdPath) == 0 {
+		c.write(1000)
+	}
+}
+
+// Replaces the disk buffer keys of the plugin context.
+//
+// Parameters:
+//   - keys: Encoded keys separated by commas
+func (c *crashTest) setKeys(keys string) {
+	c.t.Setenv(testKeyEnv, keys)
+	cipher, err := c.ctx.Config.NewBufferCipher()
+	if err != nil {
+		c.t.Fatalf("failed to create cipher: %v", err)
+	}
+	c.ctx.BufferCipher = cipher
+}
+
+// Stops writer without terminating streams, leaving disk buffers as they would be after a crash.
+func (c *crashTest) crash() {
+	if err := c.writer.Close(); err != nil {
+		c.t.Fatalf("failed to close writer: %v", err)
+	}
+}
+
+// Appends data to a disk buffer file.
+func (c *crashTest) appendFile(path string, data []byte) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		c.t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		c.t.Fatalf("failed to write %s: %v", path, err)
+	}
+}
+
+// Compresses the IR buffer into a Zstd frame as done during compaction.
+func (c *crashTest) compactIr() []byte {
+	ir, err := os.ReadFile(c.irPath)
+	if err != nil {
+		c.t.Fatalf("failed to read IR buffer: %v", err)
+	}
+	return encodeFrame(c.t, ir)
+}
+
+// Runs recovery and decodes the uploaded object. Fails the test unless every acknowledged event is
+// in the object in order.
+//
+// Parameters:
+//   - allowTruncated: Allow a decode error after the acknowledged events
+func (c *crashTest) recoverAndCheck(allowTruncated bool) {
+	c.t.Helper()
+
+	if err := RecoverBufferFiles(c.ctx); err != nil {
+		c.t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(c.ctx); err != nil {
+		c.t.Fatalf("exit failed: %v", err)
+	}
+
+	objects := c.server.Objects(testutil.Bucket)
+	if len(objects) != 1 {
+		c.t.Fatalf("expected 1 uploaded object, got %d", len(objects))
+	}
+
+	events, err := testutil.DecodeUnterminatedEvents(objects[0].Body)
+	if err != nil && !allowTruncated {
+		c.t.Fatalf("failed to decode uploaded object: %v", err)
+	}
+
+	if len(events) < len(c.acked) {
+		c.t.Fatalf("expected at least %d events, got %d", len(c.acked), len(events))
+	}
+	for i, acked := range c.acked {
+		if events[i].UserKvPairs["log"] != acked.UserKvPairs["log"] {
+			c.t.Fatalf(
+				"event %d: expected %v, got %v",
+				i,
+				acked.UserKvPairs["log"],
+				events[i].UserKvPairs["log"],
+			)
+		}
+	}
+	if !allowTruncated && len(events) != len(c.acked) {
+		c.t.Fatalf("expected %d events, got %d", len(c.acked), len(events))
+	}
+}
+
+func TestRecoverAfterExit(t *testing.T) {
+	c := newCrashTest(t)
+	c.write(10)
+	c.crash()
+	c.recoverAndCheck(false)
+}
+
+func TestDiskBufferPermissions(t *testing.T) {
+	c := newCrashTest(t)
+	c.write(10)
+
+	// Buffers hold log contents, so only the owner may access them.
+	for _, path := range []string{c.irPath, c.zstdPath} {
+		for path, expected := range map[string]os.FileMode{
+			path:               0o600,
+			filepath.Dir(path): 0o700,
+		} {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("failed to stat %s: %v", path, err)
+			}
+			if info.Mode().Perm() != expected {
+				t.Errorf("expected %s to have mode %o, got %o", path, expected, info.Mode().Perm())
+			}
+		}
+	}
+}
+
+func TestRecoverMidIrWrite(t *testing.T) {
+	c := newCrashTest(t)
+	c.write(10)
+	acked := len(c.acked)
+	c.write(10)
+	c.crash()
+
+	// Crash while writing the second batch cuts the last event short. The batch was never
+	// acknowledged.
+	c.acked = c.acked[:acked]
+	if err := os.Truncate(c.irPath, fileSize(t, c.irPath)-5); err != nil {
+		t.Fatalf("failed to truncate IR buffer: %v", err)
+	}
+
+	c.recoverAndCheck(true)
+}
+
+func TestRecoverMidCompaction(t *testing.T) {
+	c := newCrashTest(t)
+	c.writeUntilCompacted()
+	c.write(10)
+	c.crash()
+
+	// Crash while compacting leaves an incomplete frame and an untruncated IR buffer.
+	frame := c.compactIr()
+	c.appendFile(c.zstdPath, frame[:len(frame)/2])
+
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverBetweenUploadAndReset(t *testing.T) {
+	c := newCrashTest(t)
+	c.writeUntilCompacted()
+	c.write(10)
+	if err := c.writer.CloseStreams(); err != nil {
+		t.Fatalf("failed to close streams: %v", err)
+	}
+	c.crash()
+
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverMidCloseStreams(t *testing.T) {
+	c := newCrashTest(t)
+	c.write(10)
+	c.crash()
+
+	// Crash after IR buffer is compacted and truncated, but while writing the frame with the end
+	// of stream byte.
+	c.appendFile(c.zstdPath, c.compactIr())
+	if err := os.Truncate(c.irPath, 0); err != nil {
+		t.Fatalf("failed to truncate IR buffer: %v", err)
+	}
+	endOfStream := encodeFrame(t, []byte{0})
+	c.appendFile(c.zstdPath, endOfStream[:len(endOfStream)-2])
+
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverRemovesEmptyBuffers(t *testing.T) {
+	c := newCrashTest(t)
+	c.crash()
+
+	if err := RecoverBufferFiles(c.ctx); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+
+	for _, path := range []string{c.irPath, c.zstdPath} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected %s to be removed: %v", path, err)
+		}
+	}
+	if objects := c.server.Objects(testutil.Bucket); len(objects) != 0 {
+		t.Errorf("expected no uploads, got %d", len(objects))
+	}
+}
+
+func TestRecoverEncrypted(t *testing.T) {
+	c := newEncryptedCrashTest(t)
+	c.writeUntilCompacted()
+	c.write(10)
+	c.crash()
+
+	for _, path := range []string{c.irPath, c.zstdPath} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", path, err)
+		}
+		if strings.Contains(string(data), "payload") {
+			t.Errorf("expected %s to be encrypted", path)
+		}
+	}
+
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverEncryptedMidIrWrite(t *testing.T) {
+	c := newEncryptedCrashTest(t)
+	c.writeUntilCompacted()
+	c.write(10)
+	acked := len(c.acked)
+	c.write(10)
+	c.crash()
+
+	// Crash while appending the sealed frame of the second batch. The incomplete frame cannot be
+	// decrypted, so the whole batch is dropped. The batch was never acknowledged.
+	c.acked = c.acked[:acked]
+	if err := os.Truncate(c.irPath, fileSize(t, c.irPath)-5); err != nil {
+		t.Fatalf("failed to truncate IR buffer: %v", err)
+	}
+
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverEncryptedMidCompaction(t *testing.T) {
+	c := newEncryptedCrashTest(t)
+	c.writeUntilCompacted()
+	c.write(10)
+	c.crash()
+
+	// Crash while appending the sealed frame of a compaction leaves an incomplete sealed frame and
+	// an untruncated IR buffer.
+	zstdSize := fileSize(t, c.zstdPath)
+	c.appendFile(c.zstdPath, make([]byte, 100))
+	f, err := os.OpenFile(c.zstdPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open Zstd buffer: %v", err)
+	}
+	if _, err := f.WriteAt([]byte("CLPE\xff\xff\x00\x00"), zstdSize); err != nil {
+		t.Fatalf("failed to write Zstd buffer: %v", err)
+	}
+	f.Close()
+
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverEncryptedWrongKey(t *testing.T) {
+	c := newEncryptedCrashTest(t)
+	c.write(10)
+	c.crash()
+
+	irSize := fileSize(t, c.irPath)
+
+	// Data key of the buffer cannot be unwrapped with a different key.
+	c.setKeys(strings.Repeat("cd", irzstd.KeySize))
+	err := RecoverBufferFiles(c.ctx)
+	if !errors.Is(err, irzstd.ErrDecryptionFailed) {
+		t.Fatalf("expected decryption error, got %v", err)
+	}
+	if size := fileSize(t, c.irPath); size != irSize {
+		t.Errorf("expected IR buffer of %d bytes to be kept, got %d bytes", irSize, size)
+	}
+}
+
+func TestRecoverEncryptedRotatedKey(t *testing.T) {
+	c := newEncryptedCrashTest(t)
+	c.writeUntilCompacted()
+	c.write(10)
+	c.crash()
+	irSize := fileSize(t, c.irPath)
+	zstdSize := fileSize(t, c.zstdPath)
+
+	// Recovering with the new key followed by the previous key rewraps the data keys.
+	previousKey := strings.Repeat("ab", irzstd.KeySize)
+	newKey := strings.Repeat("cd", irzstd.KeySize)
+	c.setKeys(newKey + "," + previousKey)
+	writer, err := irzstd.RecoverWriter(c.irPath, c.zstdPath, c.ctx.BufferCipher, "")
+	if err != nil {
+		t.Fatalf("recovery with rotated key failed: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	// Frames are not re-encrypted, only their wrapped data keys are replaced.
+	if size := fileSize(t, c.irPath); size != irSize {
+		t.Errorf("expected IR buffer of %d bytes, got %d bytes", irSize, size)
+	}
+	if size := fileSize(t, c.zstdPath); size != zstdSize {
+		t.Errorf("expected Zstd buffer of %d bytes, got %d bytes", zstdSize, size)
+	}
+
+	// Previous key is no longer needed.
+	c.setKeys(newKey)
+	c.recoverAndCheck(false)
+}
+
+func TestRecoverGcs(t *testing.T) {
+	server := testutil.NewGcsServer(t)
+	ctx := testutil.NewGcsContext(t, server, testutil.NewGcsConfig(t, server))
+	irPath, zstdPath := ctx.GetBufferFilePaths(testTag)
+	writer, err := irzstd.NewDiskWriter(irPath, zstdPath, ctx.BufferCipher, "")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	events := []irzstd.LogEvent{{
+		LogEvent: ffi.LogEvent{
+			AutoKvPairs: map[string]any{},
+			UserKvPairs: map[string]any{"log": "event"},
+		},
+	}}
+	if _, err := writer.WriteIrZstd(events); err != nil {
+		t.Fatalf("failed to write events: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	if err := RecoverBufferFiles(ctx); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 1 {
+		t.Fatalf("expected 1 uploaded object, got %d", len(objects))
+	}
+	decoded := testutil.DecodeEvents(t, objects[0].Body)
+	if len(decoded) != 1 || decoded[0].UserKvPairs["log"] != "event" {
+		t.Errorf("unexpected events %v", decoded)
+	}
+}
+
+// Sends batches of events with random payloads to the listener until done returns true, or until
+// the listener fails to write a batch. Each batch is written before the next is sent, but the
+// listener may still be uploading, so done should check state changed by earlier batches.
+//
+// Returns:
+//   - sent: Events sent to the listener
+func sendUntil(t *testing.T, ctx *outctx.Context, done func() bool) []irzstd.LogEvent {
+	eventManager, err := ctx.GetEventManager(testTag)
+	if err != nil {
+		t.Fatalf("failed to create event manager: %v", err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	var sent []irzstd.LogEvent
+	for !done() {
+		events := make([]irzstd.LogEvent, 1000)
+		for i := range events {
+			events[i].LogEvent = ffi.LogEvent{
+				AutoKvPairs: map[string]any{},
+				UserKvPairs: map[string]any{
+					"log": fmt.Sprintf("event %d payload %x", len(sent)+i, r.Uint64()),
+				},
+			}
+		}
+		if err := <-eventManager.Send(events); err != nil {
+			// Writer rejects events while a failed upload is pending.
+			return sent
+		}
+		sent = append(sent, events...)
+	}
+	return sent
+}
+
+// Sends events to the listener of a context with multipart streaming until a multipart upload is
+// created, then stops the plugin without uploading.
+//
+// Returns:
+//   - sent: Events sent to the listener
+func streamUntilMultipartUpload(
+	t *testing.T,
+	server *testutil.S3Server,
+	ctx *outctx.Context,
+) []irzstd.LogEvent {
+	sent := sendUntil(t, ctx, func() bool {
+		return len(server.PendingMultipartUploads()) > 0
+	})
+	if err := exit.NoUpload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	return sent
+}
+
+// Checks that the bucket has one object with every sent event in order, and no multipart uploads.
+func checkSingleObject(t *testing.T, server *testutil.S3Server, sent []irzstd.LogEvent) {
+	t.Helper()
+
+	if pending := server.PendingMultipartUploads(); len(pending) != 0 {
+		t.Errorf("expected no pending multipart uploads, got %v", pending)
+	}
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 1 {
+		t.Fatalf("expected 1 uploaded object, got %d", len(objects))
+	}
+	decoded := testutil.DecodeEvents(t, objects[0].Body)
+	if len(decoded) != len(sent) {
+		t.Fatalf("expected %d events, got %d", len(sent), len(decoded))
+	}
+	for i, event := range decoded {
+		if event.UserKvPairs["log"] != sent[i].UserKvPairs["log"] {
+			t.Fatalf(
+				"event %d: expected %v, got %v",
+				i,
+				sent[i].UserKvPairs["log"],
+				event.UserKvPairs["log"],
+			)
+		}
+	}
+}
+
+func TestRecoverMultipartUpload(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.S3MultipartStreaming = true
+	ctx := testutil.NewS3Context(t, server, config)
+	// Small parts so the buffer is streamed after the first compaction.
+	ctx.MultipartPartSize = 64 << 10
+
+	sent := streamUntilMultipartUpload(t, server, ctx)
+	if objects := server.Objects(testutil.Bucket); len(objects) != 0 {
+		t.Fatalf("expected no uploaded objects before restart, got %d", len(objects))
+	}
+
+	restarted := testutil.NewS3Context(t, server, config)
+	restarted.MultipartPartSize = ctx.MultipartPartSize
+	if err := RecoverBufferFiles(restarted); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(restarted); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	checkSingleObject(t, server, sent)
+	object := server.Objects(testutil.Bucket)[0]
+	if object.Tagging != "fluentBitTag="+testTag || object.Metadata["plugin-id"] != "test" {
+		t.Errorf("unexpected tagging %q and metadata %v", object.Tagging, object.Metadata)
+	}
+	multipartPath := restarted.GetMultipartFilePath(testTag)
+	if _, err := os.Stat(multipartPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %s to be removed: %v", multipartPath, err)
+	}
+}
+
+func TestRecoverAbortsMultipartUpload(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.S3MultipartStreaming = true
+	ctx := testutil.NewS3Context(t, server, config)
+	ctx.MultipartPartSize = 64 << 10
+
+	sent := streamUntilMultipartUpload(t, server, ctx)
+
+	// Upload cannot be resumed once streaming is disabled, so the whole buffer is uploaded.
+	config.S3MultipartStreaming = false
+	restarted := testutil.NewS3Context(t, server, config)
+	if err := RecoverBufferFiles(restarted); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(restarted); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	checkSingleObject(t, server, sent)
+}
+
+// Restarts the plugin with the same configuration and recovers disk buffers.
+func restartAndRecover(t *testing.T, server *testutil.S3Server, config outctx.S3Config) {
+	t.Helper()
+
+	ctx := testutil.NewS3Context(t, server, config)
+	if err := RecoverBufferFiles(ctx); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	irPath, zstdPath := ctx.GetBufferFilePaths(testTag)
+	for _, path := range []string{irPath, zstdPath} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected buffer to be moved to memory after upload, %s: %v", path, err)
+		}
+	}
+}
+
+func TestRecoverHybridBuffer(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.HybridBuffer = true
+	ctx := testutil.NewS3Context(t, server, config)
+
+	batches := 0
+	sent := sendUntil(t, ctx, func() bool {
+		batches += 1
+		return batches > 3
+	})
+	_, zstdPath := ctx.GetBufferFilePaths(testTag)
+	if _, err := os.Stat(zstdPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected buffer to be in memory before exit: %v", err)
+	}
+
+	// Exit moves the buffer to disk so it is recovered.
+	if err := exit.NoUpload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	if fileSize(t, zstdPath) == 0 {
+		t.Fatalf("expected buffer to be moved to disk on exit")
+	}
+
+	restartAndRecover(t, server, config)
+	checkSingleObject(t, server, sent)
+}
+
+func TestRecoverHybridBufferWatermark(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.HybridBuffer = true
+	config.HybridBufferWatermarkMb = 1
+	ctx := testutil.NewS3Context(t, server, config)
+
+	// Events sent after the buffer crosses the watermark continue the stream on disk.
+	_, zstdPath := ctx.GetBufferFilePaths(testTag)
+	persisted := 0
+	sent := sendUntil(t, ctx, func() bool {
+		if _, err := os.Stat(zstdPath); err == nil {
+			persisted += 1
+		}
+		return persisted > 3
+	})
+	if err := exit.NoUpload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+
+	restartAndRecover(t, server, config)
+	checkSingleObject(t, server, sent)
+}
+
+func TestRecoverHybridBufferFailedUpload(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.HybridBuffer = true
+	config.UploadSizeMb = 2
+	ctx := testutil.NewS3Context(t, server, config)
+	server.FailRequests(1000)
+
+	_, zstdPath := ctx.GetBufferFilePaths(testTag)
+	sent := sendUntil(t, ctx, func() bool {
+		_, err := os.Stat(zstdPath)
+		return err == nil
+	})
+	if err := exit.NoUpload(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	if objects := server.Objects(testutil.Bucket); len(objects) != 0 {
+		t.Fatalf("expected no uploaded objects before restart, got %d", len(objects))
+	}
+
+	server.FailRequests(0)
+	restartAndRecover(t, server, config)
+
+	// Events received after the failed upload are not written until the upload is retried.
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 1 {
+		t.Fatalf("expected 1 uploaded object, got %d", len(objects))
+	}
+	decoded, err := testutil.DecodeUnterminatedEvents(objects[0].Body)
+	if err != nil {
+		t.Fatalf("failed to decode uploaded object: %v", err)
+	}
+	if len(decoded) == 0 {
+		t.Fatalf("expected events written before the failed upload")
+	}
+	for i, event := range decoded {
+		if event.UserKvPairs["log"] != sent[i].UserKvPairs["log"] {
+			t.Fatalf("event %d does not match", i)
+		}
+	}
+}
+
+// Sends batches of events with the test tag.
+//
+// Returns:
+//   - sent: Events sent to the listener
+func sendBatches(t *testing.T, ctx *outctx.Context, n int) []irzstd.LogEvent {
+	batches := 0
+	return sendUntil(t, ctx, func() bool {
+		batches += 1
+		return batches > n
+	})
+}
+
+func TestUploadOnExit(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.UploadOnExit = true
+	ctx := testutil.NewS3Context(t, server, config)
+
+	sent := sendBatches(t, ctx, 3)
+	other, err := ctx.GetEventManager("other")
+	if err != nil {
+		t.Fatalf("failed to create event manager: %v", err)
+	}
+	if err := <-other.Send(sent[:10]); err != nil {
+		t.Fatalf("failed to write events: %v", err)
+	}
+
+	if err := exit.UploadWithDeadline(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	objects := server.Objects(testutil.Bucket)
+	if len(objects) != 2 {
+		t.Fatalf("expected 1 uploaded object per tag, got %d", len(objects))
+	}
+	for _, tag := range []string{testTag, "other"} {
+		_, zstdPath := ctx.GetBufferFilePaths(tag)
+		if size := fileSize(t, zstdPath); size != 0 {
+			t.Errorf("expected empty buffer for tag %s after exit, got %d bytes", tag, size)
+		}
+	}
+
+}
+
+func TestUploadOnExitDeadline(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.UploadOnExit = true
+	config.UploadOnExitTimeout = 100 * time.Millisecond
+	ctx := testutil.NewS3Context(t, server, config)
+
+	sent := sendBatches(t, ctx, 3)
+	server.DelayRequests(time.Minute)
+
+	start := time.Now()
+	if err := exit.UploadWithDeadline(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected exit to stop uploading at the deadline, took %v", elapsed)
+	}
+	if objects := server.Objects(testutil.Bucket); len(objects) != 0 {
+		t.Fatalf("expected no uploaded objects before restart, got %d", len(objects))
+	}
+
+	// Buffer which missed the deadline is left on disk and uploaded on restart.
+	server.DelayRequests(0)
+	restarted := testutil.NewS3Context(t, server, config)
+	if err := RecoverBufferFiles(restarted); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(restarted); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	checkSingleObject(t, server, sent)
+}
+
+func TestUploadOnExitDeadlineDuringListenerUpload(t *testing.T) {
+	server := testutil.NewS3Server(t)
+	config := testutil.NewS3Config(t)
+	config.UploadOnExit = true
+	config.UploadOnExitTimeout = 100 * time.Millisecond
+	config.MaxBufferAge = 10 * time.Millisecond
+	ctx := testutil.NewS3Context(t, server, config)
+
+	// Single batch is sent, since the listener does not receive events while it is uploading.
+	server.DelayRequests(time.Minute)
+	sent := sendBatches(t, ctx, 1)
+
+	// Listener starts uploading once the max buffer age passes.
+	deadline := time.Now().Add(10 * time.Second)
+	for server.DelayedRequests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected listener to start uploading")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := exit.UploadWithDeadline(ctx); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("expected exit to cancel the listener upload at the deadline, took %v", elapsed)
+	}
+	if objects := server.Objects(testutil.Bucket); len(objects) != 0 {
+		t.Fatalf("expected no uploaded objects before restart, got %d", len(objects))
+	}
+
+	// Buffer of the cancelled upload is left on disk and uploaded on restart.
+	server.DelayRequests(0)
+	restarted := testutil.NewS3Context(t, server, config)
+	if err := RecoverBufferFiles(restarted); err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	if err := exit.NoUpload(restarted); err != nil {
+		t.Fatalf("exit failed: %v", err)
+	}
+	checkSingleObject(t, server, sent)
+}
+
+func encodeFrame(t *testing.T, data []byte) []byte {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create encoder: %v", err)
+	}
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %v", path, err)
+	}
+	return info.Size()
+}
@@ -0,0 +1,338 @@
+// Package implements redaction of sensitive values in records before they are buffered. Buffers are
+// persisted on local disk and then in S3, so secrets logged by mistake are difficult to purge once
+// they reach the buffer.
+//
+// Values are redacted by rules. Key rules replace the entire value of keys with matching names.
+// Pattern rules replace matches in string values, using either built-in patterns or a user
+// regular expression. Each replacement is counted per rule.
+package redact
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Replacement modes.
+const (
+	// Replace with rule name (e.g. "[REDACTED:email]").
+	ModeMask = "mask"
+	// Replace with rule name and keyed hash of value (e.g. "[REDACTED:email:3f2a9c0b1d4e5f60]").
+	// Equal values have equal hashes, so redacted values can still be correlated.
+	ModeHash = "hash"
+)
+
+// Names of rules which are not built-in patterns.
+const (
+	KeyRuleName   = "key"
+	RegexRuleName = "regex"
+)
+
+// Name of capture group used to redact part of a match. If a pattern has the group, only the group
+// is replaced so context such as "Bearer " is kept.
+const secretGroup = "secret"
+
+// Length of hash in replacement, in hex characters.
+const hashLength = 16
+
+// Pattern rule applied to string values.
+type pattern struct {
+	name   string
+	regex  *regexp.Regexp
+	secret int
+	// Optional check of match to reduce false positives.
+	valid func(match string) bool
+}
+
+// Built-in patterns which can be enabled by name.
+var builtInPatterns = map[string]pattern{
+	"email": {
+		regex: regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`),
+	},
+	"bearer_token": {
+		regex: regexp.MustCompile(`(?i)\bbearer\s+(?P<secret>[A-Za-z0-9\-._~+/]+=*)`),
+	},
+	"aws_access_key": {
+		regex: regexp.MustCompile(`\b(?:AKIA|ASIA|AIDA|AROA)[A-Z0-9]{16}\b`),
+	},
+	"aws_secret_key": {
+		regex: regexp.MustCompile(
+			`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})\b`,
+		),
+	},
+	"credit_card": {
+		regex: regexp.MustCompile(`\b\d(?:[ \-]?\d){12,18}\b`),
+		valid: luhn,
+	},
+}
+
+// Redacts records and counts replacements. Not safe for concurrent use.
+type Redactor struct {
+	keys     map[string]bool
+	patterns []pattern
+	mode     string
+	hashKey  []byte
+	counts   map[string]int
+}
+
+// Creates a new redactor. Returns a nil redactor if no rules are set.
+//
+// Parameters:
+//   - patterns: Names of built-in patterns separated by commas
+//   - keys: Names of keys whose values are redacted, separated by commas. Matched at any depth
+//     ignoring case.
+//   - regex: Regular expression matched against string values
+//   - mode: Replacement mode
+//   - hashKey: Key for hash replacement mode
+//
+// Returns:
+//   - redactor: Redactor, nil if no rules are set
+//   - err: Unknown pattern, invalid regular expression, unknown mode
+func New(
+	patterns string,
+	keys string,
+	regex string,
+	mode string,
+	hashKey string,
+) (*Redactor, error) {
+	if mode != ModeMask && mode != ModeHash {
+		return nil, fmt.Errorf("unknown redaction mode %q", mode)
+	}
+
+	redactor := Redactor{
+		keys:    make(map[string]bool),
+		mode:    mode,
+		hashKey: []byte(hashKey),
+		counts:  make(map[string]int),
+	}
+
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			redactor.keys[strings.ToLower(key)] = true
+		}
+	}
+
+	for _, name := range strings.Split(patterns, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		builtIn, ok := builtInPatterns[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction pattern %q", name)
+		}
+		builtIn.name = name
+		redactor.patterns = append(redactor.patterns, newPattern(builtIn))
+	}
+
+	if regex != "" {
+		compiled, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling redaction regex: %w", err)
+		}
+		userPattern := pattern{name: RegexRuleName, regex: compiled}
+		redactor.patterns = append(redactor.patterns, newPattern(userPattern))
+	}
+
+	if len(redactor.keys) == 0 && len(redactor.patterns) == 0 {
+		return nil, nil
+	}
+	return &redactor, nil
+}
+
+// Applies rules to every value in record. Record is modified in place.
+//
+// Parameters:
+//   - record: Record from Fluent Bit
+func (redactor *Redactor) Apply(record map[string]any) {
+	if redactor == nil {
+		return
+	}
+	redactor.redactMap(record)
+}
+
+// Retrieves number of replacements made by each rule.
+//
+// Returns:
+//   - counts: Replacements keyed by rule name. Rules without replacements are omitted.
+func (redactor *Redactor) Counts() map[string]int {
+	counts := make(map[string]int)
+	if redactor == nil {
+		return counts
+	}
+	for name, count := range redactor.counts {
+		counts[name] = count
+	}
+	return counts
+}
+
+// Formats replacement counts for logging.
+//
+// Returns:
+//   - summary: Counts sorted by rule name (e.g. "email=2, key=1")
+func (redactor *Redactor) String() string {
+	counts := redactor.Counts()
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	summary := make([]string, len(names))
+	for i, name := range names {
+		summary[i] = fmt.Sprintf("%s=%d", name, counts[name])
+	}
+	return strings.Join(summary, ", ")
+}
+
+// Redacts values in map. Values of matching keys are replaced, other values are redacted
+// recursively.
+//
+// Parameters:
+//   - m: Map to redact
+func (redactor *Redactor) redactMap(m map[string]any) {
+	for key, value := range m {
+		if redactor.keys[strings.ToLower(key)] {
+			m[key] = redactor.replacement(KeyRuleName, fmt.Sprint(value))
+			continue
+		}
+		m[key] = redactor.redactValue(value)
+	}
+}
+
+// Redacts value.
+//
+// Parameters:
+//   - value: Value to redact
+//
+// Returns:
+//   - redacted: Redacted value
+func (redactor *Redactor) redactValue(value any) any {
+	switch v := value.(type) {
+	case string:
+		return redactor.redactString(v)
+	case map[string]any:
+		redactor.redactMap(v)
+		return v
+	case []any:
+		for i, element := range v {
+			v[i] = redactor.redactValue(element)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Replaces matches of each pattern in string.
+//
+// Parameters:
+//   - s: String to redact
+//
+// Returns:
+//   - redacted: Redacted string
+func (redactor *Redactor) redactString(s string) string {
+	for _, p := range redactor.patterns {
+		matches := p.regex.FindAllStringSubmatchIndex(s, -1)
+		if matches == nil {
+			continue
+		}
+
+		var builder strings.Builder
+		last := 0
+		replaced := false
+		for _, match := range matches {
+			start, end := match[0], match[1]
+			if p.secret > 0 {
+				start, end = match[2*p.secret], match[2*p.secret+1]
+			}
+			// Skip empty matches and matches where the secret group did not participate.
+			if start == end {
+				continue
+			}
+			if p.valid != nil && !p.valid(s[start:end]) {
+				continue
+			}
+			builder.WriteString(s[last:start])
+			builder.WriteString(redactor.replacement(p.name, s[start:end]))
+			last = end
+			replaced = true
+		}
+		if !replaced {
+			continue
+		}
+		builder.WriteString(s[last:])
+		s = builder.String()
+	}
+	return s
+}
+
+// Creates replacement for value and counts it.
+//
+// Parameters:
+//   - rule: Name of rule
+//   - value: Value being replaced
+//
+// Returns:
+//   - replacement: Replacement string
+func (redactor *Redactor) replacement(rule string, value string) string {
+	redactor.counts[rule]++
+	if redactor.mode == ModeMask {
+		return fmt.Sprintf("[REDACTED:%s]", rule)
+	}
+
+	mac := hmac.New(sha256.New, redactor.hashKey)
+	mac.Write([]byte(value))
+	hash := hex.EncodeToString(mac.Sum(nil))[:hashLength]
+	return fmt.Sprintf("[REDACTED:%s:%s]", rule, hash)
+}
+
+// Sets index of secret capture group in pattern.
+//
+// Parameters:
+//   - p: Pattern
+//
+// Returns:
+//   - p: Pattern with secret group index set, 0 if pattern does not have the group
+func newPattern(p pattern) pattern {
+	p.secret = p.regex.SubexpIndex(secretGroup)
+	if p.secret < 0 {
+		p.secret = 0
+	}
+	return p
+}
+
+// Checks card number with the [Luhn algorithm].
+//
+// Parameters:
+//   - number: Card number, which may contain spaces or dashes
+//
+// Returns:
+//   - valid: Whether checksum is valid
+//
+// [Luhn algorithm]: https://en.wikipedia.org/wiki/Luhn_algorithm
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+	return sum%10 == 0
+}
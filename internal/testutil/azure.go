@@ -0,0 +1,392 @@
+package testutil
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Well-known account name and key of the Azurite emulator.
+const (
+	AzuriteAccountName = "devstoreaccount1"
+	AzuriteAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/" +
+		"K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// Signature of SAS tokens returned by [AzureServer.SasToken].
+const azureSasSignature = "test-signature"
+
+// Blob stored by [AzureServer].
+type AzureBlob struct {
+	Name        string
+	Body        []byte
+	ContentType string
+	Metadata    map[string]string
+	Tags        map[string]string
+}
+
+// In-process Azure Blob Storage compatible server, similar to Azurite. Uses path-style URLs with
+// the Azurite account name. Supports the subset of the REST API used by the plugin. Requests must
+// be signed with [AzuriteAccountKey] or include a token from [AzureServer.SasToken]. Containers
+// are created with [AzureServer.CreateContainer].
+type AzureServer struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	containers map[string]map[string]*AzureBlob
+	// Staged blocks of uncommitted blobs by container and blob name.
+	blocks   map[string]map[string][]byte
+	failures int
+}
+
+// Starts a new [AzureServer]. Server is closed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - server: Azure server
+func NewAzureServer(t testing.TB) *AzureServer {
+	s := &AzureServer{
+		containers: make(map[string]map[string]*AzureBlob),
+		blocks:     make(map[string]map[string][]byte),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// Creates an empty container.
+//
+// Parameters:
+//   - container: Container name
+func (s *AzureServer) CreateContainer(container string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.containers[container] = make(map[string]*AzureBlob)
+}
+
+// Fails the next requests with an internal server error.
+//
+// Parameters:
+//   - n: Number of requests to fail
+func (s *AzureServer) FailRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Returns the endpoint URL of the storage account.
+func (s *AzureServer) URL() string {
+	return s.server.URL + "/" + AzuriteAccountName
+}
+
+// Returns a SAS token accepted by the server.
+func (s *AzureServer) SasToken() string {
+	return "sv=2021-12-02&ss=b&srt=co&sp=cwt&sig=" + url.QueryEscape(azureSasSignature)
+}
+
+// Retrieves committed blobs in a container sorted by name.
+//
+// Parameters:
+//   - container: Container name
+//
+// Returns:
+//   - blobs: Copies of blobs in container
+func (s *AzureServer) Objects(container string) []AzureBlob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var blobs []AzureBlob
+	for _, blob := range s.containers[container] {
+		blobs = append(blobs, *blob)
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Name < blobs[j].Name
+	})
+	return blobs
+}
+
+// Routes Blob Storage API requests.
+func (s *AzureServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures -= 1
+		writeAzureError(w, http.StatusInternalServerError, "InternalError", "internal error")
+		return
+	}
+
+	if !s.authorized(r) {
+		writeAzureError(w, http.StatusForbidden, "AuthenticationFailed", "invalid signature")
+		return
+	}
+
+	resource, ok := strings.CutPrefix(r.URL.Path, "/"+AzuriteAccountName+"/")
+	if !ok {
+		writeAzureError(w, http.StatusBadRequest, "InvalidUri", "unknown account")
+		return
+	}
+	containerName, blobName, _ := strings.Cut(resource, "/")
+	container, ok := s.containers[containerName]
+	if !ok {
+		writeAzureError(w, http.StatusNotFound, "ContainerNotFound", "container not found")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case blobName == "" && r.Method == http.MethodHead && query.Get("restype") == "container":
+		w.WriteHeader(http.StatusOK)
+	case blobName != "" && r.Method == http.MethodPut && query.Get("comp") == "":
+		s.putBlob(w, r, container, blobName)
+	case blobName != "" && r.Method == http.MethodPut && query.Get("comp") == "block":
+		s.stageBlock(w, r, containerName+"/"+blobName, query.Get("blockid"))
+	case blobName != "" && r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		s.commitBlockList(w, r, container, containerName+"/"+blobName, blobName)
+	default:
+		writeAzureError(w, http.StatusNotImplemented, "NotImplemented", "not implemented")
+	}
+}
+
+// Checks the Shared Key signature or SAS token of a request.
+func (s *AzureServer) authorized(r *http.Request) bool {
+	if r.URL.Query().Get("sig") == azureSasSignature {
+		return true
+	}
+
+	authorization, ok := strings.CutPrefix(
+		r.Header.Get("Authorization"),
+		"SharedKey "+AzuriteAccountName+":",
+	)
+	if !ok {
+		return false
+	}
+	key, _ := base64.StdEncoding.DecodeString(AzuriteAccountKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(azureStringToSign(r, AzuriteAccountName)))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(authorization), []byte(expected))
+}
+
+// Stores an uncommitted block. Block ids of a blob must have the same length.
+func (s *AzureServer) stageBlock(w http.ResponseWriter, r *http.Request, blob, blockId string) {
+	blocks, ok := s.blocks[blob]
+	if !ok {
+		blocks = make(map[string][]byte)
+		s.blocks[blob] = blocks
+	}
+	for id := range blocks {
+		if len(id) != len(blockId) {
+			writeAzureError(w, http.StatusBadRequest, "InvalidBlobOrBlock", "block id length")
+			return
+		}
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidInput", "incomplete body")
+		return
+	}
+	blocks[blockId] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Commits staged blocks into a blob with properties from request headers.
+func (s *AzureServer) commitBlockList(
+	w http.ResponseWriter,
+	r *http.Request,
+	container map[string]*AzureBlob,
+	blob string,
+	blobName string,
+) {
+	var blockList struct {
+		Latest []string `xml:"Latest"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&blockList); err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidXmlDocument", "invalid block list")
+		return
+	}
+
+	object, err := newAzureBlob(r, blobName)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidTag", "invalid tags")
+		return
+	}
+	for _, blockId := range blockList.Latest {
+		data, ok := s.blocks[blob][blockId]
+		if !ok {
+			writeAzureError(w, http.StatusBadRequest, "InvalidBlockList", "unknown block")
+			return
+		}
+		object.Body = append(object.Body, data...)
+	}
+
+	container[blobName] = object
+	delete(s.blocks, blob)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Stores a blob uploaded in a single request with properties from request headers.
+func (s *AzureServer) putBlob(
+	w http.ResponseWriter,
+	r *http.Request,
+	container map[string]*AzureBlob,
+	blobName string,
+) {
+	object, err := newAzureBlob(r, blobName)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidTag", "invalid tags")
+		return
+	}
+	object.Body, err = io.ReadAll(r.Body)
+	if err != nil {
+		writeAzureError(w, http.StatusBadRequest, "InvalidInput", "incomplete body")
+		return
+	}
+
+	container[blobName] = object
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Creates an empty blob with the content type, metadata, and tags set in request headers.
+func newAzureBlob(r *http.Request, blobName string) (*AzureBlob, error) {
+	object := AzureBlob{
+		Name:        blobName,
+		Body:        []byte{},
+		ContentType: r.Header.Get("x-ms-blob-content-type"),
+		Metadata:    make(map[string]string),
+		Tags:        make(map[string]string),
+	}
+	for name, values := range r.Header {
+		if metadataKey, ok := strings.CutPrefix(strings.ToLower(name), "x-ms-meta-"); ok {
+			object.Metadata[metadataKey] = values[0]
+		}
+	}
+	tags, err := url.ParseQuery(r.Header.Get("x-ms-tags"))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range tags {
+		object.Tags[name] = values[0]
+	}
+	return &object, nil
+}
+
+// Builds the string signed with Shared Key authorization as described in [Authorize with Shared
+// Key].
+//
+// Parameters:
+//   - req: Request
+//   - accountName: Storage account name
+//
+// Returns:
+//   - stringToSign: Canonical representation of request
+//
+// [Authorize with Shared Key]: https://learn.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func azureStringToSign(req *http.Request, accountName string) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		// Date is empty since x-ms-date is signed instead.
+		"",
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		azureCanonicalizedHeaders(req.Header),
+		azureCanonicalizedResource(req.URL, accountName),
+	}, "\n")
+}
+
+// Builds the canonical form of x-ms- headers, sorted by lowercase name.
+//
+// Parameters:
+//   - header: Request headers
+//
+// Returns:
+//   - headers: Canonicalized headers separated by newlines
+func azureCanonicalizedHeaders(header http.Header) string {
+	var lines []string
+	for name, values := range header {
+		name = strings.ToLower(name)
+		if !strings.HasPrefix(name, "x-ms-") {
+			continue
+		}
+		lines = append(lines, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// Builds the canonical form of the resource, which is the account name, the escaped path, and the
+// query parameters sorted by lowercase name.
+//
+// Parameters:
+//   - u: Request URL
+//   - accountName: Storage account name
+//
+// Returns:
+//   - resource: Canonicalized resource
+func azureCanonicalizedResource(u *url.URL, accountName string) string {
+	var resource strings.Builder
+	resource.WriteString("/" + accountName)
+	if path := u.EscapedPath(); path != "" {
+		resource.WriteString(path)
+	} else {
+		resource.WriteString("/")
+	}
+
+	params := make(map[string][]string)
+	for name, values := range u.Query() {
+		name = strings.ToLower(name)
+		params[name] = append(params[name], values...)
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		resource.WriteString("\n" + name + ":" + strings.Join(values, ","))
+	}
+
+	return resource.String()
+}
+
+func writeAzureError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(
+		w,
+		"%s<Error><Code>%s</Code><Message>%s</Message></Error>",
+		xml.Header,
+		code,
+		message,
+	)
+}
@@ -0,0 +1,121 @@
+package testutil
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/y-scope/fluent-bit-clp/internal/clpcompress"
+)
+
+// Compress tool of [ClpPackage]. Copies the staged file of each job into a numbered job directory
+// with the arguments of the job, and fails once if the fail file exists.
+const clpCompressScript = `#!/bin/sh
+dir=$(dirname "$0")/..
+if [ -f "$dir/fail" ]; then
+	rm "$dir/fail"
+	echo "Compression job failed." >&2
+	exit 1
+fi
+job=$(ls "$dir/jobs" | wc -l | tr -d ' ')
+mkdir "$dir/jobs/$job"
+printf '%s\n' "$@" > "$dir/jobs/$job/args"
+for path; do :; done
+cp "$path" "$dir/jobs/$job/data"
+echo "Compression job $job submitted."
+echo "Compression finished."
+`
+
+// Compress job run by [ClpPackage].
+type ClpJob struct {
+	// Arguments of compress tool, ending with the path of the staged file.
+	Args []string
+	// Content of the staged file when the job ran.
+	Data []byte
+}
+
+// CLP package directory with a compress tool that records jobs instead of compressing.
+type ClpPackage struct {
+	dir string
+}
+
+// Creates a new [ClpPackage] in a temporary directory removed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - pkg: CLP package
+func NewClpPackage(t testing.TB) *ClpPackage {
+	dir := t.TempDir()
+	script := filepath.Join(dir, filepath.FromSlash(clpcompress.CompressScript))
+	if err := os.MkdirAll(filepath.Dir(script), 0o755); err != nil {
+		t.Fatalf("failed to create sbin: %v", err)
+	}
+	if err := os.WriteFile(script, []byte(clpCompressScript), 0o755); err != nil {
+		t.Fatalf("failed to write compress script: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "jobs"), 0o755); err != nil {
+		t.Fatalf("failed to create jobs directory: %v", err)
+	}
+	return &ClpPackage{dir: dir}
+}
+
+// Returns the package directory.
+func (p *ClpPackage) Dir() string {
+	return p.dir
+}
+
+// Fails the next compress job.
+//
+// Parameters:
+//   - t: Test
+func (p *ClpPackage) FailNextJob(t testing.TB) {
+	if err := os.WriteFile(filepath.Join(p.dir, "fail"), nil, 0o644); err != nil {
+		t.Fatalf("failed to write fail file: %v", err)
+	}
+}
+
+// Retrieves successful compress jobs in the order they ran.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - jobs: Compress jobs
+func (p *ClpPackage) Jobs(t testing.TB) []ClpJob {
+	entries, err := os.ReadDir(filepath.Join(p.dir, "jobs"))
+	if err != nil {
+		t.Fatalf("failed to read jobs: %v", err)
+	}
+	var ids []int
+	for _, entry := range entries {
+		id, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			t.Fatalf("unexpected job directory %s", entry.Name())
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	var jobs []ClpJob
+	for _, id := range ids {
+		jobDir := filepath.Join(p.dir, "jobs", strconv.Itoa(id))
+		args, err := os.ReadFile(filepath.Join(jobDir, "args"))
+		if err != nil {
+			t.Fatalf("failed to read job arguments: %v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(jobDir, "data"))
+		if err != nil {
+			t.Fatalf("failed to read job data: %v", err)
+		}
+		jobs = append(jobs, ClpJob{
+			Args: strings.Split(strings.TrimSuffix(string(args), "\n"), "\n"),
+			Data: data,
+		})
+	}
+	return jobs
+}
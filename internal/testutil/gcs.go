@@ -0,0 +1,317 @@
+package testutil
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Object stored by [GcsServer].
+type GcsObject struct {
+	Name        string
+	Body        []byte
+	ContentType string
+	Metadata    map[string]string
+}
+
+// In-process GCS compatible server, similar to fake-gcs-server. Supports the subset of the JSON
+// API used by the plugin and the OAuth token endpoint used by service account credentials.
+// Requests are only authenticated once credentials are created with
+// [GcsServer.WriteCredentialsFile]. Buckets are created with [GcsServer.CreateBucket].
+type GcsServer struct {
+	server *httptest.Server
+
+	mu            sync.Mutex
+	buckets       map[string]map[string]*GcsObject
+	publicKey     *rsa.PublicKey
+	clientEmail   string
+	tokens        map[string]bool
+	tokenRequests int
+	failures      int
+}
+
+// Starts a new [GcsServer]. Server is closed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - server: GCS server
+func NewGcsServer(t testing.TB) *GcsServer {
+	s := &GcsServer{
+		buckets: make(map[string]map[string]*GcsObject),
+		tokens:  make(map[string]bool),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// Creates an empty bucket.
+//
+// Parameters:
+//   - bucket: Bucket name
+func (s *GcsServer) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = make(map[string]*GcsObject)
+}
+
+// Fails the next requests with an internal server error.
+//
+// Parameters:
+//   - n: Number of requests to fail
+func (s *GcsServer) FailRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Returns the endpoint URL of the server.
+func (s *GcsServer) URL() string {
+	return s.server.URL
+}
+
+// Returns the number of access tokens issued by the server.
+func (s *GcsServer) TokenRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tokenRequests
+}
+
+// Writes a service account key file whose token URI points to the server. Afterwards, the server
+// rejects requests without an access token issued for the key.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - path: Path to service account JSON key file
+func (s *GcsServer) WriteCredentialsFile(t testing.TB) string {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode key: %v", err)
+	}
+
+	s.mu.Lock()
+	s.publicKey = &key.PublicKey
+	s.clientEmail = "fluent-bit@test.iam.gserviceaccount.com"
+	s.mu.Unlock()
+
+	credentials, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   s.clientEmail,
+		"private_key_id": "test",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      s.server.URL + "/token",
+	})
+	if err != nil {
+		t.Fatalf("failed to encode credentials: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(path, credentials, 0o600); err != nil {
+		t.Fatalf("failed to write credentials: %v", err)
+	}
+	return path
+}
+
+// Retrieves objects in a bucket sorted by name.
+//
+// Parameters:
+//   - bucket: Bucket name
+//
+// Returns:
+//   - objects: Copies of objects in bucket
+func (s *GcsServer) Objects(bucket string) []GcsObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var objects []GcsObject
+	for _, object := range s.buckets[bucket] {
+		objects = append(objects, *object)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Name < objects[j].Name
+	})
+	return objects
+}
+
+// Routes GCS API requests.
+func (s *GcsServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures -= 1
+		writeGcsError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	if r.URL.Path == "/token" && r.Method == http.MethodPost {
+		s.issueToken(w, r)
+		return
+	}
+
+	if s.publicKey != nil {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !s.tokens[token] {
+			writeGcsError(w, http.StatusUnauthorized, "invalid credentials")
+			return
+		}
+	}
+
+	if bucketName, ok := strings.CutPrefix(r.URL.Path, "/upload/storage/v1/b/"); ok {
+		bucketName = strings.TrimSuffix(bucketName, "/o")
+		if r.Method != http.MethodPost || r.URL.Query().Get("uploadType") != "multipart" {
+			writeGcsError(w, http.StatusNotImplemented, "unsupported upload")
+			return
+		}
+		s.upload(w, r, bucketName)
+		return
+	}
+
+	if bucketName, ok := strings.CutPrefix(r.URL.Path, "/storage/v1/b/"); ok &&
+		r.Method == http.MethodGet {
+		if _, ok := s.buckets[bucketName]; !ok {
+			writeGcsError(w, http.StatusNotFound, "bucket not found")
+			return
+		}
+		writeJson(w, map[string]string{"name": bucketName})
+		return
+	}
+
+	writeGcsError(w, http.StatusNotImplemented, "not implemented")
+}
+
+// Exchanges a signed service account assertion for an access token.
+func (s *GcsServer) issueToken(w http.ResponseWriter, r *http.Request) {
+	if s.publicKey == nil ||
+		r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+		writeGcsError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	claims, err := s.verifyAssertion(r.FormValue("assertion"))
+	if err != nil {
+		writeGcsError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if claims.Iss != s.clientEmail || claims.Aud != s.server.URL+"/token" {
+		writeGcsError(w, http.StatusBadRequest, "invalid claims")
+		return
+	}
+
+	s.tokenRequests += 1
+	token := fmt.Sprintf("token-%d", s.tokenRequests)
+	s.tokens[token] = true
+	writeJson(w, map[string]any{
+		"access_token": token,
+		"expires_in":   3600,
+		"token_type":   "Bearer",
+	})
+}
+
+// Verifies the RS256 signature of a JWT assertion and decodes its claims.
+func (s *GcsServer) verifyAssertion(assertion string) (*struct{ Iss, Aud string }, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed assertion")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(s.publicKey, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims struct{ Iss, Aud string }
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// Stores an object from a multipart upload containing object metadata followed by data.
+func (s *GcsServer) upload(w http.ResponseWriter, r *http.Request, bucketName string) {
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeGcsError(w, http.StatusNotFound, "bucket not found")
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" {
+		writeGcsError(w, http.StatusBadRequest, "expected multipart/related")
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	metadataPart, err := reader.NextPart()
+	if err != nil {
+		writeGcsError(w, http.StatusBadRequest, "missing metadata part")
+		return
+	}
+	var object GcsObject
+	if err := json.NewDecoder(metadataPart).Decode(&object); err != nil {
+		writeGcsError(w, http.StatusBadRequest, "invalid metadata")
+		return
+	}
+
+	dataPart, err := reader.NextPart()
+	if err != nil {
+		writeGcsError(w, http.StatusBadRequest, "missing data part")
+		return
+	}
+	object.Body, err = io.ReadAll(dataPart)
+	if err != nil {
+		writeGcsError(w, http.StatusBadRequest, "incomplete body")
+		return
+	}
+
+	bucket[object.Name] = &object
+	writeJson(w, map[string]any{"name": object.Name, "bucket": bucketName})
+}
+
+func writeJson(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeGcsError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"code": status, "message": message},
+	})
+}
@@ -0,0 +1,94 @@
+package testutil
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Request received by [HttpServer].
+type HttpRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   []byte
+}
+
+// In-process HTTP server which records requests, similar to an ingestion gateway.
+type HttpServer struct {
+	server *httptest.Server
+
+	mu            sync.Mutex
+	requests      []HttpRequest
+	failures      int
+	failureStatus int
+}
+
+// Starts a new [HttpServer]. Server is closed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - server: HTTP server
+func NewHttpServer(t testing.TB) *HttpServer {
+	s := &HttpServer{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// Fails the next requests with a status asking the client to retry immediately.
+//
+// Parameters:
+//   - n: Number of requests to fail
+//   - status: Response status
+func (s *HttpServer) FailRequests(n int, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+	s.failureStatus = status
+}
+
+// Returns the URL of the server.
+func (s *HttpServer) URL() string {
+	return s.server.URL
+}
+
+// Retrieves successful requests in the order they were received.
+//
+// Returns:
+//   - requests: Copies of requests
+func (s *HttpServer) Requests() []HttpRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]HttpRequest(nil), s.requests...)
+}
+
+// Records a request.
+func (s *HttpServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures -= 1
+		w.Header().Set("Retry-After", "0")
+		http.Error(w, http.StatusText(s.failureStatus), s.failureStatus)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "incomplete body", http.StatusBadRequest)
+		return
+	}
+	s.requests = append(s.requests, HttpRequest{
+		Method: r.Method,
+		Path:   r.URL.EscapedPath(),
+		Header: r.Header.Clone(),
+		Body:   body,
+	})
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,210 @@
+package testutil
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Maximum time to wait for published messages to be fetched.
+const kafkaFetchTimeout = 10 * time.Second
+
+// Message published to [KafkaBroker].
+type KafkaMessage struct {
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+}
+
+// In-process Kafka broker with a single topic, backed by a [kfake.Cluster]. Produce requests can
+// be failed to test retries.
+type KafkaBroker struct {
+	t             testing.TB
+	cluster       *kfake.Cluster
+	topic         string
+	numPartitions int
+
+	mu       sync.Mutex
+	failures int
+	drops    int
+}
+
+// Starts a new [KafkaBroker]. Broker is closed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//   - topic: Topic hosted by broker
+//   - numPartitions: Number of partitions of topic
+//
+// Returns:
+//   - broker: Kafka broker
+func NewKafkaBroker(t testing.TB, topic string, numPartitions int) *KafkaBroker {
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(int32(numPartitions), topic),
+	)
+	if err != nil {
+		t.Fatalf("failed to start kafka cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+
+	b := &KafkaBroker{
+		t:             t,
+		cluster:       cluster,
+		topic:         topic,
+		numPartitions: numPartitions,
+	}
+	cluster.ControlKey(int16(kmsg.Produce), b.controlProduce)
+	return b
+}
+
+// Returns the address of the broker.
+func (b *KafkaBroker) Addr() string {
+	return b.cluster.ListenAddrs()[0]
+}
+
+// Fails the next produce requests with a retriable error.
+//
+// Parameters:
+//   - n: Number of requests to fail
+func (b *KafkaBroker) FailRequests(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = n
+}
+
+// Closes the connection instead of handling the next produce requests. Simulates requests lost in
+// the network.
+//
+// Parameters:
+//   - n: Number of requests to drop
+func (b *KafkaBroker) DropResponses(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drops = n
+}
+
+// Retrieves messages of all partitions ordered by partition and offset.
+//
+// Returns:
+//   - messages: Copies of messages
+func (b *KafkaBroker) Messages() []KafkaMessage {
+	b.t.Helper()
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(b.Addr()),
+		kgo.ConsumeTopics(b.topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		b.t.Fatalf("failed to create kafka consumer: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), kafkaFetchTimeout)
+	defer cancel()
+	count := b.countMessages(ctx, client)
+
+	var messages []KafkaMessage
+	for len(messages) < count {
+		fetches := client.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			b.t.Fatalf("fetched %d of %d messages: %v", len(messages), count, err)
+		}
+		fetches.EachRecord(func(record *kgo.Record) {
+			headers := make(map[string]string, len(record.Headers))
+			for _, header := range record.Headers {
+				headers[header.Key] = string(header.Value)
+			}
+			messages = append(messages, KafkaMessage{
+				Partition: record.Partition,
+				Offset:    record.Offset,
+				Key:       record.Key,
+				Value:     record.Value,
+				Headers:   headers,
+			})
+		})
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].Partition != messages[j].Partition {
+			return messages[i].Partition < messages[j].Partition
+		}
+		return messages[i].Offset < messages[j].Offset
+	})
+	return messages
+}
+
+// Counts the messages of all partitions using their end offsets.
+func (b *KafkaBroker) countMessages(ctx context.Context, client *kgo.Client) int {
+	request := kmsg.NewPtrListOffsetsRequest()
+	requestTopic := kmsg.NewListOffsetsRequestTopic()
+	requestTopic.Topic = b.topic
+	for partition := range int32(b.numPartitions) {
+		requestPartition := kmsg.NewListOffsetsRequestTopicPartition()
+		requestPartition.Partition = partition
+		// Latest offset.
+		requestPartition.Timestamp = -1
+		requestTopic.Partitions = append(requestTopic.Partitions, requestPartition)
+	}
+	request.Topics = append(request.Topics, requestTopic)
+
+	response, err := request.RequestWith(ctx, client)
+	if err != nil {
+		b.t.Fatalf("failed to list offsets: %v", err)
+	}
+	count := 0
+	for _, responseTopic := range response.Topics {
+		for _, responsePartition := range responseTopic.Partitions {
+			if err := kerr.ErrorForCode(responsePartition.ErrorCode); err != nil {
+				b.t.Fatalf("failed to list offsets: %v", err)
+			}
+			count += int(responsePartition.Offset)
+		}
+	}
+	return count
+}
+
+// Fails or drops produce requests while failures or drops remain. Other requests are handled by
+// the cluster.
+func (b *KafkaBroker) controlProduce(
+	request kmsg.Request,
+) (kmsg.Response, error, bool) {
+	b.cluster.KeepControl()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.drops > 0 {
+		b.drops -= 1
+		return nil, errors.New("dropped request"), true
+	}
+	if b.failures == 0 {
+		return nil, nil, false
+	}
+	b.failures -= 1
+
+	produceRequest := request.(*kmsg.ProduceRequest)
+	response := produceRequest.ResponseKind().(*kmsg.ProduceResponse)
+	for _, requestTopic := range produceRequest.Topics {
+		responseTopic := kmsg.NewProduceResponseTopic()
+		responseTopic.Topic = requestTopic.Topic
+		for _, requestPartition := range requestTopic.Partitions {
+			responsePartition := kmsg.NewProduceResponseTopicPartition()
+			responsePartition.Partition = requestPartition.Partition
+			responsePartition.ErrorCode = kerr.NotEnoughReplicas.Code
+			responseTopic.Partitions = append(responseTopic.Partitions, responsePartition)
+		}
+		response.Topics = append(response.Topics, responseTopic)
+	}
+	return response, nil, true
+}
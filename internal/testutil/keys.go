@@ -0,0 +1,49 @@
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Generates an RSA key and writes it to PEM files in a temporary directory removed when the test
+// ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - privateKeyPath: Path to PKCS #8 private key
+//   - publicKeyPath: Path to PKIX public key
+func WriteRsaKeyFiles(t testing.TB) (string, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to encode private key: %v", err)
+	}
+	publicDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+
+	dir := t.TempDir()
+	privateKeyPath := filepath.Join(dir, "private.pem")
+	publicKeyPath := filepath.Join(dir, "public.pem")
+	privatePem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDer})
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer})
+	if err := os.WriteFile(privateKeyPath, privatePem, 0o600); err != nil {
+		t.Fatalf("failed to write private key: %v", err)
+	}
+	if err := os.WriteFile(publicKeyPath, publicPem, 0o600); err != nil {
+		t.Fatalf("failed to write public key: %v", err)
+	}
+	return privateKeyPath, publicKeyPath
+}
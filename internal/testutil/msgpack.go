@@ -0,0 +1,107 @@
+package testutil
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Formats of Fluent Bit Msgpack events. See [Fluent Bit Msgpack format].
+//
+// [Fluent Bit Msgpack format]: https://github.com/fluent/fluent-bit-docs/blob/master/development/msgpack-format.md
+type EventFormat int
+
+const (
+	// [TIMESTAMP, RECORD] with timestamp as integer seconds. Used by legacy forwarders.
+	LegacyFormat EventFormat = iota
+	// [TIMESTAMP, RECORD] with timestamp as Fluent Bit fixext 8.
+	FlbTimeFormat
+	// [[TIMESTAMP, METADATA], RECORD] with timestamp as Fluent Bit fixext 8. Used by Fluent Bit v2+.
+	V2MetadataFormat
+)
+
+// Event to encode into a Fluent Bit chunk.
+type Event struct {
+	Timestamp time.Time
+	Record    map[string]any
+}
+
+// Encodes events into a Fluent Bit chunk as provided to the flush callback.
+//
+// Parameters:
+//   - t: Test
+//   - format: Event format
+//   - events: Events to encode
+//
+// Returns:
+//   - chunk: Msgpack encoded chunk
+func Chunk(t testing.TB, format EventFormat, events ...Event) []byte {
+	var chunk []byte
+	for _, event := range events {
+		chunk = append(chunk, EncodeEvent(t, format, event)...)
+	}
+	return chunk
+}
+
+// Encodes a single Fluent Bit event.
+//
+// Parameters:
+//   - t: Test
+//   - format: Event format
+//   - event: Event to encode
+//
+// Returns:
+//   - encoded: Msgpack encoded event
+func EncodeEvent(t testing.TB, format EventFormat, event Event) []byte {
+	// Fixarray of length 2.
+	encoded := []byte{0x92}
+	switch format {
+	case LegacyFormat:
+		encoded = append(encoded, Encode(t, uint64(event.Timestamp.Unix()))...)
+	case FlbTimeFormat:
+		encoded = append(encoded, EncodeFlbTime(event.Timestamp)...)
+	case V2MetadataFormat:
+		encoded = append(encoded, 0x92)
+		encoded = append(encoded, EncodeFlbTime(event.Timestamp)...)
+		encoded = append(encoded, Encode(t, map[string]any{})...)
+	default:
+		t.Fatalf("unknown event format %d", format)
+	}
+	return append(encoded, Encode(t, event.Record)...)
+}
+
+// Encodes timestamp in Fluent Bit fixext 8 format. Extension type is 0, followed by big-endian
+// seconds and nanoseconds.
+//
+// Parameters:
+//   - timestamp: Timestamp to encode
+//
+// Returns:
+//   - encoded: Msgpack encoded timestamp
+func EncodeFlbTime(timestamp time.Time) []byte {
+	encoded := []byte{0xd7, 0x00}
+	encoded = binary.BigEndian.AppendUint32(encoded, uint32(timestamp.Unix()))
+	return binary.BigEndian.AppendUint32(encoded, uint32(timestamp.Nanosecond()))
+}
+
+// Encodes a value with Msgpack. Strings are encoded as str type as done by Fluent Bit.
+//
+// Parameters:
+//   - t: Test
+//   - v: Value to encode
+//
+// Returns:
+//   - encoded: Msgpack encoded value
+func Encode(t testing.TB, v any) []byte {
+	var mh codec.MsgpackHandle
+	mh.WriteExt = true
+
+	var encoded []byte
+	err := codec.NewEncoderBytes(&encoded, &mh).Encode(v)
+	if err != nil {
+		t.Fatalf("failed to encode %v: %v", v, err)
+	}
+	return encoded
+}
@@ -0,0 +1,415 @@
+package testutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/y-scope/clp-ffi-go/ffi"
+
+	"github.com/y-scope/fluent-bit-clp/internal/clpcompress"
+	"github.com/y-scope/fluent-bit-clp/internal/httpout"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+)
+
+// Bucket created for contexts returned by [NewS3Context] and [NewGcsContext], and container
+// created for contexts returned by [NewAzureBlobContext].
+const Bucket = "test-bucket"
+
+// Creates shared settings with plugin defaults. Disk buffer is in a temporary directory removed
+// when the test ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - config: Shared plugin configuration
+func NewConfig(t testing.TB) outctx.Config {
+	config := outctx.DefaultConfig()
+	config.Id = "test"
+	config.DiskBufferPath = t.TempDir()
+	return config
+}
+
+// Creates an S3 plugin configuration with plugin defaults.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - config: Plugin configuration
+func NewS3Config(t testing.TB) outctx.S3Config {
+	return outctx.S3Config{
+		Config:              NewConfig(t),
+		S3Region:            "us-east-1",
+		S3Bucket:            Bucket,
+		S3BucketPrefix:      "logs/",
+		S3PartSizeMb:        outctx.DefaultS3PartSizeMb,
+		S3UploadConcurrency: outctx.DefaultS3UploadConcurrency,
+	}
+}
+
+// Creates a GCS plugin configuration with plugin defaults which uploads to server.
+//
+// Parameters:
+//   - t: Test
+//   - server: GCS server
+//
+// Returns:
+//   - config: Plugin configuration
+func NewGcsConfig(t testing.TB, server *GcsServer) outctx.GcsConfig {
+	return outctx.GcsConfig{
+		Config:          NewConfig(t),
+		GcsBucket:       Bucket,
+		GcsBucketPrefix: "logs/",
+		GcsEndpoint:     server.URL(),
+	}
+}
+
+// Creates an Azure Blob Storage plugin configuration with plugin defaults which uploads to server
+// using the Azurite account key.
+//
+// Parameters:
+//   - t: Test
+//   - server: Azure server
+//
+// Returns:
+//   - config: Plugin configuration
+func NewAzureBlobConfig(t testing.TB, server *AzureServer) outctx.AzureBlobConfig {
+	return outctx.AzureBlobConfig{
+		Config:           NewConfig(t),
+		AzureAccountName: AzuriteAccountName,
+		AzureAccountKey:  AzuriteAccountKey,
+		AzureContainer:   Bucket,
+		AzureBlobPrefix:  "logs/",
+		AzureEndpoint:    server.URL(),
+		AzureBlockSizeMb: 4,
+	}
+}
+
+// Creates an HTTP plugin configuration with plugin defaults which sends objects to server.
+//
+// Parameters:
+//   - t: Test
+//   - server: HTTP server
+//
+// Returns:
+//   - config: Plugin configuration
+func NewHttpConfig(t testing.TB, server *HttpServer) outctx.HttpConfig {
+	return outctx.HttpConfig{
+		Config:         NewConfig(t),
+		HttpUrl:        server.URL() + "/ingest",
+		HttpMethod:     "POST",
+		HttpTimeout:    time.Minute,
+		HttpRetryLimit: 3,
+	}
+}
+
+// Creates a configuration which publishes to broker.
+//
+// Parameters:
+//   - t: Test
+//   - broker: Kafka broker
+//   - topic: Topic hosted by broker
+//
+// Returns:
+//   - config: Plugin configuration
+func NewKafkaConfig(t testing.TB, broker *KafkaBroker, topic string) outctx.KafkaConfig {
+	return outctx.KafkaConfig{
+		Config:              NewConfig(t),
+		KafkaBrokers:        broker.Addr(),
+		KafkaTopic:          topic,
+		KafkaMaxRecordBytes: 1000000,
+		KafkaTimeout:        10 * time.Second,
+		KafkaRetryLimit:     3,
+	}
+}
+
+// Creates a configuration which ingests into pkg. Objects are staged in a temporary directory.
+//
+// Parameters:
+//   - t: Test
+//   - pkg: CLP package
+//
+// Returns:
+//   - config: Plugin configuration
+func NewClpConfig(t testing.TB, pkg *ClpPackage) outctx.ClpConfig {
+	return outctx.ClpConfig{
+		Config:        NewConfig(t),
+		ClpPackageDir: pkg.Dir(),
+		ClpStagingDir: t.TempDir(),
+		ClpTimeout:    time.Minute,
+	}
+}
+
+// Creates a plugin context which uploads to server. Unlike [outctx.NewS3Context], does not load
+// AWS credentials or register the disk buffer path.
+//
+// Parameters:
+//   - t: Test
+//   - server: S3 server
+//   - config: Plugin configuration
+//
+// Returns:
+//   - ctx: Plugin context
+func NewS3Context(t testing.TB, server *S3Server, config outctx.S3Config) *outctx.Context {
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	server.CreateBucket(config.S3Bucket)
+	uploader := outctx.NewS3Uploader(
+		server.Client(),
+		config.S3Bucket,
+		config.S3BucketPrefix,
+		config.S3PartSizeMb<<20,
+		config.S3UploadConcurrency,
+	)
+	ctx := newContext(t, config.Config, uploader)
+	if config.S3MultipartStreaming {
+		ctx.MultipartPartSize = config.S3PartSizeMb << 20
+	}
+	return ctx
+}
+
+// Creates a plugin context which uploads to server. Unlike [outctx.NewGcsContext], does not check
+// the bucket or register the disk buffer path.
+//
+// Parameters:
+//   - t: Test
+//   - server: GCS server
+//   - config: Plugin configuration
+//
+// Returns:
+//   - ctx: Plugin context
+func NewGcsContext(t testing.TB, server *GcsServer, config outctx.GcsConfig) *outctx.Context {
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	server.CreateBucket(config.GcsBucket)
+	client, err := outctx.NewGcsClient(
+		context.Background(),
+		config.GcsEndpoint,
+		config.GcsCredentialsFile,
+	)
+	if err != nil {
+		t.Fatalf("failed to create GCS client: %v", err)
+	}
+	uploader := outctx.NewGcsUploader(client, config.GcsBucket, config.GcsBucketPrefix)
+	return newContext(t, config.Config, uploader)
+}
+
+// Creates a plugin context which uploads to server. Unlike [outctx.NewAzureBlobContext], does not
+// check the container or register the disk buffer path.
+//
+// Parameters:
+//   - t: Test
+//   - server: Azure server
+//   - config: Plugin configuration
+//
+// Returns:
+//   - ctx: Plugin context
+func NewAzureBlobContext(
+	t testing.TB,
+	server *AzureServer,
+	config outctx.AzureBlobConfig,
+) *outctx.Context {
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	server.CreateContainer(config.AzureContainer)
+	client, err := outctx.NewAzureBlobClient(
+		config.AzureEndpoint,
+		config.AzureAccountName,
+		config.AzureAccountKey,
+		config.AzureSasToken,
+	)
+	if err != nil {
+		t.Fatalf("failed to create Azure client: %v", err)
+	}
+	uploader := outctx.NewAzureBlobUploader(
+		client,
+		config.AzureContainer,
+		config.AzureBlobPrefix,
+		config.AzureBlockSizeMb<<20,
+	)
+	return newContext(t, config.Config, uploader)
+}
+
+// Creates a plugin context which sends objects to server. Unlike [outctx.NewHttpContext], does not
+// register the disk buffer path.
+//
+// Parameters:
+//   - t: Test
+//   - config: Plugin configuration
+//
+// Returns:
+//   - ctx: Plugin context
+func NewHttpContext(t testing.TB, config outctx.HttpConfig) *outctx.Context {
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	header, err := config.NewHeader()
+	if err != nil {
+		t.Fatalf("invalid headers: %v", err)
+	}
+	tlsConfig, err := config.NewTlsConfig()
+	if err != nil {
+		t.Fatalf("invalid TLS options: %v", err)
+	}
+	client := httpout.NewClient(
+		config.HttpUrl,
+		config.HttpMethod,
+		header,
+		tlsConfig,
+		config.HttpTimeout,
+		config.HttpRetryLimit,
+	)
+	return newContext(t, config.Config, outctx.NewHttpUploader(client))
+}
+
+// Creates a plugin context which publishes to the brokers of config. Unlike
+// [outctx.NewKafkaContext], does not check the topic or register the disk buffer path. The
+// client is closed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//   - config: Plugin configuration
+//
+// Returns:
+//   - ctx: Plugin context
+func NewKafkaContext(t testing.TB, config outctx.KafkaConfig) *outctx.Context {
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	brokers, err := config.Brokers()
+	if err != nil {
+		t.Fatalf("invalid brokers: %v", err)
+	}
+	client, err := outctx.NewKafkaClient(
+		brokers,
+		config.KafkaTopic,
+		config.Id,
+		config.KafkaTimeout,
+		config.KafkaRetryLimit,
+		config.KafkaMaxRecordBytes,
+		// Refresh metadata immediately after failed requests instead of waiting 5s.
+		kgo.MetadataMinAge(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("failed to create kafka client: %v", err)
+	}
+	t.Cleanup(client.Close)
+	uploader := outctx.NewKafkaUploader(
+		client,
+		config.KafkaTopic,
+		config.KafkaMaxRecordBytes,
+		config.KafkaKeyField != "",
+	)
+	ctx := newContext(t, config.Config, uploader)
+	ctx.GroupKey = config.KafkaKeyField
+	return ctx
+}
+
+// Creates a plugin context which ingests into the CLP package of config. Unlike
+// [outctx.NewClpContext], does not register the disk buffer path.
+//
+// Parameters:
+//   - t: Test
+//   - config: Plugin configuration
+//
+// Returns:
+//   - ctx: Plugin context
+func NewClpContext(t testing.TB, config outctx.ClpConfig) *outctx.Context {
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	compressor, err := clpcompress.NewCompressor(
+		config.NewCompressCommand(),
+		config.ClpStagingDir,
+		config.ClpTimeout,
+		config.ClpKeepStagedFiles,
+	)
+	if err != nil {
+		t.Fatalf("failed to create compressor: %v", err)
+	}
+	return newContext(t, config.Config, outctx.NewClpUploader(compressor))
+}
+
+// Creates a plugin context from validated shared settings.
+func newContext(t testing.TB, config outctx.Config, uploader outctx.Uploader) *outctx.Context {
+	keyFilter, err := config.NewKeyFilter()
+	if err != nil {
+		t.Fatalf("invalid key options: %v", err)
+	}
+	redactor, err := config.NewRedactor()
+	if err != nil {
+		t.Fatalf("invalid redaction options: %v", err)
+	}
+	bufferCipher, err := config.NewBufferCipher()
+	if err != nil {
+		t.Fatalf("invalid disk buffer key options: %v", err)
+	}
+	keyProvider, err := config.NewKeyProvider()
+	if err != nil {
+		t.Fatalf("invalid client encryption options: %v", err)
+	}
+	return &outctx.Context{
+		Config:        config,
+		Uploader:      uploader,
+		EventManagers: make(map[string]*outctx.EventManager),
+		KeyFilter:     keyFilter,
+		Redactor:      redactor,
+		BufferCipher:  bufferCipher,
+		KeyProvider:   keyProvider,
+		MemoryBudget:  config.NewMemoryBudget(),
+	}
+}
+
+// Decodes Zstd compressed or uncompressed KV-IR. Fails the test if the stream is not terminated.
+//
+// Parameters:
+//   - t: Test
+//   - data: KV-IR
+//
+// Returns:
+//   - events: Decoded log events
+func DecodeEvents(t testing.TB, data []byte) []ffi.LogEvent {
+	events, err := DecodeUnterminatedEvents(data)
+	if err != nil {
+		t.Fatalf("failed to decode KV-IR: %v", err)
+	}
+	return events
+}
+
+// Decodes Zstd compressed or uncompressed KV-IR which may not be terminated.
+//
+// Parameters:
+//   - data: KV-IR
+//
+// Returns:
+//   - events: Log events decoded before end of stream or error
+//   - err: [irzstd.ErrUnterminatedStream] if stream is not terminated, error decoding
+func DecodeUnterminatedEvents(data []byte) ([]ffi.LogEvent, error) {
+	reader, err := irzstd.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var events []ffi.LogEvent
+	for {
+		event, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, *event)
+	}
+}
@@ -0,0 +1,408 @@
+// Package testutil provides a test harness to drive the plugins without Fluent Bit or cloud
+// storage. Includes in-process S3, GCS, and Azure Blob Storage compatible servers, an HTTP server
+// recording requests, a Kafka broker, a CLP package recording compress jobs, builders for Fluent
+// Bit Msgpack chunks, and helpers to decode uploaded KV-IR.
+package testutil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Object stored by [S3Server].
+type S3Object struct {
+	Key      string
+	Body     []byte
+	Metadata map[string]string
+	Tagging  string
+}
+
+// In-process S3 compatible server. Supports the subset of the S3 API used by the plugin. Requests
+// are not authenticated. Buckets are created with [S3Server.CreateBucket].
+type S3Server struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	buckets    map[string]map[string]*S3Object
+	uploads    map[string]*multipartUpload
+	nextUpload int
+	failures   int
+	delay      time.Duration
+	delayed    int
+}
+
+// Parts of an in progress multipart upload.
+type multipartUpload struct {
+	bucket string
+	key    string
+	object S3Object
+	parts  map[int][]byte
+}
+
+// Starts a new [S3Server]. Server is closed when the test ends.
+//
+// Parameters:
+//   - t: Test
+//
+// Returns:
+//   - server: S3 server
+func NewS3Server(t testing.TB) *S3Server {
+	s := &S3Server{
+		buckets: make(map[string]map[string]*S3Object),
+		uploads: make(map[string]*multipartUpload),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+// Creates an empty bucket.
+//
+// Parameters:
+//   - bucket: Bucket name
+func (s *S3Server) CreateBucket(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = make(map[string]*S3Object)
+}
+
+// Fails the next requests with an internal server error. The SDK retries failed requests, so
+// multiple failures may be needed to fail an upload.
+//
+// Parameters:
+//   - n: Number of requests to fail
+func (s *S3Server) FailRequests(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// Delays responses to later requests. Requests cancelled by the client while delayed are dropped.
+//
+// Parameters:
+//   - d: Delay of each request
+func (s *S3Server) DelayRequests(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = d
+}
+
+// Gets the number of requests currently being delayed.
+//
+// Returns:
+//   - n: Number of delayed requests
+func (s *S3Server) DelayedRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delayed
+}
+
+// Returns the endpoint URL of the server.
+func (s *S3Server) URL() string {
+	return s.server.URL
+}
+
+// Creates an S3 client for the server.
+//
+// Returns:
+//   - client: S3 client
+func (s *S3Server) Client() *s3.Client {
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(s.server.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+}
+
+// Retrieves objects in a bucket sorted by key.
+//
+// Parameters:
+//   - bucket: Bucket name
+//
+// Returns:
+//   - objects: Copies of objects in bucket
+func (s *S3Server) Objects(bucket string) []S3Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var objects []S3Object
+	for _, object := range s.buckets[bucket] {
+		objects = append(objects, *object)
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects
+}
+
+// Retrieves keys of in progress multipart uploads.
+//
+// Returns:
+//   - keys: Keys of in progress multipart uploads
+func (s *S3Server) PendingMultipartUploads() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var keys []string
+	for _, upload := range s.uploads {
+		keys = append(keys, upload.key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Routes S3 API requests.
+func (s *S3Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	delay := s.delay
+	s.mu.Unlock()
+	if delay > 0 {
+		// Cancellation is only detected once the request body is read.
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		s.mu.Lock()
+		s.delayed += 1
+		s.mu.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+		s.mu.Lock()
+		s.delayed -= 1
+		s.mu.Unlock()
+		if r.Context().Err() != nil {
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures -= 1
+		writeError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	bucket, ok := s.buckets[bucketName]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet && query.Has("uploads"):
+		s.listMultipartUploads(w, bucketName)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, bucketName, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, bucket, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		body, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		object := newObject(r, key)
+		object.Body = body
+		bucket[key] = &object
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodGet:
+		object, ok := bucket[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.Body)))
+		w.Write(object.Body)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *S3Server) createMultipartUpload(
+	w http.ResponseWriter,
+	r *http.Request,
+	bucket string,
+	key string,
+) {
+	s.nextUpload += 1
+	uploadId := strconv.Itoa(s.nextUpload)
+	s.uploads[uploadId] = &multipartUpload{
+		bucket: bucket,
+		key:    key,
+		object: newObject(r, key),
+		parts:  make(map[int][]byte),
+	}
+	writeXml(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: bucket, Key: key, UploadId: uploadId})
+}
+
+func (s *S3Server) uploadPart(w http.ResponseWriter, r *http.Request, uploadId, partNumber string) {
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	number, err := strconv.Atoi(partNumber)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument")
+		return
+	}
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	upload.parts[number] = body
+	w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, number))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *S3Server) completeMultipartUpload(
+	w http.ResponseWriter,
+	bucket map[string]*S3Object,
+	uploadId string,
+) {
+	upload, ok := s.uploads[uploadId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var numbers []int
+	for number := range upload.parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	object := upload.object
+	for _, number := range numbers {
+		object.Body = append(object.Body, upload.parts[number]...)
+	}
+	bucket[upload.key] = &object
+	delete(s.uploads, uploadId)
+
+	writeXml(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: upload.bucket, Key: upload.key, ETag: `"etag"`})
+}
+
+func (s *S3Server) listMultipartUploads(w http.ResponseWriter, bucket string) {
+	type upload struct {
+		Key      string
+		UploadId string
+	}
+	var uploads []upload
+	for uploadId, u := range s.uploads {
+		if u.bucket == bucket {
+			uploads = append(uploads, upload{Key: u.key, UploadId: uploadId})
+		}
+	}
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].UploadId < uploads[j].UploadId
+	})
+	writeXml(w, struct {
+		XMLName xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket  string
+		Upload  []upload
+	}{Bucket: bucket, Upload: uploads})
+}
+
+// Creates an object with metadata and tagging from request headers.
+func newObject(r *http.Request, key string) S3Object {
+	object := S3Object{
+		Key:      key,
+		Metadata: make(map[string]string),
+		Tagging:  r.Header.Get("X-Amz-Tagging"),
+	}
+	for name, values := range r.Header {
+		name = strings.ToLower(name)
+		if metadataKey, ok := strings.CutPrefix(name, "x-amz-meta-"); ok {
+			object.Metadata[metadataKey] = values[0]
+		}
+	}
+	return object
+}
+
+// Reads request body. Decodes aws-chunked payloads used by the SDK for streaming signatures.
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var body bytes.Buffer
+	reader := bufio.NewReader(r.Body)
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeString, _, _ := strings.Cut(strings.TrimSpace(header), ";")
+		size, err := strconv.ParseInt(sizeString, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return body.Bytes(), nil
+		}
+		if _, err := io.CopyN(&body, reader, size); err != nil {
+			return nil, err
+		}
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func writeXml(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
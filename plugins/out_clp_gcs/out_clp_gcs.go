@@ -0,0 +1,88 @@
+// Package defines high-level callback functions required by Fluent Bit go plugin documentation.
+// See article/repo fo more information [Fluent Bit go], [Fluent Bit stdout example].
+//
+// [Fluent Bit go]: https://docs.fluentbit.io/manual/development/golang-output-plugins
+// [Fluent Bit stdout example]: https://github.com/fluent/fluent-bit-go/tree/master/examples/out_multiinstance
+package main
+
+// Note package name "main" is required by Fluent Bit which suppresses go docs. Do not remove
+// export, required for use by Fluent Bit C calls. Callbacks are implemented by [plugin].
+
+import (
+	"C"
+	"unsafe"
+
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+	"github.com/y-scope/fluent-bit-clp/internal/plugin"
+)
+
+const gcsPluginName = "out_clp_gcs"
+
+// Required Fluent Bit registration callback.
+//
+// Parameters:
+//   - def: Fluent Bit plugin definition
+//
+// Returns:
+//   - nil
+//
+//export FLBPluginRegister
+func FLBPluginRegister(def unsafe.Pointer) int {
+	return plugin.Register(def, gcsPluginName, "CLP gcs plugin")
+}
+
+// Required Fluent Bit initialization callback.
+//
+// Parameters:
+//   - def: Fluent Bit plugin reference
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+//
+//export FLBPluginInit
+func FLBPluginInit(def unsafe.Pointer) int {
+	return plugin.Init(def, outctx.NewGcsContext)
+}
+
+// Required Fluent Bit flush callback.
+//
+// Parameters:
+//   - ctx: Fluent Bit plugin context
+//   - data: Msgpack data
+//   - length: Byte length
+//   - tag: Fluent Bit tag
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+//
+//export FLBPluginFlushCtx
+func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
+	// Copy chunk into Go memory since Fluent Bit frees the chunk after flush returns.
+	return plugin.Flush(ctx, C.GoBytes(data, length), C.GoString(tag))
+}
+
+//export FLBPluginExit
+func FLBPluginExit() int {
+	return plugin.Exit()
+}
+
+// Required Fluent Bit exit callback.
+//
+// Parameters:
+//   - ctx: Fluent Bit plugin context
+//
+// Returns:
+//   - code: Fluent Bit success code (OK, RETRY, ERROR)
+//
+//export FLBPluginExitCtx
+func FLBPluginExitCtx(ctx unsafe.Pointer) int {
+	return plugin.ExitCtx(ctx)
+}
+
+//export FLBPluginUnregister
+func FLBPluginUnregister(def unsafe.Pointer) {
+	plugin.Unregister(def)
+}
+
+func main() {
+}
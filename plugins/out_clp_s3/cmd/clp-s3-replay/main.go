@@ -0,0 +1,231 @@
+// Command clp-s3-replay uploads the disk buffers of an out_clp_s3 plugin to S3 without running
+// Fluent Bit. Useful when a node is decommissioned with a non-empty disk_buffer_path. Buffers are
+// validated, terminated and uploaded using the same code as plugin recovery, so uploaded objects
+// are identical to objects uploaded when Fluent Bit restarts.
+//
+// Usage:
+//
+//	clp-s3-replay -disk_buffer_path ./disk_buffer/ -s3_bucket myBucket [-dry_run]
+//
+// With -dry_run, buffers are decoded and reported without uploading or modifying any files.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/y-scope/fluent-bit-clp/internal/exit"
+	"github.com/y-scope/fluent-bit-clp/internal/irzstd"
+	"github.com/y-scope/fluent-bit-clp/internal/outctx"
+	"github.com/y-scope/fluent-bit-clp/internal/recovery"
+)
+
+func main() {
+	log.SetPrefix("[clp-s3-replay] ")
+	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
+
+	config, dryRun, err := parseFlags(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid options: %s", err)
+	}
+
+	if dryRun {
+		err = report(&config)
+	} else {
+		err = replay(&config)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Parses command line flags into a validated configuration. Flag names and defaults match plugin
+// options, and settings without a flag keep their plugin defaults.
+//
+// Parameters:
+//   - args: Command line arguments without the program name
+//
+// Returns:
+//   - config: Plugin configuration
+//   - dryRun: Whether buffers are only reported
+//   - err: Error parsing flags, validation errors in config
+func parseFlags(args []string) (outctx.S3Config, bool, error) {
+	config := outctx.DefaultS3Config()
+	flags := flag.NewFlagSet("clp-s3-replay", flag.ExitOnError)
+	flags.StringVar(&config.DiskBufferPath, "disk_buffer_path", config.DiskBufferPath,
+		"directory of disk buffer to upload")
+	flags.StringVar(&config.DiskBufferKeyFile, "disk_buffer_key_file", "",
+		"file containing key of encrypted disk buffer")
+	flags.StringVar(&config.DiskBufferKeyEnv, "disk_buffer_key_env", "",
+		"environment variable containing key of encrypted disk buffer")
+	flags.StringVar(&config.S3Region, "s3_region", config.S3Region, "AWS region of S3 bucket")
+	flags.StringVar(&config.S3Bucket, "s3_bucket", "", "S3 bucket name")
+	flags.StringVar(&config.S3BucketPrefix, "s3_bucket_prefix", config.S3BucketPrefix,
+		"bucket prefix path")
+	flags.IntVar(&config.S3PartSizeMb, "s3_part_size_mb", config.S3PartSizeMb,
+		"size of parts of multipart uploads in MB")
+	flags.IntVar(&config.S3UploadConcurrency, "s3_upload_concurrency",
+		config.S3UploadConcurrency,
+		"number of parts of an object uploaded in parallel")
+	flags.StringVar(&config.RoleArn, "role_arn", "", "ARN of an IAM role to assume")
+	flags.StringVar(&config.Id, "id", config.Id, "id appended to object keys")
+	flags.StringVar(&config.ObjectKeyTemplate, "object_key_template",
+		config.ObjectKeyTemplate, "template of object keys")
+	flags.BoolVar(&config.UploadManifest, "upload_manifest", false,
+		"upload a JSON manifest describing uploaded objects")
+	flags.StringVar(&config.ClientEncryptionKeyFile, "client_encryption_key_file", "",
+		"PEM file with RSA public key to encrypt uploaded objects")
+	dryRun := flags.Bool("dry_run", false, "report buffers that would be uploaded and exit")
+	err := flags.Parse(args)
+	if err != nil {
+		return config, false, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return config, false, err
+	}
+	return config, *dryRun, nil
+}
+
+// Decodes every disk buffer and prints what would be uploaded. Does not modify any files or
+// connect to AWS.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - err: Error retrieving buffers
+func report(config *outctx.S3Config) error {
+	ctx := outctx.Context{Config: config.Config}
+	buffers, err := recovery.GetBuffers(&ctx)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := config.NewBufferCipher()
+	if err != nil {
+		return err
+	}
+
+	var numUploads int
+	for _, buffer := range buffers {
+		if buffer.Empty() {
+			fmt.Printf("%s: empty, would be removed\n", buffer.Tag)
+			continue
+		}
+
+		numEvents, err := countEvents(buffer, cipher)
+		status := "valid"
+		if err != nil {
+			status = fmt.Sprintf("invalid: %v", err)
+		}
+		fmt.Printf(
+			"%s: would upload to s3://%s/%s (IR %d bytes, Zstd %d bytes, %d events, %s)\n",
+			buffer.Tag,
+			config.S3Bucket,
+			// Upload index restarts on recovery.
+			filepath.Join(
+				config.S3BucketPrefix,
+				outctx.ObjectKey(config.ObjectKeyTemplate, buffer.Tag, 0, time.Now(), config.Id),
+			),
+			buffer.IrSize,
+			buffer.ZstdSize,
+			numEvents,
+			status,
+		)
+		numUploads += 1
+	}
+
+	fmt.Printf("%d of %d buffers would be uploaded\n", numUploads, len(buffers))
+	return nil
+}
+
+// Counts events in a disk buffer by decoding the Zstd buffer followed by the IR buffer as a
+// single stream. Buffers of a running or crashed plugin are not terminated, so an unterminated
+// stream is still valid.
+//
+// Parameters:
+//   - buffer: Disk buffer files
+//   - cipher: Cipher used to encrypt buffers, nil if buffers are not encrypted
+//
+// Returns:
+//   - numEvents: Number of decoded events
+//   - err: Error opening files, error decrypting buffers, error decoding IR
+func countEvents(buffer recovery.Buffer, cipher *irzstd.Cipher) (int, error) {
+	zstdFile, err := os.Open(buffer.ZstdPath)
+	if err != nil {
+		return 0, err
+	}
+	defer zstdFile.Close()
+
+	irFile, err := os.Open(buffer.IrPath)
+	if err != nil {
+		return 0, err
+	}
+	defer irFile.Close()
+
+	zstdDecompressor, err := irzstd.NewDecompressor(irzstd.NewDecryptReader(zstdFile, cipher))
+	if err != nil {
+		return 0, err
+	}
+	defer zstdDecompressor.Close()
+
+	irReader := irzstd.NewDecryptReader(irFile, cipher)
+	reader, err := irzstd.NewReader(io.MultiReader(zstdDecompressor, irReader))
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	var numEvents int
+	for {
+		_, err := reader.Read()
+		if errors.Is(err, io.EOF) || errors.Is(err, irzstd.ErrUnterminatedStream) {
+			return numEvents, nil
+		}
+		if err != nil {
+			return numEvents, err
+		}
+		numEvents += 1
+	}
+}
+
+// Uploads every non-empty disk buffer, then closes and removes the emptied buffer files.
+//
+// Parameters:
+//   - config: Plugin configuration
+//
+// Returns:
+//   - err: Error creating context, error uploading buffers, error closing or removing files
+func replay(config *outctx.S3Config) error {
+	ctx, err := outctx.NewS3ContextFromConfig(config)
+	if err != nil {
+		return fmt.Errorf("failed to initialize: %w", err)
+	}
+
+	err = recovery.RecoverBufferFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to upload disk buffers: %w", err)
+	}
+
+	// Recovered event managers start listeners which must be stopped before files are closed.
+	err = exit.NoUpload(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to close disk buffers: %w", err)
+	}
+
+	err = recovery.RemoveEmptyBufferFiles(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to remove uploaded disk buffers: %w", err)
+	}
+
+	log.Printf("Uploaded %d disk buffers", len(ctx.EventManagers))
+	return nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFlags(t *testing.T) {
+	config, dryRun, err := parseFlags(
+		[]string{"-disk_buffer_path", t.TempDir(), "-s3_bucket", "bucket", "-dry_run"},
+	)
+	if err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+	if !dryRun || config.S3Bucket != "bucket" || config.S3Region != "us-east-1" {
+		t.Errorf("unexpected config %+v", config)
+	}
+	// Settings without a flag keep their plugin defaults.
+	if config.UploadOnExitTimeout != 4*time.Second || config.UploadSizeMb != 16 {
+		t.Errorf("expected plugin defaults, got %+v", config)
+	}
+}
+
+func TestParseFlagsValidates(t *testing.T) {
+	_, _, err := parseFlags([]string{"-disk_buffer_path", t.TempDir()})
+	if err == nil {
+		t.Errorf("expected missing bucket to fail validation")
+	}
+}
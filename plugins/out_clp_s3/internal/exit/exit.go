@@ -1,61 +0,0 @@
-// Package exit provides functions for gracefully shutting down the plugin. Exit functions are only
-// called when Fluent Bit receives a kill signal, not during an abrupt crash. The plugin is given
-// limited time to clean up resources before Fluent Bit terminates it.
-
-package exit
-
-import (
-	"github.com/y-scope/fluent-bit-clp/internal/outctx"
-)
-
-// NoUpload gracefully exits the plugin by closing writers without uploading.
-//
-// Parameters:
-//   - ctx: Plugin context
-//
-// Returns:
-//   - err: Error closing file
-func NoUpload(ctx *outctx.S3Context) error {
-	for _, eventManager := range ctx.EventManagers {
-		eventManager.StopListening()
-		err := eventManager.Writer.Close()
-		if err != nil {
-			return err
-		}
-		eventManager.Writer = nil
-	}
-
-	return nil
-}
-
-// S3 gracefully exits the plugin by flushing buffered data to S3. Makes a best-effort attempt,
-// however Fluent Bit may kill the plugin before the upload completes.
-//
-// Parameters:
-//   - ctx: Plugin context
-//
-// Returns:
-//   - err: Error closing file
-func S3(ctx *outctx.S3Context) error {
-	for _, eventManager := range ctx.EventManagers {
-		eventManager.StopListening()
-		empty, err := eventManager.Writer.Empty()
-		if err != nil {
-			return err
-		}
-		if empty {
-			continue
-		}
-		err = eventManager.ToS3(ctx.Config, ctx.Uploader)
-		if err != nil {
-			return err
-		}
-		err = eventManager.Writer.Close()
-		if err != nil {
-			return err
-		}
-		eventManager.Writer = nil
-	}
-
-	return nil
-}
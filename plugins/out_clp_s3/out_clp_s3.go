@@ -6,21 +6,14 @@
 package main
 
 // Note package name "main" is required by Fluent Bit which suppresses go docs. Do not remove
-// export, required for use by Fluent Bit C calls.
+// export, required for use by Fluent Bit C calls. Callbacks are implemented by [plugin].
 
 import (
 	"C"
-	"fmt"
-	"log"
 	"unsafe"
 
-	"github.com/fluent/fluent-bit-go/output"
-
 	"github.com/y-scope/fluent-bit-clp/internal/outctx"
-	"github.com/y-scope/fluent-bit-clp/internal/pathregistry"
-	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3/internal/exit"
-	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3/internal/flush"
-	"github.com/y-scope/fluent-bit-clp/plugins/out_clp_s3/internal/recovery"
+	"github.com/y-scope/fluent-bit-clp/internal/plugin"
 )
 
 const s3PluginName = "out_clp_s3"
@@ -35,11 +28,7 @@ const s3PluginName = "out_clp_s3"
 //
 //export FLBPluginRegister
 func FLBPluginRegister(def unsafe.Pointer) int {
-	logPrefix := fmt.Sprintf("[%s] ", s3PluginName)
-	log.SetPrefix(logPrefix)
-	log.SetFlags(log.LstdFlags | log.Lmsgprefix)
-	log.Printf("Register called")
-	return output.FLBPluginRegister(def, s3PluginName, "CLP s3 plugin")
+	return plugin.Register(def, s3PluginName, "CLP s3 plugin")
 }
 
 // Required Fluent Bit initialization callback.
@@ -51,24 +40,8 @@ func FLBPluginRegister(def unsafe.Pointer) int {
 //   - code: Fluent Bit success code (OK, RETRY, ERROR)
 //
 //export FLBPluginInit
-func FLBPluginInit(plugin unsafe.Pointer) int {
-	outCtx, err := outctx.NewS3Context(plugin)
-	if err != nil {
-		log.Fatalf("Failed to initialize plugin: %s", err)
-	}
-
-	log.Printf("Init called for id: %s", outCtx.Config.Id)
-
-	if outCtx.Config.UseDiskBuffer {
-		err = recovery.RecoverBufferFiles(outCtx)
-		if err != nil {
-			log.Fatalf("Failed to recover logs stored on disk: %s", err)
-		}
-	}
-
-	// Set the context for this instance so that params can be retrieved during flush.
-	output.FLBPluginSetContext(plugin, outCtx)
-	return output.FLB_OK
+func FLBPluginInit(def unsafe.Pointer) int {
+	return plugin.Init(def, outctx.NewS3Context)
 }
 
 // Required Fluent Bit flush callback.
@@ -84,37 +57,13 @@ func FLBPluginInit(plugin unsafe.Pointer) int {
 //
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
-	p := output.FLBPluginGetContext(ctx)
-	// Type assert context back into the original type for the Go variable.
-	outCtx, ok := p.(*outctx.S3Context)
-	if !ok {
-		log.Fatal("Could not read context during flush")
-	}
-
-	size := int(length)
-	stringTag := C.GoString(tag)
-
-	log.Printf(
-		"Flush called for id %s with tag %s and size %d",
-		outCtx.Config.Id,
-		stringTag,
-		size,
-	)
-
-	code, err := flush.Ingest(data, size, stringTag, outCtx)
-	if err != nil {
-		log.Printf("error flushing data: %s", err)
-		// RETRY or ERROR
-		return code
-	}
-
-	return output.FLB_OK
+	// Copy chunk into Go memory since Fluent Bit frees the chunk after flush returns.
+	return plugin.Flush(ctx, C.GoBytes(data, length), C.GoString(tag))
 }
 
 //export FLBPluginExit
 func FLBPluginExit() int {
-	log.Printf("Exit called for unknown instance")
-	return output.FLB_OK
+	return plugin.Exit()
 }
 
 // Required Fluent Bit exit callback.
@@ -127,34 +76,12 @@ func FLBPluginExit() int {
 //
 //export FLBPluginExitCtx
 func FLBPluginExitCtx(ctx unsafe.Pointer) int {
-	p := output.FLBPluginGetContext(ctx)
-	// Type assert context back into the original type for the Go variable.
-
-	outCtx, ok := p.(*outctx.S3Context)
-	if !ok {
-		log.Fatal("Could not read context during flush")
-	}
-
-	log.Printf("Exit called for id: %s", outCtx.Config.Id)
-
-	var err error
-	if outCtx.Config.UseDiskBuffer {
-		err = exit.NoUpload(outCtx)
-		pathregistry.Unregister(outCtx.Config.DiskBufferPath)
-	} else {
-		err = exit.S3(outCtx)
-	}
-	if err != nil {
-		log.Printf("Failed to exit gracefully")
-	}
-
-	return output.FLB_OK
+	return plugin.ExitCtx(ctx)
 }
 
 //export FLBPluginUnregister
 func FLBPluginUnregister(def unsafe.Pointer) {
-	log.Printf("Unregister called")
-	output.FLBPluginUnregister(def)
+	plugin.Unregister(def)
 }
 
 func main() {